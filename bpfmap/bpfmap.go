@@ -26,7 +26,7 @@ func GetMapByPinnedPath(pinPath string, opts ...*ebpf.LoadPinOptions) (*ebpf.Map
 func createMap(name string, _type ebpf.MapType, keySize, valueSize, maxEntries, flags uint32) (*ebpf.Map, error) {
 	spec := ebpf.MapSpec{
 		Name:       name,
-		Type:       ebpf.Hash,
+		Type:       _type,
 		KeySize:    keySize,
 		ValueSize:  valueSize,
 		MaxEntries: maxEntries,
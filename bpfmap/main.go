@@ -13,11 +13,6 @@ const (
 	MAX_ENTRIES          = 32
 	ETH_ALEN             = 6
 
-	// podmap 实际上没用到 可以删除
-	POD_IP_MAP_PATH        = "/sys/fs/bpf/pod_map"
-	POD_IP_MAP_NAME        = "pod_map"
-	POD_IP_MAP_MAX_ENTRIES = 32
-
 	// vxlan map存储了 本地的vxlan设备号
 	VXLAN_MAP_DEFAULT_PATH = "/sys/fs/bpf/tc/globals/node_vxlan_map"
 	VXLAN_MAP_NAME         = "node_vxlan_map"
@@ -47,15 +42,6 @@ type EndpointMapInfo struct {
 	PodVethMAC [8]byte // MAC string
 }
 
-// Not used..
-type PodInfoKey struct {
-	PodName [8]byte
-}
-
-type PodInfoValue struct {
-	IP uint32
-}
-
 // this is for mapping between net_type -> net_dev_ifindex
 type VirtualNetKey struct {
 	NetType uint32
@@ -105,34 +91,6 @@ func CreateLxcMap() (*ebpf.Map, error) {
 	return mp, nil
 }
 
-// Create podname - ip mapping
-func CreatePodIPMap() (*ebpf.Map, error) {
-	const (
-		pinPath    = POD_IP_MAP_PATH
-		name       = POD_IP_MAP_NAME
-		_type      = ebpf.Hash
-		keySize    = uint32(unsafe.Sizeof(PodInfoKey{}))
-		valueSize  = uint32(unsafe.Sizeof(PodInfoValue{}))
-		maxEntries = POD_IP_MAP_MAX_ENTRIES
-		flags      = 0
-	)
-
-	mp, err := CreatePinMapOnce(
-		pinPath,
-		name,
-		_type,
-		keySize,
-		valueSize,
-		maxEntries,
-		flags,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-	return mp, nil
-}
-
 // create map record of vxlan device id
 func CreateVxlanMap() (*ebpf.Map, error) {
 	const (
@@ -198,15 +156,6 @@ func SetLxcMap(key EndpointMapKey, value EndpointMapInfo) error {
 	return mp.Put(key, value)
 }
 
-// set endpoint value into not used map
-func SetPodIPMap(key PodInfoKey, value PodInfoValue) error {
-	mp, err := GetMapByPinnedPath(POD_IP_MAP_PATH)
-	if err != nil {
-		return err
-	}
-	return mp.Put(key, value)
-}
-
 // set endpoint value into vxlan dev map
 func SetVxlanMap(key VirtualNetKey, value VirtualNetValue) error {
 	mp, err := GetMapByPinnedPath(VXLAN_MAP_DEFAULT_PATH)
@@ -316,15 +265,32 @@ func GetKeyValueFromLxcMap(key EndpointMapKey) (*EndpointMapInfo, error) {
 	return res, nil
 }
 
-func GetKeyValueFromPodIPMap(key PodInfoKey) (*PodInfoValue, error) {
-	mp, err := GetMapByPinnedPath(POD_IP_MAP_PATH)
+// List all endpoints inside linux-container-map, keyed by pod ip
+func ListLxcMap() (map[EndpointMapKey]EndpointMapInfo, error) {
+	mp, err := GetMapByPinnedPath(LXC_MAP_DEFAULT_PATH)
 	if err != nil {
 		return nil, err
 	}
 
-	// Lookup endpoint inside map
-	res := &PodInfoValue{}
-	// return err if keyNotExist, else store value into 'res'
+	res := make(map[EndpointMapKey]EndpointMapInfo)
+	iter := mp.Iterate()
+	var key EndpointMapKey
+	var value EndpointMapInfo
+
+	for iter.Next(&key, &value) {
+		res[key] = value
+	}
+	return res, iter.Err()
+}
+
+// given net type(like MODE_VXLAN), lookup the virtual netdev's ifindex
+func GetKeyValueFromVxlanMap(key VirtualNetKey) (*VirtualNetValue, error) {
+	mp, err := GetMapByPinnedPath(VXLAN_MAP_DEFAULT_PATH)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &VirtualNetValue{}
 	err = mp.Lookup(key, res)
 	if err != nil {
 		return nil, err
@@ -333,7 +299,7 @@ func GetKeyValueFromPodIPMap(key PodInfoKey) (*PodInfoValue, error) {
 }
 
 // 从ip - nodereal ip的映射中拿到实际的nodeip做转发
-func GetKeyValueFromNodeCIDRMap(key PodInfoKey) (*NodeCIDRValue, error) {
+func GetKeyValueFromNodeCIDRMap(key NodeCIDRKey) (*NodeCIDRValue, error) {
 	mp, err := GetMapByPinnedPath(NODE_CIDR_MAP_PATH)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,179 @@
+package bpfmap
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// policy map 记录了 本节点endpoint允许的对端(cidr) 端口 协议
+	POLICY_MAP_PATH        = "/sys/fs/bpf/tc/globals/policy_map"
+	POLICY_MAP_NAME        = "policy_map"
+	POLICY_MAP_MAX_ENTRIES = 4096
+
+	// 被networkpolicy选中(隔离)的endpoint
+	POLICY_EP_MAP_PATH        = "/sys/fs/bpf/tc/globals/policy_ep_map"
+	POLICY_EP_MAP_NAME        = "policy_ep_map"
+	POLICY_EP_MAP_MAX_ENTRIES = 256
+
+	// 已放行的连接, 回包直接通过
+	POLICY_CT_MAP_PATH        = "/sys/fs/bpf/tc/globals/policy_ct_map"
+	POLICY_CT_MAP_NAME        = "policy_ct_map"
+	POLICY_CT_MAP_MAX_ENTRIES = 65536
+
+	// Fixed part of policy key before peer ip: ep ip + direction + proto + port
+	POLICY_KEY_FIXED_BITS = 64
+
+	POLICY_INGRESS = 1
+	POLICY_EGRESS  = 2
+
+	POLICY_DENY  = 0
+	POLICY_ALLOW = 1
+)
+
+// LPM trie key, the peer ip is matched by prefix, others are matched exactly.
+// port == 0 means any port, proto == 0 means any protocol.
+// 4+4+1+1+2+4 = 16bytes
+type PolicyKey struct {
+	PrefixLen uint32
+	EpIP      uint32 // endpoint ip, same as the key of lxc_map
+	Direction uint8
+	Proto     uint8
+	Port      uint16
+	PeerIP    [4]byte // network byte order
+}
+
+type PolicyValue struct {
+	Action uint32
+}
+
+// endpoint is isolated on the direction if the flag is set
+type PolicyEndpointValue struct {
+	Ingress uint8
+	Egress  uint8
+	Pad     [2]uint8
+}
+
+// connection allowed by policy, 4+4+2+2+1+3 = 16bytes
+type PolicyCTKey struct {
+	SrcIP uint32
+	DstIP uint32
+	Sport uint16
+	Dport uint16
+	Proto uint8
+	Pad   [3]uint8
+}
+
+// Create policy map, an LPM trie keyed by (endpoint, direction, proto, port, peer cidr)
+func CreatePolicyMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		POLICY_MAP_PATH,
+		POLICY_MAP_NAME,
+		ebpf.LPMTrie,
+		uint32(unsafe.Sizeof(PolicyKey{})),
+		uint32(unsafe.Sizeof(PolicyValue{})),
+		POLICY_MAP_MAX_ENTRIES,
+		unix.BPF_F_NO_PREALLOC,
+	)
+}
+
+// Create policy endpoint map, endpoints not inside are not isolated
+func CreatePolicyEndpointMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		POLICY_EP_MAP_PATH,
+		POLICY_EP_MAP_NAME,
+		ebpf.Hash,
+		uint32(unsafe.Sizeof(EndpointMapKey{})),
+		uint32(unsafe.Sizeof(PolicyEndpointValue{})),
+		POLICY_EP_MAP_MAX_ENTRIES,
+		0,
+	)
+}
+
+// Create policy conntrack map, entries are evicted by LRU
+func CreatePolicyCTMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		POLICY_CT_MAP_PATH,
+		POLICY_CT_MAP_NAME,
+		ebpf.LRUHash,
+		uint32(unsafe.Sizeof(PolicyCTKey{})),
+		uint32(unsafe.Sizeof(uint32(0))),
+		POLICY_CT_MAP_MAX_ENTRIES,
+		0,
+	)
+}
+
+// Replace all entries of policy maps.
+//
+// new entries are written before stale ones are removed,
+// so traffic allowed by both old and new policies is never dropped.
+func SyncPolicyMaps(endpoints map[EndpointMapKey]PolicyEndpointValue, rules map[PolicyKey]PolicyValue) error {
+	epMap, err := GetMapByPinnedPath(POLICY_EP_MAP_PATH)
+	if err != nil {
+		return err
+	}
+	ruleMap, err := GetMapByPinnedPath(POLICY_MAP_PATH)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range rules {
+		if err := ruleMap.Put(key, value); err != nil {
+			return err
+		}
+	}
+	var staleRules []PolicyKey
+	var rk PolicyKey
+	var rv PolicyValue
+	iter := ruleMap.Iterate()
+	for iter.Next(&rk, &rv) {
+		if _, ok := rules[rk]; !ok {
+			staleRules = append(staleRules, rk)
+		}
+	}
+
+	for key, value := range endpoints {
+		if err := epMap.Put(key, value); err != nil {
+			return err
+		}
+	}
+	var staleEps []EndpointMapKey
+	var ek EndpointMapKey
+	var ev PolicyEndpointValue
+	iter = epMap.Iterate()
+	for iter.Next(&ek, &ev) {
+		if _, ok := endpoints[ek]; !ok {
+			staleEps = append(staleEps, ek)
+		}
+	}
+
+	for _, key := range staleEps {
+		if err := epMap.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range staleRules {
+		if err := ruleMap.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build policy key for endpoint, peer is matched by its prefix
+func NewPolicyKey(ep net.IP, direction, proto uint8, port uint16, peer *net.IPNet) PolicyKey {
+	ones, _ := peer.Mask.Size()
+	key := PolicyKey{
+		PrefixLen: POLICY_KEY_FIXED_BITS + uint32(ones),
+		EpIP:      binary.BigEndian.Uint32(ep.To4()),
+		Direction: direction,
+		Proto:     proto,
+		Port:      port,
+	}
+	copy(key.PeerIP[:], peer.IP.To4())
+	return key
+}
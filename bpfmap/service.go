@@ -0,0 +1,177 @@
+package bpfmap
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+)
+
+const (
+	// service map 记录了 ClusterIP:port 对应的后端数量
+	LB_SERVICE_MAP_PATH        = "/sys/fs/bpf/tc/globals/lb_service_map"
+	LB_SERVICE_MAP_NAME        = "lb_service_map"
+	LB_SERVICE_MAP_MAX_ENTRIES = 1024
+
+	// backend map 记录了 ClusterIP:port 的第slot个后端 ip:port
+	LB_BACKEND_MAP_PATH        = "/sys/fs/bpf/tc/globals/lb_backend_map"
+	LB_BACKEND_MAP_NAME        = "lb_backend_map"
+	LB_BACKEND_MAP_MAX_ENTRIES = 16384
+
+	// 做过DNAT的连接, 用于保持后端选择 以及回包的反向转换
+	LB_CT_MAP_PATH        = "/sys/fs/bpf/tc/globals/lb_ct_map"
+	LB_CT_MAP_NAME        = "lb_ct_map"
+	LB_CT_MAP_MAX_ENTRIES = 65536
+
+	LB_CT_ORIGINAL = 0
+	LB_CT_REPLY    = 1
+)
+
+// Service frontend, ip & port in host byte order(same as lxc_map),
+// 4+2+1+1 = 8bytes
+type LBServiceKey struct {
+	Address uint32
+	Port    uint16
+	Proto   uint8
+	Pad     uint8
+}
+
+type LBServiceValue struct {
+	Count uint32 // number of backends, slots are [0, Count)
+}
+
+// 8+4 = 12bytes
+type LBBackendKey struct {
+	Service LBServiceKey
+	Slot    uint32
+}
+
+type LBBackendValue struct {
+	Address uint32
+	Port    uint16
+	Pad     [2]uint8
+}
+
+// Translated connection, 4+4+2+2+1+1+2 = 16bytes
+type LBCTKey struct {
+	SrcIP uint32
+	DstIP uint32
+	Sport uint16
+	Dport uint16
+	Proto uint8
+	Dir   uint8 // LB_CT_ORIGINAL or LB_CT_REPLY
+	Pad   [2]uint8
+}
+
+// backend ip:port for the original direction, vip:port for replies
+type LBCTValue struct {
+	Address uint32
+	Port    uint16
+	Pad     [2]uint8
+}
+
+// Create service frontend map
+func CreateLBServiceMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		LB_SERVICE_MAP_PATH,
+		LB_SERVICE_MAP_NAME,
+		ebpf.Hash,
+		uint32(unsafe.Sizeof(LBServiceKey{})),
+		uint32(unsafe.Sizeof(LBServiceValue{})),
+		LB_SERVICE_MAP_MAX_ENTRIES,
+		0,
+	)
+}
+
+// Create service backend map
+func CreateLBBackendMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		LB_BACKEND_MAP_PATH,
+		LB_BACKEND_MAP_NAME,
+		ebpf.Hash,
+		uint32(unsafe.Sizeof(LBBackendKey{})),
+		uint32(unsafe.Sizeof(LBBackendValue{})),
+		LB_BACKEND_MAP_MAX_ENTRIES,
+		0,
+	)
+}
+
+// Create conntrack-like map for service translation
+func CreateLBCTMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		LB_CT_MAP_PATH,
+		LB_CT_MAP_NAME,
+		ebpf.LRUHash,
+		uint32(unsafe.Sizeof(LBCTKey{})),
+		uint32(unsafe.Sizeof(LBCTValue{})),
+		LB_CT_MAP_MAX_ENTRIES,
+		0,
+	)
+}
+
+// Build service key with ipv4 address
+func NewLBServiceKey(ip net.IP, port uint16, proto uint8) LBServiceKey {
+	return LBServiceKey{
+		Address: binary.BigEndian.Uint32(ip.To4()),
+		Port:    port,
+		Proto:   proto,
+	}
+}
+
+// Replace all entries of service maps.
+//
+// backends are written before the count of their service grows,
+// and removed after it shrinks, so a slot in use always exists.
+func SyncLBMaps(services map[LBServiceKey]LBServiceValue, backends map[LBBackendKey]LBBackendValue) error {
+	svcMap, err := GetMapByPinnedPath(LB_SERVICE_MAP_PATH)
+	if err != nil {
+		return err
+	}
+	beMap, err := GetMapByPinnedPath(LB_BACKEND_MAP_PATH)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range backends {
+		if err := beMap.Put(key, value); err != nil {
+			return err
+		}
+	}
+	for key, value := range services {
+		if err := svcMap.Put(key, value); err != nil {
+			return err
+		}
+	}
+
+	var staleSvcs []LBServiceKey
+	var sk LBServiceKey
+	var sv LBServiceValue
+	iter := svcMap.Iterate()
+	for iter.Next(&sk, &sv) {
+		if _, ok := services[sk]; !ok {
+			staleSvcs = append(staleSvcs, sk)
+		}
+	}
+	for _, key := range staleSvcs {
+		if err := svcMap.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	var staleBes []LBBackendKey
+	var bk LBBackendKey
+	var bv LBBackendValue
+	iter = beMap.Iterate()
+	for iter.Next(&bk, &bv) {
+		if _, ok := backends[bk]; !ok {
+			staleBes = append(staleBes, bk)
+		}
+	}
+	for _, key := range staleBes {
+		if err := beMap.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
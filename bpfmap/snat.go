@@ -0,0 +1,240 @@
+package bpfmap
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// snat ct map 记录了 pod出集群的连接 用于回包时把目的地址还原成pod ip
+	SNAT_CT_MAP_PATH        = "/sys/fs/bpf/tc/globals/snat_ct_map"
+	SNAT_CT_MAP_NAME        = "snat_ct_map"
+	SNAT_CT_MAP_MAX_ENTRIES = 65536
+
+	// snat fwd map 记录了 pod的连接分配到的节点端口
+	SNAT_FWD_MAP_PATH        = "/sys/fs/bpf/tc/globals/snat_fwd_map"
+	SNAT_FWD_MAP_NAME        = "snat_fwd_map"
+	SNAT_FWD_MAP_MAX_ENTRIES = 65536
+
+	// 不做masquerade的目的网段(LPM)
+	NO_MASQ_MAP_PATH        = "/sys/fs/bpf/tc/globals/no_masq_map"
+	NO_MASQ_MAP_NAME        = "no_masq_map"
+	NO_MASQ_MAP_MAX_ENTRIES = 64
+
+	// snat使用的节点ip
+	SNAT_CONFIG_MAP_PATH        = "/sys/fs/bpf/tc/globals/snat_config_map"
+	SNAT_CONFIG_MAP_NAME        = "snat_config_map"
+	SNAT_CONFIG_MAP_MAX_ENTRIES = 1
+)
+
+// A connection leaving the cluster, seen from the reply side,
+// LocalPort is the node port allocated by snat_egress.
+// 4+2+2+1+3 = 12bytes
+type SNATKey struct {
+	RemoteIP   uint32
+	RemotePort uint16
+	LocalPort  uint16
+	Proto      uint8
+	Pad        [3]uint8
+}
+
+// original source of the connection
+type SNATValue struct {
+	PodIP   uint32
+	PodPort uint16
+	Pad     [2]uint8
+}
+
+// A connection leaving the cluster, seen from the pod side,
+// 4+4+2+2+1+3 = 16bytes
+type SNATFwdKey struct {
+	PodIP      uint32
+	RemoteIP   uint32
+	PodPort    uint16
+	RemotePort uint16
+	Proto      uint8
+	Pad        [3]uint8
+}
+
+// node port allocated for the connection
+type SNATFwdValue struct {
+	NodePort uint16
+	Pad      [2]uint8
+}
+
+// LPM trie key, ip is in network byte order
+type NoMasqKey struct {
+	PrefixLen uint32
+	IP        [4]byte
+}
+
+type NoMasqValue struct {
+	Flag uint32
+}
+
+type SNATConfigKey struct {
+	Index uint32
+}
+
+type SNATConfigValue struct {
+	NodeIP uint32
+}
+
+// Create conntrack-like map for ebpf snat
+func CreateSNATCTMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		SNAT_CT_MAP_PATH,
+		SNAT_CT_MAP_NAME,
+		ebpf.LRUHash,
+		uint32(unsafe.Sizeof(SNATKey{})),
+		uint32(unsafe.Sizeof(SNATValue{})),
+		SNAT_CT_MAP_MAX_ENTRIES,
+		0,
+	)
+}
+
+// Create map of node ports allocated by ebpf snat
+func CreateSNATFwdMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		SNAT_FWD_MAP_PATH,
+		SNAT_FWD_MAP_NAME,
+		ebpf.LRUHash,
+		uint32(unsafe.Sizeof(SNATFwdKey{})),
+		uint32(unsafe.Sizeof(SNATFwdValue{})),
+		SNAT_FWD_MAP_MAX_ENTRIES,
+		0,
+	)
+}
+
+// Create non-masquerade cidr map for ebpf snat
+func CreateNoMasqMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		NO_MASQ_MAP_PATH,
+		NO_MASQ_MAP_NAME,
+		ebpf.LPMTrie,
+		uint32(unsafe.Sizeof(NoMasqKey{})),
+		uint32(unsafe.Sizeof(NoMasqValue{})),
+		NO_MASQ_MAP_MAX_ENTRIES,
+		unix.BPF_F_NO_PREALLOC,
+	)
+}
+
+// Create snat config map, holding the node ip
+func CreateSNATConfigMap() (*ebpf.Map, error) {
+	return CreatePinMapOnce(
+		SNAT_CONFIG_MAP_PATH,
+		SNAT_CONFIG_MAP_NAME,
+		ebpf.Array,
+		uint32(unsafe.Sizeof(SNATConfigKey{})),
+		uint32(unsafe.Sizeof(SNATConfigValue{})),
+		SNAT_CONFIG_MAP_MAX_ENTRIES,
+		0,
+	)
+}
+
+// Convert cidr into the key of no_masq_map
+func NewNoMasqKey(cidr *net.IPNet) NoMasqKey {
+	ones, _ := cidr.Mask.Size()
+	key := NoMasqKey{PrefixLen: uint32(ones)}
+	copy(key.IP[:], cidr.IP.To4())
+	return key
+}
+
+// Replace all entries in no_masq_map with given cidrs
+func SetNoMasqMap(cidrs []*net.IPNet) error {
+	mp, err := GetMapByPinnedPath(NO_MASQ_MAP_PATH)
+	if err != nil {
+		return err
+	}
+
+	var keys []NoMasqKey
+	var key NoMasqKey
+	var value NoMasqValue
+	iter := mp.Iterate()
+	for iter.Next(&key, &value) {
+		keys = append(keys, key)
+	}
+	for _, k := range keys {
+		if err := mp.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	for _, cidr := range cidrs {
+		if err := mp.Put(NewNoMasqKey(cidr), NoMasqValue{Flag: 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set node ip used by snat
+func SetSNATConfigMap(value SNATConfigValue) error {
+	mp, err := GetMapByPinnedPath(SNAT_CONFIG_MAP_PATH)
+	if err != nil {
+		return err
+	}
+	return mp.Put(SNATConfigKey{Index: 0}, value)
+}
+
+// Reset the conntrack-like map
+func ResetSNATCTMap() (int, error) {
+	mp, err := GetMapByPinnedPath(SNAT_CT_MAP_PATH)
+	if err != nil {
+		return -1, err
+	}
+
+	iter := mp.Iterate()
+	keys := []SNATKey{}
+	var key SNATKey
+	var value SNATValue
+
+	for iter.Next(&key, &value) {
+		keys = append(keys, key)
+	}
+	for _, k := range keys {
+		if err := mp.Delete(k); err != nil {
+			return -1, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Reset node ports allocated for connections
+func ResetSNATFwdMap() (int, error) {
+	mp, err := GetMapByPinnedPath(SNAT_FWD_MAP_PATH)
+	if err != nil {
+		return -1, err
+	}
+
+	iter := mp.Iterate()
+	keys := []SNATFwdKey{}
+	var key SNATFwdKey
+	var value SNATFwdValue
+
+	for iter.Next(&key, &value) {
+		keys = append(keys, key)
+	}
+	for _, k := range keys {
+		if err := mp.Delete(k); err != nil {
+			return -1, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Remove pinned snat maps, they are freed once no program holds them.
+// maps not pinned are skipped.
+func RemoveSNATMaps() error {
+	for _, path := range []string{SNAT_CT_MAP_PATH, SNAT_FWD_MAP_PATH, NO_MASQ_MAP_PATH, SNAT_CONFIG_MAP_PATH} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove pinned map %s: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -18,4 +18,20 @@ for d in $PLUGINS; do
 			${GO:-go} build -o "${PWD}/bin/$plugin" "$@" ./"$d"
 		fi
 	fi
-done
\ No newline at end of file
+done
+
+# vmlinux.h of the running kernel is generated once, unless one is put in ebpf/
+echo "Building ebpf objects"
+CLANG="${CLANG:-clang}"
+if ! command -v "$CLANG" >/dev/null 2>&1; then
+	echo "  $CLANG not found, ebpf objects in bin/ are left as they are"
+elif [ ! -f ebpf/vmlinux.h ] && ! bpftool btf dump file /sys/kernel/btf/vmlinux format c > ebpf/vmlinux.h; then
+	rm -f ebpf/vmlinux.h
+	echo "  cannot generate ebpf/vmlinux.h with bpftool, ebpf objects in bin/ are left as they are"
+else
+	for src in ebpf/*.bpf.c; do
+		obj="$(basename "${src%.c}").o"
+		echo "  $obj"
+		"$CLANG" -O2 -g -target bpf -I ebpf -c "$src" -o "${PWD}/bin/$obj"
+	done
+fi
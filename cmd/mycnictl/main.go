@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/podinfo"
+	"mycni/plugins/ipam/etcdmode/allocator"
+	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/plugins/ipam/local/store"
+)
+
+const usage = `usage: mycnictl reserve <add|del|list> [flags] [ip|cidr]
+       mycnictl lookup [flags] <ip|namespace/name>
+       mycnictl release [flags] <ip>
+
+flags:
+  -ipam      etcdmode or local, default etcdmode
+  -data-dir  data dir of local ipam, default /var/lib/testcni
+  -network   network name of local ipam, default mynet
+  -reason    why the range is reserved, for reserve add only
+  -quarantine  quarantine of local ipam, ips released are not reused within it, like 30s
+  -backend   store of etcdmode, etcd or kubernetes, default etcd
+  -kubeconfig  apiserver of the kubernetes backend
+
+etcd flags of etcdmode, defaults from MYCNI_ETCD_* env:
+  -etcd-endpoints, -etcd-cert-file, -etcd-key-file, -etcd-ca-file,
+  -etcd-username, -etcd-dial-timeout, -etcd-request-timeout, -etcd-key-prefix, -etcd-config
+`
+
+// 管理ipam预留地址 查询ip归属的命令行
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// reservations kept by one of the ipam plugins
+type reserver interface {
+	Reserve(cidr, reason string) error
+	Unreserve(cidr string) (bool, error)
+	List() (map[string]string, error)
+}
+
+// owner of an allocated ip
+type owner struct {
+	pod    string
+	device string
+	node   string
+}
+
+// allocations recorded by one of the ipam plugins, keyed by ip
+type finder interface {
+	ByIP(ip string) (map[string]owner, error)
+	ByPod(namespace, name string) (map[string]owner, error)
+}
+
+// ips released by hand, like ones of containers the runtime never deleted
+type releaser interface {
+	ReleaseByIP(ip string) (owner, bool, error)
+}
+
+// both backends of one ipam plugin
+type backend interface {
+	reserver
+	finder
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return fmt.Errorf(usage)
+	}
+	switch args[0] {
+	case "reserve":
+		if len(args) < 2 {
+			return fmt.Errorf(usage)
+		}
+		return runReserve(args[1], args[2:], out)
+	case "lookup":
+		return runLookup(args[1:], out)
+	case "release":
+		return runRelease(args[1:], out)
+	}
+	return fmt.Errorf(usage)
+}
+
+type flags struct {
+	fs      *flag.FlagSet
+	ipam    *string
+	dataDir *string
+	network *string
+	reason  *string
+	backend *string
+	kube    etcdwrap.KubeBackendConfig
+	etcd    etcdwrap.Config
+
+	// 与网络配置中local ipam的quarantine一致
+	quarantine *time.Duration
+}
+
+func parseFlags(name string, args []string) (*flags, error) {
+	f := &flags{fs: flag.NewFlagSet(name, flag.ContinueOnError)}
+	f.fs.SetOutput(io.Discard)
+	f.ipam = f.fs.String("ipam", "etcdmode", "")
+	f.dataDir = f.fs.String("data-dir", "", "")
+	f.network = f.fs.String("network", "mynet", "")
+	f.reason = f.fs.String("reason", "", "")
+	f.quarantine = f.fs.Duration("quarantine", 0, "")
+	f.backend = f.fs.String("backend", allocator.BackendEtcd, "")
+	f.fs.StringVar(&f.kube.Kubeconfig, "kubeconfig", "", "")
+	f.etcd.AddFlags(f.fs)
+	if err := f.fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%v\n%s", err, usage)
+	}
+	if *f.quarantine < 0 {
+		return nil, fmt.Errorf("invalid quarantine %s\n%s", *f.quarantine, usage)
+	}
+	return f, nil
+}
+
+// open the ipam plugin given by -ipam, close it when done
+func (f *flags) open() (backend, func(), error) {
+	switch *f.ipam {
+	case "etcdmode":
+		if *f.backend == allocator.BackendKubernetes {
+			cli, err := etcdwrap.NewKubeBackendFromConfig(&f.kube)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &etcdBackend{cli}, func() {}, nil
+		}
+		if err := f.etcd.Complete(); err != nil {
+			return nil, nil, err
+		}
+		cli, err := etcdwrap.New(&f.etcd)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &etcdBackend{cli}, cli.CloseEtcdClient, nil
+	case "local":
+		s, err := store.NewStore(*f.dataDir, *f.network)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.Recover = store.FromResultCache("", *f.network)
+		s.Quarantine = *f.quarantine
+		return &localBackend{s}, func() { s.Close() }, nil
+	}
+	return nil, nil, fmt.Errorf("unknown ipam %q\n%s", *f.ipam, usage)
+}
+
+func runReserve(action string, args []string, out io.Writer) error {
+	f, err := parseFlags("reserve", args)
+	if err != nil {
+		return err
+	}
+	r, closeFn, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	fs := f.fs
+	switch action {
+	case "add", "del":
+		if fs.NArg() != 1 {
+			return fmt.Errorf(usage)
+		}
+		if action == "add" {
+			if err := r.Reserve(fs.Arg(0), *f.reason); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "reserved %s\n", fs.Arg(0))
+			return nil
+		}
+		ok, err := r.Unreserve(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s is not reserved", fs.Arg(0))
+		}
+		fmt.Fprintf(out, "unreserved %s\n", fs.Arg(0))
+		return nil
+	case "list":
+		list, err := r.List()
+		if err != nil {
+			return err
+		}
+		cidrs := make([]string, 0, len(list))
+		for cidr := range list {
+			cidrs = append(cidrs, cidr)
+		}
+		sort.Strings(cidrs)
+		for _, cidr := range cidrs {
+			fmt.Fprintf(out, "%s\t%s\n", cidr, list[cidr])
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action %q\n%s", action, usage)
+}
+
+// which pod owns the ip, or which ips the pod has
+func runLookup(args []string, out io.Writer) error {
+	f, err := parseFlags("lookup", args)
+	if err != nil {
+		return err
+	}
+	if f.fs.NArg() != 1 {
+		return fmt.Errorf(usage)
+	}
+	b, closeFn, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	var res map[string]owner
+	if arg := f.fs.Arg(0); net.ParseIP(arg) != nil {
+		res, err = b.ByIP(arg)
+	} else {
+		namespace, name, perr := podinfo.ParseName(arg)
+		if perr != nil {
+			return perr
+		}
+		res, err = b.ByPod(namespace, name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return fmt.Errorf("nothing is allocated to %s", f.fs.Arg(0))
+	}
+
+	ips := make([]string, 0, len(res))
+	for ip := range res {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		o := res[ip]
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", ip, orDash(o.pod), o.device, orDash(o.node))
+	}
+	return nil
+}
+
+// give back an allocated ip, whoever holds it
+func runRelease(args []string, out io.Writer) error {
+	f, err := parseFlags("release", args)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(f.fs.Arg(0))
+	if f.fs.NArg() != 1 || ip == nil {
+		return fmt.Errorf(usage)
+	}
+	b, closeFn, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	r, ok := b.(releaser)
+	if !ok {
+		return fmt.Errorf("release is not supported by ipam %s", *f.ipam)
+	}
+	o, ok, err := r.ReleaseByIP(ip.String())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("nothing is allocated to %s", ip)
+	}
+	fmt.Fprintf(out, "released %s\t%s\t%s\n", ip, orDash(o.pod), o.device)
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+type etcdBackend struct {
+	cli etcdwrap.Backend
+}
+
+func (r *etcdBackend) Reserve(cidr, reason string) error {
+	return allocator.Reserve(context.Background(), cidr, reason, r.cli)
+}
+
+func (r *etcdBackend) Unreserve(cidr string) (bool, error) {
+	return allocator.Unreserve(context.Background(), cidr, r.cli)
+}
+
+func (r *etcdBackend) List() (map[string]string, error) {
+	list, err := allocator.ListReservations(context.Background(), r.cli)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(list))
+	for cidr, v := range list {
+		res[cidr] = v.Reason
+	}
+	return res, nil
+}
+
+// local store is locked & reloaded for every operation, like the plugin does
+type localBackend struct {
+	s *store.Store
+}
+
+func (r *localBackend) Reserve(cidr, reason string) error {
+	ipnet, err := initpool.ParseRange(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid range %q: %v", cidr, err)
+	}
+	r.s.Lock()
+	defer r.s.Unlock()
+	if err := r.s.LoadData(); err != nil {
+		return err
+	}
+	return r.s.Reserve(ipnet, reason)
+}
+
+func (r *localBackend) Unreserve(cidr string) (bool, error) {
+	ipnet, err := initpool.ParseRange(cidr)
+	if err != nil {
+		return false, fmt.Errorf("invalid range %q: %v", cidr, err)
+	}
+	r.s.Lock()
+	defer r.s.Unlock()
+	if err := r.s.LoadData(); err != nil {
+		return false, err
+	}
+	return r.s.Unreserve(ipnet)
+}
+
+func (r *localBackend) List() (map[string]string, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+	if err := r.s.LoadData(); err != nil {
+		return nil, err
+	}
+	return r.s.Reservations(), nil
+}
+
+func etcdOwner(a *allocator.Allocation) owner {
+	o := owner{pod: a.Pod.String(), device: a.ContainerID + "-" + a.IfName, node: a.Node}
+	// device is gone, ip is kept for the pod
+	if a.ReleasedAt != nil {
+		o.device = "(sticky)"
+	}
+	return o
+}
+
+func (r *etcdBackend) ByIP(ip string) (map[string]owner, error) {
+	a, err := allocator.FindByIP(context.Background(), ip, r.cli)
+	if err != nil || a == nil {
+		return nil, err
+	}
+	return map[string]owner{net.ParseIP(ip).String(): etcdOwner(a)}, nil
+}
+
+func (r *etcdBackend) ByPod(namespace, name string) (map[string]owner, error) {
+	allocs, err := allocator.FindByPod(context.Background(), namespace, name, r.cli)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]owner, len(allocs))
+	for ip, a := range allocs {
+		res[ip] = etcdOwner(a)
+	}
+	return res, nil
+}
+
+func localOwner(info store.ContainerNetInfo) owner {
+	return owner{pod: info.Pod.String(), device: info.ID + "-" + info.IFName}
+}
+
+func (r *localBackend) ByIP(ip string) (map[string]owner, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+	if err := r.s.LoadData(); err != nil {
+		return nil, err
+	}
+	info, ok := r.s.GetByIP(net.ParseIP(ip))
+	if !ok {
+		return nil, nil
+	}
+	return map[string]owner{net.ParseIP(ip).String(): localOwner(info)}, nil
+}
+
+func (r *localBackend) ByPod(namespace, name string) (map[string]owner, error) {
+	r.s.RLock()
+	defer r.s.RUnlock()
+	if err := r.s.LoadData(); err != nil {
+		return nil, err
+	}
+	res := make(map[string]owner)
+	for ip, info := range r.s.GetByPod(namespace, name) {
+		res[ip] = localOwner(info)
+	}
+	return res, nil
+}
+
+func (r *localBackend) ReleaseByIP(ip string) (owner, bool, error) {
+	r.s.Lock()
+	defer r.s.Unlock()
+	if err := r.s.LoadData(); err != nil {
+		return owner{}, false, err
+	}
+	info, ok, err := r.s.ReleaseByIP(net.ParseIP(ip))
+	if err != nil || !ok {
+		return owner{}, false, err
+	}
+	return localOwner(info), true, nil
+}
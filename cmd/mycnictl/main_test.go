@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/pkg/podinfo"
+	"mycni/plugins/ipam/local/store"
+)
+
+func TestReserveLocal(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	flags := []string{"-ipam", "local", "-data-dir", dir}
+
+	out := &bytes.Buffer{}
+	te.Nil(run(append(append([]string{"reserve", "add"}, flags...), "-reason", "vip", "10.244.0.3"), out))
+	te.Nil(run(append(append([]string{"reserve", "add"}, flags...), "10.244.0.128/25"), out))
+
+	out.Reset()
+	te.Nil(run(append([]string{"reserve", "list"}, flags...), out))
+	te.Equal(out.String(), "10.244.0.128/25\t\n10.244.0.3/32\tvip\n")
+
+	te.Nil(run(append(append([]string{"reserve", "del"}, flags...), "10.244.0.3"), out))
+	te.NotNil(run(append(append([]string{"reserve", "del"}, flags...), "10.244.0.3"), out))
+	te.NotNil(run([]string{"reserve", "add", "-ipam", "local", "-data-dir", dir, "foo"}, out))
+	te.NotNil(run([]string{"foo"}, out))
+}
+
+func TestLookupLocal(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	flags := []string{"-ipam", "local", "-data-dir", dir}
+
+	s, err := store.NewStore(dir, "mynet")
+	te.Nil(err)
+	te.Nil(s.LoadData())
+	te.Nil(s.AddPod(net.ParseIP("10.244.0.2"), "c0", "eth0", &podinfo.Pod{Namespace: "default", Name: "db-0"}))
+	te.Nil(s.Add(net.ParseIP("10.244.0.3"), "c1", "eth0"))
+	te.Nil(s.Close())
+
+	out := &bytes.Buffer{}
+	te.Nil(run(append(append([]string{"lookup"}, flags...), "10.244.0.2"), out))
+	te.Equal(out.String(), "10.244.0.2\tdefault/db-0\tc0-eth0\t-\n")
+
+	out.Reset()
+	te.Nil(run(append(append([]string{"lookup"}, flags...), "db-0"), out))
+	te.Equal(out.String(), "10.244.0.2\tdefault/db-0\tc0-eth0\t-\n")
+
+	out.Reset()
+	te.Nil(run(append(append([]string{"lookup"}, flags...), "10.244.0.3"), out))
+	te.Equal(out.String(), "10.244.0.3\t-\tc1-eth0\t-\n")
+
+	te.NotNil(run(append(append([]string{"lookup"}, flags...), "10.244.0.4"), out))
+	te.NotNil(run(append(append([]string{"lookup"}, flags...), "default/db-1"), out))
+	te.NotNil(run(append(append([]string{"lookup"}, flags...), "a/b/c"), out))
+	te.NotNil(run([]string{"lookup"}, out))
+}
+
+func TestReleaseLocal(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	flags := []string{"-ipam", "local", "-data-dir", dir}
+
+	s, err := store.NewStore(dir, "mynet")
+	te.Nil(err)
+	te.Nil(s.LoadData())
+	te.Nil(s.AddPod(net.ParseIP("10.244.0.2"), "c0", "eth0", &podinfo.Pod{Namespace: "default", Name: "db-0"}))
+	te.Nil(s.Add(net.ParseIP("10.244.0.3"), "c0", "eth1"))
+	te.Nil(s.Close())
+
+	out := &bytes.Buffer{}
+	te.Nil(run(append(append([]string{"release"}, flags...), "10.244.0.2"), out))
+	te.Equal(out.String(), "released 10.244.0.2\tdefault/db-0\tc0-eth0\n")
+	te.NotNil(run(append(append([]string{"release"}, flags...), "10.244.0.2"), out))
+	te.NotNil(run(append(append([]string{"release"}, flags...), "db-0"), out))
+
+	// the other interface is untouched
+	out.Reset()
+	te.Nil(run(append(append([]string{"lookup"}, flags...), "10.244.0.3"), out))
+	te.Equal(out.String(), "10.244.0.3\t-\tc0-eth1\t-\n")
+}
+
+func TestReleaseLocalQuarantine(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	flags := []string{"-ipam", "local", "-data-dir", dir, "-quarantine", "1h"}
+
+	s, err := store.NewStore(dir, "mynet")
+	te.Nil(err)
+	te.Nil(s.LoadData())
+	te.Nil(s.Add(net.ParseIP("10.244.0.2"), "c0", "eth0"))
+	te.Nil(s.Add(net.ParseIP("10.244.0.3"), "c1", "eth0"))
+	te.Nil(s.Close())
+
+	out := &bytes.Buffer{}
+	te.Nil(run(append(append([]string{"release"}, flags...), "10.244.0.2"), out))
+	// without the flag, not quarantined
+	te.Nil(run([]string{"release", "-ipam", "local", "-data-dir", dir, "10.244.0.3"}, out))
+	te.NotNil(run(append([]string{"release", "-quarantine", "-1s"}, flags...), out))
+
+	s, err = store.NewStore(dir, "mynet")
+	te.Nil(err)
+	defer s.Close()
+	s.Quarantine = time.Hour
+	te.Nil(s.LoadData())
+	_, quarantined := s.Quarantined(net.ParseIP("10.244.0.2"))
+	te.True(quarantined)
+	_, quarantined = s.Quarantined(net.ParseIP("10.244.0.3"))
+	te.False(quarantined)
+}
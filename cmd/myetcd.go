@@ -2,11 +2,19 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"mycni/etcdwrap"
 	"mycni/pkg/config"
+	"mycni/pkg/masq"
+	"mycni/pkg/podinfo"
+	"mycni/pkg/policy"
+	"mycni/pkg/service"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/etcdmode/allocator"
+	"mycni/tc"
 	"net"
 	"strconv"
 	"strings"
@@ -17,9 +25,9 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	etcd "go.etcd.io/etcd/client/v3"
-	"go.etcd.io/etcd/pkg/transport"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -32,11 +40,98 @@ var (
 	errBitMaskGetFailed     = errors.New("subnet bitmask could not get!")
 )
 
-type EtcdConfig struct {
-	Endpoints []string
-	Keyfile   string
-	Certfile  string
-	CAFile    string
+// 节点daemon的配置
+type NodeConf struct {
+	ipMasq        bool
+	masqMode      string
+	nonMasqCIDRs  string
+	clusterCIDR   string
+	uplink        string
+	hostIngress   bool
+	tcReconcile   bool
+	masqInterval  time.Duration
+	nonMasqIPNets []*net.IPNet
+	clusterIPNet  *net.IPNet
+	networkPolicy bool
+	serviceLB     bool
+	kubeconfig    string
+	nodeName      string
+	ipamLease     bool
+	ipamBackend   string
+	ipamKube      etcdwrap.KubeBackendConfig
+	reclaimGrace  time.Duration
+	staticIP      bool
+	staticIPDir   string
+	podMeta       bool
+	podMetaDir    string
+	etcd          etcdwrap.Config
+}
+
+func (conf *NodeConf) addFlags() {
+	flag.BoolVar(&conf.ipMasq, "ip-masq", false, "masquerade pods' traffic leaving the cluster")
+	flag.StringVar(&conf.masqMode, "masq-mode", masq.MODE_NFTABLES, "masquerade mode, nftables or ebpf")
+	flag.StringVar(&conf.nonMasqCIDRs, "non-masq-cidrs", "", "comma separated cidrs keeping pod ip, besides node subnet & cluster cidr")
+	flag.StringVar(&conf.clusterCIDR, "cluster-cidr", "10.244.0.0/16", "cidr of all pods, traffic inside it keeps pod ip")
+	flag.StringVar(&conf.uplink, "uplink", "", "node's uplink device, default to the one holding default route")
+	flag.BoolVar(&conf.hostIngress, "host-ingress", false, "host_ingress is attached to the uplink (\"hostIngress\" of the vxlan plugin conf), keep it attached")
+	flag.BoolVar(&conf.tcReconcile, "tc-reconcile", true, "re-attach tc programs missing on host veths, vxlan and uplink")
+	flag.DurationVar(&conf.masqInterval, "masq-sync-interval", 30*time.Second, "interval of syncing masquerade rules")
+	flag.BoolVar(&conf.networkPolicy, "network-policy", false, "enforce kubernetes networkpolicy with ebpf")
+	flag.BoolVar(&conf.serviceLB, "service-lb", false, "load balance clusterip services with ebpf")
+	flag.StringVar(&conf.kubeconfig, "kubeconfig", "/root/.kube/config", "path of kubeconfig")
+	flag.StringVar(&conf.nodeName, "node", "", "name of current node, default to $NODE_NAME or hostname")
+	flag.BoolVar(&conf.ipamLease, "ipam-lease", false, "hold etcdmode ipam blocks of this node with a lease, and reclaim blocks of dead nodes")
+	flag.BoolVar(&conf.staticIP, "static-ip", false, "publish static ip annotations of pods on this node for ipam plugins")
+	flag.StringVar(&conf.staticIPDir, "static-ip-dir", staticip.DefaultDir, "where static ip annotations are published")
+	flag.BoolVar(&conf.podMeta, "pod-meta", false, "publish labels of pods on this node, their namespaces & the node for ipam pools selecting by labels")
+	flag.StringVar(&conf.podMetaDir, "pod-meta-dir", podinfo.DefaultMetaDir, "where labels of pods are published")
+	flag.StringVar(&conf.ipamBackend, "ipam-backend", allocator.BackendEtcd, "where etcdmode ipam is stored, etcd or kubernetes(CRDs, with -kubeconfig)")
+	flag.StringVar(&conf.ipamKube.LeaseNamespace, "ipam-lease-namespace", etcdwrap.DefaultLeaseNamespace, "namespace of node leases & elections of the kubernetes backend")
+	flag.DurationVar(&conf.reclaimGrace, "ipam-reclaim-grace", allocator.DefaultReclaimGrace, "how long blocks of a node are kept after its lease expires")
+	conf.etcd.AddFlags(flag.CommandLine)
+}
+
+func (conf *NodeConf) parseConfig() error {
+	if err := conf.etcd.Complete(); err != nil {
+		return err
+	}
+	if conf.nodeName == "" {
+		conf.nodeName = os.Getenv("NODE_NAME")
+	}
+	if conf.nodeName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		conf.nodeName = hostname
+	}
+
+	if !conf.ipMasq {
+		return nil
+	}
+	if err := masq.ValidMode(conf.masqMode); err != nil {
+		return err
+	}
+
+	var cidrs []string
+	if conf.nonMasqCIDRs != "" {
+		cidrs = strings.Split(conf.nonMasqCIDRs, ",")
+	}
+	ipnets, err := masq.ParseNonMasqCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	conf.nonMasqIPNets = ipnets
+
+	if conf.clusterCIDR == "" {
+		return nil
+	}
+	clusterCIDR, err := masq.ParseNonMasqCIDRs([]string{conf.clusterCIDR})
+	if err != nil {
+		return err
+	}
+	conf.clusterIPNet = clusterCIDR[0]
+	return nil
 }
 
 type Manager interface {
@@ -54,15 +149,15 @@ type Manager interface {
 	Name() string
 }
 
-type etcdNewFunc func(ctx context.Context, c *EtcdConfig) (*etcd.Client, etcd.KV, error)
+type etcdNewFunc func(ctx context.Context, c *etcdwrap.Config) (*etcd.Client, etcd.KV, error)
 
 // 假设操作Etcd相关的注册项是这些
 type EtcdManager struct {
-	cliNewFunc etcdNewFunc  // 初始化handler
-	mux        sync.Mutex   // 锁
-	kvApi      etcd.KV      // kvapi
-	cli        *etcd.Client // 实际的客户端对象
-	etcdConfig *EtcdConfig  // etcd配置
+	cliNewFunc etcdNewFunc      // 初始化handler
+	mux        sync.Mutex       // 锁
+	kvApi      etcd.KV          // kvapi
+	cli        *etcd.Client     // 实际的客户端对象
+	etcdConfig *etcdwrap.Config // etcd配置
 }
 
 func ListNodeFromK8s(ctx context.Context) error {
@@ -93,6 +188,23 @@ func ListNodeFromK8s(ctx context.Context) error {
 	// sm, err := newKubeSubnetManager(ctx, c, sc, nodeName, prefix, useMultiClusterCidr)
 }
 
+func newK8sClient(kubeconfig string) (*clientset.Clientset, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return clientset.NewForConfig(cfg)
+}
+
+// Store of etcdmode ipam, given by -ipam-backend
+func newIPAMBackend(conf *NodeConf) (etcdwrap.Backend, error) {
+	if conf.ipamBackend == allocator.BackendKubernetes {
+		conf.ipamKube.Kubeconfig = conf.kubeconfig
+		return etcdwrap.NewKubeBackendFromConfig(&conf.ipamKube)
+	}
+	return etcdwrap.New(&conf.etcd)
+}
+
 func shutdownHandler(ctx context.Context, sigs chan os.Signal, cancel context.CancelFunc) {
 	// Wait for the context do be Done or for the signal to come in to shutdown.
 	select {
@@ -108,32 +220,16 @@ func shutdownHandler(ctx context.Context, sigs chan os.Signal, cancel context.Ca
 	signal.Stop(sigs)
 }
 
-func newTlsConfig(c *EtcdConfig) (*tls.Config, error) {
-	if c.Keyfile == "" || c.Certfile == "" || c.CAFile == "" {
-		curLog.Fatal("no certificate provided: connecting to etcd with http. This is insecure")
-		return nil, nil
-	} else {
-		tlsInfo := transport.TLSInfo{
-			CertFile:      c.Certfile,
-			KeyFile:       c.Keyfile,
-			TrustedCAFile: c.CAFile,
-		}
-
-		tlsConfig, err := tlsInfo.ClientConfig()
-		return tlsConfig, err
-	}
-}
-
-func newEtcdClient(ctx context.Context, c *EtcdConfig) (*etcd.Client, etcd.KV, error) {
-	tlscfg, err := newTlsConfig(c)
+func newEtcdClient(ctx context.Context, c *etcdwrap.Config) (*etcd.Client, etcd.KV, error) {
+	cfg, err := c.ClientConfig()
 	if err != nil {
 		return nil, nil, err
 	}
+	if cfg.TLS == nil {
+		curLog.Print("no certificate provided: connecting to etcd with http. This is insecure")
+	}
 
-	cli, err := etcd.New(etcd.Config{
-		Endpoints: c.Endpoints,
-		TLS:       tlscfg,
-	})
+	cli, err := etcd.New(cfg)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -147,13 +243,7 @@ func newEtcdClient(ctx context.Context, c *EtcdConfig) (*etcd.Client, etcd.KV, e
 	return cli, kv, nil
 }
 
-func newEtcdManager(ctx context.Context) (*EtcdManager, error) {
-	c := &EtcdConfig{
-		Endpoints: []string{"127.0.0.1:2379", "10.176.35.14:2379"},
-		Keyfile:   "/etc/kubernetes/pki/etcd/healthcheck-client.key",
-		Certfile:  "/etc/kubernetes/pki/etcd/healthcheck-client.crt",
-		CAFile:    "/etc/kubernetes/pki/etcd/ca.crt",
-	}
+func newEtcdManager(ctx context.Context, c *etcdwrap.Config) (*EtcdManager, error) {
 	em := &EtcdManager{
 		cliNewFunc: newEtcdClient,
 		etcdConfig: c,
@@ -345,11 +435,18 @@ func updateLocalSubnetConfig(notUsed int) error {
 }
 
 func main() {
+	conf := &NodeConf{}
+	conf.addFlags()
+	flag.Parse()
+	if err := conf.parseConfig(); err != nil {
+		curLog.Fatal(err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	sm, err := newEtcdManager(ctx)
+	sm, err := newEtcdManager(ctx, &conf.etcd)
 	if err != nil {
-		curLog.Fatal("Failed to create etcd manager!")
+		curLog.Fatalf("Failed to create etcd manager! %v", err)
 	}
 	curLog.Printf("Created etcd manager %s", "just-a-test")
 
@@ -433,4 +530,127 @@ func main() {
 		break
 
 	}
+
+	// 定期(以及网卡变化时)检查节点上tc程序的挂载情况 缺失的重新挂载
+	if conf.tcReconcile {
+		uplink := tc.UplinkConf{
+			Device:      conf.uplink,
+			HostIngress: conf.hostIngress,
+			SNAT:        conf.ipMasq && conf.masqMode == masq.MODE_EBPF,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := tc.NewReconciler(tc.DefaultReconcileInterval, uplink).Run(ctx)
+			if err != nil {
+				curLog.Printf("tc reconciler stopped: %v", err)
+			}
+		}()
+	}
+
+	// 保持masquerade规则与本节点pod一致 没有pod时清理规则
+	if conf.ipMasq {
+		syncer := &masq.Syncer{
+			Mode:        conf.masqMode,
+			Uplink:      conf.uplink,
+			NonMasq:     conf.nonMasqIPNets,
+			ClusterCIDR: conf.clusterIPNet,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			syncer.Run(ctx, conf.masqInterval)
+		}()
+	}
+
+	// 根据networkpolicy编译本节点endpoint的策略 写入bpf map
+	if conf.networkPolicy {
+		c, err := newK8sClient(conf.kubeconfig)
+		if err != nil {
+			curLog.Fatal(err)
+		}
+		ctrl := policy.NewController(c, conf.nodeName, policy.BPFWriter{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ctrl.Run(ctx); err != nil {
+				curLog.Printf("networkpolicy controller stopped: %v", err)
+			}
+		}()
+	}
+
+	// 根据Service/EndpointSlice写入service map 由tc程序完成DNAT
+	if conf.serviceLB {
+		c, err := newK8sClient(conf.kubeconfig)
+		if err != nil {
+			curLog.Fatal(err)
+		}
+		ctrl := service.NewController(c, service.BPFWriter{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ctrl.Run(ctx); err != nil {
+				curLog.Printf("service controller stopped: %v", err)
+			}
+		}()
+	}
+
+	// 把本节点pod的静态ip注解写到本地 供ipam插件读取
+	if conf.staticIP {
+		c, err := newK8sClient(conf.kubeconfig)
+		if err != nil {
+			curLog.Fatal(err)
+		}
+		ctrl := staticip.NewController(c, conf.nodeName, staticip.NewStore(conf.staticIPDir))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ctrl.Run(ctx); err != nil {
+				curLog.Printf("static ip controller stopped: %v", err)
+			}
+		}()
+	}
+
+	// 把本节点pod及其namespace、node的标签写到本地 供ipam插件按标签选择pool
+	if conf.podMeta {
+		c, err := newK8sClient(conf.kubeconfig)
+		if err != nil {
+			curLog.Fatal(err)
+		}
+		ctrl := podinfo.NewMetaController(c, conf.nodeName, podinfo.NewMetaStore(conf.podMetaDir))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ctrl.Run(ctx); err != nil {
+				curLog.Printf("pod metadata controller stopped: %v", err)
+			}
+		}()
+	}
+
+	// 用租约维持本节点ipam block的归属 选主回收失联节点的block
+	if conf.ipamLease {
+		cli, err := newIPAMBackend(conf)
+		if err != nil {
+			curLog.Fatal(err)
+		}
+		lease := allocator.NewNodeLease(cli)
+		reclaimer := allocator.NewReclaimer(cli, conf.nodeName)
+		reclaimer.Grace = conf.reclaimGrace
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := lease.Run(ctx); err != nil {
+				curLog.Printf("ipam node lease stopped: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := reclaimer.Run(ctx); err != nil {
+				curLog.Printf("ipam block reclaimer stopped: %v", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	wg.Wait()
 }
@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause)
+/* Copyright (c) 2023 */
+#include <vmlinux.h>
+#include <bpf/bpf_endian.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+
+//  Attached to the ingress of node's uplink(physical interface),
+//  handles return traffic for pods which has left the cluster.
+#define TC_ACT_UNSPEC   (-1)
+#define TC_ACT_OK	0
+#define ETH_P_IP	0x0800		/* Internet Protocol packet	*/
+#define ETH_ALEN    6           /* Ethernet Address len*/
+#define ETH_HLEN    14
+#define IPPROTO_TCP 6
+#define IPPROTO_UDP 17
+#define BPF_F_PSEUDO_HDR (1ULL << 4)
+#define BPF_F_MARK_MANGLED_0 (1ULL << 5)
+
+#define IP_CSUM_OFF   (ETH_HLEN + offsetof(struct iphdr, check))
+#define IP_DST_OFF    (ETH_HLEN + offsetof(struct iphdr, daddr))
+#define L4_DPORT_OFF  (ETH_HLEN + sizeof(struct iphdr) + offsetof(struct tcphdr, dest))
+#define TCP_CSUM_OFF  (ETH_HLEN + sizeof(struct iphdr) + offsetof(struct tcphdr, check))
+#define UDP_CSUM_OFF  (ETH_HLEN + sizeof(struct iphdr) + offsetof(struct udphdr, check))
+
+// BPF mapping for local pods
+struct epInfo {
+    __u32 lxc_ifindex;       // inside host
+    __u32 pod_ifindex;       // inside pod
+    __u8  lxc_mac[8];        // veth pair lxc, 2 bytes for padding
+    __u8  pod_mac[8];        // veth pair mac, 2 bytes for padding
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 32);
+    __type(key, __u32);
+    __type(value, struct epInfo);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} lxc_map SEC(".maps");
+
+// connections masqueraded by `snat_egress`
+struct snatKey {
+    __u32 remote_ip;
+    __u16 remote_port;
+    __u16 local_port;
+    __u8  proto;
+    __u8  pad[3];
+};
+
+struct snatValue {
+    __u32 pod_ip;
+    __u16 pod_port;
+    __u8  pad[2];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct snatKey);
+    __type(value, struct snatValue);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} snat_ct_map SEC(".maps");
+
+// Translate replies of masqueraded connections back to pod ip & port,
+// returns the (maybe rewritten) destination ip
+static __always_inline __u32 snat_reverse(struct __sk_buff *ctx, struct iphdr *l3, void *data_end)
+{
+    __u32 dst_ip = bpf_htonl(l3->daddr);
+    struct snatKey key = {};
+    __u64 l4_csum_off;
+    __u64 flags = 0;
+
+    if (l3->ihl != 5)
+        return dst_ip;
+
+    key.remote_ip = bpf_htonl(l3->saddr);
+    key.proto = l3->protocol;
+    if (l3->protocol == IPPROTO_TCP) {
+        struct tcphdr *tcp = (struct tcphdr *)(l3 + 1);
+        if ((void *)(tcp + 1) > data_end)
+            return dst_ip;
+        key.remote_port = bpf_ntohs(tcp->source);
+        key.local_port = bpf_ntohs(tcp->dest);
+        l4_csum_off = TCP_CSUM_OFF;
+    } else if (l3->protocol == IPPROTO_UDP) {
+        struct udphdr *udp = (struct udphdr *)(l3 + 1);
+        if ((void *)(udp + 1) > data_end)
+            return dst_ip;
+        key.remote_port = bpf_ntohs(udp->source);
+        key.local_port = bpf_ntohs(udp->dest);
+        l4_csum_off = UDP_CSUM_OFF;
+        flags = BPF_F_MARK_MANGLED_0;
+    } else {
+        return dst_ip;
+    }
+
+    struct snatValue *val = bpf_map_lookup_elem(&snat_ct_map, &key);
+    if (!val)
+        return dst_ip;
+
+    __u32 pod_ip = val->pod_ip;
+    __u32 old_ip = l3->daddr;
+    __u32 new_ip = bpf_htonl(pod_ip);
+    __u16 old_port = bpf_htons(key.local_port);
+    __u16 new_port = bpf_htons(val->pod_port);
+    bpf_l4_csum_replace(ctx, l4_csum_off, old_ip, new_ip, flags | BPF_F_PSEUDO_HDR | sizeof(new_ip));
+    bpf_l3_csum_replace(ctx, IP_CSUM_OFF, old_ip, new_ip, sizeof(new_ip));
+    bpf_skb_store_bytes(ctx, IP_DST_OFF, &new_ip, sizeof(new_ip), 0);
+    // dest port is at the same offset for tcp & udp
+    bpf_l4_csum_replace(ctx, l4_csum_off, old_port, new_port, flags | sizeof(new_port));
+    bpf_skb_store_bytes(ctx, L4_DPORT_OFF, &new_port, sizeof(new_port), 0);
+    return pod_ip;
+}
+
+
+SEC("classifier")
+int host_ingress(struct __sk_buff *ctx)
+{
+	void *data_end = (void *)(__u64)ctx->data_end;
+	void *data = (void *)(__u64)ctx->data;
+	struct ethhdr *l2;
+	struct iphdr *l3;
+
+    // non-ip protocol
+	if (ctx->protocol != bpf_htons(ETH_P_IP))
+		return TC_ACT_OK;
+
+    // empty l2 frames
+	l2 = data;
+	if ((void *)(l2 + 1) > data_end)
+		return TC_ACT_OK;
+
+    // empty l3 packets
+	l3 = (struct iphdr *)(l2 + 1);
+	if ((void *)(l3 + 1) > data_end)
+		return TC_ACT_OK;
+
+    // replies to masqueraded connections are translated back first,
+    // packet pointers are invalid after rewriting
+    __u32 dst_ip = snat_reverse(ctx, l3, data_end);
+
+    // Only replies to pods on this node are handled,
+    // everything else goes through host stack as usual
+    struct epInfo *ep = bpf_map_lookup_elem(&lxc_map, &dst_ip);
+    if (!ep)
+        return TC_ACT_OK;
+
+    // rewrite mac addr to src:[lxc mac] and dst:[pod mac],
+    // as if the packet is sent by the host veth end
+    unsigned char src_mac[ETH_ALEN];
+    unsigned char dst_mac[ETH_ALEN];
+    for (int i = 0; i < ETH_ALEN; i++) {
+        src_mac[i] = ep->lxc_mac[i];
+        dst_mac[i] = ep->pod_mac[i];
+    }
+
+    bpf_skb_store_bytes(ctx, offsetof(struct ethhdr, h_source), src_mac, ETH_ALEN, 0);
+    bpf_skb_store_bytes(ctx, offsetof(struct ethhdr, h_dest), dst_mac, ETH_ALEN, 0);
+
+    // skip the host stack, deliver straight into pod's netns
+    return bpf_redirect_peer(ep->lxc_ifindex, 0);
+}
+
+char __license[] SEC("license") = "GPL";
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause)
+/* Copyright (c) 2023 */
+#ifndef __MYCNI_LB_H
+#define __MYCNI_LB_H
+
+//  ClusterIP service load balancing shared by `veth_ingress` and `vxlan_ingress`,
+//  maps are written by the service controller of node daemon.
+#define LB_CT_ORIGINAL  0
+#define LB_CT_REPLY     1
+
+#ifndef IPPROTO_TCP
+#define IPPROTO_TCP 6
+#endif
+#ifndef IPPROTO_UDP
+#define IPPROTO_UDP 17
+#endif
+#ifndef ETH_HLEN
+#define ETH_HLEN    14
+#endif
+#ifndef BPF_F_PSEUDO_HDR
+#define BPF_F_PSEUDO_HDR (1ULL << 4)
+#endif
+#ifndef BPF_F_MARK_MANGLED_0
+#define BPF_F_MARK_MANGLED_0 (1ULL << 5)
+#endif
+
+#define LB_IP_CSUM_OFF  (ETH_HLEN + offsetof(struct iphdr, check))
+#define LB_IP_SRC_OFF   (ETH_HLEN + offsetof(struct iphdr, saddr))
+#define LB_IP_DST_OFF   (ETH_HLEN + offsetof(struct iphdr, daddr))
+#define LB_L4_OFF       (ETH_HLEN + sizeof(struct iphdr))
+#define LB_L4_SPORT_OFF (LB_L4_OFF + 0)   /* same for tcp & udp */
+#define LB_L4_DPORT_OFF (LB_L4_OFF + 2)
+#define LB_TCP_CSUM_OFF (LB_L4_OFF + offsetof(struct tcphdr, check))
+#define LB_UDP_CSUM_OFF (LB_L4_OFF + offsetof(struct udphdr, check))
+
+// Service frontend, ip & port in host byte order
+struct lbServiceKey {
+    __u32 address;
+    __u16 port;
+    __u8  proto;
+    __u8  pad;
+};
+
+struct lbServiceValue {
+    __u32 count;             // backends are in slot [0, count)
+};
+
+struct lbBackendKey {
+    struct lbServiceKey service;
+    __u32 slot;
+};
+
+struct lbBackendValue {
+    __u32 address;
+    __u16 port;
+    __u8  pad[2];
+};
+
+struct lbCtKey {
+    __u32 src_ip;
+    __u32 dst_ip;
+    __u16 sport;
+    __u16 dport;
+    __u8  proto;
+    __u8  dir;               // original or reply
+    __u8  pad[2];
+};
+
+// backend for original direction, frontend for replies
+struct lbCtValue {
+    __u32 address;
+    __u16 port;
+    __u8  pad[2];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1024);
+    __type(key, struct lbServiceKey);
+    __type(value, struct lbServiceValue);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} lb_service_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 16384);
+    __type(key, struct lbBackendKey);
+    __type(value, struct lbBackendValue);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} lb_backend_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct lbCtKey);
+    __type(value, struct lbCtValue);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} lb_ct_map SEC(".maps");
+
+// Load the tuple of tcp/udp packet, returns 0 on success
+static __always_inline int lb_load_tuple(struct __sk_buff *ctx, struct lbCtKey *t, __u64 *csum_off)
+{
+    void *data_end = (void *)(__u64)ctx->data_end;
+    void *data = (void *)(__u64)ctx->data;
+    struct ethhdr *l2 = data;
+    struct iphdr *l3;
+
+    if ((void *)(l2 + 1) > data_end)
+        return -1;
+    l3 = (struct iphdr *)(l2 + 1);
+    if ((void *)(l3 + 1) > data_end || l3->ihl != 5)
+        return -1;
+
+    t->src_ip = bpf_htonl(l3->saddr);
+    t->dst_ip = bpf_htonl(l3->daddr);
+    t->proto = l3->protocol;
+    if (l3->protocol == IPPROTO_TCP) {
+        struct tcphdr *tcp = (struct tcphdr *)(l3 + 1);
+        if ((void *)(tcp + 1) > data_end)
+            return -1;
+        t->sport = bpf_ntohs(tcp->source);
+        t->dport = bpf_ntohs(tcp->dest);
+        *csum_off = LB_TCP_CSUM_OFF;
+        return 0;
+    }
+    if (l3->protocol == IPPROTO_UDP) {
+        struct udphdr *udp = (struct udphdr *)(l3 + 1);
+        if ((void *)(udp + 1) > data_end)
+            return -1;
+        t->sport = bpf_ntohs(udp->source);
+        t->dport = bpf_ntohs(udp->dest);
+        *csum_off = LB_UDP_CSUM_OFF;
+        return 0;
+    }
+    return -1;
+}
+
+// Rewrite ip & port at given offsets, with checksums fixed
+static __always_inline void lb_rewrite(struct __sk_buff *ctx, __u64 csum_off, __u8 proto,
+                                       __u64 ip_off, __u32 old_ip, __u32 new_ip,
+                                       __u64 port_off, __u16 old_port, __u16 new_port)
+{
+    __u64 flags = proto == IPPROTO_UDP ? BPF_F_MARK_MANGLED_0 : 0;
+    __u32 old_ip_be = bpf_htonl(old_ip);
+    __u32 new_ip_be = bpf_htonl(new_ip);
+    __u16 old_port_be = bpf_htons(old_port);
+    __u16 new_port_be = bpf_htons(new_port);
+
+    bpf_l4_csum_replace(ctx, csum_off, old_ip_be, new_ip_be, flags | BPF_F_PSEUDO_HDR | sizeof(new_ip_be));
+    bpf_l3_csum_replace(ctx, LB_IP_CSUM_OFF, old_ip_be, new_ip_be, sizeof(new_ip_be));
+    bpf_skb_store_bytes(ctx, ip_off, &new_ip_be, sizeof(new_ip_be), 0);
+
+    if (old_port != new_port) {
+        bpf_l4_csum_replace(ctx, csum_off, old_port_be, new_port_be, flags | sizeof(new_port_be));
+        bpf_skb_store_bytes(ctx, port_off, &new_port_be, sizeof(new_port_be), 0);
+    }
+}
+
+// DNAT packets sent to a service frontend into one of its backends,
+// packet pointers are invalid after rewriting.
+static __always_inline void lb_dnat(struct __sk_buff *ctx)
+{
+    struct lbCtKey ct = {};
+    __u64 csum_off = 0;
+
+    if (lb_load_tuple(ctx, &ct, &csum_off))
+        return;
+
+    struct lbServiceKey svc = {};
+    svc.address = ct.dst_ip;
+    svc.port = ct.dport;
+    svc.proto = ct.proto;
+    struct lbServiceValue *sv = bpf_map_lookup_elem(&lb_service_map, &svc);
+    if (!sv || sv->count == 0)
+        return;
+
+    // keep using the backend chosen by previous packets of the connection
+    struct lbCtValue backend = {};
+    ct.dir = LB_CT_ORIGINAL;
+    struct lbCtValue *prev = bpf_map_lookup_elem(&lb_ct_map, &ct);
+    if (prev) {
+        backend = *prev;
+    } else {
+        struct lbBackendKey bk = {};
+        bk.service = svc;
+        bk.slot = bpf_get_prandom_u32() % sv->count;
+        struct lbBackendValue *bv = bpf_map_lookup_elem(&lb_backend_map, &bk);
+        if (!bv)
+            return;
+        backend.address = bv->address;
+        backend.port = bv->port;
+        bpf_map_update_elem(&lb_ct_map, &ct, &backend, BPF_ANY);
+    }
+
+    // replies from backend are translated back to the frontend
+    struct lbCtKey rev = {};
+    rev.src_ip = backend.address;
+    rev.dst_ip = ct.src_ip;
+    rev.sport = backend.port;
+    rev.dport = ct.sport;
+    rev.proto = ct.proto;
+    rev.dir = LB_CT_REPLY;
+    struct lbCtValue frontend = {};
+    frontend.address = ct.dst_ip;
+    frontend.port = ct.dport;
+    bpf_map_update_elem(&lb_ct_map, &rev, &frontend, BPF_ANY);
+
+    lb_rewrite(ctx, csum_off, ct.proto,
+               LB_IP_DST_OFF, ct.dst_ip, backend.address,
+               LB_L4_DPORT_OFF, ct.dport, backend.port);
+}
+
+// Translate source of replies from backend back to the service frontend,
+// packet pointers are invalid after rewriting.
+static __always_inline void lb_reverse(struct __sk_buff *ctx)
+{
+    struct lbCtKey ct = {};
+    __u64 csum_off = 0;
+
+    if (lb_load_tuple(ctx, &ct, &csum_off))
+        return;
+
+    ct.dir = LB_CT_REPLY;
+    struct lbCtValue *frontend = bpf_map_lookup_elem(&lb_ct_map, &ct);
+    if (!frontend)
+        return;
+
+    lb_rewrite(ctx, csum_off, ct.proto,
+               LB_IP_SRC_OFF, ct.src_ip, frontend->address,
+               LB_L4_SPORT_OFF, ct.sport, frontend->port);
+}
+
+#endif /* __MYCNI_LB_H */
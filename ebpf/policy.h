@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause)
+/* Copyright (c) 2023 */
+#ifndef __MYCNI_POLICY_H
+#define __MYCNI_POLICY_H
+
+//  NetworkPolicy enforcement shared by `veth_ingress` and `vxlan_ingress`,
+//  maps are compiled by the policy controller of node daemon.
+#define POLICY_INGRESS  1
+#define POLICY_EGRESS   2
+#define POLICY_DENY     0
+#define POLICY_ALLOW    1
+#define POLICY_KEY_FIXED_BITS 64    /* ep_ip + direction + proto + port */
+
+#ifndef IPPROTO_TCP
+#define IPPROTO_TCP 6
+#endif
+#ifndef IPPROTO_UDP
+#define IPPROTO_UDP 17
+#endif
+
+// LPM key, peer ip is matched by prefix, port/proto == 0 means any
+struct policyKey {
+    __u32 prefixlen;
+    __u32 ep_ip;             // same as the key of lxc_map
+    __u8  direction;
+    __u8  proto;
+    __u16 port;
+    __u8  peer_ip[4];        // network byte order
+};
+
+struct policyValue {
+    __u32 action;
+};
+
+// endpoint selected by any policy is isolated on that direction
+struct policyEpValue {
+    __u8 ingress;
+    __u8 egress;
+    __u8 pad[2];
+};
+
+// connections allowed by policy, replies are allowed as well
+struct policyCtKey {
+    __u32 src_ip;
+    __u32 dst_ip;
+    __u16 sport;
+    __u16 dport;
+    __u8  proto;
+    __u8  pad[3];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 4096);
+    __type(key, struct policyKey);
+    __type(value, struct policyValue);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} policy_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 256);
+    __type(key, __u32);
+    __type(value, struct policyEpValue);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} policy_ep_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct policyCtKey);
+    __type(value, __u32);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} policy_ct_map SEC(".maps");
+
+// Lookup the action for endpoint, from the most specific port to any protocol.
+// Rules are additive: a DENY(ipBlock.except) only hides allows of its own port level,
+// so it falls through to the less specific ones, which may be allowed by another rule.
+// Keep in sync with Compiled.Lookup of pkg/policy.
+static __always_inline __u32 policy_lookup(__u32 ep_ip, __u8 direction, __u32 peer_ip, __u8 proto, __u16 port)
+{
+    struct policyKey key = {};
+    struct policyValue *val;
+
+    key.prefixlen = POLICY_KEY_FIXED_BITS + 32;
+    key.ep_ip = ep_ip;
+    key.direction = direction;
+    __builtin_memcpy(key.peer_ip, &peer_ip, 4);
+
+    key.proto = proto;
+    key.port = port;
+    val = bpf_map_lookup_elem(&policy_map, &key);
+    if (val && val->action == POLICY_ALLOW)
+        return POLICY_ALLOW;
+
+    key.port = 0;
+    val = bpf_map_lookup_elem(&policy_map, &key);
+    if (val && val->action == POLICY_ALLOW)
+        return POLICY_ALLOW;
+
+    key.proto = 0;
+    val = bpf_map_lookup_elem(&policy_map, &key);
+    if (val && val->action == POLICY_ALLOW)
+        return POLICY_ALLOW;
+
+    return POLICY_DENY;
+}
+
+// Check policy of packet, returns 1 if allowed.
+//
+// check_egress: source is a local pod, check its egress policy
+// check_ingress: destination is a local pod, check its ingress policy
+static __always_inline int policy_allowed(struct iphdr *l3, void *data_end, int check_egress, int check_ingress)
+{
+    __u32 src_ip = bpf_htonl(l3->saddr);
+    __u32 dst_ip = bpf_htonl(l3->daddr);
+    struct policyEpValue *src_ep = NULL;
+    struct policyEpValue *dst_ep = NULL;
+    struct policyCtKey ct = {};
+    struct policyCtKey rev = {};
+
+    if (check_egress)
+        src_ep = bpf_map_lookup_elem(&policy_ep_map, &src_ip);
+    if (check_ingress)
+        dst_ep = bpf_map_lookup_elem(&policy_ep_map, &dst_ip);
+
+    // endpoints not selected by any policy are not isolated
+    if (!src_ep && !dst_ep)
+        return 1;
+
+    ct.src_ip = src_ip;
+    ct.dst_ip = dst_ip;
+    ct.proto = l3->protocol;
+    if (l3->ihl == 5 && l3->protocol == IPPROTO_TCP) {
+        struct tcphdr *tcp = (struct tcphdr *)(l3 + 1);
+        if ((void *)(tcp + 1) > data_end)
+            return 0;
+        ct.sport = bpf_ntohs(tcp->source);
+        ct.dport = bpf_ntohs(tcp->dest);
+    } else if (l3->ihl == 5 && l3->protocol == IPPROTO_UDP) {
+        struct udphdr *udp = (struct udphdr *)(l3 + 1);
+        if ((void *)(udp + 1) > data_end)
+            return 0;
+        ct.sport = bpf_ntohs(udp->source);
+        ct.dport = bpf_ntohs(udp->dest);
+    }
+
+    // established or reply of an allowed connection
+    if (bpf_map_lookup_elem(&policy_ct_map, &ct))
+        return 1;
+    rev.src_ip = dst_ip;
+    rev.dst_ip = src_ip;
+    rev.sport = ct.dport;
+    rev.dport = ct.sport;
+    rev.proto = ct.proto;
+    if (bpf_map_lookup_elem(&policy_ct_map, &rev))
+        return 1;
+
+    if (src_ep && src_ep->egress &&
+        policy_lookup(src_ip, POLICY_EGRESS, l3->daddr, ct.proto, ct.dport) != POLICY_ALLOW)
+        return 0;
+
+    if (dst_ep && dst_ep->ingress &&
+        policy_lookup(dst_ip, POLICY_INGRESS, l3->saddr, ct.proto, ct.dport) != POLICY_ALLOW)
+        return 0;
+
+    // track the connection, so replies pass the other direction
+    __u32 one = 1;
+    bpf_map_update_elem(&policy_ct_map, &ct, &one, BPF_ANY);
+    return 1;
+}
+
+#endif /* __MYCNI_POLICY_H */
@@ -0,0 +1,249 @@
+// SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause)
+/* Copyright (c) 2023 */
+#include <vmlinux.h>
+#include <bpf/bpf_endian.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+
+//  Attached to the egress of node's uplink, masquerade pods' traffic
+//  leaving the cluster with node ip. Replies are translated back by `host_ingress`.
+#define TC_ACT_OK	0
+#define ETH_P_IP	0x0800		/* Internet Protocol packet	*/
+#define ETH_HLEN    14
+#define IPPROTO_TCP 6
+#define IPPROTO_UDP 17
+#define TC_ACT_SHOT 2
+#define BPF_F_PSEUDO_HDR (1ULL << 4)
+#define BPF_F_MARK_MANGLED_0 (1ULL << 5)
+
+#define IP_CSUM_OFF   (ETH_HLEN + offsetof(struct iphdr, check))
+#define IP_SRC_OFF    (ETH_HLEN + offsetof(struct iphdr, saddr))
+#define L4_SPORT_OFF  (ETH_HLEN + sizeof(struct iphdr))
+#define TCP_CSUM_OFF  (ETH_HLEN + sizeof(struct iphdr) + offsetof(struct tcphdr, check))
+#define UDP_CSUM_OFF  (ETH_HLEN + sizeof(struct iphdr) + offsetof(struct udphdr, check))
+
+// node ports used for masqueraded connections, above the default
+// net.ipv4.ip_local_port_range(32768-60999) so node sockets don't collide
+#define SNAT_PORT_MIN   61000
+#define SNAT_PORT_MAX   65535
+#define SNAT_PORT_TRIES 16
+
+// BPF mapping for local pods
+struct epInfo {
+    __u32 lxc_ifindex;       // inside host
+    __u32 pod_ifindex;       // inside pod
+    __u8  lxc_mac[8];        // veth pair lxc, 2 bytes for padding
+    __u8  pod_mac[8];        // veth pair mac, 2 bytes for padding
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 32);
+    __type(key, __u32);
+    __type(value, struct epInfo);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} lxc_map SEC(".maps");
+
+// connection seen from the reply side, local_port is the allocated node port
+struct snatKey {
+    __u32 remote_ip;
+    __u16 remote_port;
+    __u16 local_port;
+    __u8  proto;
+    __u8  pad[3];
+};
+
+struct snatValue {
+    __u32 pod_ip;
+    __u16 pod_port;
+    __u8  pad[2];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct snatKey);
+    __type(value, struct snatValue);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} snat_ct_map SEC(".maps");
+
+// connection seen from the pod side, to find the node port again
+struct snatFwdKey {
+    __u32 pod_ip;
+    __u32 remote_ip;
+    __u16 pod_port;
+    __u16 remote_port;
+    __u8  proto;
+    __u8  pad[3];
+};
+
+struct snatFwdValue {
+    __u16 node_port;
+    __u8  pad[2];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct snatFwdKey);
+    __type(value, struct snatFwdValue);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} snat_fwd_map SEC(".maps");
+
+// destinations which should keep pod ip
+struct noMasqKey {
+    __u32 prefixlen;
+    __u8  ip[4];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 64);
+    __type(key, struct noMasqKey);
+    __type(value, __u32);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} no_masq_map SEC(".maps");
+
+struct snatConfig {
+    __u32 node_ip;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct snatConfig);
+    __uint(pinning, LIBBPF_PIN_BY_NAME);
+} snat_config_map SEC(".maps");
+
+// Node port of the connection: reuse the one already allocated, otherwise claim
+// a free one for the reply side. Returns 0 when no free port is found.
+static __always_inline __u16 snat_port(struct snatFwdKey *fwd, struct snatKey *key, struct snatValue *val)
+{
+    struct snatFwdValue *old = bpf_map_lookup_elem(&snat_fwd_map, fwd);
+    if (old) {
+        key->local_port = old->node_port;
+        struct snatValue *cur = bpf_map_lookup_elem(&snat_ct_map, key);
+        if (cur && cur->pod_ip == val->pod_ip && cur->pod_port == val->pod_port)
+            return old->node_port;
+        // reply side was evicted, claim the same port again if it's still free
+        if (!cur && bpf_map_update_elem(&snat_ct_map, key, val, BPF_NOEXIST) == 0)
+            return old->node_port;
+    }
+
+    __u32 start = bpf_get_prandom_u32();
+    for (int i = 0; i < SNAT_PORT_TRIES; i++) {
+        key->local_port = SNAT_PORT_MIN + (start + i) % (SNAT_PORT_MAX - SNAT_PORT_MIN + 1);
+        // taken by another connection to the same remote
+        if (bpf_map_update_elem(&snat_ct_map, key, val, BPF_NOEXIST))
+            continue;
+
+        struct snatFwdValue fv = {};
+        fv.node_port = key->local_port;
+        bpf_map_update_elem(&snat_fwd_map, fwd, &fv, BPF_ANY);
+        return key->local_port;
+    }
+    return 0;
+}
+
+
+SEC("classifier")
+int snat_egress(struct __sk_buff *ctx)
+{
+	void *data_end = (void *)(__u64)ctx->data_end;
+	void *data = (void *)(__u64)ctx->data;
+	struct ethhdr *l2;
+	struct iphdr *l3;
+
+    // non-ip protocol
+	if (ctx->protocol != bpf_htons(ETH_P_IP))
+		return TC_ACT_OK;
+
+	l2 = data;
+	if ((void *)(l2 + 1) > data_end)
+		return TC_ACT_OK;
+
+	l3 = (struct iphdr *)(l2 + 1);
+	if ((void *)(l3 + 1) > data_end)
+		return TC_ACT_OK;
+
+    // ip options are not handled
+    if (l3->ihl != 5)
+        return TC_ACT_OK;
+
+    __u32 src_ip = bpf_htonl(l3->saddr);
+    __u32 dst_ip = bpf_htonl(l3->daddr);
+
+    // only pods on this node are masqueraded
+    if (!bpf_map_lookup_elem(&lxc_map, &src_ip))
+        return TC_ACT_OK;
+
+    // destination inside non-masquerade cidrs
+    struct noMasqKey nk = {};
+    nk.prefixlen = 32;
+    __builtin_memcpy(nk.ip, &l3->daddr, 4);
+    if (bpf_map_lookup_elem(&no_masq_map, &nk))
+        return TC_ACT_OK;
+
+    __u32 zero = 0;
+    struct snatConfig *conf = bpf_map_lookup_elem(&snat_config_map, &zero);
+    if (!conf || conf->node_ip == 0)
+        return TC_ACT_OK;
+
+    struct snatFwdKey fwd = {};
+    struct snatKey key = {};
+    struct snatValue val = {};
+    __u64 l4_csum_off;
+    __u64 flags = 0;
+    fwd.pod_ip = src_ip;
+    fwd.remote_ip = dst_ip;
+    fwd.proto = l3->protocol;
+
+    if (l3->protocol == IPPROTO_TCP) {
+        struct tcphdr *tcp = (struct tcphdr *)(l3 + 1);
+        if ((void *)(tcp + 1) > data_end)
+            return TC_ACT_OK;
+        fwd.remote_port = bpf_ntohs(tcp->dest);
+        fwd.pod_port = bpf_ntohs(tcp->source);
+        l4_csum_off = TCP_CSUM_OFF;
+    } else if (l3->protocol == IPPROTO_UDP) {
+        struct udphdr *udp = (struct udphdr *)(l3 + 1);
+        if ((void *)(udp + 1) > data_end)
+            return TC_ACT_OK;
+        fwd.remote_port = bpf_ntohs(udp->dest);
+        fwd.pod_port = bpf_ntohs(udp->source);
+        l4_csum_off = UDP_CSUM_OFF;
+        // udp packets without checksum must keep it 0
+        flags = BPF_F_MARK_MANGLED_0;
+    } else {
+        // other protocols are left to the host stack
+        return TC_ACT_OK;
+    }
+
+    // remember the original source, so replies find the pod again
+    key.remote_ip = dst_ip;
+    key.remote_port = fwd.remote_port;
+    key.proto = fwd.proto;
+    val.pod_ip = src_ip;
+    val.pod_port = fwd.pod_port;
+    __u16 node_port = snat_port(&fwd, &key, &val);
+    // all tried ports are taken, the sender retries with a new attempt
+    if (!node_port)
+        return TC_ACT_SHOT;
+
+    // rewrite source to node ip & port, fixing both l3 & l4 checksum
+    __u32 old_ip = l3->saddr;
+    __u32 new_ip = bpf_htonl(conf->node_ip);
+    __u16 old_port = bpf_htons(fwd.pod_port);
+    __u16 new_port = bpf_htons(node_port);
+    bpf_l4_csum_replace(ctx, l4_csum_off, old_ip, new_ip, flags | BPF_F_PSEUDO_HDR | sizeof(new_ip));
+    bpf_l3_csum_replace(ctx, IP_CSUM_OFF, old_ip, new_ip, sizeof(new_ip));
+    bpf_skb_store_bytes(ctx, IP_SRC_OFF, &new_ip, sizeof(new_ip), 0);
+    bpf_l4_csum_replace(ctx, l4_csum_off, old_port, new_port, flags | sizeof(new_port));
+    bpf_skb_store_bytes(ctx, L4_SPORT_OFF, &new_port, sizeof(new_port), 0);
+
+    return TC_ACT_OK;
+}
+
+char __license[] SEC("license") = "GPL";
@@ -8,6 +8,7 @@
 //  First, let's copy a template from `tc.bpf.c` as a good start,
 #define TC_ACT_UNSPEC   (-1)
 #define TC_ACT_OK	0
+#define TC_ACT_SHOT 2
 #define ETH_P_IP	0x0800		/* Internet Protocol packet	*/
 #define ETH_ALEN    6           /* Ethernet Address len*/
 #define MODE_VXLAN  1
@@ -64,6 +65,9 @@ struct {
     __uint(pinning, LIBBPF_PIN_BY_NAME);
 } node_vxlan_map SEC(".maps");
 
+#include "policy.h"
+#include "lb.h"
+
 
 SEC("classifier") // bind to the section of 'tc'
 int veth_ingress(struct __sk_buff *ctx)
@@ -88,6 +92,18 @@ int veth_ingress(struct __sk_buff *ctx)
 	if ((void *)(l3 + 1) > data_end)
 		return TC_ACT_UNSPEC;
 
+    // service frontend => backend, policy & routing see the backend,
+    // packet pointers are invalid after rewriting
+    lb_dnat(ctx);
+	data_end = (void *)(__u64)ctx->data_end;
+	data = (void *)(__u64)ctx->data;
+	l2 = data;
+	if ((void *)(l2 + 1) > data_end)
+		return TC_ACT_UNSPEC;
+	l3 = (struct iphdr *)(l2 + 1);
+	if ((void *)(l3 + 1) > data_end)
+		return TC_ACT_UNSPEC;
+
     // Ensure that it's an ip packet(version unknown)
     __u32 src_ip = bpf_htonl(l3->saddr);
     __u32 dst_ip = bpf_htonl(l3->daddr);
@@ -98,6 +114,19 @@ int veth_ingress(struct __sk_buff *ctx)
     
     // Lookup ep info with dest ip    
     struct epInfo *ep = bpf_map_lookup_elem(&lxc_map, &dst_ip);    
+
+    // egress policy of source pod, and ingress policy if target pod is local
+    if (!policy_allowed(l3, data_end, 1, ep != NULL))
+        return TC_ACT_SHOT;
+
+    // replies of local backends to a service client, destination is kept
+    lb_reverse(ctx);
+	data_end = (void *)(__u64)ctx->data_end;
+	data = (void *)(__u64)ctx->data;
+	l2 = data;
+	if ((void *)(l2 + 1) > data_end)
+		return TC_ACT_UNSPEC;
+
     if (ep) {
         // exist inside lxc_map => pods on same node
         // rewrite mac addr to src:[lxc mac] and dst:[pod mac]
@@ -135,8 +164,8 @@ int veth_ingress(struct __sk_buff *ctx)
         return TC_ACT_UNSPEC;
     }
 
-    // Then, the packet is not to pod on same node, handling to host's gateway
-    // Not implemented yet...	
+    // Then, the packet is leaving the cluster, handling to host's stack,
+    // replies are redirected back to the pod by `host_ingress` on the uplink
     return TC_ACT_OK;
 }
 
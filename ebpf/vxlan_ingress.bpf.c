@@ -8,7 +8,7 @@
 //  First, let's copy a template from `tc.bpf.c` as a good start,
 #define TC_ACT_UNSPEC   (-1)
 #define TC_ACT_OK	0
-#define TC_ACT_SHOT 1
+#define TC_ACT_SHOT 2
 #define ETH_P_IP	0x0800		/* Internet Protocol packet	*/
 #define ETH_ALEN    6           /* Ethernet Address len*/
 #define DEFAULT_TUNNEL_ID 13190
@@ -28,6 +28,9 @@ struct {
     __uint(pinning, LIBBPF_PIN_BY_NAME);
 } lxc_map SEC(".maps");
 
+#include "policy.h"
+#include "lb.h"
+
 
 SEC("classifier")
 int vxlan_ingress(struct __sk_buff *ctx)
@@ -61,8 +64,21 @@ int vxlan_ingress(struct __sk_buff *ctx)
     unsigned char dst_mac[ETH_ALEN] = {0xab, 0xcd, 0xef, 0xab, 0xcd, 0xef};
     
     // Almost same with `veth_ingress` except that it's attached to vxlan device
-    struct epInfo *ep = bpf_map_lookup_elem(&lxc_map, &ep);
+    struct epInfo *ep = bpf_map_lookup_elem(&lxc_map, &dst_ip);
     if (ep) {
+        // ingress policy of target pod, egress is checked on the sender's node
+        if (!policy_allowed(l3, data_end, 0, 1))
+            return TC_ACT_SHOT;
+
+        // replies of remote backends to a service client on this node,
+        // packet pointers are invalid after rewriting
+        lb_reverse(ctx);
+        data_end = (void *)(__u64)ctx->data_end;
+        data = (void *)(__u64)ctx->data;
+        l2 = data;
+        if ((void *)(l2 + 1) > data_end)
+            return TC_ACT_UNSPEC;
+
         // exist inside lxc_map => pods on same node
         // rewrite mac addr to src:[lxc mac] and dst:[pod mac]
         // then, redirect the packet to target pod's lxc
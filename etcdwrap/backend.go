@@ -0,0 +1,256 @@
+package etcdwrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Storage of the ipam, keys are versioned by a store-wide revision like etcd.
+//
+// WrappedClient keeps everything in etcd, MemoryBackend in memory for tests.
+// The allocator only talks to a Backend, so any store with revisions,
+// conditional txns, watches & leases can hold the ipam.
+type Backend interface {
+	// value & mod revision of key, revision is 0 if the key doesn't exist
+	Get(ctx context.Context, key string) (string, int64, error)
+	// all keys & values under the prefix, with their mod revisions
+	GetPrefix(ctx context.Context, prefix string) (map[string]VersionedValue, error)
+	Put(ctx context.Context, key, value string, opts ...OpOption) error
+	Delete(ctx context.Context, key string, opts ...OpOption) error
+	// commit ops only if all comparisons hold, false if any doesn't
+	Txn(ctx context.Context, cmps []Cmp, ops ...Op) (bool, error)
+	// changes under the prefix since rev(0 for now on), until ctx is done
+	Watch(ctx context.Context, prefix string, rev int64) <-chan WatchResponse
+
+	Lease
+
+	// block until name is the leader of the election, or ctx is done
+	Campaign(ctx context.Context, election, name string, ttl int) (Leadership, error)
+}
+
+// Leases in seconds, keys put with a lease are deleted once it expires
+type Lease interface {
+	GrantLease(ctx context.Context, ttl int64) (int64, error)
+	// keep the lease alive until ctx is done, channel is closed once the lease is lost
+	KeepAlive(ctx context.Context, id int64) (<-chan struct{}, error)
+	// remaining ttl, -1 if it has expired or never existed
+	LeaseTTL(ctx context.Context, id int64) (int64, error)
+	RevokeLease(ctx context.Context, id int64) error
+}
+
+// Leadership won by Campaign
+type Leadership interface {
+	// closed once the leadership is lost
+	Done() <-chan struct{}
+	Resign(ctx context.Context) error
+}
+
+// Value with the revision it was last modified at
+type VersionedValue struct {
+	Value       string
+	ModRevision int64
+}
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+type Event struct {
+	Type        EventType
+	Key         string
+	Value       string
+	ModRevision int64
+}
+
+type WatchResponse struct {
+	Events []Event
+	Err    error
+}
+
+type CmpTarget int
+
+const (
+	TargetModRevision CmpTarget = iota
+	TargetCreateRevision
+	TargetValue
+)
+
+// Comparison of a txn, built like clientv3: Compare(ModRevision(key), "=", rev)
+type Cmp struct {
+	Key    string
+	Target CmpTarget
+	// one of =, !=, <, >
+	Result string
+	Rev    int64
+	Value  string
+	// every key under Key should hold, a missing key has revisions of 0
+	Prefix bool
+}
+
+func ModRevision(key string) Cmp {
+	return Cmp{Key: key, Target: TargetModRevision}
+}
+
+func CreateRevision(key string) Cmp {
+	return Cmp{Key: key, Target: TargetCreateRevision}
+}
+
+func Value(key string) Cmp {
+	return Cmp{Key: key, Target: TargetValue}
+}
+
+// v is a revision for ModRevision & CreateRevision, a string for Value
+func Compare(c Cmp, result string, v interface{}) Cmp {
+	c.Result = result
+	switch val := v.(type) {
+	case int64:
+		c.Rev = val
+	case int:
+		c.Rev = int64(val)
+	case string:
+		c.Value = val
+	default:
+		panic(fmt.Sprintf("unknown type %T to compare", v))
+	}
+	return c
+}
+
+func (c Cmp) WithPrefix() Cmp {
+	c.Prefix = true
+	return c
+}
+
+// Whether the comparison holds for a key, which is nil if missing
+func (c Cmp) holds(kv *memValue) bool {
+	if kv == nil {
+		if c.Target == TargetValue {
+			return false
+		}
+		kv = &memValue{}
+	}
+	var diff int
+	switch c.Target {
+	case TargetModRevision:
+		diff = compareInt(kv.modRev, c.Rev)
+	case TargetCreateRevision:
+		diff = compareInt(kv.createRev, c.Rev)
+	case TargetValue:
+		diff = strings.Compare(kv.value, c.Value)
+	}
+	switch c.Result {
+	case "=":
+		return diff == 0
+	case "!=":
+		return diff != 0
+	case "<":
+		return diff < 0
+	case ">":
+		return diff > 0
+	}
+	return false
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type OpType int
+
+const (
+	OpTypePut OpType = iota
+	OpTypeDelete
+)
+
+// Write of a txn
+type Op struct {
+	Type  OpType
+	Key   string
+	Value string
+	Lease int64
+	// delete every key under Key
+	Prefix bool
+}
+
+type OpOption func(*Op)
+
+func WithLease(id int64) OpOption {
+	return func(op *Op) { op.Lease = id }
+}
+
+func WithPrefix() OpOption {
+	return func(op *Op) { op.Prefix = true }
+}
+
+func OpPut(key, value string, opts ...OpOption) Op {
+	op := Op{Type: OpTypePut, Key: key, Value: value}
+	for _, opt := range opts {
+		opt(&op)
+	}
+	return op
+}
+
+func OpDelete(key string, opts ...OpOption) Op {
+	op := Op{Type: OpTypeDelete, Key: key}
+	for _, opt := range opts {
+		opt(&op)
+	}
+	return op
+}
+
+// Commit ops only if every key still has the given mod revision(0 means not exist),
+// returns false if any of them has been changed by others
+func CommitIfUnchanged(ctx context.Context, b Backend, revs map[string]int64, ops ...Op) (bool, error) {
+	cmps := make([]Cmp, 0, len(revs))
+	for key, rev := range revs {
+		cmps = append(cmps, Compare(ModRevision(key), "=", rev))
+	}
+	return b.Txn(ctx, cmps, ops...)
+}
+
+// Put value only if key still has the given mod revision(0 means not exist)
+func CompareAndSwap(ctx context.Context, b Backend, key string, rev int64, value string, opts ...OpOption) (bool, error) {
+	return CommitIfUnchanged(ctx, b, map[string]int64{key: rev}, OpPut(key, value, opts...))
+}
+
+// Delete key only if it still has the given mod revision
+func CompareAndDelete(ctx context.Context, b Backend, key string, rev int64) (bool, error) {
+	return CommitIfUnchanged(ctx, b, map[string]int64{key: rev}, OpDelete(key))
+}
+
+// List all keys & values under the given prefix
+func ListKV(ctx context.Context, b Backend, prefix string) (map[string]string, error) {
+	kvs, err := b.GetPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string, len(kvs))
+	for key, kv := range kvs {
+		res[key] = kv.Value
+	}
+	return res, nil
+}
+
+// List keys under the given prefix
+func ListKeys(ctx context.Context, b Backend, prefix string) ([]string, error) {
+	kvs, err := b.GetPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(kvs))
+	for key := range kvs {
+		res = append(res, key)
+	}
+	return res, nil
+}
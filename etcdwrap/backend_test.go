@@ -0,0 +1,182 @@
+package etcdwrap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/pkg/testutils"
+)
+
+// Both backends should behave the same
+func forEachBackend(t *testing.T, f func(t *testing.T, b Backend)) {
+	t.Run("memory", func(t *testing.T) { f(t, NewMemoryBackend()) })
+	t.Run("etcd", func(t *testing.T) { f(t, NewWrappedClient(testutils.NewEmbeddedEtcd(t))) })
+	t.Run("kubernetes", func(t *testing.T) {
+		k := NewKubeBackend(testutils.NewFakeKubeClient(t), &KubeBackendConfig{})
+		k.PollInterval = 50 * time.Millisecond
+		f(t, k)
+	})
+}
+
+func TestBackendTxn(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		te := assert.New(t)
+		ctx := context.Background()
+
+		// create only if absent
+		ok, err := CompareAndSwap(ctx, b, "a/1", 0, "x")
+		te.Nil(err)
+		te.True(ok)
+		ok, err = CompareAndSwap(ctx, b, "a/1", 0, "y")
+		te.Nil(err)
+		te.False(ok)
+
+		// update only if unchanged
+		val, rev, err := b.Get(ctx, "a/1")
+		te.Nil(err)
+		te.Equal(val, "x")
+		ok, err = CompareAndSwap(ctx, b, "a/1", rev, "y")
+		te.Nil(err)
+		te.True(ok)
+		ok, err = CompareAndDelete(ctx, b, "a/1", rev)
+		te.Nil(err)
+		te.False(ok)
+
+		te.Nil(b.Put(ctx, "a/2", "z"))
+		kvs, err := b.GetPrefix(ctx, "a/")
+		te.Nil(err)
+		te.Equal(len(kvs), 2)
+		te.Equal(kvs["a/1"].Value, "y")
+		keys, err := ListKeys(ctx, b, "a/")
+		te.Nil(err)
+		te.ElementsMatch(keys, []string{"a/1", "a/2"})
+
+		// comparisons over a prefix hold for every key, or for none if empty
+		ok, err = b.Txn(ctx, []Cmp{Compare(CreateRevision("b/"), "=", 0).WithPrefix()}, OpPut("b/1", "x"))
+		te.Nil(err)
+		te.True(ok)
+		ok, err = b.Txn(ctx, []Cmp{Compare(CreateRevision("b/"), "=", 0).WithPrefix()}, OpPut("b/2", "x"))
+		te.Nil(err)
+		te.False(ok)
+		ok, err = b.Txn(ctx, []Cmp{Compare(ModRevision("a/"), "<", kvs["a/2"].ModRevision+1).WithPrefix()}, OpDelete("a/", WithPrefix()))
+		te.Nil(err)
+		te.True(ok)
+		kvs, err = b.GetPrefix(ctx, "a/")
+		te.Nil(err)
+		te.Equal(len(kvs), 0)
+
+		ok, err = b.Txn(ctx, []Cmp{Compare(Value("b/1"), "=", "x")}, OpDelete("b/1"))
+		te.Nil(err)
+		te.True(ok)
+		// value of a missing key never matches
+		ok, err = b.Txn(ctx, []Cmp{Compare(Value("b/1"), "!=", "x")}, OpPut("b/1", "y"))
+		te.Nil(err)
+		te.False(ok)
+	})
+}
+
+func TestBackendWatch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		te := assert.New(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		te.Nil(b.Put(ctx, "a/1", "x"))
+		_, rev, err := b.Get(ctx, "a/1")
+		te.Nil(err)
+		wch := b.Watch(ctx, "a/", rev)
+		te.Nil(b.Put(ctx, "b/1", "y"))
+		te.Nil(b.Delete(ctx, "a/1"))
+
+		var events []Event
+		for len(events) < 2 {
+			wresp := <-wch
+			te.Nil(wresp.Err)
+			events = append(events, wresp.Events...)
+		}
+		te.Equal(events[0].Type, EventPut)
+		te.Equal(events[0].Key, "a/1")
+		te.Equal(events[0].Value, "x")
+		te.Equal(events[1].Type, EventDelete)
+		te.Equal(events[1].Key, "a/1")
+	})
+}
+
+func TestBackendLease(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		te := assert.New(t)
+		ctx := context.Background()
+
+		id, err := b.GrantLease(ctx, 30)
+		te.Nil(err)
+		te.Nil(b.Put(ctx, "a/1", "x", WithLease(id)))
+		ttl, err := b.LeaseTTL(ctx, id)
+		te.Nil(err)
+		te.True(ttl > 0 && ttl <= 30)
+
+		// keys go away with the lease
+		te.Nil(b.RevokeLease(ctx, id))
+		val, _, err := b.Get(ctx, "a/1")
+		te.Nil(err)
+		te.Equal(val, "")
+		ttl, err = b.LeaseTTL(ctx, id)
+		te.Nil(err)
+		te.Equal(ttl, int64(-1))
+
+		// kept alive until ctx is done, then lost
+		id, err = b.GrantLease(ctx, 1)
+		te.Nil(err)
+		kctx, cancel := context.WithCancel(ctx)
+		ch, err := b.KeepAlive(kctx, id)
+		te.Nil(err)
+		time.Sleep(1500 * time.Millisecond)
+		ttl, err = b.LeaseTTL(ctx, id)
+		te.Nil(err)
+		te.True(ttl >= 0)
+		cancel()
+		for range ch {
+		}
+	})
+}
+
+func TestBackendCampaign(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		te := assert.New(t)
+		ctx := context.Background()
+
+		l1, err := b.Campaign(ctx, "election/", "r1", 5)
+		te.Nil(err)
+
+		// the second one waits until the first resigns
+		won := make(chan Leadership)
+		go func() {
+			l2, err := b.Campaign(ctx, "election/", "r2", 5)
+			te.Nil(err)
+			won <- l2
+		}()
+		select {
+		case <-won:
+			t.Fatal("two leaders at the same time")
+		case <-time.After(200 * time.Millisecond):
+		}
+		te.Nil(l1.Resign(ctx))
+		select {
+		case l2 := <-won:
+			te.Nil(l2.Resign(ctx))
+		case <-time.After(5 * time.Second):
+			t.Fatal("no leader after resigning")
+		}
+
+		// campaigning ends with ctx
+		l3, err := b.Campaign(ctx, "election/", "r3", 5)
+		te.Nil(err)
+		cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		_, err = b.Campaign(cctx, "election/", "r4", 5)
+		te.NotNil(err)
+		te.Nil(l3.Resign(ctx))
+	})
+}
@@ -2,121 +2,331 @@ package etcdwrap
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"mycni/consts"
 	"mycni/utils"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"go.etcd.io/etcd/pkg/transport"
+	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
-const (
-	sampleTimeout = 5 * time.Second
-)
+var _ Backend = &WrappedClient{}
+
+var ErrNotInitialized = errors.New("etcd client is not initialized, call Init or InitWithConfig first")
 
 type WrappedClient struct {
-	client         *clientv3.Client
-	poolInitStatus bool
+	client *clientv3.Client
+	// deadline of every single request
+	requestTimeout time.Duration
 }
 
 var __innerGetEtcdClient func() (*WrappedClient, error)
 
 func GetEtcdClient() (*WrappedClient, error) {
 	if __innerGetEtcdClient == nil {
-		return nil, nil
+		return nil, ErrNotInitialized
 	}
 	return __innerGetEtcdClient()
 }
 
-func _innerGetEtcdClient() func() (*WrappedClient, error) {
+// Connect once with the given config, the client is shared afterwards
+func _innerGetEtcdClient(conf *Config) func() (*WrappedClient, error) {
 	var _cli *WrappedClient
-
 	return func() (*WrappedClient, error) {
 		if _cli != nil {
 			return _cli, nil
-		} else {
-			tlsInfo := transport.TLSInfo{
-				CertFile:      consts.K8S_CERT_FILEPATH,
-				KeyFile:       consts.K8S_KEY_FILEPATH,
-				TrustedCAFile: consts.K8S_CA_FILEPATH,
-			}
-
-			tlsConfig, err := tlsInfo.ClientConfig()
-
-			cli, err := clientv3.New(clientv3.Config{
-				Endpoints:   []string{"127.0.0.1:2379", "10.128.47.22:2379"},
-				DialTimeout: sampleTimeout,
-				TLS:         tlsConfig,
-			})
-
-			if err != nil {
-				// handle error
-				return nil, fmt.Errorf("Failed to connected etcd server, message: %w", err)
-			}
+		}
+		cli, err := New(conf)
+		if err != nil {
+			return nil, err
+		}
+		_cli = cli
+		return _cli, nil
+	}
+}
 
-			_cli = &WrappedClient{
-				client:         cli,
-				poolInitStatus: false,
-			}
+// Connect to etcd with the given config, keys of ipam are put under its key prefix
+func New(conf *Config) (*WrappedClient, error) {
+	clientConf, err := conf.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := clientv3.New(clientConf)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connected etcd server, message: %w", err)
+	}
+	utils.SetKeyPrefix(conf.Prefix())
+	wrapped := NewWrappedClient(cli)
+	wrapped.requestTimeout, _ = conf.requestTimeout()
+	return wrapped, nil
+}
 
-			return _cli, nil
-		}
+// Wrap an existing etcd client, used by tests & the node daemon
+func NewWrappedClient(client *clientv3.Client) *WrappedClient {
+	return &WrappedClient{
+		client:         client,
+		requestTimeout: DefaultRequestTimeout,
 	}
 }
 
+// Use the default config, overridden by MYCNI_ETCD_* env
 func Init() {
-	if __innerGetEtcdClient == nil {
-		__innerGetEtcdClient = _innerGetEtcdClient()
+	if __innerGetEtcdClient != nil {
+		return
+	}
+	conf, err := ConfigFromEnv()
+	if err != nil {
+		__innerGetEtcdClient = func() (*WrappedClient, error) { return nil, err }
+		return
 	}
+	InitWithConfig(conf)
+}
+
+// Use the given config, nil for the default one
+func InitWithConfig(conf *Config) {
+	if __innerGetEtcdClient != nil {
+		return
+	}
+	if conf == nil {
+		conf = DefaultConfig()
+	}
+	__innerGetEtcdClient = _innerGetEtcdClient(conf)
 }
 
 func (cli *WrappedClient) CloseEtcdClient() {
 	cli.client.Close()
 }
 
+// Every request is bounded by the request timeout, and by the deadline of ctx if earlier
+func (cli *WrappedClient) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cli.requestTimeout)
+}
+
 // Given key, fetch the value from etcd
-func (cli *WrappedClient) GetKV(key string) (string, error) {
-	resp, err := cli.client.Get(context.TODO(), key)
+func (cli *WrappedClient) GetKV(ctx context.Context, key string) (string, error) {
+	val, _, err := cli.Get(ctx, key)
+	return val, err
+}
+
+// update value according to the given key
+func (cli *WrappedClient) PutKV(ctx context.Context, key, value string, opts ...OpOption) error {
+	return cli.Put(ctx, key, value, opts...)
+}
+
+// delete value according to the given key
+func (cli *WrappedClient) DelKV(ctx context.Context, key string) error {
+	return cli.Delete(ctx, key)
+}
+
+// Given key, fetch the value with its mod revision,
+// revision is 0 if the key doesn't exist
+func (cli *WrappedClient) Get(ctx context.Context, key string) (string, int64, error) {
+	ctx, cancel := cli.opContext(ctx)
+	defer cancel()
+	resp, err := cli.client.Get(ctx, key)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	if len(resp.Kvs) > 0 {
 		// return last item's first value
-		return string(resp.Kvs[len(resp.Kvs)-1:][0].Value), nil
+		kv := resp.Kvs[len(resp.Kvs)-1]
+		return string(kv.Value), kv.ModRevision, nil
 	}
-	return "", nil
+	return "", 0, nil
 }
 
-// update value according to the given key
-func (cli *WrappedClient) PutKV(key, value string) error {
-	_, err := cli.client.Put(context.TODO(), key, value)
+// Get all keys & values under the given prefix, with their mod revisions
+func (cli *WrappedClient) GetPrefix(ctx context.Context, prefix string) (map[string]VersionedValue, error) {
+	ctx, cancel := cli.opContext(ctx)
+	defer cancel()
+	resp, err := cli.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
 
+	res := make(map[string]VersionedValue, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		res[string(kv.Key)] = VersionedValue{Value: string(kv.Value), ModRevision: kv.ModRevision}
+	}
+	return res, nil
+}
+
+func (cli *WrappedClient) Put(ctx context.Context, key, value string, opts ...OpOption) error {
+	ctx, cancel := cli.opContext(ctx)
+	defer cancel()
+	_, err := cli.client.Do(ctx, etcdOp(OpPut(key, value, opts...)))
+	return err
+}
+
+func (cli *WrappedClient) Delete(ctx context.Context, key string, opts ...OpOption) error {
+	ctx, cancel := cli.opContext(ctx)
+	defer cancel()
+	_, err := cli.client.Do(ctx, etcdOp(OpDelete(key, opts...)))
+	return err
+}
+
+func etcdCmp(c Cmp) clientv3.Cmp {
+	var cmp clientv3.Cmp
+	switch c.Target {
+	case TargetModRevision:
+		cmp = clientv3.Compare(clientv3.ModRevision(c.Key), c.Result, c.Rev)
+	case TargetCreateRevision:
+		cmp = clientv3.Compare(clientv3.CreateRevision(c.Key), c.Result, c.Rev)
+	case TargetValue:
+		cmp = clientv3.Compare(clientv3.Value(c.Key), c.Result, c.Value)
+	}
+	if c.Prefix {
+		cmp = cmp.WithPrefix()
+	}
+	return cmp
+}
+
+func etcdOp(op Op) clientv3.Op {
+	if op.Type == OpTypeDelete {
+		if op.Prefix {
+			return clientv3.OpDelete(op.Key, clientv3.WithPrefix())
+		}
+		return clientv3.OpDelete(op.Key)
+	}
+	if op.Lease != 0 {
+		return clientv3.OpPut(op.Key, op.Value, clientv3.WithLease(clientv3.LeaseID(op.Lease)))
+	}
+	return clientv3.OpPut(op.Key, op.Value)
+}
+
+// Commit ops only if all comparisons hold
+func (cli *WrappedClient) Txn(ctx context.Context, cmps []Cmp, ops ...Op) (bool, error) {
+	etcdCmps := make([]clientv3.Cmp, 0, len(cmps))
+	for _, c := range cmps {
+		etcdCmps = append(etcdCmps, etcdCmp(c))
+	}
+	etcdOps := make([]clientv3.Op, 0, len(ops))
+	for _, op := range ops {
+		etcdOps = append(etcdOps, etcdOp(op))
+	}
+
+	ctx, cancel := cli.opContext(ctx)
+	defer cancel()
+	resp, err := cli.client.Txn(ctx).If(etcdCmps...).Then(etcdOps...).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// Watch changes under the given prefix since rev(0 for now on), until ctx is done.
+// Not bounded by the request timeout.
+func (cli *WrappedClient) Watch(ctx context.Context, prefix string, rev int64) <-chan WatchResponse {
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+	wch := cli.client.Watch(clientv3.WithRequireLeader(ctx), prefix, opts...)
+
+	ch := make(chan WatchResponse)
+	go func() {
+		defer close(ch)
+		for wresp := range wch {
+			resp := WatchResponse{Err: wresp.Err()}
+			for _, ev := range wresp.Events {
+				event := Event{Type: EventPut, Key: string(ev.Kv.Key), Value: string(ev.Kv.Value), ModRevision: ev.Kv.ModRevision}
+				if ev.Type == clientv3.EventTypeDelete {
+					event.Type = EventDelete
+				}
+				resp.Events = append(resp.Events, event)
+			}
+			select {
+			case ch <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Grant a lease with ttl in seconds, returns the lease id
+func (cli *WrappedClient) GrantLease(ctx context.Context, ttl int64) (int64, error) {
+	ctx, cancel := cli.opContext(ctx)
+	defer cancel()
+	resp, err := cli.client.Grant(ctx, ttl)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return int64(resp.ID), nil
+}
 
-	return nil
+// Keep the lease alive until ctx is done, channel is closed once the lease is lost
+func (cli *WrappedClient) KeepAlive(ctx context.Context, id int64) (<-chan struct{}, error) {
+	kch, err := cli.client.KeepAlive(ctx, clientv3.LeaseID(id))
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		for range kch {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
 }
 
-// delete value according to the given key
-func (cli *WrappedClient) DelKV(key string) error {
-	_, err := cli.client.Delete(context.TODO(), key)
+// Remaining ttl of the lease in seconds, -1 if it has expired or never existed
+func (cli *WrappedClient) LeaseTTL(ctx context.Context, id int64) (int64, error) {
+	ctx, cancel := cli.opContext(ctx)
+	defer cancel()
+	resp, err := cli.client.TimeToLive(ctx, clientv3.LeaseID(id))
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return resp.TTL, nil
+}
+
+func (cli *WrappedClient) RevokeLease(ctx context.Context, id int64) error {
+	ctx, cancel := cli.opContext(ctx)
+	defer cancel()
+	_, err := cli.client.Revoke(ctx, clientv3.LeaseID(id))
 	return err
 }
 
-// set pool status for other packages
-func (cli *WrappedClient) SetInitPoolStatus(stat bool) {
-	cli.poolInitStatus = stat
+// leader of an etcd election, lost with the session
+type etcdLeadership struct {
+	session  *concurrency.Session
+	election *concurrency.Election
+}
+
+func (l *etcdLeadership) Done() <-chan struct{} {
+	return l.session.Done()
+}
+
+func (l *etcdLeadership) Resign(ctx context.Context) error {
+	defer l.session.Close()
+	return l.election.Resign(ctx)
+}
+
+// Campaign with a session of ttl in seconds, the leadership is lost once the session expires
+func (cli *WrappedClient) Campaign(ctx context.Context, election, name string, ttl int) (Leadership, error) {
+	session, err := concurrency.NewSession(cli.client, concurrency.WithTTL(ttl), concurrency.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	e := concurrency.NewElection(session, election)
+	if err := e.Campaign(ctx, name); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &etcdLeadership{session: session, election: e}, nil
 }
 
 // get pool status for other packages
-func (cli *WrappedClient) GetInitPoolStatus() bool {
-	resp, err := cli.GetKV(utils.GetIPPoolPath())
+func (cli *WrappedClient) GetInitPoolStatus(ctx context.Context) bool {
+	resp, err := cli.GetKV(ctx, utils.GetIPPoolPath())
 	if err != nil {
 		return false
 	}
@@ -1,10 +1,24 @@
 package etcdwrap
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestNotInitialized(t *testing.T) {
+	te := assert.New(t)
+	saved := __innerGetEtcdClient
+	__innerGetEtcdClient = nil
+	defer func() { __innerGetEtcdClient = saved }()
+
+	cli, err := GetEtcdClient()
+	te.Nil(cli)
+	te.True(errors.Is(err, ErrNotInitialized))
+}
+
 func TestInitClient(t *testing.T) {
 	te := assert.New(t)
 
@@ -13,7 +27,6 @@ func TestInitClient(t *testing.T) {
 	te.Nil(err)
 	te.NotNil(cli)
 	te.NotNil(cli.client)
-	te.Equal(cli.poolInitStatus, false)
 }
 
 func TestPutAndGetAndDelValue(t *testing.T) {
@@ -24,25 +37,50 @@ func TestPutAndGetAndDelValue(t *testing.T) {
 	te.Nil(err)
 	te.NotNil(cli)
 	te.NotNil(cli.client)
-	te.Equal(cli.poolInitStatus, false)
 
-	err = cli.PutKV("foo1", "bar1")
+	ctx := context.Background()
+	err = cli.PutKV(ctx, "foo1", "bar1")
 	te.Nil(err)
 
 	var value string
-	value, err = cli.GetKV("foo1")
+	value, err = cli.GetKV(ctx, "foo1")
 	te.Nil(err)
 	te.NotNil(value)
 	te.Equal(value, "bar1")
 
-	err = cli.DelKV("foo1")
+	err = cli.DelKV(ctx, "foo1")
 	te.Nil(err)
 
-	value, err = cli.GetKV("foo1")
+	value, err = cli.GetKV(ctx, "foo1")
 	te.Nil(err)
 	te.NotNil(value)
 	te.Equal(value, "")
 
 	cli.CloseEtcdClient()
 	te.Nil(err)
-}
\ No newline at end of file
+}
+func TestRequestTimeout(t *testing.T) {
+	te := assert.New(t)
+
+	// nothing listens there, requests wait until the deadline
+	cli, err := New(&Config{Endpoints: []string{"127.0.0.1:1"}, RequestTimeout: "200ms"})
+	te.Nil(err)
+	defer cli.CloseEtcdClient()
+
+	start := time.Now()
+	_, err = cli.GetKV(context.Background(), "foo")
+	te.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+	te.Less(time.Since(start), 2*time.Second)
+
+	// an earlier deadline of the command wins
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	te.NotNil(cli.PutKV(ctx, "foo", "bar"))
+	te.Less(time.Since(start), 150*time.Millisecond)
+
+	// nothing is sent once the command is cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	te.True(errors.Is(cli.DelKV(ctx, "foo"), context.Canceled))
+}
@@ -0,0 +1,293 @@
+package etcdwrap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"mycni/consts"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	DefaultEndpoint    = "127.0.0.1:2379"
+	DefaultDialTimeout = 5 * time.Second
+	// a single request, the whole cni command is bounded by its own timeout
+	DefaultRequestTimeout = 5 * time.Second
+)
+
+var ErrInvalidConfig = errors.New("invalid etcd config")
+
+// Connection to etcd, shared by the ipam plugins & the daemons.
+//
+// Plugins read it from `etcd` of the ipam block, or the file referred by `etcdConfigFile`,
+// daemons from flags or MYCNI_ETCD_* env.
+// Each of cert, key & ca is given either as a file or as inline PEM.
+type Config struct {
+	// like "127.0.0.1:2379" or "https://10.0.0.1:2379"
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	CAFile   string `json:"caFile,omitempty"`
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	CA       string `json:"ca,omitempty"`
+
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// like "5s", DefaultDialTimeout if empty
+	DialTimeout string `json:"dialTimeout,omitempty"`
+	// deadline of every request, DefaultRequestTimeout if empty
+	RequestTimeout string `json:"requestTimeout,omitempty"`
+	// prefix of all ipam keys, "mycni/ipam/" if empty
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+
+	// -etcd-config of the daemons
+	file string
+}
+
+// Local etcd with the client certs of kubeadm
+func DefaultConfig() *Config {
+	return &Config{
+		Endpoints: []string{DefaultEndpoint},
+		CertFile:  consts.K8S_CERT_FILEPATH,
+		KeyFile:   consts.K8S_KEY_FILEPATH,
+		CAFile:    consts.K8S_CA_FILEPATH,
+	}
+}
+
+// Load config from a json file
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse %s: %v", ErrInvalidConfig, path, err)
+	}
+	return c, c.Validate()
+}
+
+// Default config overridden by MYCNI_ETCD_* env, MYCNI_ETCD_CONFIG refers to a config file
+func ConfigFromEnv() (*Config, error) {
+	if path := os.Getenv("MYCNI_ETCD_CONFIG"); path != "" {
+		return LoadConfigFile(path)
+	}
+	c := DefaultConfig()
+	c.loadEnv()
+	return c, c.Validate()
+}
+
+func (c *Config) loadEnv() {
+	if v := os.Getenv("MYCNI_ETCD_ENDPOINTS"); v != "" {
+		c.Endpoints = strings.Split(v, ",")
+	}
+	for env, field := range map[string]*string{
+		"MYCNI_ETCD_CERT_FILE":       &c.CertFile,
+		"MYCNI_ETCD_KEY_FILE":        &c.KeyFile,
+		"MYCNI_ETCD_CA_FILE":         &c.CAFile,
+		"MYCNI_ETCD_USERNAME":        &c.Username,
+		"MYCNI_ETCD_PASSWORD":        &c.Password,
+		"MYCNI_ETCD_DIAL_TIMEOUT":    &c.DialTimeout,
+		"MYCNI_ETCD_REQUEST_TIMEOUT": &c.RequestTimeout,
+		"MYCNI_ETCD_KEY_PREFIX":      &c.KeyPrefix,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+}
+
+// Flags of the daemons, defaults are taken from MYCNI_ETCD_* env.
+// Call Complete after parsing, to apply -etcd-config.
+func (c *Config) AddFlags(fs *flag.FlagSet) {
+	def := DefaultConfig()
+	def.loadEnv()
+	*c = *def
+
+	endpoints := strings.Join(def.Endpoints, ",")
+	fs.Func("etcd-endpoints", "comma separated etcd endpoints (default \""+endpoints+"\")", func(s string) error {
+		c.Endpoints = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&c.CertFile, "etcd-cert-file", def.CertFile, "client cert of etcd")
+	fs.StringVar(&c.KeyFile, "etcd-key-file", def.KeyFile, "client key of etcd")
+	fs.StringVar(&c.CAFile, "etcd-ca-file", def.CAFile, "ca of etcd")
+	fs.StringVar(&c.Username, "etcd-username", def.Username, "username of etcd, $MYCNI_ETCD_PASSWORD is the password")
+	fs.StringVar(&c.DialTimeout, "etcd-dial-timeout", def.DialTimeout, "dial timeout of etcd, like 5s")
+	fs.StringVar(&c.RequestTimeout, "etcd-request-timeout", def.RequestTimeout, "deadline of every etcd request, like 5s")
+	fs.StringVar(&c.KeyPrefix, "etcd-key-prefix", def.KeyPrefix, "prefix of ipam keys in etcd, default mycni/ipam/")
+	fs.StringVar(&c.file, "etcd-config", os.Getenv("MYCNI_ETCD_CONFIG"), "json file of the etcd config, other -etcd-* flags are ignored if set")
+}
+
+// Apply the config file given by -etcd-config if any, and validate the result
+func (c *Config) Complete() error {
+	if c.file != "" {
+		fc, err := LoadConfigFile(c.file)
+		if err != nil {
+			return err
+		}
+		*c = *fc
+	}
+	return c.Validate()
+}
+
+func validEndpoint(ep string) bool {
+	if strings.Contains(ep, "://") {
+		u, err := url.Parse(ep)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "unix") && u.Host != ""
+	}
+	host, port, err := net.SplitHostPort(ep)
+	return err == nil && host != "" && port != ""
+}
+
+// Check that the config is complete & consistent
+func (c *Config) Validate() error {
+	if len(c.Endpoints) == 0 {
+		return fmt.Errorf("%w: no endpoints", ErrInvalidConfig)
+	}
+	for _, ep := range c.Endpoints {
+		if !validEndpoint(ep) {
+			return fmt.Errorf("%w: bad endpoint %q, want host:port or a url", ErrInvalidConfig, ep)
+		}
+	}
+
+	for _, pair := range [][3]string{
+		{"cert", c.CertFile, c.Cert},
+		{"key", c.KeyFile, c.Key},
+		{"ca", c.CAFile, c.CA},
+	} {
+		if pair[1] != "" && pair[2] != "" {
+			return fmt.Errorf("%w: both %sFile and inline %s are given", ErrInvalidConfig, pair[0], pair[0])
+		}
+	}
+	hasCert := c.CertFile != "" || c.Cert != ""
+	hasKey := c.KeyFile != "" || c.Key != ""
+	if hasCert != hasKey {
+		return fmt.Errorf("%w: client cert and key must be given together", ErrInvalidConfig)
+	}
+
+	if (c.Username == "") != (c.Password == "") {
+		return fmt.Errorf("%w: username and password must be given together", ErrInvalidConfig)
+	}
+
+	if _, err := c.dialTimeout(); err != nil {
+		return err
+	}
+	if _, err := c.requestTimeout(); err != nil {
+		return err
+	}
+	if strings.HasPrefix(c.KeyPrefix, "/") {
+		return fmt.Errorf("%w: keyPrefix %q must not start with /", ErrInvalidConfig, c.KeyPrefix)
+	}
+	return nil
+}
+
+func parseTimeout(name, s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: bad %s %q", ErrInvalidConfig, name, s)
+	}
+	return d, nil
+}
+
+func (c *Config) dialTimeout() (time.Duration, error) {
+	return parseTimeout("dialTimeout", c.DialTimeout, DefaultDialTimeout)
+}
+
+func (c *Config) requestTimeout() (time.Duration, error) {
+	return parseTimeout("requestTimeout", c.RequestTimeout, DefaultRequestTimeout)
+}
+
+// Prefix of ipam keys, always ends with /
+func (c *Config) Prefix() string {
+	if c.KeyPrefix == "" {
+		return consts.ETCD_COMMON_PREFIX
+	}
+	return strings.TrimSuffix(c.KeyPrefix, "/") + "/"
+}
+
+// inline PEM, or the content of file
+func pemOf(inline, file string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return data, nil
+}
+
+// Tls config of the client, nil if neither cert nor ca is given
+func (c *Config) TLS() (*tls.Config, error) {
+	cert, err := pemOf(c.Cert, c.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pemOf(c.Key, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := pemOf(c.CA, c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil && ca == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad client cert or key: %v", ErrInvalidConfig, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: no certificate found in ca", ErrInvalidConfig)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// Config of the etcd client
+func (c *Config) ClientConfig() (clientv3.Config, error) {
+	if err := c.Validate(); err != nil {
+		return clientv3.Config{}, err
+	}
+	tlsConfig, err := c.TLS()
+	if err != nil {
+		return clientv3.Config{}, err
+	}
+	timeout, _ := c.dialTimeout()
+	return clientv3.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: timeout,
+		TLS:         tlsConfig,
+		Username:    c.Username,
+		Password:    c.Password,
+	}, nil
+}
@@ -0,0 +1,161 @@
+package etcdwrap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// self signed cert & key in PEM
+func selfSigned(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mycni"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return string(cert), string(keyPem)
+}
+
+func TestValidateConfig(t *testing.T) {
+	te := assert.New(t)
+
+	te.Nil(DefaultConfig().Validate())
+	te.Nil((&Config{Endpoints: []string{"https://10.0.0.1:2379", "etcd-0:2379"}}).Validate())
+
+	for _, c := range []*Config{
+		{},
+		{Endpoints: []string{"10.0.0.1"}},
+		{Endpoints: []string{"ftp://10.0.0.1:2379"}},
+		{Endpoints: []string{DefaultEndpoint}, CertFile: "a.crt", Cert: "inline"},
+		{Endpoints: []string{DefaultEndpoint}, CertFile: "a.crt"},
+		{Endpoints: []string{DefaultEndpoint}, Username: "root"},
+		{Endpoints: []string{DefaultEndpoint}, DialTimeout: "soon"},
+		{Endpoints: []string{DefaultEndpoint}, DialTimeout: "-1s"},
+		{Endpoints: []string{DefaultEndpoint}, KeyPrefix: "/mycni/"},
+	} {
+		err := c.Validate()
+		te.True(errors.Is(err, ErrInvalidConfig), "%+v should be refused", c)
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	te := assert.New(t)
+	cert, key := selfSigned(t)
+
+	// inline PEM
+	c := &Config{Endpoints: []string{DefaultEndpoint}, Cert: cert, Key: key, CA: cert, DialTimeout: "2s"}
+	cc, err := c.ClientConfig()
+	te.Nil(err)
+	te.Equal(cc.DialTimeout, 2*time.Second)
+	te.Equal(len(cc.TLS.Certificates), 1)
+	te.NotNil(cc.TLS.RootCAs)
+
+	// the same from files
+	dir := t.TempDir()
+	te.Nil(os.WriteFile(filepath.Join(dir, "client.crt"), []byte(cert), 0600))
+	te.Nil(os.WriteFile(filepath.Join(dir, "client.key"), []byte(key), 0600))
+	c = &Config{
+		Endpoints: []string{DefaultEndpoint},
+		CertFile:  filepath.Join(dir, "client.crt"),
+		KeyFile:   filepath.Join(dir, "client.key"),
+		CAFile:    filepath.Join(dir, "client.crt"),
+	}
+	cc, err = c.ClientConfig()
+	te.Nil(err)
+	te.Equal(cc.DialTimeout, DefaultDialTimeout)
+	te.Equal(len(cc.TLS.Certificates), 1)
+
+	// no tls at all
+	cc, err = (&Config{Endpoints: []string{DefaultEndpoint}}).ClientConfig()
+	te.Nil(err)
+	te.Nil(cc.TLS)
+
+	// missing or broken certs are reported, not ignored
+	c.CAFile = filepath.Join(dir, "missing.crt")
+	_, err = c.ClientConfig()
+	te.True(errors.Is(err, ErrInvalidConfig))
+	_, err = (&Config{Endpoints: []string{DefaultEndpoint}, Cert: cert, Key: "broken"}).ClientConfig()
+	te.True(errors.Is(err, ErrInvalidConfig))
+}
+
+func TestConfigPrefix(t *testing.T) {
+	te := assert.New(t)
+	te.Equal((&Config{}).Prefix(), "mycni/ipam/")
+	te.Equal((&Config{KeyPrefix: "cluster-a/ipam"}).Prefix(), "cluster-a/ipam/")
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	te := assert.New(t)
+	t.Setenv("MYCNI_ETCD_ENDPOINTS", "10.0.0.1:2379,10.0.0.2:2379")
+	t.Setenv("MYCNI_ETCD_USERNAME", "root")
+	t.Setenv("MYCNI_ETCD_PASSWORD", "secret")
+	t.Setenv("MYCNI_ETCD_KEY_PREFIX", "cluster-a/")
+
+	c, err := ConfigFromEnv()
+	te.Nil(err)
+	te.Equal(c.Endpoints, []string{"10.0.0.1:2379", "10.0.0.2:2379"})
+	te.Equal(c.Username, "root")
+	te.Equal(c.Password, "secret")
+	te.Equal(c.Prefix(), "cluster-a/")
+
+	// a config file replaces all the others
+	path := filepath.Join(t.TempDir(), "etcd.json")
+	te.Nil(os.WriteFile(path, []byte(`{"endpoints": ["https://etcd:2379"], "dialTimeout": "3s"}`), 0600))
+	t.Setenv("MYCNI_ETCD_CONFIG", path)
+	c, err = ConfigFromEnv()
+	te.Nil(err)
+	te.Equal(c, &Config{Endpoints: []string{"https://etcd:2379"}, DialTimeout: "3s"})
+
+	te.Nil(os.WriteFile(path, []byte(`{"endpoints": []}`), 0600))
+	_, err = ConfigFromEnv()
+	te.True(errors.Is(err, ErrInvalidConfig))
+}
+
+func TestConfigFlags(t *testing.T) {
+	te := assert.New(t)
+	t.Setenv("MYCNI_ETCD_DIAL_TIMEOUT", "7s")
+
+	c := &Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.AddFlags(fs)
+	te.Nil(fs.Parse([]string{"-etcd-endpoints", "10.0.0.1:2379,10.0.0.2:2379", "-etcd-ca-file", ""}))
+	te.Nil(c.Complete())
+	te.Equal(c.Endpoints, []string{"10.0.0.1:2379", "10.0.0.2:2379"})
+	te.Equal(c.DialTimeout, "7s")
+	te.Equal(c.CAFile, "")
+
+	c = &Config{}
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	c.AddFlags(fs)
+	te.Nil(fs.Parse([]string{"-etcd-config", filepath.Join(t.TempDir(), "missing.json")}))
+	te.True(errors.Is(c.Complete(), ErrInvalidConfig))
+}
@@ -0,0 +1,1332 @@
+package etcdwrap
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mycni/pkg/apis/ipam/v1alpha1"
+	"mycni/utils"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	DefaultLeaseNamespace = "kube-system"
+	// how often watches & campaigns poll the apiserver
+	DefaultKubePollInterval = time.Second
+	// txns pending longer are taken as dead, and aborted by others
+	DefaultKubeTxnTimeout = 30 * time.Second
+	// deleted keys & finished txns are kept this long before they're really gone
+	kubeTombstoneTTL = time.Minute
+
+	// what lists of blocks, hosts & devices of a node, or ips of a block are narrowed by
+	labelNode  = "ipam.mycni.io/node"
+	labelBlock = "ipam.mycni.io/block"
+)
+
+// a txn touching the same keys is older, try again once it's done
+var errTxnConflict = errors.New("conflicting with an older txn")
+
+// Backend on the CRDs of ipam.mycni.io, `kubernetes` of the ipam block
+type KubeBackendConfig struct {
+	// path of kubeconfig, KUBECONFIG, ~/.kube/config or in-cluster config if empty
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// namespace of coordination leases for node leases & elections, "kube-system" if empty
+	LeaseNamespace string `json:"leaseNamespace,omitempty"`
+}
+
+func NewKubeScheme() (*runtime.Scheme, error) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := coordinationv1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	// pods, namespaces & nodes which ip pools are selected by
+	if err := corev1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	return scheme, nil
+}
+
+// Client of the apiserver with ipam CRDs, coordination leases & core objects registered
+func (c *KubeBackendConfig) Client() (client.Client, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = c.Kubeconfig
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load kubeconfig: %w", err)
+	}
+	cfg.Timeout = DefaultRequestTimeout
+	scheme, err := NewKubeScheme()
+	if err != nil {
+		return nil, err
+	}
+	return client.New(cfg, client.Options{Scheme: scheme})
+}
+
+// Keys of the store in typed CRDs, one object per key, through the apiserver instead of etcd.
+//
+// IPAllocation holds blocks/<cidr>/<ip>, IPBlock <node>/blocks/<cidr>, IPHost <node> & <node>/gateway,
+// IPDevice <node>/<containerID>-<ifname>, IPSticky sticky/<namespace>/<name>, IPPool all the others.
+// Revisions are resourceVersions: a key's modRevision is the resourceVersion of the txn which wrote it,
+// or of the object if that's later, so each key's revisions keep growing & never repeat.
+//
+// Every write goes through a txn of its own, there is no object all of them update:
+//   - the txn is recorded in an IPTxn, then intents are put on the written keys by
+//     updates guarded by their resourceVersions, keys missing are created as tombstones
+//   - comparisons are checked once the intents are in place, keys which aren't written
+//     are read until two rounds agree
+//   - flipping the IPTxn to committed is the commit point, then intents are applied & the IPTxn removed
+//
+// A txn running into the intent of another one applies it if that one is committed, drops it if aborted,
+// aborts it if it's younger or pending past its deadline, or else gives way & starts over.
+// Readers apply committed intents in memory only, so Get is one request unless the key has an intent.
+// Txns of unrelated keys never conflict, but a txn is ~5 requests plus 3 per written key,
+// and prefix reads list a kind, narrowed to a node or a block by labels where the prefix allows.
+// Leases & elections are coordination.k8s.io leases, watches poll the apiserver.
+type KubeBackend struct {
+	c         client.Client
+	namespace string
+
+	PollInterval time.Duration
+	TxnTimeout   time.Duration
+}
+
+var _ Backend = &KubeBackend{}
+
+func NewKubeBackend(c client.Client, conf *KubeBackendConfig) *KubeBackend {
+	k := &KubeBackend{
+		c:            c,
+		namespace:    conf.LeaseNamespace,
+		PollInterval: DefaultKubePollInterval,
+		TxnTimeout:   DefaultKubeTxnTimeout,
+	}
+	if k.namespace == "" {
+		k.namespace = DefaultLeaseNamespace
+	}
+	return k
+}
+
+// Connect to the apiserver with conf
+func NewKubeBackendFromConfig(conf *KubeBackendConfig) (*KubeBackend, error) {
+	c, err := conf.Client()
+	if err != nil {
+		return nil, err
+	}
+	return NewKubeBackend(c, conf), nil
+}
+
+type kvObject interface {
+	client.Object
+	KV() *v1alpha1.KVSpec
+	Value() *string
+}
+
+type kvKind struct {
+	newObject func() kvObject
+	newList   func() client.ObjectList
+	items     func(client.ObjectList) []kvObject
+}
+
+var (
+	poolKind = kvKind{
+		newObject: func() kvObject { return &v1alpha1.IPPool{} },
+		newList:   func() client.ObjectList { return &v1alpha1.IPPoolList{} },
+		items: func(l client.ObjectList) []kvObject {
+			var res []kvObject
+			for i := range l.(*v1alpha1.IPPoolList).Items {
+				res = append(res, &l.(*v1alpha1.IPPoolList).Items[i])
+			}
+			return res
+		},
+	}
+	blockKind = kvKind{
+		newObject: func() kvObject { return &v1alpha1.IPBlock{} },
+		newList:   func() client.ObjectList { return &v1alpha1.IPBlockList{} },
+		items: func(l client.ObjectList) []kvObject {
+			var res []kvObject
+			for i := range l.(*v1alpha1.IPBlockList).Items {
+				res = append(res, &l.(*v1alpha1.IPBlockList).Items[i])
+			}
+			return res
+		},
+	}
+	allocationKind = kvKind{
+		newObject: func() kvObject { return &v1alpha1.IPAllocation{} },
+		newList:   func() client.ObjectList { return &v1alpha1.IPAllocationList{} },
+		items: func(l client.ObjectList) []kvObject {
+			var res []kvObject
+			for i := range l.(*v1alpha1.IPAllocationList).Items {
+				res = append(res, &l.(*v1alpha1.IPAllocationList).Items[i])
+			}
+			return res
+		},
+	}
+	hostKind = kvKind{
+		newObject: func() kvObject { return &v1alpha1.IPHost{} },
+		newList:   func() client.ObjectList { return &v1alpha1.IPHostList{} },
+		items: func(l client.ObjectList) []kvObject {
+			var res []kvObject
+			for i := range l.(*v1alpha1.IPHostList).Items {
+				res = append(res, &l.(*v1alpha1.IPHostList).Items[i])
+			}
+			return res
+		},
+	}
+	deviceKind = kvKind{
+		newObject: func() kvObject { return &v1alpha1.IPDevice{} },
+		newList:   func() client.ObjectList { return &v1alpha1.IPDeviceList{} },
+		items: func(l client.ObjectList) []kvObject {
+			var res []kvObject
+			for i := range l.(*v1alpha1.IPDeviceList).Items {
+				res = append(res, &l.(*v1alpha1.IPDeviceList).Items[i])
+			}
+			return res
+		},
+	}
+	stickyKind = kvKind{
+		newObject: func() kvObject { return &v1alpha1.IPSticky{} },
+		newList:   func() client.ObjectList { return &v1alpha1.IPStickyList{} },
+		items: func(l client.ObjectList) []kvObject {
+			var res []kvObject
+			for i := range l.(*v1alpha1.IPStickyList).Items {
+				res = append(res, &l.(*v1alpha1.IPStickyList).Items[i])
+			}
+			return res
+		},
+	}
+)
+
+// first parts of keys which are never nodes
+var reservedRoots = map[string]bool{
+	"pool": true, "config": true, "reclaimer": true, "pools": true, "reservations": true, "leases": true,
+}
+
+// Where a key is kept by the layout of utils, with the typed fields parsed from it
+type keyInfo struct {
+	kind      *kvKind
+	node      string
+	block     string
+	ip        string
+	device    string
+	namespace string
+	name      string
+}
+
+func parseKey(key string) keyInfo {
+	pool := keyInfo{kind: &poolKind}
+	if !strings.HasPrefix(key, utils.GetKeyPrefix()) {
+		return pool
+	}
+	root, rest, nested := strings.Cut(strings.TrimPrefix(key, utils.GetKeyPrefix()), "/")
+	switch {
+	case root == "blocks":
+		if i := strings.LastIndex(rest, "/"); i > 0 {
+			return keyInfo{kind: &allocationKind, block: rest[:i], ip: rest[i+1:]}
+		}
+	case root == "sticky":
+		if ns, name, ok := strings.Cut(rest, "/"); ok && !strings.Contains(name, "/") {
+			return keyInfo{kind: &stickyKind, namespace: ns, name: name}
+		}
+	case root == "" || reservedRoots[root]:
+	case !nested, rest == "gateway":
+		return keyInfo{kind: &hostKind, node: root}
+	case strings.HasPrefix(rest, "blocks/"):
+		return keyInfo{kind: &blockKind, node: root, block: strings.TrimPrefix(rest, "blocks/")}
+	case rest != "pool" && !strings.Contains(rest, "/"):
+		return keyInfo{kind: &deviceKind, node: root, device: rest}
+	}
+	return pool
+}
+
+// Object for key with its typed fields & labels, not created yet
+func newObject(key string) kvObject {
+	info := parseKey(key)
+	obj := info.kind.newObject()
+	obj.SetName(objectName(key))
+	obj.KV().Key = key
+	switch o := obj.(type) {
+	case *v1alpha1.IPAllocation:
+		o.Spec.Block, o.Spec.IP = info.block, info.ip
+		o.SetLabels(map[string]string{labelBlock: labelValue(info.block)})
+	case *v1alpha1.IPBlock:
+		o.Spec.Node, o.Spec.Block = info.node, info.block
+		o.SetLabels(map[string]string{labelNode: labelValue(info.node)})
+	case *v1alpha1.IPHost:
+		o.Spec.Node = info.node
+		o.SetLabels(map[string]string{labelNode: labelValue(info.node)})
+	case *v1alpha1.IPDevice:
+		o.Spec.Node, o.Spec.Device = info.node, info.device
+		o.SetLabels(map[string]string{labelNode: labelValue(info.node)})
+	case *v1alpha1.IPSticky:
+		o.Spec.Namespace, o.Spec.Name = info.namespace, info.name
+	}
+	return obj
+}
+
+// A kind to list, narrowed by labels if not nil
+type listScope struct {
+	kind   *kvKind
+	labels client.MatchingLabels
+}
+
+// Lists which may hold keys under prefix
+func scopesUnder(prefix string) []listScope {
+	all := []listScope{{kind: &poolKind}, {kind: &blockKind}, {kind: &allocationKind},
+		{kind: &hostKind}, {kind: &deviceKind}, {kind: &stickyKind}}
+	if !strings.HasPrefix(prefix, utils.GetKeyPrefix()) {
+		if strings.HasPrefix(utils.GetKeyPrefix(), prefix) {
+			return all
+		}
+		return []listScope{{kind: &poolKind}}
+	}
+	root, rest, nested := strings.Cut(strings.TrimPrefix(prefix, utils.GetKeyPrefix()), "/")
+	switch {
+	case !nested:
+		return all
+	case root == "blocks":
+		if i := strings.LastIndex(rest, "/"); i > 0 {
+			if _, _, err := net.ParseCIDR(rest[:i]); err == nil {
+				return []listScope{{kind: &allocationKind, labels: client.MatchingLabels{labelBlock: labelValue(rest[:i])}}}
+			}
+		}
+		return []listScope{{kind: &allocationKind}}
+	case root == "sticky":
+		return []listScope{{kind: &stickyKind}}
+	case reservedRoots[root]:
+		return []listScope{{kind: &poolKind}}
+	}
+	node := client.MatchingLabels{labelNode: labelValue(root)}
+	if strings.HasPrefix(rest, "blocks/") {
+		return []listScope{{kind: &blockKind, labels: node}}
+	}
+	return []listScope{{kind: &blockKind, labels: node}, {kind: &hostKind, labels: node},
+		{kind: &deviceKind, labels: node}, {kind: &poolKind}}
+}
+
+// Readable part of s with its hash, at most max+9 long, like mycni-ipam-blocks-10.1.0.0-24-10.1.0.5-1a2b3c4d
+func hashedName(s string, max int) string {
+	sum := sha1.Sum([]byte(s))
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '-'
+	}, strings.ToLower(s))
+
+	// every dot separated label starts & ends with alphanumerics
+	var labels []string
+	for _, l := range strings.Split(mapped, ".") {
+		if l = strings.Trim(l, "-"); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	name := strings.Join(labels, ".")
+	if len(name) > max {
+		name = strings.TrimRight(name[:max], ".-")
+	}
+	if name == "" {
+		name = "key"
+	}
+	return name + "-" + hex.EncodeToString(sum[:4])
+}
+
+// Name of the object of key
+func objectName(key string) string {
+	return hashedName(key, 200)
+}
+
+// Label value of a node or a block
+func labelValue(s string) string {
+	return hashedName(s, 54)
+}
+
+func parseRevision(rv string) int64 {
+	rev, _ := strconv.ParseInt(rv, 10, 64)
+	return rev
+}
+
+func isVisible(kv *v1alpha1.KVSpec, alive func(int64) bool) bool {
+	return !kv.Deleted && (kv.Lease == 0 || alive(kv.Lease))
+}
+
+func toMemValue(obj kvObject) *memValue {
+	kv := obj.KV()
+	return &memValue{value: *obj.Value(), createRev: kv.CreateRevision, modRev: kv.ModRevision, lease: kv.Lease}
+}
+
+// Lease checks of one request, every lease is read once.
+// Keys stay if their lease can't be read, better than freeing ips by mistake.
+func (k *KubeBackend) leaseChecker(ctx context.Context) func(int64) bool {
+	seen := make(map[int64]bool)
+	return func(id int64) bool {
+		if alive, ok := seen[id]; ok {
+			return alive
+		}
+		ttl, err := k.LeaseTTL(ctx, id)
+		seen[id] = err != nil || ttl >= 0
+		return seen[id]
+	}
+}
+
+// object of key, tombstones included, nil if never written
+func (k *KubeBackend) getObject(ctx context.Context, key string) (kvObject, error) {
+	obj := parseKey(key).kind.newObject()
+	err := k.c.Get(ctx, client.ObjectKey{Name: objectName(key)}, obj)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if obj.KV().Key != key {
+		return nil, fmt.Errorf("object %s holds %q instead of %q", obj.GetName(), obj.KV().Key, key)
+	}
+	return obj, nil
+}
+
+// objects of keys under prefix, tombstones included
+func (k *KubeBackend) listObjects(ctx context.Context, prefix string) ([]kvObject, error) {
+	var res []kvObject
+	for _, scope := range scopesUnder(prefix) {
+		list := scope.kind.newList()
+		var opts []client.ListOption
+		if scope.labels != nil {
+			opts = append(opts, scope.labels)
+		}
+		if err := k.c.List(ctx, list, opts...); err != nil {
+			return nil, err
+		}
+		for _, obj := range scope.kind.items(list) {
+			if strings.HasPrefix(obj.KV().Key, prefix) {
+				res = append(res, obj)
+			}
+		}
+	}
+	return res, nil
+}
+
+// record of txn, nil if it's gone
+func (k *KubeBackend) getTxn(ctx context.Context, name string) (*v1alpha1.IPTxn, error) {
+	t := &v1alpha1.IPTxn{}
+	err := k.c.Get(ctx, client.ObjectKey{Name: name}, t)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Whether txn a wins over b, the one started first, or of the smaller name
+func olderTxn(a, b *v1alpha1.IPTxn) bool {
+	if !a.Spec.StartedAt.Equal(&b.Spec.StartedAt) {
+		return a.Spec.StartedAt.Before(&b.Spec.StartedAt)
+	}
+	return a.Name < b.Name
+}
+
+// obj with the intent of txn t applied, or dropped if t isn't committed, in memory
+func settled(obj kvObject, t *v1alpha1.IPTxn, alive func(int64) bool) kvObject {
+	obj = obj.DeepCopyObject().(kvObject)
+	kv := obj.KV()
+	intent := kv.Intent
+	kv.Intent = nil
+	now := metav1.Now()
+	if intent == nil || t == nil || t.Spec.State != v1alpha1.TxnCommitted {
+		// created for the txn, gone with it
+		if kv.Deleted && kv.DeletedAt == nil {
+			kv.DeletedAt = &now
+		}
+		return obj
+	}
+
+	// revision of the commit, later than all revisions before it
+	rev := parseRevision(t.ResourceVersion)
+	if r := parseRevision(obj.GetResourceVersion()); r > rev {
+		rev = r
+	}
+	if rev <= kv.ModRevision {
+		rev = kv.ModRevision + 1
+	}
+	if intent.Delete {
+		if !kv.Deleted {
+			kv.Deleted, kv.DeletedAt, kv.ModRevision = true, &now, rev
+		}
+		return obj
+	}
+	if !isVisible(kv, alive) {
+		kv.CreateRevision = rev
+	}
+	*obj.Value() = intent.Value
+	kv.Lease, kv.ModRevision = intent.Lease, rev
+	kv.Deleted, kv.DeletedAt = false, nil
+	return obj
+}
+
+// Committed state of obj for readers, intents of committed txns are applied in memory,
+// others are left out as their txns may still abort. txns caches records of one request
+func (k *KubeBackend) view(ctx context.Context, obj kvObject, txns map[string]*v1alpha1.IPTxn, alive func(int64) bool) (kvObject, error) {
+	intent := obj.KV().Intent
+	if intent == nil {
+		return obj, nil
+	}
+	t, ok := txns[intent.Txn]
+	if !ok {
+		var err error
+		if t, err = k.getTxn(ctx, intent.Txn); err != nil {
+			return nil, err
+		}
+		txns[intent.Txn] = t
+	}
+	if t != nil && t.Spec.State == v1alpha1.TxnCommitted {
+		return settled(obj, t, alive), nil
+	}
+	return obj, nil
+}
+
+// Apply the intent of txn t on obj, or drop it if t isn't committed.
+// Done if someone else gets there first, or the intent is gone otherwise
+func (k *KubeBackend) settle(ctx context.Context, obj kvObject, t *v1alpha1.IPTxn, alive func(int64) bool) error {
+	name := obj.KV().Intent.Txn
+	for {
+		err := k.c.Update(ctx, settled(obj, t, alive))
+		if err == nil || apierrors.IsNotFound(err) {
+			return nil
+		}
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+		if obj, err = k.getObject(ctx, obj.KV().Key); err != nil {
+			return err
+		}
+		if obj == nil || obj.KV().Intent == nil || obj.KV().Intent.Txn != name {
+			return nil
+		}
+	}
+}
+
+// Get the foreign intent on obj out of the way of txn me: applied or dropped if its txn is over,
+// its txn aborted if it's younger than me or pending past its deadline,
+// errTxnConflict if me has to give way
+func (k *KubeBackend) resolve(ctx context.Context, obj kvObject, me *v1alpha1.IPTxn, alive func(int64) bool) error {
+	name := obj.KV().Intent.Txn
+	for {
+		t, err := k.getTxn(ctx, name)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			// records are removed only after all their intents are settled, obj is stale then
+			fresh, err := k.getObject(ctx, obj.KV().Key)
+			if err != nil || fresh == nil || fresh.KV().Intent == nil || fresh.KV().Intent.Txn != name {
+				return err
+			}
+			return k.settle(ctx, fresh, nil, alive)
+		}
+		if t.Spec.State != v1alpha1.TxnPending {
+			return k.settle(ctx, obj, t, alive)
+		}
+		if time.Now().Before(t.Spec.Deadline.Time) && !olderTxn(me, t) {
+			return errTxnConflict
+		}
+		t.Spec.State = v1alpha1.TxnAborted
+		if err := k.c.Update(ctx, t); apierrors.IsConflict(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		return k.settle(ctx, obj, t, alive)
+	}
+}
+
+// Remove tombstones old enough, errors are ignored as the next one retries
+func (k *KubeBackend) purge(ctx context.Context, objs []kvObject) {
+	for _, obj := range objs {
+		kv := obj.KV()
+		if !kv.Deleted || kv.Intent != nil || kv.DeletedAt == nil || time.Since(kv.DeletedAt.Time) < kubeTombstoneTTL {
+			continue
+		}
+		rv := obj.GetResourceVersion()
+		_ = k.c.Delete(ctx, obj, client.Preconditions{ResourceVersion: &rv})
+	}
+}
+
+// Settle txns left by dead writers & remove their records, errors are ignored as the next one retries
+func (k *KubeBackend) purgeTxns(ctx context.Context) {
+	list := &v1alpha1.IPTxnList{}
+	if err := k.c.List(ctx, list); err != nil {
+		return
+	}
+	alive := k.leaseChecker(ctx)
+	for i := range list.Items {
+		t := &list.Items[i]
+		if time.Since(t.Spec.Deadline.Time) < kubeTombstoneTTL {
+			continue
+		}
+		if t.Spec.State == v1alpha1.TxnPending {
+			t.Spec.State = v1alpha1.TxnAborted
+			if err := k.c.Update(ctx, t); err != nil {
+				continue
+			}
+		}
+		if k.settleAll(ctx, t, t.Spec.Keys, alive) == nil {
+			_ = k.c.Delete(ctx, t)
+		}
+	}
+}
+
+// Settle intents of txn t on keys
+func (k *KubeBackend) settleAll(ctx context.Context, t *v1alpha1.IPTxn, keys []string, alive func(int64) bool) error {
+	for _, key := range keys {
+		obj, err := k.getObject(ctx, key)
+		if err != nil {
+			return err
+		}
+		if obj == nil || obj.KV().Intent == nil || obj.KV().Intent.Txn != t.Name {
+			continue
+		}
+		if err := k.settle(ctx, obj, t, alive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *KubeBackend) Get(ctx context.Context, key string) (string, int64, error) {
+	obj, err := k.getObject(ctx, key)
+	if err != nil || obj == nil {
+		return "", 0, err
+	}
+	alive := k.leaseChecker(ctx)
+	if obj, err = k.view(ctx, obj, make(map[string]*v1alpha1.IPTxn), alive); err != nil {
+		return "", 0, err
+	}
+	if kv := obj.KV(); isVisible(kv, alive) {
+		return *obj.Value(), kv.ModRevision, nil
+	}
+	return "", 0, nil
+}
+
+func (k *KubeBackend) GetPrefix(ctx context.Context, prefix string) (map[string]VersionedValue, error) {
+	objs, err := k.listObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	k.purge(ctx, objs)
+
+	alive := k.leaseChecker(ctx)
+	txns := make(map[string]*v1alpha1.IPTxn)
+	res := make(map[string]VersionedValue)
+	for _, obj := range objs {
+		if obj, err = k.view(ctx, obj, txns, alive); err != nil {
+			return nil, err
+		}
+		if kv := obj.KV(); isVisible(kv, alive) {
+			res[kv.Key] = VersionedValue{Value: *obj.Value(), ModRevision: kv.ModRevision}
+		}
+	}
+	return res, nil
+}
+
+func (k *KubeBackend) Put(ctx context.Context, key, value string, opts ...OpOption) error {
+	_, err := k.Txn(ctx, nil, OpPut(key, value, opts...))
+	return err
+}
+
+func (k *KubeBackend) Delete(ctx context.Context, key string, opts ...OpOption) error {
+	_, err := k.Txn(ctx, nil, OpDelete(key, opts...))
+	return err
+}
+
+// Whether all comparisons hold at once, for txn me which has its intents on the keys of prepared,
+// or for a reader if me is nil.
+// Those keys can't change while the intents are there, the others are read again
+// until two rounds agree, so what's compared is a state the store had at some point.
+func (k *KubeBackend) check(ctx context.Context, me *v1alpha1.IPTxn, prepared map[string]kvObject, cmps []Cmp) (bool, error) {
+	var last map[string]string
+	for {
+		seen, ok, err := k.evaluate(ctx, me, prepared, cmps)
+		if errors.Is(err, errIntentResolved) {
+			last = nil
+			continue
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+		// one key is always read as a whole
+		if len(seen) <= 1 && !hasPrefixCmp(cmps) {
+			return true, nil
+		}
+		if last != nil && sameRevisions(last, seen) {
+			return true, nil
+		}
+		last = seen
+	}
+}
+
+// an intent was in the way of the comparisons & is settled, read them again
+var errIntentResolved = errors.New("intent resolved")
+
+func hasPrefixCmp(cmps []Cmp) bool {
+	for _, c := range cmps {
+		if c.Prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func sameRevisions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, rv := range a {
+		if other, ok := b[name]; !ok || other != rv {
+			return false
+		}
+	}
+	return true
+}
+
+// One round of check, with resourceVersions of the objects read by name, empty for missing keys
+func (k *KubeBackend) evaluate(ctx context.Context, me *v1alpha1.IPTxn, prepared map[string]kvObject, cmps []Cmp) (map[string]string, bool, error) {
+	alive := k.leaseChecker(ctx)
+	txns := make(map[string]*v1alpha1.IPTxn)
+	seen := make(map[string]string)
+	holds := true
+	for _, c := range cmps {
+		var objs []kvObject
+		if c.Prefix {
+			var err error
+			if objs, err = k.listObjects(ctx, c.Key); err != nil {
+				return nil, false, err
+			}
+		} else if obj, ok := prepared[c.Key]; ok {
+			objs = append(objs, obj)
+		} else {
+			obj, err := k.getObject(ctx, c.Key)
+			if err != nil {
+				return nil, false, err
+			}
+			if obj == nil {
+				seen[objectName(c.Key)] = ""
+			} else {
+				objs = append(objs, obj)
+			}
+		}
+
+		matched := 0
+		for _, obj := range objs {
+			intent := obj.KV().Intent
+			switch {
+			case intent == nil, me != nil && intent.Txn == me.Name:
+			case me == nil:
+				var err error
+				if obj, err = k.view(ctx, obj, txns, alive); err != nil {
+					return nil, false, err
+				}
+			default:
+				if err := k.resolve(ctx, obj, me, alive); err != nil {
+					return nil, false, err
+				}
+				return nil, false, errIntentResolved
+			}
+			if _, ok := prepared[obj.KV().Key]; !ok {
+				seen[obj.GetName()] = obj.GetResourceVersion()
+			}
+			if kv := obj.KV(); isVisible(kv, alive) {
+				matched++
+				if !c.holds(toMemValue(obj)) {
+					holds = false
+				}
+			}
+		}
+		if matched == 0 && !c.holds(nil) {
+			holds = false
+		}
+	}
+	return seen, holds, nil
+}
+
+// Put the intent of op of txn t on its key, creating the key as a tombstone if it's missing.
+// Returns the object holding the intent, nil if there's nothing to delete
+func (k *KubeBackend) prepare(ctx context.Context, t *v1alpha1.IPTxn, op Op, alive func(int64) bool) (kvObject, error) {
+	intent := &v1alpha1.Intent{Txn: t.Name, Delete: op.Type == OpTypeDelete, Value: op.Value, Lease: op.Lease}
+	for {
+		obj, err := k.getObject(ctx, op.Key)
+		if err != nil {
+			return nil, err
+		}
+		if obj == nil {
+			if intent.Delete {
+				return nil, nil
+			}
+			obj = newObject(op.Key)
+			obj.KV().Deleted = true
+			obj.KV().Intent = intent
+			if err := k.c.Create(ctx, obj); apierrors.IsAlreadyExists(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			return obj, nil
+		}
+
+		if cur := obj.KV().Intent; cur != nil && cur.Txn == t.Name {
+			return obj, nil
+		} else if cur != nil {
+			if err := k.resolve(ctx, obj, t, alive); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		obj.KV().Intent = intent
+		if err := k.c.Update(ctx, obj); apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+}
+
+func (k *KubeBackend) Txn(ctx context.Context, cmps []Cmp, ops ...Op) (bool, error) {
+	if len(ops) == 0 {
+		return k.check(ctx, nil, nil, cmps)
+	}
+	for _, op := range ops {
+		if op.Type == OpTypePut && op.Lease != 0 {
+			if ttl, err := k.LeaseTTL(ctx, op.Lease); err != nil {
+				return false, err
+			} else if ttl < 0 {
+				return false, ErrLeaseNotFound
+			}
+		}
+	}
+
+	// kept over retries, so the txn gets older & wins at last
+	started := metav1.NowMicro()
+	for {
+		ok, err := k.txn(ctx, started, cmps, ops)
+		if !errors.Is(err, errTxnConflict) {
+			return ok, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(time.Duration(10+rand.Intn(40)) * time.Millisecond):
+		}
+	}
+}
+
+// One attempt of Txn
+func (k *KubeBackend) txn(ctx context.Context, started metav1.MicroTime, cmps []Cmp, ops []Op) (bool, error) {
+	// writes by key, a prefix delete is a delete of every key under it
+	writes := make(map[string]Op)
+	for _, op := range ops {
+		if op.Type == OpTypeDelete && op.Prefix {
+			objs, err := k.listObjects(ctx, op.Key)
+			if err != nil {
+				return false, err
+			}
+			for _, obj := range objs {
+				if kv := obj.KV(); !kv.Deleted || kv.Intent != nil {
+					writes[kv.Key] = OpDelete(kv.Key)
+				}
+			}
+			continue
+		}
+		writes[op.Key] = op
+	}
+	if len(writes) == 0 {
+		return k.check(ctx, nil, nil, cmps)
+	}
+	keys := make([]string, 0, len(writes))
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	t := &v1alpha1.IPTxn{Spec: v1alpha1.IPTxnSpec{
+		State:     v1alpha1.TxnPending,
+		StartedAt: started,
+		Deadline:  metav1.NewMicroTime(time.Now().Add(k.TxnTimeout)),
+		Keys:      keys,
+	}}
+	for {
+		t.Name = fmt.Sprintf("mycni-ipam-txn-%016x", rand.Int63())
+		if err := k.c.Create(ctx, t); apierrors.IsAlreadyExists(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		break
+	}
+
+	alive := k.leaseChecker(ctx)
+	prepared := make(map[string]kvObject, len(keys))
+	ok, err := func() (bool, error) {
+		for _, key := range keys {
+			obj, err := k.prepare(ctx, t, writes[key], alive)
+			if err != nil {
+				return false, err
+			}
+			if obj != nil {
+				prepared[key] = obj
+			}
+		}
+		return k.check(ctx, t, prepared, cmps)
+	}()
+
+	if err == nil && ok {
+		// the commit point, fails if the txn has been aborted by an older one
+		t.Spec.State = v1alpha1.TxnCommitted
+		if err = k.c.Update(ctx, t); apierrors.IsConflict(err) {
+			err = errTxnConflict
+		} else if err != nil {
+			// the txn may be committed or not, it's left to others
+			return false, err
+		}
+	}
+	if err != nil || !ok {
+		t.Spec.State = v1alpha1.TxnAborted
+		if k.settleAll(ctx, t, keys, alive) == nil {
+			_ = k.c.Delete(ctx, t)
+		}
+		return false, err
+	}
+
+	// committed, anyone running into the intents applies them if this fails
+	for _, key := range keys {
+		if obj, ok := prepared[key]; ok {
+			if err := k.settle(ctx, obj, t, alive); err != nil {
+				utils.Log(fmt.Sprintf("Txn %s is left to others: %v", t.Name, err))
+				return true, nil
+			}
+		}
+	}
+	if err := k.c.Delete(ctx, t); err != nil && !apierrors.IsNotFound(err) {
+		utils.Log(fmt.Sprintf("Cannot remove txn %s: %v", t.Name, err))
+	}
+	return true, nil
+}
+
+// Changes under prefix are found by listing it again every PollInterval.
+// Deletes of rev or later are replayed only while their tombstones are kept.
+func (k *KubeBackend) Watch(ctx context.Context, prefix string, rev int64) <-chan WatchResponse {
+	ch := make(chan WatchResponse, 64)
+	prev, err := k.snapshot(ctx, prefix)
+
+	go func() {
+		defer close(ch)
+		send := func(resp WatchResponse) bool {
+			select {
+			case ch <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if err != nil {
+			send(WatchResponse{Err: err})
+			return
+		}
+
+		var events []Event
+		if rev > 0 {
+			events = diffSnapshots(nil, prev, rev)
+		}
+		ticker := time.NewTicker(k.PollInterval)
+		defer ticker.Stop()
+		for {
+			if len(events) > 0 && !send(WatchResponse{Events: events}) {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			cur, err := k.snapshot(ctx, prefix)
+			if err != nil {
+				if ctx.Err() != nil || !send(WatchResponse{Err: err}) {
+					return
+				}
+				events = nil
+				continue
+			}
+			events = diffSnapshots(prev, cur, 0)
+			prev = cur
+		}
+	}()
+	return ch
+}
+
+// keys under prefix with their tombstones & keys of expired leases, which are deleted ones
+func (k *KubeBackend) snapshot(ctx context.Context, prefix string) (map[string]Event, error) {
+	objs, err := k.listObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	alive := k.leaseChecker(ctx)
+	txns := make(map[string]*v1alpha1.IPTxn)
+	res := make(map[string]Event, len(objs))
+	for _, obj := range objs {
+		if obj, err = k.view(ctx, obj, txns, alive); err != nil {
+			return nil, err
+		}
+		kv := obj.KV()
+		// never written yet
+		if kv.Deleted && kv.ModRevision == 0 {
+			continue
+		}
+		ev := Event{Type: EventPut, Key: kv.Key, Value: *obj.Value(), ModRevision: kv.ModRevision}
+		if !isVisible(kv, alive) {
+			ev = Event{Type: EventDelete, Key: kv.Key, ModRevision: kv.ModRevision}
+		}
+		res[kv.Key] = ev
+	}
+	return res, nil
+}
+
+// Events turning prev into cur, or those of cur since rev if rev > 0, ordered by revision
+func diffSnapshots(prev, cur map[string]Event, rev int64) []Event {
+	var events []Event
+	for key, ev := range cur {
+		old, seen := prev[key]
+		switch {
+		case rev > 0:
+			if ev.ModRevision >= rev {
+				events = append(events, ev)
+			}
+		case ev.Type == EventPut && (!seen || old != ev):
+			events = append(events, ev)
+		case ev.Type == EventDelete && seen && old.Type == EventPut:
+			events = append(events, ev)
+		}
+	}
+	for key, old := range prev {
+		// tombstone gone already
+		if _, ok := cur[key]; !ok && old.Type == EventPut {
+			events = append(events, Event{Type: EventDelete, Key: key})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].ModRevision != events[j].ModRevision {
+			return events[i].ModRevision < events[j].ModRevision
+		}
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
+
+func leaseName(id int64) string {
+	return fmt.Sprintf("mycni-ipam-%016x", id)
+}
+
+// remaining time of a coordination lease
+func leaseRemaining(l *coordinationv1.Lease) time.Duration {
+	if l.Spec.RenewTime == nil || l.Spec.LeaseDurationSeconds == nil {
+		return 0
+	}
+	return time.Until(l.Spec.RenewTime.Add(time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+func (k *KubeBackend) getLease(ctx context.Context, name string) (*coordinationv1.Lease, error) {
+	l := &coordinationv1.Lease{}
+	err := k.c.Get(ctx, client.ObjectKey{Namespace: k.namespace, Name: name}, l)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return l, err
+}
+
+func (k *KubeBackend) GrantLease(ctx context.Context, ttl int64) (int64, error) {
+	// like the minimal ttl of etcd
+	if ttl < 1 {
+		ttl = 1
+	}
+	seconds := int32(ttl)
+	for {
+		id := rand.Int63()
+		if id == 0 {
+			continue
+		}
+		now := metav1.NowMicro()
+		l := &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Namespace: k.namespace, Name: leaseName(id)},
+			Spec: coordinationv1.LeaseSpec{
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if err := k.c.Create(ctx, l); apierrors.IsAlreadyExists(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+}
+
+func (k *KubeBackend) KeepAlive(ctx context.Context, id int64) (<-chan struct{}, error) {
+	l, err := k.getLease(ctx, leaseName(id))
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || leaseRemaining(l) <= 0 {
+		return nil, ErrLeaseNotFound
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			l, err := k.getLease(ctx, leaseName(id))
+			if err != nil {
+				// try again on the next tick, unless it has expired meanwhile
+				continue
+			}
+			if l == nil || leaseRemaining(l) <= 0 {
+				return
+			}
+			now := metav1.NowMicro()
+			l.Spec.RenewTime = &now
+			if err := k.c.Update(ctx, l); err != nil {
+				continue
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (k *KubeBackend) LeaseTTL(ctx context.Context, id int64) (int64, error) {
+	l, err := k.getLease(ctx, leaseName(id))
+	if err != nil {
+		return 0, err
+	}
+	if l == nil {
+		return -1, nil
+	}
+	remaining := leaseRemaining(l)
+	if remaining <= 0 {
+		return -1, nil
+	}
+	return int64(remaining.Seconds()), nil
+}
+
+// Delete the lease, then the keys attached to it
+func (k *KubeBackend) RevokeLease(ctx context.Context, id int64) error {
+	l, err := k.getLease(ctx, leaseName(id))
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+	if err := k.c.Delete(ctx, l); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	objs, err := k.listObjects(ctx, "")
+	if err != nil {
+		return err
+	}
+	var ops []Op
+	for _, obj := range objs {
+		if kv := obj.KV(); !kv.Deleted && kv.Lease == id {
+			ops = append(ops, OpDelete(kv.Key))
+		}
+	}
+	_, err = k.Txn(ctx, nil, ops...)
+	return err
+}
+
+type kubeLeadership struct {
+	k      *KubeBackend
+	name   string
+	holder string
+	done   chan struct{}
+	stop   context.CancelFunc
+	// renewal has stopped
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (l *kubeLeadership) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *kubeLeadership) lost() {
+	l.once.Do(func() { close(l.done) })
+}
+
+// Renew the lease every third of ttl, the leadership is lost once it can't be renewed in time.
+// The leader also cleans up txns left by dead writers
+func (l *kubeLeadership) renew(ctx context.Context, ttl time.Duration) {
+	defer close(l.stopped)
+	renewed := time.Now()
+	var purged time.Time
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(renewed) >= ttl {
+			l.lost()
+			return
+		}
+		lease, err := l.k.getLease(ctx, l.name)
+		if err != nil {
+			continue
+		}
+		if lease == nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.holder {
+			l.lost()
+			return
+		}
+		now := metav1.NowMicro()
+		lease.Spec.RenewTime = &now
+		if err := l.k.c.Update(ctx, lease); err == nil {
+			renewed = now.Time
+		}
+		if time.Since(purged) >= kubeTombstoneTTL {
+			l.k.purgeTxns(ctx)
+			purged = time.Now()
+		}
+	}
+}
+
+func (l *kubeLeadership) Resign(ctx context.Context) error {
+	l.stop()
+	<-l.stopped
+	defer l.lost()
+
+	lease, err := l.k.getLease(ctx, l.name)
+	if err != nil || lease == nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.holder {
+		return nil
+	}
+	lease.Spec.HolderIdentity = nil
+	return l.k.c.Update(ctx, lease)
+}
+
+// Take the lease of election if nobody holds it, or its holder has stopped renewing
+func (k *KubeBackend) tryAcquire(ctx context.Context, name, holder string, ttl int) (bool, error) {
+	seconds := int32(ttl)
+	now := metav1.NowMicro()
+	lease, err := k.getLease(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if lease == nil {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Namespace: k.namespace, Name: name},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if err := k.c.Create(ctx, lease); apierrors.IsAlreadyExists(err) {
+			return false, nil
+		} else {
+			return err == nil, err
+		}
+	}
+
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" && leaseRemaining(lease) > 0 {
+		return false, nil
+	}
+	transitions := int32(0)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions = *lease.Spec.LeaseTransitions + 1
+	}
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseTransitions = &transitions
+	if err := k.c.Update(ctx, lease); apierrors.IsConflict(err) {
+		return false, nil
+	} else {
+		return err == nil, err
+	}
+}
+
+// Leader election on a coordination lease, like the one of client-go
+func (k *KubeBackend) Campaign(ctx context.Context, election, name string, ttl int) (Leadership, error) {
+	if ttl < 1 {
+		ttl = 1
+	}
+	d := time.Duration(ttl) * time.Second
+	interval := k.PollInterval
+	if interval > d/3 {
+		interval = d / 3
+	}
+
+	leaseName := objectName(election)
+	for {
+		won, err := k.tryAcquire(ctx, leaseName, name, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if won {
+			renewCtx, cancel := context.WithCancel(context.Background())
+			l := &kubeLeadership{
+				k:       k,
+				name:    leaseName,
+				holder:  name,
+				done:    make(chan struct{}),
+				stop:    cancel,
+				stopped: make(chan struct{}),
+			}
+			go l.renew(renewCtx, d)
+			return l, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package etcdwrap
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"mycni/pkg/apis/ipam/v1alpha1"
+	"mycni/pkg/testutils"
+	"mycni/utils"
+)
+
+func TestObjectName(t *testing.T) {
+	te := assert.New(t)
+	for _, key := range []string{
+		"mycni/ipam/blocks/10.1.0.0/24/10.1.0.5",
+		"mycni/ipam/Node-1/blocks/10.1.0.0/24",
+		"mycni/ipam/node-1/2f1c..-/-eth0",
+		"/",
+		"",
+	} {
+		name := objectName(key)
+		te.Empty(validation.IsDNS1123Subdomain(name), "%q of %q", name, key)
+		te.Empty(validation.IsValidLabelValue(labelValue(key)), "%q of %q", labelValue(key), key)
+	}
+	te.Equal(objectName("mycni/ipam/blocks/10.1.0.0/24/10.1.0.5")[:38], "mycni-ipam-blocks-10.1.0.0-24-10.1.0.5")
+	te.NotEqual(objectName("mycni/ipam/Node-1"), objectName("mycni/ipam/node-1"))
+}
+
+func TestKubeTypedKeys(t *testing.T) {
+	te := assert.New(t)
+	prefix := utils.GetKeyPrefix()
+	for key, want := range map[string]kvObject{
+		prefix + "blocks/10.1.0.0/24/10.1.0.5": &v1alpha1.IPAllocation{Spec: v1alpha1.IPAllocationSpec{Block: "10.1.0.0/24", IP: "10.1.0.5"}},
+		prefix + "node-1/blocks/10.1.0.0/24":   &v1alpha1.IPBlock{Spec: v1alpha1.IPBlockSpec{Node: "node-1", Block: "10.1.0.0/24"}},
+		prefix + "node-1":                      &v1alpha1.IPHost{Spec: v1alpha1.IPHostSpec{Node: "node-1"}},
+		prefix + "node-1/gateway":              &v1alpha1.IPHost{Spec: v1alpha1.IPHostSpec{Node: "node-1"}},
+		prefix + "node-1/2f1c-eth0":            &v1alpha1.IPDevice{Spec: v1alpha1.IPDeviceSpec{Node: "node-1", Device: "2f1c-eth0"}},
+		prefix + "sticky/default/db-0":         &v1alpha1.IPSticky{Spec: v1alpha1.IPStickySpec{Namespace: "default", Name: "db-0"}},
+		prefix + "pools/pci/pool":              &v1alpha1.IPPool{},
+		prefix + "reservations/10.1.0.0/28":    &v1alpha1.IPPool{},
+		prefix + "node-1/pool":                 &v1alpha1.IPPool{},
+		"a/1":                                  &v1alpha1.IPPool{},
+	} {
+		obj := newObject(key)
+		want.KV().Key = key
+		want.SetName(objectName(key))
+		want.SetLabels(obj.GetLabels())
+		te.Equal(obj, want, key)
+	}
+
+	// values are in typed fields
+	ctx := context.Background()
+	c := testutils.NewFakeKubeClient(t)
+	k := NewKubeBackend(c, &KubeBackendConfig{})
+	te.Nil(k.Put(ctx, prefix+"node-1", "10.1.0.0/24"))
+	te.Nil(k.Put(ctx, prefix+"node-1/gateway", "10.1.0.1/24"))
+	te.Nil(k.Put(ctx, prefix+"node-1/2f1c-eth0", "10.1.0.5/24"))
+	hosts := &v1alpha1.IPHostList{}
+	te.Nil(c.List(ctx, hosts, client.MatchingLabels{labelNode: labelValue("node-1")}))
+	te.Equal(len(hosts.Items), 2)
+	dev := &v1alpha1.IPDevice{}
+	te.Nil(c.Get(ctx, client.ObjectKey{Name: objectName(prefix + "node-1/2f1c-eth0")}, dev))
+	te.Equal(dev.Spec.Address, "10.1.0.5/24")
+	kvs, err := k.GetPrefix(ctx, prefix+"node-1/")
+	te.Nil(err)
+	te.Equal(len(kvs), 2)
+	te.Equal(kvs[prefix+"node-1/gateway"].Value, "10.1.0.1/24")
+
+	// nothing else is written, done txns are removed
+	pools := &v1alpha1.IPPoolList{}
+	te.Nil(c.List(ctx, pools))
+	te.Empty(pools.Items)
+	txns := &v1alpha1.IPTxnList{}
+	te.Nil(c.List(ctx, txns))
+	te.Empty(txns.Items)
+}
+
+// client counting its Gets
+type countingClient struct {
+	client.Client
+	gets int
+}
+
+func (c *countingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	c.gets++
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func TestKubeIntents(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	c := &countingClient{Client: testutils.NewFakeKubeClient(t)}
+	k := NewKubeBackend(c, &KubeBackendConfig{})
+
+	te.Nil(k.Put(ctx, "a/1", "x"))
+	te.Nil(k.Put(ctx, "a/2", "y"))
+	_, rev, err := k.Get(ctx, "a/1")
+	te.Nil(err)
+
+	// a plain read is one request
+	c.gets = 0
+	val, _, err := k.Get(ctx, "a/2")
+	te.Nil(err)
+	te.Equal(val, "y")
+	te.Equal(c.gets, 1)
+
+	// writer died right after committing
+	intend := func(t *v1alpha1.IPTxn, key string, intent v1alpha1.Intent) {
+		obj, err := k.getObject(ctx, key)
+		te.Nil(err)
+		if obj == nil {
+			obj = newObject(key)
+			obj.KV().Deleted = true
+			intent.Txn = t.Name
+			obj.KV().Intent = &intent
+			te.Nil(c.Create(ctx, obj))
+			return
+		}
+		intent.Txn = t.Name
+		obj.KV().Intent = &intent
+		te.Nil(c.Update(ctx, obj))
+	}
+	done := &v1alpha1.IPTxn{
+		ObjectMeta: metav1.ObjectMeta{Name: "done"},
+		Spec:       v1alpha1.IPTxnSpec{State: v1alpha1.TxnCommitted, Keys: []string{"a/1", "b/1"}},
+	}
+	te.Nil(c.Create(ctx, done))
+	intend(done, "a/1", v1alpha1.Intent{Delete: true})
+	intend(done, "b/1", v1alpha1.Intent{Value: "z"})
+
+	// readers see it as a whole without writing
+	kvs, err := k.GetPrefix(ctx, "a/")
+	te.Nil(err)
+	te.Equal(len(kvs), 1)
+	val, _, err = k.Get(ctx, "b/1")
+	te.Nil(err)
+	te.Equal(val, "z")
+	obj, err := k.getObject(ctx, "b/1")
+	te.Nil(err)
+	te.NotNil(obj.KV().Intent)
+
+	// and writers apply it first
+	ok, err := CompareAndSwap(ctx, k, "a/1", rev, "new")
+	te.Nil(err)
+	te.False(ok)
+	ok, err = CompareAndSwap(ctx, k, "a/1", 0, "new")
+	te.Nil(err)
+	te.True(ok)
+	val, rev2, err := k.Get(ctx, "a/1")
+	te.Nil(err)
+	te.Equal(val, "new")
+	te.Greater(rev2, rev)
+
+	// a younger pending txn is aborted by older writers, its keys are left as they were
+	young := &v1alpha1.IPTxn{
+		ObjectMeta: metav1.ObjectMeta{Name: "young"},
+		Spec: v1alpha1.IPTxnSpec{State: v1alpha1.TxnPending, StartedAt: metav1.NewMicroTime(time.Now().Add(time.Hour)),
+			Deadline: metav1.NewMicroTime(time.Now().Add(time.Hour)), Keys: []string{"a/2"}},
+	}
+	te.Nil(c.Create(ctx, young))
+	intend(young, "a/2", v1alpha1.Intent{Value: "never"})
+	val, _, err = k.Get(ctx, "a/2")
+	te.Nil(err)
+	te.Equal(val, "y")
+	te.Nil(k.Put(ctx, "a/2", "y2"))
+	val, _, err = k.Get(ctx, "a/2")
+	te.Nil(err)
+	te.Equal(val, "y2")
+	te.Nil(c.Get(ctx, client.ObjectKey{Name: "young"}, young))
+	te.Equal(young.Spec.State, v1alpha1.TxnAborted)
+
+	// an older one is waited for, until its deadline
+	old := &v1alpha1.IPTxn{
+		ObjectMeta: metav1.ObjectMeta{Name: "old"},
+		Spec: v1alpha1.IPTxnSpec{State: v1alpha1.TxnPending, StartedAt: metav1.NewMicroTime(time.Now().Add(-time.Hour)),
+			Deadline: metav1.NewMicroTime(time.Now().Add(300 * time.Millisecond)), Keys: []string{"a/2"}},
+	}
+	te.Nil(c.Create(ctx, old))
+	intend(old, "a/2", v1alpha1.Intent{Value: "never"})
+	start := time.Now()
+	te.Nil(k.Put(ctx, "a/2", "y3"))
+	te.True(time.Since(start) >= 200*time.Millisecond)
+	val, _, err = k.Get(ctx, "a/2")
+	te.Nil(err)
+	te.Equal(val, "y3")
+
+	// records of dead writers are cleaned up by leaders
+	te.Nil(c.Get(ctx, client.ObjectKey{Name: "done"}, done))
+	done.Spec.Deadline = metav1.NewMicroTime(time.Now().Add(-2 * kubeTombstoneTTL))
+	te.Nil(c.Update(ctx, done))
+	k.purgeTxns(ctx)
+	txns := &v1alpha1.IPTxnList{}
+	te.Nil(c.List(ctx, txns))
+	te.Equal(len(txns.Items), 2)
+	for _, t := range txns.Items {
+		te.NotEqual(t.Name, "done")
+	}
+}
+
+// Txns on the same keys from many writers are serialized
+func TestKubeConcurrentTxns(t *testing.T) {
+	te := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	k := NewKubeBackend(testutils.NewFakeKubeClient(t), &KubeBackendConfig{})
+	te.Nil(k.Put(ctx, "acct/a", "100"))
+	te.Nil(k.Put(ctx, "acct/b", "0"))
+
+	// move one from a to b each time, only if neither has changed since read
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for moved := 0; moved < 5; {
+				a, revA, err := k.Get(ctx, "acct/a")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				b, revB, err := k.Get(ctx, "acct/b")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				na, _ := strconv.Atoi(a)
+				nb, _ := strconv.Atoi(b)
+				ok, err := CommitIfUnchanged(ctx, k, map[string]int64{"acct/a": revA, "acct/b": revB},
+					OpPut("acct/a", strconv.Itoa(na-1)), OpPut("acct/b", strconv.Itoa(nb+1)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					moved++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	kvs, err := ListKV(ctx, k, "acct/")
+	te.Nil(err)
+	te.Equal(kvs, map[string]string{"acct/a": "60", "acct/b": "40"})
+}
@@ -0,0 +1,391 @@
+package etcdwrap
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Backend = &MemoryBackend{}
+
+var ErrLeaseNotFound = errors.New("lease not found")
+
+type memValue struct {
+	value     string
+	createRev int64
+	modRev    int64
+	lease     int64
+}
+
+type memLease struct {
+	ttl    time.Duration
+	expiry time.Time
+}
+
+type memWatcher struct {
+	prefix string
+	ch     chan WatchResponse
+	done   <-chan struct{}
+}
+
+type memElection struct {
+	leader string
+	// closed when the leader resigns
+	resigned chan struct{}
+}
+
+// Backend keeping everything in memory, for tests & single node setups.
+//
+// Revisions, txns, prefix watches & leases behave like etcd,
+// expired leases are purged lazily on the next request.
+type MemoryBackend struct {
+	mu        sync.Mutex
+	rev       int64
+	kvs       map[string]*memValue
+	history   []Event
+	leases    map[int64]*memLease
+	nextLease int64
+	watchers  []*memWatcher
+	elections map[string]*memElection
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		kvs:       make(map[string]*memValue),
+		leases:    make(map[int64]*memLease),
+		nextLease: 1,
+		elections: make(map[string]*memElection),
+	}
+}
+
+// keys matched by key, or by key as a prefix
+func (m *MemoryBackend) matched(key string, prefix bool) []string {
+	if !prefix {
+		if _, ok := m.kvs[key]; ok {
+			return []string{key}
+		}
+		return nil
+	}
+	var keys []string
+	for k := range m.kvs {
+		if strings.HasPrefix(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// drop expired leases with their keys, under lock
+func (m *MemoryBackend) expire() {
+	now := time.Now()
+	var expired []int64
+	for id, l := range m.leases {
+		if !now.Before(l.expiry) {
+			expired = append(expired, id)
+		}
+	}
+	for _, id := range expired {
+		m.revoke(id)
+	}
+}
+
+func (m *MemoryBackend) revoke(id int64) {
+	delete(m.leases, id)
+	var ops []Op
+	for _, k := range m.matched("", true) {
+		if m.kvs[k].lease == id {
+			ops = append(ops, OpDelete(k))
+		}
+	}
+	m.apply(ops)
+}
+
+// apply ops in one revision & notify watchers, under lock
+func (m *MemoryBackend) apply(ops []Op) {
+	var events []Event
+	rev := m.rev + 1
+	for _, op := range ops {
+		switch op.Type {
+		case OpTypePut:
+			kv, ok := m.kvs[op.Key]
+			if !ok {
+				kv = &memValue{createRev: rev}
+				m.kvs[op.Key] = kv
+			}
+			kv.value, kv.modRev, kv.lease = op.Value, rev, op.Lease
+			events = append(events, Event{Type: EventPut, Key: op.Key, Value: op.Value, ModRevision: rev})
+		case OpTypeDelete:
+			for _, k := range m.matched(op.Key, op.Prefix) {
+				delete(m.kvs, k)
+				events = append(events, Event{Type: EventDelete, Key: k, ModRevision: rev})
+			}
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	m.rev = rev
+	m.history = append(m.history, events...)
+	m.notify(events)
+}
+
+func (m *MemoryBackend) notify(events []Event) {
+	alive := m.watchers[:0]
+	for _, w := range m.watchers {
+		select {
+		case <-w.done:
+			close(w.ch)
+			continue
+		default:
+		}
+		alive = append(alive, w)
+		if matched := filterEvents(events, w.prefix); len(matched) > 0 {
+			w.send(matched)
+		}
+	}
+	m.watchers = alive
+}
+
+func filterEvents(events []Event, prefix string) []Event {
+	var res []Event
+	for _, ev := range events {
+		if strings.HasPrefix(ev.Key, prefix) {
+			res = append(res, ev)
+		}
+	}
+	return res
+}
+
+// watchers are buffered, a stuck one blocks writers until its ctx is done
+func (w *memWatcher) send(events []Event) {
+	select {
+	case w.ch <- WatchResponse{Events: events}:
+	case <-w.done:
+	}
+}
+
+func (m *MemoryBackend) Get(ctx context.Context, key string) (string, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	if kv, ok := m.kvs[key]; ok {
+		return kv.value, kv.modRev, nil
+	}
+	return "", 0, nil
+}
+
+func (m *MemoryBackend) GetPrefix(ctx context.Context, prefix string) (map[string]VersionedValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	res := make(map[string]VersionedValue)
+	for _, k := range m.matched(prefix, true) {
+		kv := m.kvs[k]
+		res[k] = VersionedValue{Value: kv.value, ModRevision: kv.modRev}
+	}
+	return res, nil
+}
+
+func (m *MemoryBackend) Put(ctx context.Context, key, value string, opts ...OpOption) error {
+	_, err := m.Txn(ctx, nil, OpPut(key, value, opts...))
+	return err
+}
+
+func (m *MemoryBackend) Delete(ctx context.Context, key string, opts ...OpOption) error {
+	_, err := m.Txn(ctx, nil, OpDelete(key, opts...))
+	return err
+}
+
+func (m *MemoryBackend) Txn(ctx context.Context, cmps []Cmp, ops ...Op) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	for _, c := range cmps {
+		keys := m.matched(c.Key, c.Prefix)
+		if len(keys) == 0 && !c.holds(nil) {
+			return false, nil
+		}
+		for _, k := range keys {
+			if !c.holds(m.kvs[k]) {
+				return false, nil
+			}
+		}
+	}
+	for _, op := range ops {
+		if op.Type == OpTypePut && op.Lease != 0 {
+			if _, ok := m.leases[op.Lease]; !ok {
+				return false, ErrLeaseNotFound
+			}
+		}
+	}
+	m.apply(ops)
+	return true, nil
+}
+
+func (m *MemoryBackend) Watch(ctx context.Context, prefix string, rev int64) <-chan WatchResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := &memWatcher{prefix: prefix, ch: make(chan WatchResponse, 64), done: ctx.Done()}
+	if rev > 0 {
+		var past []Event
+		for _, ev := range m.history {
+			if ev.ModRevision >= rev {
+				past = append(past, ev)
+			}
+		}
+		if past = filterEvents(past, prefix); len(past) > 0 {
+			w.ch <- WatchResponse{Events: past}
+		}
+	}
+	m.watchers = append(m.watchers, w)
+	// closed on the next write after ctx is done, or right away if nothing is written
+	go func() {
+		<-w.done
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i, x := range m.watchers {
+			if x == w {
+				m.watchers = append(m.watchers[:i], m.watchers[i+1:]...)
+				close(w.ch)
+				break
+			}
+		}
+	}()
+	return w.ch
+}
+
+func (m *MemoryBackend) GrantLease(ctx context.Context, ttl int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextLease
+	m.nextLease++
+	// like the minimal ttl of etcd
+	if ttl < 1 {
+		ttl = 1
+	}
+	d := time.Duration(ttl) * time.Second
+	m.leases[id] = &memLease{ttl: d, expiry: time.Now().Add(d)}
+	return id, nil
+}
+
+func (m *MemoryBackend) KeepAlive(ctx context.Context, id int64) (<-chan struct{}, error) {
+	m.mu.Lock()
+	l, ok := m.leases[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			m.mu.Lock()
+			m.expire()
+			l, ok := m.leases[id]
+			if ok {
+				l.expiry = time.Now().Add(l.ttl)
+			}
+			m.mu.Unlock()
+			if !ok {
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (m *MemoryBackend) LeaseTTL(ctx context.Context, id int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	l, ok := m.leases[id]
+	if !ok {
+		return -1, nil
+	}
+	return int64(time.Until(l.expiry).Seconds()), nil
+}
+
+func (m *MemoryBackend) RevokeLease(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.leases[id]; !ok {
+		return ErrLeaseNotFound
+	}
+	m.revoke(id)
+	return nil
+}
+
+type memLeadership struct {
+	m        *MemoryBackend
+	election string
+	e        *memElection
+}
+
+func (l *memLeadership) Done() <-chan struct{} {
+	return l.e.resigned
+}
+
+func (l *memLeadership) Resign(ctx context.Context) error {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+	if l.m.elections[l.election] == l.e {
+		delete(l.m.elections, l.election)
+		close(l.e.resigned)
+	}
+	return nil
+}
+
+// Leaders never expire in memory, until they resign
+func (m *MemoryBackend) Campaign(ctx context.Context, election, name string, ttl int) (Leadership, error) {
+	for {
+		m.mu.Lock()
+		cur, ok := m.elections[election]
+		if !ok {
+			e := &memElection{leader: name, resigned: make(chan struct{})}
+			m.elections[election] = e
+			m.mu.Unlock()
+			return &memLeadership{m: m, election: election, e: e}, nil
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-cur.resigned:
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func (in *KVSpec) DeepCopyInto(out *KVSpec) {
+	*out = *in
+	if in.DeletedAt != nil {
+		out.DeletedAt = in.DeletedAt.DeepCopy()
+	}
+	if in.Intent != nil {
+		out.Intent = new(Intent)
+		*out.Intent = *in.Intent
+	}
+}
+
+func (in *IPPoolSpec) DeepCopyInto(out *IPPoolSpec) {
+	*out = *in
+	in.KVSpec.DeepCopyInto(&out.KVSpec)
+}
+
+func (in *IPBlockSpec) DeepCopyInto(out *IPBlockSpec) {
+	*out = *in
+	in.KVSpec.DeepCopyInto(&out.KVSpec)
+}
+
+func (in *IPAllocationSpec) DeepCopyInto(out *IPAllocationSpec) {
+	*out = *in
+	in.KVSpec.DeepCopyInto(&out.KVSpec)
+}
+
+func (in *IPHostSpec) DeepCopyInto(out *IPHostSpec) {
+	*out = *in
+	in.KVSpec.DeepCopyInto(&out.KVSpec)
+}
+
+func (in *IPDeviceSpec) DeepCopyInto(out *IPDeviceSpec) {
+	*out = *in
+	in.KVSpec.DeepCopyInto(&out.KVSpec)
+}
+
+func (in *IPStickySpec) DeepCopyInto(out *IPStickySpec) {
+	*out = *in
+	in.KVSpec.DeepCopyInto(&out.KVSpec)
+}
+
+func (in *IPTxnSpec) DeepCopyInto(out *IPTxnSpec) {
+	*out = *in
+	in.StartedAt.DeepCopyInto(&out.StartedAt)
+	in.Deadline.DeepCopyInto(&out.Deadline)
+	if in.Keys != nil {
+		out.Keys = make([]string, len(in.Keys))
+		copy(out.Keys, in.Keys)
+	}
+}
+
+func (in *IPPool) DeepCopyInto(out *IPPool) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+func (in *IPPool) DeepCopy() *IPPool {
+	if in == nil {
+		return nil
+	}
+	out := new(IPPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPPool) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPPoolList) DeepCopyInto(out *IPPoolList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]IPPool, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *IPPoolList) DeepCopy() *IPPoolList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPPoolList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPPoolList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPBlock) DeepCopyInto(out *IPBlock) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+func (in *IPBlock) DeepCopy() *IPBlock {
+	if in == nil {
+		return nil
+	}
+	out := new(IPBlock)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPBlock) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPBlockList) DeepCopyInto(out *IPBlockList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]IPBlock, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *IPBlockList) DeepCopy() *IPBlockList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPBlockList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPBlockList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPAllocation) DeepCopyInto(out *IPAllocation) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+func (in *IPAllocation) DeepCopy() *IPAllocation {
+	if in == nil {
+		return nil
+	}
+	out := new(IPAllocation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPAllocation) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPAllocationList) DeepCopyInto(out *IPAllocationList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]IPAllocation, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *IPAllocationList) DeepCopy() *IPAllocationList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPAllocationList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPAllocationList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPHost) DeepCopyInto(out *IPHost) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+func (in *IPHost) DeepCopy() *IPHost {
+	if in == nil {
+		return nil
+	}
+	out := new(IPHost)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPHost) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPHostList) DeepCopyInto(out *IPHostList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]IPHost, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *IPHostList) DeepCopy() *IPHostList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPHostList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPHostList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPDevice) DeepCopyInto(out *IPDevice) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+func (in *IPDevice) DeepCopy() *IPDevice {
+	if in == nil {
+		return nil
+	}
+	out := new(IPDevice)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPDevice) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPDeviceList) DeepCopyInto(out *IPDeviceList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]IPDevice, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *IPDeviceList) DeepCopy() *IPDeviceList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPDeviceList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPDeviceList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPSticky) DeepCopyInto(out *IPSticky) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+func (in *IPSticky) DeepCopy() *IPSticky {
+	if in == nil {
+		return nil
+	}
+	out := new(IPSticky)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPSticky) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPStickyList) DeepCopyInto(out *IPStickyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]IPSticky, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *IPStickyList) DeepCopy() *IPStickyList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPStickyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPStickyList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPTxn) DeepCopyInto(out *IPTxn) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+func (in *IPTxn) DeepCopy() *IPTxn {
+	if in == nil {
+		return nil
+	}
+	out := new(IPTxn)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPTxn) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+func (in *IPTxnList) DeepCopyInto(out *IPTxnList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]IPTxn, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *IPTxnList) DeepCopy() *IPTxnList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPTxnList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *IPTxnList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
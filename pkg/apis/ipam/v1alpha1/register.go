@@ -0,0 +1,20 @@
+// Package v1alpha1 holds the CRDs of the etcdmode ipam stored through the apiserver
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	GroupVersion = schema.GroupVersion{Group: "ipam.mycni.io", Version: "v1alpha1"}
+
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(&IPPool{}, &IPPoolList{}, &IPBlock{}, &IPBlockList{}, &IPAllocation{}, &IPAllocationList{},
+		&IPHost{}, &IPHostList{}, &IPDevice{}, &IPDeviceList{}, &IPSticky{}, &IPStickyList{}, &IPTxn{}, &IPTxnList{})
+}
@@ -0,0 +1,218 @@
+package v1alpha1
+
+import (
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// One key of the ipam store, common to all kinds, the value is in the typed fields of each kind.
+// Revisions are resourceVersions of the object, modRevision the one the current value was committed at.
+type KVSpec struct {
+	Key            string `json:"key"`
+	CreateRevision int64  `json:"createRevision,omitempty"`
+	ModRevision    int64  `json:"modRevision,omitempty"`
+	// id of the coordination lease the key is attached to, 0 if none
+	Lease int64 `json:"lease,omitempty"`
+	// deleted at ModRevision, kept for a while so a compare on the old key can't match a new one
+	Deleted   bool         `json:"deleted,omitempty"`
+	DeletedAt *metav1.Time `json:"deletedAt,omitempty"`
+	// write of a txn which is not applied yet, the fields above are still the committed state
+	Intent *Intent `json:"intent,omitempty"`
+}
+
+// Write of an IPTxn to one key, applied once the txn is committed, dropped if it's aborted
+type Intent struct {
+	Txn    string `json:"txn"`
+	Delete bool   `json:"delete,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Lease  int64  `json:"lease,omitempty"`
+}
+
+type IPPoolSpec struct {
+	KVSpec `json:",inline"`
+
+	Value string `json:"value,omitempty"`
+}
+
+// Free blocks & config of a pool, reservations, node leases, any key which has no typed kind
+type IPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPPoolSpec `json:"spec,omitempty"`
+}
+
+type IPPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPPool `json:"items"`
+}
+
+type IPBlockSpec struct {
+	KVSpec `json:",inline"`
+
+	Node  string `json:"node"`
+	Block string `json:"block"`
+	// claim of the block, its lease, pool & since when it's free
+	Value string `json:"value,omitempty"`
+}
+
+// Block claimed by a node, <node>/blocks/<cidr>
+type IPBlock struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPBlockSpec `json:"spec,omitempty"`
+}
+
+type IPBlockList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPBlock `json:"items"`
+}
+
+type IPAllocationSpec struct {
+	KVSpec `json:",inline"`
+
+	Block string `json:"block"`
+	IP    string `json:"ip"`
+	// container, interface, node & pod holding the ip
+	Value string `json:"value,omitempty"`
+}
+
+// Ip allocated inside a block, blocks/<cidr>/<ip>
+type IPAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPAllocationSpec `json:"spec,omitempty"`
+}
+
+type IPAllocationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPAllocation `json:"items"`
+}
+
+type IPHostSpec struct {
+	KVSpec `json:",inline"`
+
+	Node string `json:"node"`
+	// primary block of the node, key <node>
+	Block string `json:"block,omitempty"`
+	// gateway of the primary block, key <node>/gateway
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// Primary block or gateway of a node
+type IPHost struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPHostSpec `json:"spec,omitempty"`
+}
+
+type IPHostList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPHost `json:"items"`
+}
+
+type IPDeviceSpec struct {
+	KVSpec `json:",inline"`
+
+	Node string `json:"node"`
+	// <containerID>-<ifname>
+	Device  string `json:"device"`
+	Address string `json:"address,omitempty"`
+}
+
+// Ip of an interface of a container on a node, <node>/<containerID>-<ifname>
+type IPDevice struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPDeviceSpec `json:"spec,omitempty"`
+}
+
+type IPDeviceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPDevice `json:"items"`
+}
+
+type IPStickySpec struct {
+	KVSpec `json:",inline"`
+
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// ip kept for the pod, the node & when it was released
+	Value string `json:"value,omitempty"`
+}
+
+// Ip kept for a pod after it's gone, sticky/<namespace>/<name>
+type IPSticky struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPStickySpec `json:"spec,omitempty"`
+}
+
+type IPStickyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPSticky `json:"items"`
+}
+
+const (
+	TxnPending   = "pending"
+	TxnCommitted = "committed"
+	TxnAborted   = "aborted"
+)
+
+type IPTxnSpec struct {
+	// pending, committed or aborted, only pending ones change
+	State string `json:"state"`
+	// older txns win conflicts, it's kept when the txn starts over
+	StartedAt metav1.MicroTime `json:"startedAt"`
+	// still pending past it, the writer is taken as dead & the txn aborted by others
+	Deadline metav1.MicroTime `json:"deadline"`
+	// keys holding intents of the txn
+	Keys []string `json:"keys,omitempty"`
+}
+
+// Record of a txn writing several keys, the txn is committed once its state is
+type IPTxn struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPTxnSpec `json:"spec,omitempty"`
+}
+
+type IPTxnList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPTxn `json:"items"`
+}
+
+func (p *IPPool) KV() *KVSpec       { return &p.Spec.KVSpec }
+func (b *IPBlock) KV() *KVSpec      { return &b.Spec.KVSpec }
+func (a *IPAllocation) KV() *KVSpec { return &a.Spec.KVSpec }
+func (h *IPHost) KV() *KVSpec       { return &h.Spec.KVSpec }
+func (d *IPDevice) KV() *KVSpec     { return &d.Spec.KVSpec }
+func (s *IPSticky) KV() *KVSpec     { return &s.Spec.KVSpec }
+
+// Field holding the value of the key
+func (p *IPPool) Value() *string       { return &p.Spec.Value }
+func (b *IPBlock) Value() *string      { return &b.Spec.Value }
+func (a *IPAllocation) Value() *string { return &a.Spec.Value }
+func (d *IPDevice) Value() *string     { return &d.Spec.Address }
+func (s *IPSticky) Value() *string     { return &s.Spec.Value }
+
+func (h *IPHost) Value() *string {
+	if strings.HasSuffix(h.Spec.Key, "/gateway") {
+		return &h.Spec.Gateway
+	}
+	return &h.Spec.Block
+}
@@ -28,6 +28,8 @@ type PluginConf struct {
 
 	RuntimeConfig *struct {
 		Config map[string]interface{} `json:"config,omitempty"`
+		// ips capability, ips wanted by the pod
+		IPs []string `json:"ips,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
 	Args *struct {
 		A map[string]interface{} `json:"cni,omitempty"`
@@ -35,6 +37,20 @@ type PluginConf struct {
 
 	// Add plugin-specifc flags here
 	DataDir string `json:"dataDir"`
+	// static ip annotations published by the daemon
+	StaticIPDir string `json:"staticIPDir,omitempty"`
+	// cri endpoint asked by gc when cni.dev/valid-attachments is not given
+	RuntimeEndpoint string `json:"runtimeEndpoint,omitempty"`
+	// libcni cache of the runtime, a corrupted store is rebuilt from results there, default /var/lib/cni
+	CNICacheDir string `json:"cniCacheDir,omitempty"`
+}
+
+// ips in runtimeConfig, nil if not set
+func (c *PluginConf) RuntimeIPs() []string {
+	if c.RuntimeConfig == nil {
+		return nil
+	}
+	return c.RuntimeConfig.IPs
 }
 
 type CNIConf struct {
@@ -66,7 +82,8 @@ func StoreSubnetConfig(conf *SubnetConf) error {
 	return os.WriteFile(DefaultSubnetFile, data, 0644)
 }
 
-func parsePluginConfig(stdin []byte) (*PluginConf, error) {
+// 只读取stdin中的配置 不需要subnet.json
+func LoadPluginConfig(stdin []byte) (*PluginConf, error) {
 	conf := PluginConf{}
 
 	if err := json.Unmarshal(stdin, &conf); err != nil {
@@ -77,7 +94,7 @@ func parsePluginConfig(stdin []byte) (*PluginConf, error) {
 }
 
 func LoadCNIConfig(stdin []byte) (*CNIConf, error) {
-	pluginConf, err := parsePluginConfig(stdin)
+	pluginConf, err := LoadPluginConfig(stdin)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,148 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	// allocations younger than this are kept when checking against the runtime,
+	// their sandboxes may not be listed yet
+	DefaultMinAge = time.Minute
+)
+
+// Attachment of a container, as in cni.dev/valid-attachments
+type Attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+func (a Attachment) String() string {
+	return a.ContainerID + "/" + a.IfName
+}
+
+// Checker tells whether an attachment is still in use
+type Checker interface {
+	Alive(a Attachment) bool
+}
+
+type attachmentSet map[Attachment]bool
+
+func (s attachmentSet) Alive(a Attachment) bool {
+	return s[a]
+}
+
+// Checker trusting the given attachments, which are all the valid ones
+func FromAttachments(atts []Attachment) Checker {
+	s := make(attachmentSet, len(atts))
+	for _, a := range atts {
+		s[a] = true
+	}
+	return s
+}
+
+// Lister lists ids of containers(pod sandboxes) known by the runtime
+type Lister interface {
+	ListContainers(ctx context.Context) ([]string, error)
+}
+
+type containerSet map[string]bool
+
+func (s containerSet) Alive(a Attachment) bool {
+	return s[a.ContainerID]
+}
+
+// Checker with a snapshot of containers from the runtime
+func FromLister(ctx context.Context, l Lister) (Checker, error) {
+	ids, err := l.ListContainers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	s := make(containerSet, len(ids))
+	for _, id := range ids {
+		s[id] = true
+	}
+	return s, nil
+}
+
+// CrictlLister lists pod sandboxes through crictl, standing in for a CRI client
+type CrictlLister struct {
+	// like unix:///run/containerd/containerd.sock, crictl's default if empty
+	Endpoint string
+	Command  string
+}
+
+func (l *CrictlLister) ListContainers(ctx context.Context) ([]string, error) {
+	cmd := l.Command
+	if cmd == "" {
+		cmd = "crictl"
+	}
+	var args []string
+	if l.Endpoint != "" {
+		args = append(args, "--runtime-endpoint", l.Endpoint)
+	}
+	// every sandbox, including the ones not ready, ids only
+	args = append(args, "pods", "-q")
+
+	out, err := exec.CommandContext(ctx, cmd, args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Stdin of the GC verb, the network config with valid attachments
+type Conf struct {
+	// nil if not given, empty means that nothing is valid
+	ValidAttachments []Attachment `json:"cni.dev/valid-attachments"`
+}
+
+func LoadConf(stdin []byte) (*Conf, error) {
+	conf := &Conf{}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse gc configuration: %v", err)
+	}
+	return conf, nil
+}
+
+// Checker of the GC verb, valid attachments are trusted if given,
+// otherwise the runtime is asked, and allocations younger than minAge are kept
+func NewChecker(conf *Conf, l Lister) (Checker, time.Duration, error) {
+	if conf.ValidAttachments != nil {
+		return FromAttachments(conf.ValidAttachments), 0, nil
+	}
+	if l == nil {
+		return nil, 0, fmt.Errorf("neither cni.dev/valid-attachments nor runtime is given, refuse to gc")
+	}
+	checker, err := FromLister(context.TODO(), l)
+	return checker, DefaultMinAge, err
+}
+
+// Handle the GC verb of CNI 1.1, which is unknown to skel here.
+// Returns false if it's another command.
+func HandleVerb(cmdGC func(stdin []byte) error) bool {
+	if os.Getenv("CNI_COMMAND") != "GC" {
+		return false
+	}
+	stdin, err := io.ReadAll(os.Stdin)
+	if err == nil {
+		err = cmdGC(stdin)
+	}
+	if err != nil {
+		e, ok := err.(*types.Error)
+		if !ok {
+			e = types.NewError(types.ErrInternal, err.Error(), "")
+		}
+		_ = e.Print()
+		os.Exit(1)
+	}
+	return true
+}
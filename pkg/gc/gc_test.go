@@ -0,0 +1,55 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLister stands in for the container runtime
+type fakeLister struct {
+	ids []string
+	err error
+}
+
+func (l *fakeLister) ListContainers(ctx context.Context) ([]string, error) {
+	return l.ids, l.err
+}
+
+func TestNewChecker(t *testing.T) {
+	te := assert.New(t)
+	lister := &fakeLister{ids: []string{"c0"}}
+
+	conf, err := LoadConf([]byte(`{"cniVersion":"1.1.0","name":"mynet","cni.dev/valid-attachments":[{"containerID":"c1","ifname":"eth0"}]}`))
+	te.Nil(err)
+	checker, minAge, err := NewChecker(conf, lister)
+	te.Nil(err)
+	te.Zero(minAge)
+	te.True(checker.Alive(Attachment{ContainerID: "c1", IfName: "eth0"}))
+	te.False(checker.Alive(Attachment{ContainerID: "c1", IfName: "eth1"}))
+	te.False(checker.Alive(Attachment{ContainerID: "c0", IfName: "eth0"}))
+
+	// empty list, nothing is valid
+	conf, err = LoadConf([]byte(`{"name":"mynet","cni.dev/valid-attachments":[]}`))
+	te.Nil(err)
+	checker, _, err = NewChecker(conf, lister)
+	te.Nil(err)
+	te.False(checker.Alive(Attachment{ContainerID: "c0", IfName: "eth0"}))
+
+	// runtime is asked
+	conf, err = LoadConf([]byte(`{"name":"mynet"}`))
+	te.Nil(err)
+	checker, minAge, err = NewChecker(conf, lister)
+	te.Nil(err)
+	te.Equal(minAge, DefaultMinAge)
+	te.True(checker.Alive(Attachment{ContainerID: "c0", IfName: "eth0"}))
+	te.True(checker.Alive(Attachment{ContainerID: "c0", IfName: "eth1"}))
+	te.False(checker.Alive(Attachment{ContainerID: "c1", IfName: "eth0"}))
+
+	_, _, err = NewChecker(conf, &fakeLister{err: errors.New("runtime down")})
+	te.NotNil(err)
+	_, _, err = NewChecker(conf, nil)
+	te.NotNil(err)
+}
@@ -0,0 +1,83 @@
+package masq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"mycni/bpfmap"
+	"mycni/tc"
+
+	"github.com/vishvananda/netlink"
+)
+
+// first ipv4 address of the device
+func deviceIPv4(device string) (net.IP, error) {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no ipv4 address on %s", device)
+	}
+	return addrs[0].IP.To4(), nil
+}
+
+// Setup ebpf masquerade on uplink: node ip & non-masquerade cidrs are
+// written into bpf maps, then snat_egress/host_ingress are attached.
+//
+// if uplink is empty, the device holding default route is used.
+func SetupBPF(uplink string, nonMasq []*net.IPNet) (string, error) {
+	if uplink == "" {
+		dev, err := tc.GetUplinkDevice()
+		if err != nil {
+			return "", err
+		}
+		uplink = dev
+	}
+
+	nodeIP, err := deviceIPv4(uplink)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := bpfmap.CreateSNATCTMap(); err != nil {
+		return "", err
+	}
+	if _, err := bpfmap.CreateSNATFwdMap(); err != nil {
+		return "", err
+	}
+	if _, err := bpfmap.CreateNoMasqMap(); err != nil {
+		return "", err
+	}
+	if _, err := bpfmap.CreateSNATConfigMap(); err != nil {
+		return "", err
+	}
+
+	err = bpfmap.SetSNATConfigMap(bpfmap.SNATConfigValue{NodeIP: binary.BigEndian.Uint32(nodeIP)})
+	if err != nil {
+		return "", err
+	}
+	if err := bpfmap.SetNoMasqMap(nonMasq); err != nil {
+		return "", err
+	}
+
+	return tc.AttachSNAT2Uplink(uplink)
+}
+
+// Detach snat_egress & host_ingress and remove pinned snat maps, called
+// when the last pod on the node is gone, so hostIngress doesn't need
+// host_ingress any more either. The next SetupBPF starts with fresh maps.
+func TeardownBPF(uplink string) error {
+	if err := tc.DetachSNATFromUplink(uplink); err != nil {
+		return err
+	}
+	if err := tc.DetachBPFFromUplink(uplink); err != nil {
+		return err
+	}
+	return bpfmap.RemoveSNATMaps()
+}
@@ -0,0 +1,43 @@
+package masq
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// Lock file shared by all plugin processes & the node daemon on this node
+var LockPath = "/run/mycni/masq.lock"
+
+// NodeLock serializes changes of masquerade rules & uplink programs on the node,
+// so one pod's ADD(ensure rules, add pod) doesn't interleave with the last
+// pod's DEL(del pod, teardown) in another process.
+type NodeLock struct {
+	f *filemutex.FileMutex
+}
+
+// LockNode blocks until the node lock is held
+func LockNode() (*NodeLock, error) {
+	if err := os.MkdirAll(filepath.Dir(LockPath), 0755); err != nil {
+		return nil, err
+	}
+	f, err := filemutex.New(LockPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Lock(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &NodeLock{f}, nil
+}
+
+// Unlock releases the lock & closes the lock file
+func (l *NodeLock) Unlock() error {
+	if err := l.f.Unlock(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,177 @@
+package masq
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"mycni/utils"
+)
+
+// masquerade modes
+const (
+	MODE_NFTABLES = "nftables"
+	MODE_EBPF     = "ebpf"
+)
+
+// nftables objects managed by mycni
+const (
+	TableName     = "mycni"
+	ChainName     = "postrouting"
+	PodSetName    = "pods"
+	NoMasqSetName = "nomasq"
+)
+
+// Parse non-masquerade cidr list, like ["10.244.0.0/16", "192.168.0.0/16"]
+func ParseNonMasqCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, c := range cidrs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid non-masquerade cidr %q: %v", c, err)
+		}
+		if cidr.IP.To4() == nil {
+			return nil, fmt.Errorf("non-masquerade cidr %q is not ipv4", c)
+		}
+		res = append(res, cidr)
+	}
+	return res, nil
+}
+
+// Check mode in plugin/daemon config, empty means nftables
+func ValidMode(mode string) error {
+	switch mode {
+	case "", MODE_NFTABLES, MODE_EBPF:
+		return nil
+	}
+	return fmt.Errorf("unknown masquerade mode %q, should be %s or %s", mode, MODE_NFTABLES, MODE_EBPF)
+}
+
+// nft script which (re)creates masquerade rules,
+// pods whose ip is in @pods and dst not in @nomasq are masqueraded.
+func rulesScript(nonMasq []*net.IPNet) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table ip %s\n", TableName)
+	fmt.Fprintf(&b, "add chain ip %s %s { type nat hook postrouting priority 100; policy accept; }\n", TableName, ChainName)
+	fmt.Fprintf(&b, "add set ip %s %s { type ipv4_addr; }\n", TableName, PodSetName)
+	fmt.Fprintf(&b, "add set ip %s %s { type ipv4_addr; flags interval; }\n", TableName, NoMasqSetName)
+	fmt.Fprintf(&b, "flush chain ip %s %s\n", TableName, ChainName)
+	fmt.Fprintf(&b, "flush set ip %s %s\n", TableName, NoMasqSetName)
+	if len(nonMasq) > 0 {
+		var elems []string
+		for _, cidr := range nonMasq {
+			elems = append(elems, cidr.String())
+		}
+		fmt.Fprintf(&b, "add element ip %s %s { %s }\n", TableName, NoMasqSetName, strings.Join(elems, ", "))
+	}
+	fmt.Fprintf(&b, "add rule ip %s %s ip saddr @%s ip daddr != @%s masquerade\n", TableName, ChainName, PodSetName, NoMasqSetName)
+	return b.String()
+}
+
+// Parse elements from `nft list set` output, like:
+//
+//	set pods {
+//		type ipv4_addr
+//		elements = { 10.244.0.2, 10.244.0.3 }
+//	}
+func parseSetElements(out string) []string {
+	start := strings.Index(out, "elements = {")
+	if start < 0 {
+		return nil
+	}
+	rest := out[start+len("elements = {"):]
+	end := strings.Index(rest, "}")
+	if end < 0 {
+		return nil
+	}
+
+	var elems []string
+	for _, e := range strings.Split(rest[:end], ",") {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
+// run nft with script from stdin, all commands are applied atomically
+func nft(script string) (string, error) {
+	p := exec.Command("nft", "-f", "-")
+	p.Stdin = strings.NewReader(script)
+	out, err := p.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("nft failed: %v, output: %s", err, string(out))
+	}
+	return string(out), nil
+}
+
+// Create masquerade table/chain/sets if not exists, and sync the non-masquerade list
+func EnsureRules(nonMasq []*net.IPNet) error {
+	_, err := nft(rulesScript(nonMasq))
+	return err
+}
+
+// Add pod ip into masquerade set
+func AddPod(ip net.IP) error {
+	_, err := nft(fmt.Sprintf("add element ip %s %s { %s }\n", TableName, PodSetName, ip.String()))
+	return err
+}
+
+// Remove pod ip from masquerade set, nothing happens if it is not there
+func DelPod(ip net.IP) error {
+	pods, err := ListPods()
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod == ip.String() {
+			_, err = nft(fmt.Sprintf("delete element ip %s %s { %s }\n", TableName, PodSetName, pod))
+			return err
+		}
+	}
+	return nil
+}
+
+// List pod ips which are masqueraded, empty if table does not exist
+func ListPods() ([]string, error) {
+	p := exec.Command("nft", "list", "set", "ip", TableName, PodSetName)
+	out, err := p.Output()
+	if err != nil {
+		// table(or set) has been removed
+		return nil, nil
+	}
+	return parseSetElements(string(out)), nil
+}
+
+// Replace pods in masquerade set with given ips
+func SyncPods(ips []net.IP) error {
+	script := fmt.Sprintf("flush set ip %s %s\n", TableName, PodSetName)
+	if len(ips) > 0 {
+		var elems []string
+		for _, ip := range ips {
+			elems = append(elems, ip.String())
+		}
+		script += fmt.Sprintf("add element ip %s %s { %s }\n", TableName, PodSetName, strings.Join(elems, ", "))
+	}
+	_, err := nft(script)
+	return err
+}
+
+// Remove all masquerade rules
+func Teardown() error {
+	pods, err := ListPods()
+	if err != nil {
+		return err
+	}
+	utils.Log(fmt.Sprintf("Tearing down masquerade table %s, %d pods left", TableName, len(pods)))
+
+	p := exec.Command("nft", "list", "table", "ip", TableName)
+	if err := p.Run(); err != nil {
+		// already removed
+		return nil
+	}
+	_, err = nft(fmt.Sprintf("delete table ip %s\n", TableName))
+	return err
+}
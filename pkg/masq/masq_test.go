@@ -0,0 +1,109 @@
+package masq
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNonMasqCIDRs(t *testing.T) {
+	te := assert.New(t)
+
+	cidrs, err := ParseNonMasqCIDRs([]string{"10.244.0.0/16", "192.168.1.7/24"})
+	te.Nil(err)
+	te.Equal(len(cidrs), 2)
+	te.Equal(cidrs[1].String(), "192.168.1.0/24")
+
+	_, err = ParseNonMasqCIDRs([]string{"10.244.0.0"})
+	te.NotNil(err)
+
+	_, err = ParseNonMasqCIDRs([]string{"fd00::/64"})
+	te.NotNil(err)
+}
+
+func TestRulesScript(t *testing.T) {
+	te := assert.New(t)
+
+	cidrs, err := ParseNonMasqCIDRs([]string{"10.244.0.0/16", "10.96.0.0/12"})
+	te.Nil(err)
+
+	script := rulesScript(cidrs)
+	te.Contains(script, "add table ip mycni\n")
+	te.Contains(script, "add element ip mycni nomasq { 10.244.0.0/16, 10.96.0.0/12 }\n")
+	te.Contains(script, "add rule ip mycni postrouting ip saddr @pods ip daddr != @nomasq masquerade\n")
+
+	// no element line if nothing is excluded
+	te.NotContains(rulesScript(nil), "add element")
+}
+
+func TestParseSetElements(t *testing.T) {
+	te := assert.New(t)
+
+	out := `table ip mycni {
+	set pods {
+		type ipv4_addr
+		elements = { 10.244.0.2, 10.244.0.3 }
+	}
+}`
+	te.Equal(parseSetElements(out), []string{"10.244.0.2", "10.244.0.3"})
+
+	out = `table ip mycni {
+	set pods {
+		type ipv4_addr
+	}
+}`
+	te.Equal(len(parseSetElements(out)), 0)
+}
+
+func TestSeedNonMasq(t *testing.T) {
+	te := assert.New(t)
+
+	nonMasq, err := ParseNonMasqCIDRs([]string{"192.168.0.0/16", "10.244.0.0/16"})
+	te.Nil(err)
+	seeds, err := ParseNonMasqCIDRs([]string{"10.244.1.0/24", "10.244.0.0/16"})
+	te.Nil(err)
+
+	res := SeedNonMasq(nonMasq, seeds[0], seeds[1])
+	te.Equal(len(res), 3)
+	te.Equal(res[2].String(), "10.244.1.0/24")
+	// configured cidrs are not modified
+	te.Equal(len(nonMasq), 2)
+
+	// node subnet not allocated yet
+	res = SeedNonMasq(nil, nil, seeds[1])
+	te.Equal(len(res), 1)
+	te.Equal(res[0].String(), "10.244.0.0/16")
+}
+
+func TestLockNode(t *testing.T) {
+	te := assert.New(t)
+
+	LockPath = filepath.Join(t.TempDir(), "mycni", "masq.lock")
+
+	lock, err := LockNode()
+	te.Nil(err)
+
+	// another process(here another fd) waits until the lock is released
+	locked := make(chan *NodeLock)
+	go func() {
+		l, err := LockNode()
+		te.Nil(err)
+		locked <- l
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lock is held twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	te.Nil(lock.Unlock())
+	select {
+	case l := <-locked:
+		te.Nil(l.Unlock())
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock is not released")
+	}
+}
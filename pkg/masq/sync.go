@@ -0,0 +1,122 @@
+package masq
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"mycni/bpfmap"
+	"mycni/pkg/config"
+	"mycni/utils"
+)
+
+// Syncer keeps masquerade rules consistent with pods in lxc_map,
+// used by node daemon, so rules are restored after reboot or flush.
+type Syncer struct {
+	Mode    string
+	Uplink  string
+	NonMasq []*net.IPNet
+	// traffic inside the cluster keeps pod ip, like the routes given to pods
+	ClusterCIDR *net.IPNet
+}
+
+// Pod ips on current node, read from lxc_map
+func LocalPodIPs() ([]net.IP, error) {
+	eps, err := bpfmap.ListLxcMap()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for key := range eps {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, key.IP)
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Configured non-masquerade cidrs plus node subnet & cluster cidr, which are
+// also installed by the plugin, so syncing doesn't drop them.
+func SeedNonMasq(nonMasq []*net.IPNet, subnet *net.IPNet, clusterCIDR *net.IPNet) []*net.IPNet {
+	res := append([]*net.IPNet{}, nonMasq...)
+	for _, cidr := range []*net.IPNet{subnet, clusterCIDR} {
+		if cidr == nil {
+			continue
+		}
+		exists := false
+		for _, c := range res {
+			if c.String() == cidr.String() {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			res = append(res, cidr)
+		}
+	}
+	return res
+}
+
+// node subnet in subnet.json, nil if not allocated yet
+func nodeSubnet() *net.IPNet {
+	conf, err := config.LoadSubnetConfig()
+	if err != nil {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(conf.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil
+	}
+	return subnet
+}
+
+// Sync once, rules are removed when there is no pod on this node
+func (s *Syncer) Sync() error {
+	lock, err := LockNode()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	ips, err := LocalPodIPs()
+	if err != nil {
+		return err
+	}
+	nonMasq := SeedNonMasq(s.NonMasq, nodeSubnet(), s.ClusterCIDR)
+
+	if s.Mode == MODE_EBPF {
+		if len(ips) == 0 {
+			return TeardownBPF(s.Uplink)
+		}
+		_, err := SetupBPF(s.Uplink, nonMasq)
+		return err
+	}
+
+	if len(ips) == 0 {
+		return Teardown()
+	}
+	if err := EnsureRules(nonMasq); err != nil {
+		return err
+	}
+	return SyncPods(ips)
+}
+
+// Run sync on interval until ctx is done
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sync(); err != nil {
+			utils.Log("Sync masquerade rules failed: " + err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package podinfo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"mycni/utils"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	resyncPeriod = 5 * time.Minute
+)
+
+// MetaController publishes labels & annotations of pods on this node,
+// their namespaces & the node into the store
+type MetaController struct {
+	nodeName string
+	store    *MetaStore
+	factory  informers.SharedInformerFactory
+
+	pods       corelisters.PodLister
+	namespaces corelisters.NamespaceLister
+	nodes      corelisters.NodeLister
+	synced     []cache.InformerSynced
+
+	// pending sync, events are squashed
+	trigger chan struct{}
+}
+
+func NewMetaController(client kubernetes.Interface, nodeName string, store *MetaStore) *MetaController {
+	factory := informers.NewSharedInformerFactory(client, resyncPeriod)
+	podInformer := factory.Core().V1().Pods()
+	nsInformer := factory.Core().V1().Namespaces()
+	nodeInformer := factory.Core().V1().Nodes()
+
+	c := &MetaController{
+		nodeName:   nodeName,
+		store:      store,
+		factory:    factory,
+		pods:       podInformer.Lister(),
+		namespaces: nsInformer.Lister(),
+		nodes:      nodeInformer.Lister(),
+		synced: []cache.InformerSynced{
+			podInformer.Informer().HasSynced,
+			nsInformer.Informer().HasSynced,
+			nodeInformer.Informer().HasSynced,
+		},
+		trigger: make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue() },
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+		DeleteFunc: func(obj interface{}) { c.enqueue() },
+	}
+	podInformer.Informer().AddEventHandler(handler)
+	nsInformer.Informer().AddEventHandler(handler)
+	nodeInformer.Informer().AddEventHandler(handler)
+	return c
+}
+
+func (c *MetaController) enqueue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Write metadata of pods on this node, and remove the ones of pods gone
+func (c *MetaController) Sync() error {
+	pods, err := c.pods.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	node, err := c.nodes.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("cannot get node %s: %w", c.nodeName, err)
+	}
+
+	wanted := make(map[string]bool)
+	for _, pod := range pods {
+		if pod.Spec.NodeName != c.nodeName {
+			continue
+		}
+		ns, err := c.namespaces.Get(pod.Namespace)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		meta := &Meta{
+			Namespace:       pod.Namespace,
+			Labels:          pod.Labels,
+			Annotations:     pod.Annotations,
+			NamespaceLabels: ns.Labels,
+			NodeLabels:      node.Labels,
+		}
+		if err := c.store.Write(pod.Namespace, pod.Name, meta); err != nil {
+			return err
+		}
+		wanted[pod.Namespace+"/"+pod.Name] = true
+	}
+
+	stored, err := c.store.List()
+	if err != nil {
+		return err
+	}
+	for _, key := range stored {
+		if wanted[key] {
+			continue
+		}
+		ns, name, _ := cache.SplitMetaNamespaceKey(key)
+		if err := c.store.Delete(ns, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run controller until ctx is done
+func (c *MetaController) Run(ctx context.Context) error {
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		return fmt.Errorf("failed to wait for pod caches to sync")
+	}
+
+	c.enqueue()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.trigger:
+			if err := c.Sync(); err != nil {
+				utils.Log("Sync pod metadata failed: " + err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package podinfo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPod(name, node string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: name, Labels: labels},
+		Spec:       corev1.PodSpec{NodeName: node},
+	}
+}
+
+func TestMetaControllerSync(t *testing.T) {
+	te := assert.New(t)
+	store := NewMetaStore(t.TempDir())
+
+	client := fake.NewSimpleClientset(
+		newPod("db-0", "node1", map[string]string{"tier": "db"}),
+		newPod("db-1", "node2", map[string]string{"tier": "db"}),
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"compliance": "pci"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"zone": "a"}}},
+	)
+	c := NewMetaController(client, "node1", store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	// only pods of this node
+	te.Eventually(func() bool {
+		pods, _ := store.List()
+		return len(pods) == 1 && pods[0] == "payments/db-0"
+	}, 5*time.Second, 10*time.Millisecond)
+	meta, err := store.Read("payments", "db-0")
+	te.Nil(err)
+	te.Equal(meta, &Meta{
+		Namespace:       "payments",
+		Labels:          map[string]string{"tier": "db"},
+		NamespaceLabels: map[string]string{"compliance": "pci"},
+		NodeLabels:      map[string]string{"zone": "a"},
+	})
+
+	// labels of the node are followed
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"zone": "b"}}}
+	_, err = client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	te.Nil(err)
+	te.Eventually(func() bool {
+		meta, _ := store.Read("payments", "db-0")
+		return meta != nil && meta.NodeLabels["zone"] == "b"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = client.CoreV1().Pods("payments").Delete(ctx, "db-0", metav1.DeleteOptions{})
+	te.Nil(err)
+	te.Eventually(func() bool {
+		pods, _ := store.List()
+		return len(pods) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// not published
+	meta, err = store.Read("payments", "db-1")
+	te.Nil(err)
+	te.Nil(meta)
+}
@@ -0,0 +1,54 @@
+package podinfo
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// pool wanted by the pod, among the ones its selectors allow
+	AnnotationPool = "mycni.io/ip-pool"
+)
+
+// Labels & annotations of a pod, its namespace & node, which ip pools are selected by
+type Meta struct {
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	NamespaceLabels map[string]string `json:"namespaceLabels,omitempty"`
+	NodeLabels      map[string]string `json:"nodeLabels,omitempty"`
+}
+
+// Look up the pod, its namespace & node through the apiserver
+func LookupMeta(ctx context.Context, c client.Client, pod *Pod) (*Meta, error) {
+	p := &corev1.Pod{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: pod.Name}, p); err != nil {
+		return nil, fmt.Errorf("cannot get pod %s: %w", pod, err)
+	}
+	ns := &corev1.Namespace{}
+	if err := c.Get(ctx, client.ObjectKey{Name: pod.Namespace}, ns); err != nil {
+		return nil, fmt.Errorf("cannot get namespace %s: %w", pod.Namespace, err)
+	}
+
+	// kubelet sets up the sandbox only after the pod is bound
+	nodeName := p.Spec.NodeName
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	node := &corev1.Node{}
+	if err := c.Get(ctx, client.ObjectKey{Name: nodeName}, node); err != nil {
+		return nil, fmt.Errorf("cannot get node %s: %w", nodeName, err)
+	}
+
+	return &Meta{
+		Namespace:       pod.Namespace,
+		Labels:          p.Labels,
+		Annotations:     p.Annotations,
+		NamespaceLabels: ns.Labels,
+		NodeLabels:      node.Labels,
+	}, nil
+}
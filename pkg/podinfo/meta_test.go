@@ -0,0 +1,39 @@
+package podinfo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"mycni/pkg/testutils"
+)
+
+func TestLookupMeta(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	c := testutils.NewFakeKubeClient(t,
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "db-0",
+				Labels: map[string]string{"tier": "db"}, Annotations: map[string]string{AnnotationPool: "pci"}},
+			Spec: corev1.PodSpec{NodeName: "node1"},
+		},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"compliance": "pci"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"zone": "a"}}},
+	)
+
+	meta, err := LookupMeta(ctx, c, &Pod{Namespace: "payments", Name: "db-0"})
+	te.Nil(err)
+	te.Equal(meta, &Meta{
+		Namespace:       "payments",
+		Labels:          map[string]string{"tier": "db"},
+		Annotations:     map[string]string{AnnotationPool: "pci"},
+		NamespaceLabels: map[string]string{"compliance": "pci"},
+		NodeLabels:      map[string]string{"zone": "a"},
+	})
+
+	_, err = LookupMeta(ctx, c, &Pod{Namespace: "payments", Name: "db-1"})
+	te.NotNil(err)
+}
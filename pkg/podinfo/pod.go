@@ -0,0 +1,65 @@
+package podinfo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Pod owning an allocation, recorded by ipam next to containerID & ifname
+type Pod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+}
+
+// Args in CNI_ARGS passed by kubelet, like "K8S_POD_NAMESPACE=default;K8S_POD_NAME=db-0;K8S_POD_UID=..."
+type Args struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+	K8S_POD_UID       types.UnmarshallableString
+}
+
+// Pod in CNI_ARGS, nil if the plugin is not called for a k8s pod
+func FromArgs(envArgs string) (*Pod, error) {
+	args := &Args{}
+	args.IgnoreUnknown = true
+	if err := types.LoadArgs(envArgs, args); err != nil {
+		return nil, err
+	}
+	if args.K8S_POD_NAMESPACE == "" || args.K8S_POD_NAME == "" {
+		return nil, nil
+	}
+	return &Pod{
+		Namespace: string(args.K8S_POD_NAMESPACE),
+		Name:      string(args.K8S_POD_NAME),
+		UID:       string(args.K8S_POD_UID),
+	}, nil
+}
+
+// namespace/name
+func (p *Pod) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.Namespace + "/" + p.Name
+}
+
+// Whether p is the pod namespace/name, false if p is nil
+func (p *Pod) Is(namespace, name string) bool {
+	return p != nil && p.Namespace == namespace && p.Name == name
+}
+
+// Split "namespace/name", namespace is "default" if omitted
+func ParseName(s string) (string, string, error) {
+	parts := strings.Split(s, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return "default", parts[0], nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("invalid pod %q, want namespace/name", s)
+}
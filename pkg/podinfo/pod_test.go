@@ -0,0 +1,37 @@
+package podinfo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromArgs(t *testing.T) {
+	te := assert.New(t)
+
+	pod, err := FromArgs("IgnoreUnknown=1;K8S_POD_NAMESPACE=kube-system;K8S_POD_NAME=coredns-c676cc86f-4kz2t;K8S_POD_UID=d392609d;K8S_POD_INFRA_CONTAINER_ID=308102901b7f")
+	te.Nil(err)
+	te.Equal(*pod, Pod{Namespace: "kube-system", Name: "coredns-c676cc86f-4kz2t", UID: "d392609d"})
+	te.Equal(pod.String(), "kube-system/coredns-c676cc86f-4kz2t")
+	te.True(pod.Is("kube-system", "coredns-c676cc86f-4kz2t"))
+	te.False(pod.Is("default", "coredns-c676cc86f-4kz2t"))
+
+	pod, err = FromArgs("K8S_POD_NAME=db-0")
+	te.Nil(err)
+	te.Nil(pod)
+	te.False(pod.Is("", "db-0"))
+	pod, err = FromArgs("")
+	te.Nil(err)
+	te.Nil(pod)
+
+	ns, name, err := ParseName("db-0")
+	te.Nil(err)
+	te.Equal([]string{ns, name}, []string{"default", "db-0"})
+	ns, name, err = ParseName("kube-system/coredns")
+	te.Nil(err)
+	te.Equal([]string{ns, name}, []string{"kube-system", "coredns"})
+	for _, s := range []string{"", "a/", "/b", "a/b/c"} {
+		_, _, err = ParseName(s)
+		te.NotNil(err)
+	}
+}
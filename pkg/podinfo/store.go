@@ -0,0 +1,91 @@
+package podinfo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultMetaDir = "/run/mycni/pod-meta"
+)
+
+// MetaStore keeps metadata of pods on this node, one file per pod, written by
+// the daemon so ipam plugins can select pools by labels without the apiserver.
+type MetaStore struct {
+	Dir string
+}
+
+func NewMetaStore(dir string) *MetaStore {
+	if dir == "" {
+		dir = DefaultMetaDir
+	}
+	return &MetaStore{Dir: dir}
+}
+
+// like: /run/mycni/pod-meta/default_db-0
+func (s *MetaStore) path(namespace, name string) string {
+	return filepath.Join(s.Dir, namespace+"_"+name)
+}
+
+// Metadata of the pod, nil if not published
+func (s *MetaStore) Read(namespace, name string) (*Meta, error) {
+	raw, err := os.ReadFile(s.path(namespace, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	meta := &Meta{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *MetaStore) Write(namespace, name string, meta *Meta) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// rename is atomic, plugins never read a half written file
+	tmp := s.path(namespace, name) + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(namespace, name))
+}
+
+func (s *MetaStore) Delete(namespace, name string) error {
+	err := os.Remove(s.path(namespace, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Pods with metadata stored, as namespace/name
+func (s *MetaStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var pods []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		if i := strings.Index(e.Name(), "_"); i > 0 {
+			pods = append(pods, e.Name()[:i]+"/"+e.Name()[i+1:])
+		}
+	}
+	return pods, nil
+}
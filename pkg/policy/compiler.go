@@ -0,0 +1,362 @@
+package policy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"mycni/bpfmap"
+	"mycni/utils"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// port ranges(endPort) wider than this are not expanded
+	MaxPortRange = 256
+)
+
+// Compiled policy state of endpoints on current node, ready to be written into bpf maps
+type Compiled struct {
+	Endpoints map[bpfmap.EndpointMapKey]bpfmap.PolicyEndpointValue
+	Rules     map[bpfmap.PolicyKey]bpfmap.PolicyValue
+}
+
+// peer cidr with its action, except of ipBlock are denied
+type peer struct {
+	cidr   *net.IPNet
+	action uint32
+}
+
+type port struct {
+	proto uint8
+	port  uint16
+}
+
+var anyPeer = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+
+func protoNumber(p *corev1.Protocol) uint8 {
+	if p == nil {
+		return 6
+	}
+	switch *p {
+	case corev1.ProtocolUDP:
+		return 17
+	case corev1.ProtocolSCTP:
+		return 132
+	}
+	return 6
+}
+
+func podIPv4(pod *corev1.Pod) net.IP {
+	if pod.Spec.HostNetwork || pod.Status.PodIP == "" {
+		return nil
+	}
+	return net.ParseIP(pod.Status.PodIP).To4()
+}
+
+// Resolve named port against container ports of the pod
+func namedPort(pod *corev1.Pod, name string, proto uint8) (uint16, bool) {
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == name && protoNumber(&p.Protocol) == proto {
+				return uint16(p.ContainerPort), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// compiler turns NetworkPolicy, Pod & Namespace objects into policy map entries
+type compiler struct {
+	nodeName   string
+	pods       []*corev1.Pod
+	namespaces map[string]labels.Set
+	out        *Compiled
+	// rules that produced each entry, to resolve excepts across rules
+	owners map[bpfmap.PolicyKey]map[int]bool
+	rule   int
+}
+
+// Compile policies for endpoints on given node
+func Compile(nodeName string, pods []*corev1.Pod, namespaces []*corev1.Namespace, policies []*networkingv1.NetworkPolicy) *Compiled {
+	c := &compiler{
+		nodeName:   nodeName,
+		pods:       pods,
+		namespaces: make(map[string]labels.Set),
+		out: &Compiled{
+			Endpoints: make(map[bpfmap.EndpointMapKey]bpfmap.PolicyEndpointValue),
+			Rules:     make(map[bpfmap.PolicyKey]bpfmap.PolicyValue),
+		},
+		owners: make(map[bpfmap.PolicyKey]map[int]bool),
+	}
+	for _, ns := range namespaces {
+		c.namespaces[ns.Name] = labels.Set(ns.Labels)
+	}
+
+	for _, pol := range policies {
+		if err := c.compilePolicy(pol); err != nil {
+			utils.Log(fmt.Sprintf("Skip networkpolicy %s/%s: %v", pol.Namespace, pol.Name, err))
+		}
+	}
+	c.resolveExcepts()
+	return c.out
+}
+
+func policyTypes(pol *networkingv1.NetworkPolicy) []networkingv1.PolicyType {
+	if len(pol.Spec.PolicyTypes) > 0 {
+		return pol.Spec.PolicyTypes
+	}
+	types := []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+	if len(pol.Spec.Egress) > 0 {
+		types = append(types, networkingv1.PolicyTypeEgress)
+	}
+	return types
+}
+
+func (c *compiler) compilePolicy(pol *networkingv1.NetworkPolicy) error {
+	sel, err := metav1.LabelSelectorAsSelector(&pol.Spec.PodSelector)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range c.pods {
+		if pod.Spec.NodeName != c.nodeName || pod.Namespace != pol.Namespace {
+			continue
+		}
+		ip := podIPv4(pod)
+		if ip == nil || !sel.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+
+		epKey := bpfmap.EndpointMapKey{IP: binary.BigEndian.Uint32(ip)}
+		ep := c.out.Endpoints[epKey]
+		for _, t := range policyTypes(pol) {
+			switch t {
+			case networkingv1.PolicyTypeIngress:
+				ep.Ingress = 1
+				for _, rule := range pol.Spec.Ingress {
+					c.rule++
+					peers, err := c.peers(rule.From, pol.Namespace)
+					if err != nil {
+						return err
+					}
+					c.addRules(pod, ip, bpfmap.POLICY_INGRESS, peers, rule.Ports)
+				}
+			case networkingv1.PolicyTypeEgress:
+				ep.Egress = 1
+				for _, rule := range pol.Spec.Egress {
+					c.rule++
+					peers, err := c.peers(rule.To, pol.Namespace)
+					if err != nil {
+						return err
+					}
+					c.addRules(pod, ip, bpfmap.POLICY_EGRESS, peers, rule.Ports)
+				}
+			}
+		}
+		c.out.Endpoints[epKey] = ep
+	}
+	return nil
+}
+
+// Resolve peers of a rule into cidrs, empty peers means everything
+func (c *compiler) peers(from []networkingv1.NetworkPolicyPeer, namespace string) ([]peer, error) {
+	if len(from) == 0 {
+		return []peer{{cidr: anyPeer, action: bpfmap.POLICY_ALLOW}}, nil
+	}
+
+	var res []peer
+	for _, p := range from {
+		if p.IPBlock != nil {
+			_, cidr, err := net.ParseCIDR(p.IPBlock.CIDR)
+			if err != nil {
+				return nil, err
+			}
+			if cidr.IP.To4() == nil {
+				continue
+			}
+			res = append(res, peer{cidr: cidr, action: bpfmap.POLICY_ALLOW})
+			for _, e := range p.IPBlock.Except {
+				_, except, err := net.ParseCIDR(e)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, peer{cidr: except, action: bpfmap.POLICY_DENY})
+			}
+			continue
+		}
+
+		podSel := labels.Everything()
+		if p.PodSelector != nil {
+			sel, err := metav1.LabelSelectorAsSelector(p.PodSelector)
+			if err != nil {
+				return nil, err
+			}
+			podSel = sel
+		}
+		var nsSel labels.Selector
+		if p.NamespaceSelector != nil {
+			sel, err := metav1.LabelSelectorAsSelector(p.NamespaceSelector)
+			if err != nil {
+				return nil, err
+			}
+			nsSel = sel
+		}
+
+		for _, pod := range c.pods {
+			if nsSel == nil {
+				if pod.Namespace != namespace {
+					continue
+				}
+			} else if !nsSel.Matches(c.namespaces[pod.Namespace]) {
+				continue
+			}
+			ip := podIPv4(pod)
+			if ip == nil || !podSel.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+			res = append(res, peer{
+				cidr:   &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)},
+				action: bpfmap.POLICY_ALLOW,
+			})
+		}
+	}
+	return res, nil
+}
+
+// Resolve ports of a rule, empty ports means all ports of all protocols
+func (c *compiler) ports(pod *corev1.Pod, direction uint8, ports []networkingv1.NetworkPolicyPort) []port {
+	if len(ports) == 0 {
+		return []port{{}}
+	}
+
+	var res []port
+	for _, p := range ports {
+		proto := protoNumber(p.Protocol)
+		if p.Port == nil {
+			res = append(res, port{proto: proto})
+			continue
+		}
+
+		if p.Port.Type == intstr.String {
+			// named ports can only be resolved on the endpoint itself
+			if direction != bpfmap.POLICY_INGRESS {
+				utils.Log("Named port " + p.Port.StrVal + " in egress rule is not supported")
+				continue
+			}
+			num, ok := namedPort(pod, p.Port.StrVal, proto)
+			if ok {
+				res = append(res, port{proto: proto, port: num})
+			}
+			continue
+		}
+
+		start := int(p.Port.IntVal)
+		end := start
+		if p.EndPort != nil && int(*p.EndPort) > start {
+			end = int(*p.EndPort)
+		}
+		if end-start >= MaxPortRange {
+			utils.Log(fmt.Sprintf("Port range %d-%d is too wide, skipped", start, end))
+			continue
+		}
+		for num := start; num <= end; num++ {
+			res = append(res, port{proto: proto, port: uint16(num)})
+		}
+	}
+	return res
+}
+
+func (c *compiler) addRules(pod *corev1.Pod, ip net.IP, direction uint8, peers []peer, ports []networkingv1.NetworkPolicyPort) {
+	for _, pt := range c.ports(pod, direction, ports) {
+		for _, p := range peers {
+			key := bpfmap.NewPolicyKey(ip, direction, pt.proto, pt.port, p.cidr)
+			if c.owners[key] == nil {
+				c.owners[key] = make(map[int]bool)
+			}
+			c.owners[key][c.rule] = true
+			// rules are additive, allow wins over except of another rule
+			if old, ok := c.out.Rules[key]; ok && old.Action == bpfmap.POLICY_ALLOW {
+				continue
+			}
+			c.out.Rules[key] = bpfmap.PolicyValue{Action: p.action}
+		}
+	}
+}
+
+// An except only denies peers of its own rule. The LPM trie returns the longest prefix,
+// so an except would also hide a wider allow of another rule at the same port level;
+// drop such excepts. Allows of less specific port levels are handled by the lookup.
+func (c *compiler) resolveExcepts() {
+	for key, val := range c.out.Rules {
+		if val.Action != bpfmap.POLICY_DENY {
+			continue
+		}
+		for other, oval := range c.out.Rules {
+			if oval.Action != bpfmap.POLICY_ALLOW || !sameLevel(key, other) || !covers(other, key) {
+				continue
+			}
+			if otherRule(c.owners[other], c.owners[key]) {
+				delete(c.out.Rules, key)
+				break
+			}
+		}
+	}
+}
+
+func sameLevel(a, b bpfmap.PolicyKey) bool {
+	return a.EpIP == b.EpIP && a.Direction == b.Direction && a.Proto == b.Proto && a.Port == b.Port
+}
+
+// Peer cidr of a contains peer cidr of b
+func covers(a, b bpfmap.PolicyKey) bool {
+	if a.PrefixLen > b.PrefixLen {
+		return false
+	}
+	mask := net.CIDRMask(int(a.PrefixLen-bpfmap.POLICY_KEY_FIXED_BITS), 32)
+	return net.IP(a.PeerIP[:]).Mask(mask).Equal(net.IP(b.PeerIP[:]).Mask(mask))
+}
+
+// Some rule of allow didn't produce the except
+func otherRule(allow, except map[int]bool) bool {
+	for r := range allow {
+		if !except[r] {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup the action for endpoint like policy_lookup in ebpf/policy.h does,
+// the peer is matched by longest prefix at each port level.
+func (c *Compiled) Lookup(ep net.IP, direction uint8, peer net.IP, proto uint8, port uint16) uint32 {
+	levels := []bpfmap.PolicyKey{
+		{Proto: proto, Port: port},
+		{Proto: proto},
+		{},
+	}
+	peerKey := bpfmap.NewPolicyKey(ep, direction, 0, 0, &net.IPNet{IP: peer.To4(), Mask: net.CIDRMask(32, 32)})
+	for _, level := range levels {
+		level.EpIP = peerKey.EpIP
+		level.Direction = direction
+		var best *bpfmap.PolicyKey
+		for key := range c.Rules {
+			key := key
+			if !sameLevel(key, level) || !covers(key, peerKey) {
+				continue
+			}
+			if best == nil || key.PrefixLen > best.PrefixLen {
+				best = &key
+			}
+		}
+		if best != nil && c.Rules[*best].Action == bpfmap.POLICY_ALLOW {
+			return bpfmap.POLICY_ALLOW
+		}
+	}
+	return bpfmap.POLICY_DENY
+}
@@ -0,0 +1,216 @@
+package policy
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"mycni/bpfmap"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func newPod(ns, name, node, ip string, lbs map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: lbs},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{PodIP: ip},
+	}
+}
+
+func newNamespace(name string, lbs map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: lbs}}
+}
+
+func cidr(s string) *net.IPNet {
+	_, c, _ := net.ParseCIDR(s)
+	return c
+}
+
+func epKey(ip string) bpfmap.EndpointMapKey {
+	return bpfmap.EndpointMapKey{IP: binary.BigEndian.Uint32(net.ParseIP(ip).To4())}
+}
+
+func TestCompileIngress(t *testing.T) {
+	te := assert.New(t)
+
+	tcp := corev1.ProtocolTCP
+	pods := []*corev1.Pod{
+		newPod("default", "db", "master", "10.1.1.2", map[string]string{"app": "db"}),
+		newPod("default", "web", "worker1", "10.1.2.2", map[string]string{"app": "web"}),
+		newPod("monitor", "prom", "worker1", "10.1.2.3", map[string]string{"app": "prom"}),
+		// db on the other node is not compiled here
+		newPod("default", "db-1", "worker1", "10.1.2.4", map[string]string{"app": "db"}),
+	}
+	namespaces := []*corev1.Namespace{
+		newNamespace("default", nil),
+		newNamespace("monitor", map[string]string{"team": "ops"}),
+	}
+	policies := []*networkingv1.NetworkPolicy{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+					{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "ops"}}},
+					{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.0.0/16", Except: []string{"192.168.1.0/24"}}},
+				},
+				Ports: []networkingv1.NetworkPolicyPort{
+					{Protocol: &tcp, Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 5432}},
+				},
+			}},
+		},
+	}}
+
+	res := Compile("master", pods, namespaces, policies)
+	te.Equal(res.Endpoints, map[bpfmap.EndpointMapKey]bpfmap.PolicyEndpointValue{
+		epKey("10.1.1.2"): {Ingress: 1},
+	})
+
+	db := net.ParseIP("10.1.1.2")
+	te.Equal(res.Rules, map[bpfmap.PolicyKey]bpfmap.PolicyValue{
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 6, 5432, cidr("10.1.2.2/32")):    {Action: bpfmap.POLICY_ALLOW},
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 6, 5432, cidr("10.1.2.3/32")):    {Action: bpfmap.POLICY_ALLOW},
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 6, 5432, cidr("192.168.0.0/16")): {Action: bpfmap.POLICY_ALLOW},
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 6, 5432, cidr("192.168.1.0/24")): {Action: bpfmap.POLICY_DENY},
+	})
+}
+
+func TestCompileDefaultDenyAndEgress(t *testing.T) {
+	te := assert.New(t)
+
+	pods := []*corev1.Pod{
+		newPod("default", "web", "master", "10.1.1.2", map[string]string{"app": "web"}),
+	}
+	policies := []*networkingv1.NetworkPolicy{
+		{
+			// deny all ingress of namespace
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deny"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			},
+		},
+		{
+			// allow dns only
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns"},
+			Spec: networkingv1.NetworkPolicySpec{
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 53}},
+					},
+				}},
+			},
+		},
+	}
+
+	res := Compile("master", pods, nil, policies)
+	te.Equal(res.Endpoints[epKey("10.1.1.2")], bpfmap.PolicyEndpointValue{Ingress: 1, Egress: 1})
+
+	web := net.ParseIP("10.1.1.2")
+	te.Equal(res.Rules, map[bpfmap.PolicyKey]bpfmap.PolicyValue{
+		bpfmap.NewPolicyKey(web, bpfmap.POLICY_EGRESS, 6, 53, cidr("0.0.0.0/0")): {Action: bpfmap.POLICY_ALLOW},
+	})
+}
+
+func TestCompileNamedPortAndRange(t *testing.T) {
+	te := assert.New(t)
+
+	endPort := int32(8082)
+	pod := newPod("default", "web", "master", "10.1.1.2", map[string]string{"app": "web"})
+	pod.Spec.Containers = []corev1.Container{{
+		Name:  "web",
+		Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP}},
+	}}
+	policies := []*networkingv1.NetworkPolicy{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: networkingv1.NetworkPolicySpec{
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				Ports: []networkingv1.NetworkPolicyPort{
+					{Port: &intstr.IntOrString{Type: intstr.String, StrVal: "http"}},
+					{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 8081}, EndPort: &endPort},
+				},
+			}},
+		},
+	}}
+
+	res := Compile("master", []*corev1.Pod{pod}, nil, policies)
+	web := net.ParseIP("10.1.1.2")
+	te.Equal(len(res.Rules), 3)
+	for _, port := range []uint16{8080, 8081, 8082} {
+		_, ok := res.Rules[bpfmap.NewPolicyKey(web, bpfmap.POLICY_INGRESS, 6, port, cidr("0.0.0.0/0"))]
+		te.True(ok)
+	}
+}
+
+func TestCompileExceptWithAllowOfOtherRule(t *testing.T) {
+	te := assert.New(t)
+
+	tcp := corev1.ProtocolTCP
+	pods := []*corev1.Pod{newPod("default", "db", "master", "10.1.1.2", map[string]string{"app": "db"})}
+	http := []networkingv1.NetworkPolicyPort{
+		{Protocol: &tcp, Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 80}},
+	}
+	policies := []*networkingv1.NetworkPolicy{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "http"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{
+					{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.0.0/16", Except: []string{"192.168.1.0/24"}}},
+				},
+				Ports: http,
+			}, {
+				// same level, wider allow
+				From: []networkingv1.NetworkPolicyPeer{
+					{IPBlock: &networkingv1.IPBlock{CIDR: "172.16.0.0/12", Except: []string{"172.16.1.0/24"}}},
+				},
+				Ports: http,
+			}, {
+				From:  []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "172.16.0.0/16"}}},
+				Ports: http,
+			}},
+		},
+	}, {
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "all-ports"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.1.0/28"}}},
+			}},
+		},
+	}}
+
+	res := Compile("master", pods, nil, policies)
+	db := net.ParseIP("10.1.1.2")
+	te.Equal(res.Rules, map[bpfmap.PolicyKey]bpfmap.PolicyValue{
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 6, 80, cidr("192.168.0.0/16")): {Action: bpfmap.POLICY_ALLOW},
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 6, 80, cidr("192.168.1.0/24")): {Action: bpfmap.POLICY_DENY},
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 6, 80, cidr("172.16.0.0/12")):  {Action: bpfmap.POLICY_ALLOW},
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 6, 80, cidr("172.16.0.0/16")):  {Action: bpfmap.POLICY_ALLOW},
+		bpfmap.NewPolicyKey(db, bpfmap.POLICY_INGRESS, 0, 0, cidr("192.168.1.0/28")):  {Action: bpfmap.POLICY_ALLOW},
+	})
+
+	for _, c := range []struct {
+		peer   string
+		port   uint16
+		action uint32
+	}{
+		{"192.168.2.1", 80, bpfmap.POLICY_ALLOW},
+		{"192.168.1.20", 80, bpfmap.POLICY_DENY},
+		// except of port 80 doesn't hide the all-ports allow of the other policy
+		{"192.168.1.1", 80, bpfmap.POLICY_ALLOW},
+		{"192.168.1.1", 443, bpfmap.POLICY_ALLOW},
+		{"192.168.2.1", 443, bpfmap.POLICY_DENY},
+		// except dropped since another rule allows the whole /16
+		{"172.16.1.1", 80, bpfmap.POLICY_ALLOW},
+		{"172.17.0.1", 80, bpfmap.POLICY_ALLOW},
+		{"10.0.0.1", 80, bpfmap.POLICY_DENY},
+	} {
+		te.Equal(res.Lookup(db, bpfmap.POLICY_INGRESS, net.ParseIP(c.peer), 6, c.port), c.action, c.peer)
+	}
+}
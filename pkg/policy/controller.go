@@ -0,0 +1,136 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"mycni/bpfmap"
+	"mycni/utils"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	resyncPeriod = 5 * time.Minute
+)
+
+// Writer applies compiled policies to the datapath
+type Writer interface {
+	Apply(c *Compiled) error
+}
+
+// BPFWriter writes compiled policies into pinned bpf maps
+type BPFWriter struct{}
+
+func (BPFWriter) Apply(c *Compiled) error {
+	if _, err := bpfmap.CreatePolicyMap(); err != nil {
+		return err
+	}
+	if _, err := bpfmap.CreatePolicyEndpointMap(); err != nil {
+		return err
+	}
+	if _, err := bpfmap.CreatePolicyCTMap(); err != nil {
+		return err
+	}
+	return bpfmap.SyncPolicyMaps(c.Endpoints, c.Rules)
+}
+
+// Controller watches NetworkPolicy, Pod & Namespace objects,
+// and recompiles policy maps of current node whenever any of them changes.
+type Controller struct {
+	nodeName string
+	writer   Writer
+	factory  informers.SharedInformerFactory
+
+	pods       corelisters.PodLister
+	namespaces corelisters.NamespaceLister
+	policies   networkinglisters.NetworkPolicyLister
+	synced     []cache.InformerSynced
+
+	// pending recompile, events are squashed
+	trigger chan struct{}
+}
+
+func NewController(client kubernetes.Interface, nodeName string, writer Writer) *Controller {
+	factory := informers.NewSharedInformerFactory(client, resyncPeriod)
+	podInformer := factory.Core().V1().Pods()
+	nsInformer := factory.Core().V1().Namespaces()
+	policyInformer := factory.Networking().V1().NetworkPolicies()
+
+	c := &Controller{
+		nodeName:   nodeName,
+		writer:     writer,
+		factory:    factory,
+		pods:       podInformer.Lister(),
+		namespaces: nsInformer.Lister(),
+		policies:   policyInformer.Lister(),
+		synced: []cache.InformerSynced{
+			podInformer.Informer().HasSynced,
+			nsInformer.Informer().HasSynced,
+			policyInformer.Informer().HasSynced,
+		},
+		trigger: make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue() },
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+		DeleteFunc: func(obj interface{}) { c.enqueue() },
+	}
+	podInformer.Informer().AddEventHandler(handler)
+	nsInformer.Informer().AddEventHandler(handler)
+	policyInformer.Informer().AddEventHandler(handler)
+	return c
+}
+
+func (c *Controller) enqueue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Compile with objects in informer caches and write the result
+func (c *Controller) Sync() error {
+	pods, err := c.pods.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	namespaces, err := c.namespaces.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	policies, err := c.policies.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	compiled := Compile(c.nodeName, pods, namespaces, policies)
+	return c.writer.Apply(compiled)
+}
+
+// Run controller until ctx is done
+func (c *Controller) Run(ctx context.Context) error {
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		return fmt.Errorf("failed to wait for networkpolicy caches to sync")
+	}
+
+	c.enqueue()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.trigger:
+			if err := c.Sync(); err != nil {
+				utils.Log("Sync networkpolicy failed: " + err.Error())
+			}
+		}
+	}
+}
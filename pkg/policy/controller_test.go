@@ -0,0 +1,63 @@
+package policy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeWriter records the last compiled result
+type fakeWriter struct {
+	mu   sync.Mutex
+	last *Compiled
+}
+
+func (w *fakeWriter) Apply(c *Compiled) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = c
+	return nil
+}
+
+func (w *fakeWriter) endpoints() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.last == nil {
+		return -1
+	}
+	return len(w.last.Endpoints)
+}
+
+func TestControllerSync(t *testing.T) {
+	te := assert.New(t)
+
+	client := fake.NewSimpleClientset(
+		newNamespace("default", nil),
+		newPod("default", "web", "master", "10.1.1.2", map[string]string{"app": "web"}),
+	)
+	writer := &fakeWriter{}
+	c := NewController(client, "master", writer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	// nothing isolated without policies
+	te.Eventually(func() bool { return writer.endpoints() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	_, err := client.NetworkingV1().NetworkPolicies("default").Create(ctx, &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deny"},
+	}, metav1.CreateOptions{})
+	te.Nil(err)
+	te.Eventually(func() bool { return writer.endpoints() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	err = client.NetworkingV1().NetworkPolicies("default").Delete(ctx, "deny", metav1.DeleteOptions{})
+	te.Nil(err)
+	te.Eventually(func() bool { return writer.endpoints() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
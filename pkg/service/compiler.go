@@ -0,0 +1,165 @@
+package service
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+
+	"mycni/bpfmap"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// Compiled service state, ready to be written into bpf maps
+type Compiled struct {
+	Services map[bpfmap.LBServiceKey]bpfmap.LBServiceValue
+	Backends map[bpfmap.LBBackendKey]bpfmap.LBBackendValue
+}
+
+// backend ip(host byte order) & target port
+type backend struct {
+	address uint32
+	port    uint16
+}
+
+func protoNumber(p corev1.Protocol) uint8 {
+	switch p {
+	case corev1.ProtocolUDP:
+		return 17
+	case corev1.ProtocolSCTP:
+		return 132
+	}
+	return 6
+}
+
+// ipv4 cluster ips of service, headless services have none
+func clusterIPs(svc *corev1.Service) []net.IP {
+	ips := svc.Spec.ClusterIPs
+	if len(ips) == 0 && svc.Spec.ClusterIP != "" {
+		ips = []string{svc.Spec.ClusterIP}
+	}
+
+	var res []net.IP
+	for _, s := range ips {
+		if s == corev1.ClusterIPNone {
+			continue
+		}
+		ip := net.ParseIP(s).To4()
+		if ip != nil {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
+
+func endpointReady(ep *discoveryv1.Endpoint) bool {
+	return ep.Conditions.Ready == nil || *ep.Conditions.Ready
+}
+
+// Ready backends of a service port, sorted so that slots are stable
+func backends(sp *corev1.ServicePort, slices []*discoveryv1.EndpointSlice) []backend {
+	spProto := sp.Protocol
+	if spProto == "" {
+		spProto = corev1.ProtocolTCP
+	}
+
+	seen := make(map[backend]bool)
+	var res []backend
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 {
+			continue
+		}
+		for _, p := range slice.Ports {
+			name := ""
+			if p.Name != nil {
+				name = *p.Name
+			}
+			proto := corev1.ProtocolTCP
+			if p.Protocol != nil {
+				proto = *p.Protocol
+			}
+			if name != sp.Name || proto != spProto || p.Port == nil {
+				continue
+			}
+
+			for i := range slice.Endpoints {
+				ep := &slice.Endpoints[i]
+				if !endpointReady(ep) {
+					continue
+				}
+				for _, addr := range ep.Addresses {
+					ip := net.ParseIP(addr).To4()
+					if ip == nil {
+						continue
+					}
+					be := backend{address: binary.BigEndian.Uint32(ip), port: uint16(*p.Port)}
+					if seen[be] {
+						continue
+					}
+					seen[be] = true
+					res = append(res, be)
+				}
+			}
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].address != res[j].address {
+			return res[i].address < res[j].address
+		}
+		return res[i].port < res[j].port
+	})
+	return res
+}
+
+// Compile ClusterIP services with their endpointslices
+func Compile(services []*corev1.Service, slices []*discoveryv1.EndpointSlice) *Compiled {
+	out := &Compiled{
+		Services: make(map[bpfmap.LBServiceKey]bpfmap.LBServiceValue),
+		Backends: make(map[bpfmap.LBBackendKey]bpfmap.LBBackendValue),
+	}
+
+	// endpointslices of a service are found by its label
+	owned := make(map[string][]*discoveryv1.EndpointSlice)
+	for _, slice := range slices {
+		name := slice.Labels[discoveryv1.LabelServiceName]
+		if name == "" {
+			continue
+		}
+		key := slice.Namespace + "/" + name
+		owned[key] = append(owned[key], slice)
+	}
+
+	for _, svc := range services {
+		if svc.Spec.Type == corev1.ServiceTypeExternalName {
+			continue
+		}
+		ips := clusterIPs(svc)
+		if len(ips) == 0 {
+			continue
+		}
+
+		for i := range svc.Spec.Ports {
+			sp := &svc.Spec.Ports[i]
+			bes := backends(sp, owned[svc.Namespace+"/"+svc.Name])
+			// services without backends are left to the host stack
+			if len(bes) == 0 {
+				continue
+			}
+
+			for _, ip := range ips {
+				key := bpfmap.NewLBServiceKey(ip, uint16(sp.Port), protoNumber(sp.Protocol))
+				out.Services[key] = bpfmap.LBServiceValue{Count: uint32(len(bes))}
+				for slot, be := range bes {
+					bk := bpfmap.LBBackendKey{Service: key, Slot: uint32(slot)}
+					out.Backends[bk] = bpfmap.LBBackendValue{
+						Address: be.address,
+						Port:    be.port,
+					}
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"mycni/bpfmap"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newService(ns, name, clusterIP string, ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+		Spec:       corev1.ServiceSpec{ClusterIP: clusterIP, Ports: ports},
+	}
+}
+
+func newSlice(ns, name, svc string, portName string, port int32, ready map[string]bool) *discoveryv1.EndpointSlice {
+	tcp := corev1.ProtocolTCP
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: ns,
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: svc},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port, Protocol: &tcp}},
+	}
+	for ip, r := range ready {
+		r := r
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{ip},
+			Conditions: discoveryv1.EndpointConditions{Ready: &r},
+		})
+	}
+	return slice
+}
+
+func hostOrder(ip string) uint32 {
+	return binary.BigEndian.Uint32(net.ParseIP(ip).To4())
+}
+
+func TestCompile(t *testing.T) {
+	te := assert.New(t)
+
+	services := []*corev1.Service{
+		newService("default", "web", "10.96.0.10",
+			corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}),
+		// headless service has no frontend
+		newService("default", "db", corev1.ClusterIPNone,
+			corev1.ServicePort{Name: "pg", Port: 5432}),
+		// no ready backends
+		newService("default", "idle", "10.96.0.11",
+			corev1.ServicePort{Name: "http", Port: 80}),
+	}
+	slices := []*discoveryv1.EndpointSlice{
+		newSlice("default", "web-a", "web", "http", 8080, map[string]bool{"10.244.1.3": true, "10.244.1.2": true}),
+		newSlice("default", "web-b", "web", "http", 8080, map[string]bool{"10.244.2.2": true, "10.244.2.3": false}),
+		// port of another name is not used
+		newSlice("default", "web-c", "web", "metrics", 9090, map[string]bool{"10.244.2.4": true}),
+		newSlice("default", "db-a", "db", "pg", 5432, map[string]bool{"10.244.1.4": true}),
+		newSlice("default", "idle-a", "idle", "http", 8080, map[string]bool{"10.244.1.5": false}),
+	}
+
+	res := Compile(services, slices)
+	svc := bpfmap.NewLBServiceKey(net.ParseIP("10.96.0.10"), 80, 6)
+	te.Equal(res.Services, map[bpfmap.LBServiceKey]bpfmap.LBServiceValue{
+		svc: {Count: 3},
+	})
+	te.Equal(res.Backends, map[bpfmap.LBBackendKey]bpfmap.LBBackendValue{
+		{Service: svc, Slot: 0}: {Address: hostOrder("10.244.1.2"), Port: 8080},
+		{Service: svc, Slot: 1}: {Address: hostOrder("10.244.1.3"), Port: 8080},
+		{Service: svc, Slot: 2}: {Address: hostOrder("10.244.2.2"), Port: 8080},
+	})
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"mycni/bpfmap"
+	"mycni/utils"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	resyncPeriod = 5 * time.Minute
+)
+
+// Writer applies compiled services to the datapath
+type Writer interface {
+	Apply(c *Compiled) error
+}
+
+// BPFWriter writes compiled services into pinned bpf maps
+type BPFWriter struct{}
+
+func (BPFWriter) Apply(c *Compiled) error {
+	if _, err := bpfmap.CreateLBServiceMap(); err != nil {
+		return err
+	}
+	if _, err := bpfmap.CreateLBBackendMap(); err != nil {
+		return err
+	}
+	if _, err := bpfmap.CreateLBCTMap(); err != nil {
+		return err
+	}
+	return bpfmap.SyncLBMaps(c.Services, c.Backends)
+}
+
+// Controller watches Service & EndpointSlice objects,
+// and rewrites service maps whenever any of them changes.
+type Controller struct {
+	writer  Writer
+	factory informers.SharedInformerFactory
+
+	services corelisters.ServiceLister
+	slices   discoverylisters.EndpointSliceLister
+	synced   []cache.InformerSynced
+
+	// pending recompile, events are squashed
+	trigger chan struct{}
+}
+
+func NewController(client kubernetes.Interface, writer Writer) *Controller {
+	factory := informers.NewSharedInformerFactory(client, resyncPeriod)
+	svcInformer := factory.Core().V1().Services()
+	sliceInformer := factory.Discovery().V1().EndpointSlices()
+
+	c := &Controller{
+		writer:   writer,
+		factory:  factory,
+		services: svcInformer.Lister(),
+		slices:   sliceInformer.Lister(),
+		synced: []cache.InformerSynced{
+			svcInformer.Informer().HasSynced,
+			sliceInformer.Informer().HasSynced,
+		},
+		trigger: make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue() },
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+		DeleteFunc: func(obj interface{}) { c.enqueue() },
+	}
+	svcInformer.Informer().AddEventHandler(handler)
+	sliceInformer.Informer().AddEventHandler(handler)
+	return c
+}
+
+func (c *Controller) enqueue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Compile with objects in informer caches and write the result
+func (c *Controller) Sync() error {
+	services, err := c.services.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	slices, err := c.slices.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	return c.writer.Apply(Compile(services, slices))
+}
+
+// Run controller until ctx is done
+func (c *Controller) Run(ctx context.Context) error {
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		return fmt.Errorf("failed to wait for service caches to sync")
+	}
+
+	c.enqueue()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.trigger:
+			if err := c.Sync(); err != nil {
+				utils.Log("Sync services failed: " + err.Error())
+			}
+		}
+	}
+}
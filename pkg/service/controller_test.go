@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeWriter records the last compiled result
+type fakeWriter struct {
+	mu   sync.Mutex
+	last *Compiled
+}
+
+func (w *fakeWriter) Apply(c *Compiled) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = c
+	return nil
+}
+
+func (w *fakeWriter) backends() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.last == nil {
+		return -1
+	}
+	return len(w.last.Backends)
+}
+
+func TestControllerSync(t *testing.T) {
+	te := assert.New(t)
+
+	client := fake.NewSimpleClientset(
+		newService("default", "web", "10.96.0.10", corev1.ServicePort{Name: "http", Port: 80}),
+	)
+	writer := &fakeWriter{}
+	c := NewController(client, writer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	te.Eventually(func() bool { return writer.backends() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	slice := newSlice("default", "web-a", "web", "http", 8080, map[string]bool{"10.244.1.2": true, "10.244.1.3": true})
+	_, err := client.DiscoveryV1().EndpointSlices("default").Create(ctx, slice, metav1.CreateOptions{})
+	te.Nil(err)
+	te.Eventually(func() bool { return writer.backends() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	err = client.CoreV1().Services("default").Delete(ctx, "web", metav1.DeleteOptions{})
+	te.Nil(err)
+	te.Eventually(func() bool { return writer.backends() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
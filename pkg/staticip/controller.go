@@ -0,0 +1,128 @@
+package staticip
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"mycni/pkg/podinfo"
+	"mycni/utils"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	resyncPeriod = 5 * time.Minute
+)
+
+// Controller publishes static ip & ip pool annotations of pods on this node into the store
+type Controller struct {
+	nodeName string
+	store    *Store
+	factory  informers.SharedInformerFactory
+
+	pods   corelisters.PodLister
+	synced []cache.InformerSynced
+
+	// pending sync, events are squashed
+	trigger chan struct{}
+}
+
+func NewController(client kubernetes.Interface, nodeName string, store *Store) *Controller {
+	factory := informers.NewSharedInformerFactory(client, resyncPeriod)
+	podInformer := factory.Core().V1().Pods()
+
+	c := &Controller{
+		nodeName: nodeName,
+		store:    store,
+		factory:  factory,
+		pods:     podInformer.Lister(),
+		synced:   []cache.InformerSynced{podInformer.Informer().HasSynced},
+		trigger:  make(chan struct{}, 1),
+	}
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue() },
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+		DeleteFunc: func(obj interface{}) { c.enqueue() },
+	})
+	return c
+}
+
+func (c *Controller) enqueue() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Write annotations of pods on this node, and remove the ones of pods gone
+func (c *Controller) Sync() error {
+	pods, err := c.pods.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, pod := range pods {
+		if pod.Spec.NodeName != c.nodeName {
+			continue
+		}
+		annotations := map[string]string{}
+		for _, key := range []string{AnnotationIPs, AnnotationIPRange, podinfo.AnnotationPool} {
+			if v, ok := pod.Annotations[key]; ok {
+				annotations[key] = v
+			}
+		}
+		if len(annotations) == 0 {
+			continue
+		}
+		if _, err := FromAnnotations(annotations); err != nil {
+			utils.Log(fmt.Sprintf("Pod %s/%s: %v", pod.Namespace, pod.Name, err))
+		}
+		// stored even if invalid, so ipam fails clearly instead of ignoring it
+		if err := c.store.Write(pod.Namespace, pod.Name, annotations); err != nil {
+			return err
+		}
+		wanted[pod.Namespace+"/"+pod.Name] = true
+	}
+
+	stored, err := c.store.List()
+	if err != nil {
+		return err
+	}
+	for _, key := range stored {
+		if wanted[key] {
+			continue
+		}
+		ns, name, _ := cache.SplitMetaNamespaceKey(key)
+		if err := c.store.Delete(ns, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run controller until ctx is done
+func (c *Controller) Run(ctx context.Context) error {
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		return fmt.Errorf("failed to wait for pod caches to sync")
+	}
+
+	c.enqueue()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.trigger:
+			if err := c.Sync(); err != nil {
+				utils.Log("Sync static ips failed: " + err.Error())
+			}
+		}
+	}
+}
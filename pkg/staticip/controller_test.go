@@ -0,0 +1,56 @@
+package staticip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPod(name, node string, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+		Spec:       corev1.PodSpec{NodeName: node},
+	}
+}
+
+func TestControllerSync(t *testing.T) {
+	te := assert.New(t)
+	store := NewStore(t.TempDir())
+
+	client := fake.NewSimpleClientset(
+		newPod("db-0", "node1", map[string]string{AnnotationIPs: "10.1.0.5"}),
+		newPod("db-1", "node2", map[string]string{AnnotationIPs: "10.1.1.5"}),
+		newPod("web-0", "node1", nil),
+	)
+	c := NewController(client, "node1", store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	// only annotated pods of this node
+	te.Eventually(func() bool {
+		pods, _ := store.List()
+		return len(pods) == 1 && pods[0] == "default/db-0"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	pod := newPod("web-0", "node1", map[string]string{AnnotationIPRange: "10.1.0.16/29"})
+	_, err := client.CoreV1().Pods("default").Update(ctx, pod, metav1.UpdateOptions{})
+	te.Nil(err)
+	te.Eventually(func() bool {
+		annotations, _ := store.Read("default", "web-0")
+		return annotations[AnnotationIPRange] == "10.1.0.16/29"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = client.CoreV1().Pods("default").Delete(ctx, "db-0", metav1.DeleteOptions{})
+	te.Nil(err)
+	te.Eventually(func() bool {
+		pods, _ := store.List()
+		return len(pods) == 1 && pods[0] == "default/web-0"
+	}, 5*time.Second, 10*time.Millisecond)
+}
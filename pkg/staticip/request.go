@@ -0,0 +1,178 @@
+package staticip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	// comma separated ips wanted by the pod, one of each family, like "10.1.0.5" or "10.1.0.5,fd00::5"
+	AnnotationIPs = "mycni.io/ips"
+	// any free ip inside the cidr, like "10.1.0.16/29"
+	AnnotationIPRange = "mycni.io/ip-range"
+)
+
+var (
+	ErrInvalidRequest = errors.New("invalid static ip request")
+	ErrIPNotInBlock   = errors.New("requested ip is not inside blocks of the node")
+	ErrIPTaken        = errors.New("requested ip is already taken")
+)
+
+// Ip wanted by the pod, either an exact one or any inside a range
+type Request struct {
+	IP    net.IP
+	Range *net.IPNet
+	// ipv6 wanted along with the ipv4 IP by a dual-stack pod
+	IPv6 net.IP
+}
+
+func (r *Request) String() string {
+	if r.IPv6 != nil {
+		return r.IP.String() + "," + r.IPv6.String()
+	}
+	if r.IP != nil {
+		return r.IP.String()
+	}
+	return r.Range.String()
+}
+
+// Whether ip satisfies the request
+func (r *Request) Match(ip net.IP) bool {
+	if r.IP != nil {
+		return r.IP.Equal(ip) || r.IPv6.Equal(ip)
+	}
+	return r.Range.Contains(ip)
+}
+
+// Whether nothing of ipv6 is wanted
+func (r *Request) IPv4Only() bool {
+	return r.Family(false) == nil
+}
+
+// Part of the request of ipv4 or ipv6, nil if none is wanted of the family
+func (r *Request) Family(v4 bool) *Request {
+	isV4 := func(ip net.IP) bool { return ip.To4() != nil }
+	switch {
+	case r.Range != nil:
+		if isV4(r.Range.IP) == v4 {
+			return &Request{Range: r.Range}
+		}
+	case r.IPv6 != nil && !v4:
+		return &Request{IP: r.IPv6}
+	case isV4(r.IP) == v4:
+		return &Request{IP: r.IP}
+	}
+	return nil
+}
+
+// Args in CNI_ARGS, like "IP=10.1.0.5;K8S_POD_NAMESPACE=default;K8S_POD_NAME=db-0"
+type Args struct {
+	types.CommonArgs
+	IP                types.UnmarshallableString
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+}
+
+// `ips` capability in runtimeConfig, ip with optional prefix like "10.1.0.5/24"
+type RuntimeConfig struct {
+	IPs []string `json:"ips,omitempty"`
+}
+
+func parseIP(s string) (net.IP, error) {
+	s = strings.TrimSpace(s)
+	ip := net.ParseIP(s)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(s); err != nil {
+			return nil, fmt.Errorf("%w: bad ip %q", ErrInvalidRequest, s)
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// Build request from ips & range, nil if neither is given
+func NewRequest(ips []string, ipRange string) (*Request, error) {
+	var list []string
+	for _, s := range ips {
+		if strings.TrimSpace(s) != "" {
+			list = append(list, s)
+		}
+	}
+	switch {
+	case len(list) > 2:
+		return nil, fmt.Errorf("%w: only one ip of each family per interface is supported, got %v", ErrInvalidRequest, list)
+	case len(list) > 0:
+		req := &Request{}
+		for _, s := range list {
+			ip, err := parseIP(s)
+			if err != nil {
+				return nil, err
+			}
+			if req.IP == nil {
+				req.IP = ip
+				continue
+			}
+			if (ip.To4() != nil) == (req.IP.To4() != nil) {
+				return nil, fmt.Errorf("%w: only one ip of each family per interface is supported, got %v", ErrInvalidRequest, list)
+			}
+			// ipv4 first
+			if ip.To4() != nil {
+				req.IP, ip = ip, req.IP
+			}
+			req.IPv6 = ip
+		}
+		return req, nil
+	case ipRange != "":
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(ipRange))
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad ip range %q", ErrInvalidRequest, ipRange)
+		}
+		if ip4 := cidr.IP.To4(); ip4 != nil {
+			cidr.IP = ip4
+		}
+		return &Request{Range: cidr}, nil
+	}
+	return nil, nil
+}
+
+// Request from pod annotations
+func FromAnnotations(annotations map[string]string) (*Request, error) {
+	var ips []string
+	if v := annotations[AnnotationIPs]; v != "" {
+		ips = strings.Split(v, ",")
+	}
+	return NewRequest(ips, annotations[AnnotationIPRange])
+}
+
+// Resolve ip wanted by the pod, in the order of runtimeConfig.ips, CNI_ARGS IP=
+// and annotations published by the daemon under dir. Returns nil if nothing is wanted.
+func Resolve(runtimeIPs []string, envArgs string, dir string) (*Request, error) {
+	if len(runtimeIPs) > 0 {
+		return NewRequest(runtimeIPs, "")
+	}
+
+	args := &Args{}
+	args.IgnoreUnknown = true
+	if err := types.LoadArgs(envArgs, args); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if args.IP != "" {
+		return NewRequest(strings.Split(string(args.IP), ","), "")
+	}
+
+	if args.K8S_POD_NAMESPACE == "" || args.K8S_POD_NAME == "" {
+		return nil, nil
+	}
+	annotations, err := NewStore(dir).Read(string(args.K8S_POD_NAMESPACE), string(args.K8S_POD_NAME))
+	if err != nil {
+		return nil, err
+	}
+	return FromAnnotations(annotations)
+}
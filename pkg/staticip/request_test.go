@@ -0,0 +1,95 @@
+package staticip
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRequest(t *testing.T) {
+	te := assert.New(t)
+
+	req, err := NewRequest([]string{"10.1.0.5/24"}, "")
+	te.Nil(err)
+	te.True(req.IP.Equal(net.ParseIP("10.1.0.5")))
+	te.True(req.Match(net.ParseIP("10.1.0.5")))
+	te.False(req.Match(net.ParseIP("10.1.0.6")))
+
+	req, err = NewRequest(nil, "10.1.0.16/29")
+	te.Nil(err)
+	te.True(req.Match(net.ParseIP("10.1.0.23")))
+	te.False(req.Match(net.ParseIP("10.1.0.24")))
+
+	req, err = NewRequest([]string{""}, "")
+	te.Nil(err)
+	te.Nil(req)
+
+	for _, ips := range [][]string{{"10.1.0.5", "10.1.0.6"}, {"foo"}, {"fd00::1", "fd00::2"}, {"10.1.0.5", "fd00::1", "fd00::2"}} {
+		_, err = NewRequest(ips, "")
+		te.True(errors.Is(err, ErrInvalidRequest), "%v", ips)
+	}
+	_, err = NewRequest(nil, "10.1.0.16")
+	te.True(errors.Is(err, ErrInvalidRequest))
+}
+
+func TestNewRequestDualStack(t *testing.T) {
+	te := assert.New(t)
+
+	// one of each family, ipv4 first
+	req, err := NewRequest([]string{"fd00::5/64", "10.1.0.5/24"}, "")
+	te.Nil(err)
+	te.Equal(req.String(), "10.1.0.5,fd00::5")
+	te.True(req.Match(net.ParseIP("10.1.0.5")))
+	te.True(req.Match(net.ParseIP("fd00::5")))
+	te.False(req.IPv4Only())
+	te.Equal(req.Family(true).String(), "10.1.0.5")
+	te.Equal(req.Family(false).String(), "fd00::5")
+
+	req, err = NewRequest([]string{"fd00::5"}, "")
+	te.Nil(err)
+	te.Nil(req.Family(true))
+	te.Equal(req.Family(false).String(), "fd00::5")
+
+	req, err = NewRequest([]string{"10.1.0.5"}, "")
+	te.Nil(err)
+	te.True(req.IPv4Only())
+	te.Nil(req.Family(false))
+
+	req, err = NewRequest(nil, "fd00::10/126")
+	te.Nil(err)
+	te.False(req.IPv4Only())
+	te.True(req.Family(false).Match(net.ParseIP("fd00::11")))
+	te.Nil(req.Family(true))
+}
+
+func TestResolve(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	te.Nil(NewStore(dir).Write("default", "db-0", map[string]string{AnnotationIPs: "10.1.0.7"}))
+	args := "K8S_POD_NAMESPACE=default;K8S_POD_NAME=db-0;K8S_POD_INFRA_CONTAINER_ID=abc"
+
+	// runtimeConfig first
+	req, err := Resolve([]string{"10.1.0.5/24"}, "IP=10.1.0.6;"+args, dir)
+	te.Nil(err)
+	te.Equal(req.String(), "10.1.0.5")
+
+	// then CNI_ARGS
+	req, err = Resolve(nil, "IP=10.1.0.6;"+args, dir)
+	te.Nil(err)
+	te.Equal(req.String(), "10.1.0.6")
+
+	// then annotations
+	req, err = Resolve(nil, args, dir)
+	te.Nil(err)
+	te.Equal(req.String(), "10.1.0.7")
+
+	// nothing wanted
+	req, err = Resolve(nil, "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0", dir)
+	te.Nil(err)
+	te.Nil(req)
+	req, err = Resolve(nil, "", dir)
+	te.Nil(err)
+	te.Nil(req)
+}
@@ -0,0 +1,91 @@
+package staticip
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultDir = "/run/mycni/static-ips"
+)
+
+// Store keeps static ip & ip pool annotations of pods on this node, one file per pod,
+// written by the daemon and read by ipam plugins which can't reach apiserver.
+type Store struct {
+	Dir string
+}
+
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Store{Dir: dir}
+}
+
+// like: /run/mycni/static-ips/default_db-0
+func (s *Store) path(namespace, name string) string {
+	return filepath.Join(s.Dir, namespace+"_"+name)
+}
+
+// Annotations of the pod, nil if not found
+func (s *Store) Read(namespace, name string) (map[string]string, error) {
+	raw, err := os.ReadFile(s.path(namespace, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	annotations := map[string]string{}
+	if err := json.Unmarshal(raw, &annotations); err != nil {
+		return nil, err
+	}
+	return annotations, nil
+}
+
+func (s *Store) Write(namespace, name string, annotations map[string]string) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(annotations)
+	if err != nil {
+		return err
+	}
+	// rename is atomic, plugins never read a half written file
+	tmp := s.path(namespace, name) + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(namespace, name))
+}
+
+func (s *Store) Delete(namespace, name string) error {
+	err := os.Remove(s.path(namespace, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Pods with annotations stored, as namespace/name
+func (s *Store) List() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var pods []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		if i := strings.Index(e.Name(), "_"); i > 0 {
+			pods = append(pods, e.Name()[:i]+"/"+e.Name()[i+1:])
+		}
+	}
+	return pods, nil
+}
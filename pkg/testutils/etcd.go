@@ -0,0 +1,63 @@
+package testutils
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	u, _ := url.Parse(fmt.Sprintf("http://%s", l.Addr().String()))
+	return *u
+}
+
+// Start an embedded etcd server for the test, returns a client connected to it.
+// Both are closed when the test finishes.
+func NewEmbeddedEtcd(t *testing.T) *clientv3.Client {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+
+	client, peer := freeURL(t), freeURL(t)
+	cfg.LCUrls = []url.URL{client}
+	cfg.ACUrls = []url.URL{client}
+	cfg.LPUrls = []url.URL{peer}
+	cfg.APUrls = []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start embedded etcd: %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatalf("embedded etcd took too long to start")
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{client.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		e.Close()
+		t.Fatalf("failed to connect embedded etcd: %v", err)
+	}
+
+	t.Cleanup(func() {
+		cli.Close()
+		e.Close()
+	})
+	return cli
+}
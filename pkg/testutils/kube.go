@@ -0,0 +1,63 @@
+package testutils
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"mycni/pkg/apis/ipam/v1alpha1"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Tracker giving out resourceVersions from one counter of the whole store like the apiserver, the fake client's count per object
+type revisionTracker struct {
+	clienttesting.ObjectTracker
+	mu  sync.Mutex
+	rev uint64
+}
+
+func (t *revisionTracker) next(obj runtime.Object, write func() error) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// above 999 the fake client gives objects it starts with
+	t.rev++
+	accessor.SetResourceVersion(strconv.FormatUint(1000+t.rev, 10))
+	return write()
+}
+
+func (t *revisionTracker) Create(gvr schema.GroupVersionResource, obj runtime.Object, ns string) error {
+	return t.next(obj, func() error { return t.ObjectTracker.Create(gvr, obj, ns) })
+}
+
+func (t *revisionTracker) Update(gvr schema.GroupVersionResource, obj runtime.Object, ns string) error {
+	return t.next(obj, func() error { return t.ObjectTracker.Update(gvr, obj, ns) })
+}
+
+// Fake apiserver client knowing ipam CRDs, coordination leases & core objects, holding objs
+func NewFakeKubeClient(t *testing.T, objs ...client.Object) client.Client {
+	s := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := coordinationv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := corev1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	tracker := &revisionTracker{ObjectTracker: clienttesting.NewObjectTracker(s, scheme.Codecs.UniversalDecoder())}
+	return fake.NewClientBuilder().WithScheme(s).WithObjectTracker(tracker).WithObjects(objs...).Build()
+}
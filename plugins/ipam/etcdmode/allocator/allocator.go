@@ -1,251 +1,401 @@
 package allocator
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
-	"strings"
+	"time"
 
 	"mycni/etcdwrap"
+	"mycni/pkg/podinfo"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/etcdmode/initpool"
 	"mycni/utils"
 
 	current "github.com/containernetworking/cni/pkg/types/100"
 )
 
-func GetOneIPFromPool(poolKey string, cli *etcdwrap.WrappedClient) (string, error) {
-	// Get Ip pool array from etcd first
-	val, err := cli.GetKV(poolKey)
-	if err != nil {
-		// handle error
-		return "", err
-	}
+const (
+	// max attempts of a pool mutation before giving up
+	MaxTxnRetries = 16
+)
 
-	// Next fetch the first addr
-	ippool := utils.ConvertString2Array(val)
-	ans := ippool[0]
+var ErrTxnConflict = errors.New("pool is modified concurrently, too many retries")
 
-	// update new pool
-	err = cli.PutKV(poolKey, utils.ConvertArray2String(ippool[1:]))
-	if err != nil {
-		return ans, err
+// Run the read-modify-write fn until its txn is committed or ctx is done,
+// fn returns false when any key it read has been changed by others
+func withRetry(ctx context.Context, fn func() (bool, error)) error {
+	for i := 0; i < MaxTxnRetries; i++ {
+		ok, err := fn()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		// back off a little, so concurrent allocators don't collide again
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(rand.Intn(10*(i+1))) * time.Millisecond):
+		}
 	}
-	return ans, nil
+	return ErrTxnConflict
 }
 
-// Allocate one IP subnet for host(node)
-func AllocateIP2Host(cli *etcdwrap.WrappedClient) (string, error) {
-	// 0. Find out whether host has been allocated an IP
-	hostip, err := cli.GetKV(utils.GetHostPath())
-	if err != nil {
-		return "", fmt.Errorf("Error when getting host ip! err is %v", err)
-	}
-	utils.Log("Host has an IP address " + hostip)
-	if hostip != "" {
-		return hostip, nil
+// Split pool string, ignore empty items
+func poolItems(val string) []string {
+	var items []string
+	for _, item := range utils.ConvertString2Array(val) {
+		if item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	// 1. fetch an ip cidr from ip pool
-	ip, err := GetOneIPFromPool(utils.GetIPPoolPath(), cli)
-	utils.Log("Fetched IP " + ip)
-	if err != nil {
-		return "", fmt.Errorf("Cannot get ip from ip pool, msg: %v", err)
-	}
+func GetOneIPFromPool(ctx context.Context, poolKey string, cli etcdwrap.Backend) (string, error) {
+	var ans string
+	err := withRetry(ctx, func() (bool, error) {
+		// Get Ip pool array from etcd first
+		val, rev, err := cli.Get(ctx, poolKey)
+		if err != nil {
+			return false, err
+		}
 
-	// 2. write into etcd
-	// mycni/ipam/<hostname> = ip, means that host has been allocated
-	err = cli.PutKV(utils.GetHostPath(), ip)
-	if err != nil {
-		return "", fmt.Errorf("Cannot assign up to host! Error is: %v", err)
-	}
+		// Next fetch the first addr
+		ippool := poolItems(val)
+		if len(ippool) == 0 {
+			return false, fmt.Errorf("No ip left in pool %s", poolKey)
+		}
+		ans = ippool[0]
 
-	// 3. set host's gw
-	gwip := utils.GetGateway(ip)
-	gwpath := utils.GetHostGWPath()
-	err = cli.PutKV(gwpath, gwip)
+		// update new pool, only if nobody else took it
+		return etcdwrap.CompareAndSwap(ctx, cli, poolKey, rev, utils.ConvertArray2String(ippool[1:]))
+	})
 	if err != nil {
-		return "", fmt.Errorf("Cannot assign gateway! Error is: %v", err)
+		return "", err
 	}
+	return ans, nil
+}
 
-	// 4. last, setup host's local ip pool, put the string in
-	var ips []string
-	hostPoolPath := utils.GetHostIPPoolPath()
-	ips, err = utils.GetValidIps(ip)
+// Allocate one IP subnet for host(node)
+func AllocateIP2Host(ctx context.Context, pool *initpool.Pool, cli etcdwrap.Backend) (string, error) {
+	var ans string
+	err := withRetry(ctx, func() (bool, error) {
+		// 0. Find out whether host has been allocated an IP
+		hostip, hostRev, err := cli.Get(ctx, utils.GetHostPath())
+		if err != nil {
+			return false, fmt.Errorf("Error when getting host ip! err is %w", err)
+		}
+		if hostip != "" {
+			utils.Log("Host has an IP address " + hostip)
+			ans = hostip
+			// hosts claimed before multi-block have no claim for the primary block
+			claimPath := utils.GetHostBlockPath(hostip)
+			_, claimRev, err := cli.Get(ctx, claimPath)
+			if err != nil || claimRev != 0 {
+				return err == nil, err
+			}
+			lease, err := hostLease(ctx, cli)
+			if err != nil {
+				return false, err
+			}
+			return etcdwrap.CommitIfUnchanged(ctx, cli,
+				map[string]int64{utils.GetHostPath(): hostRev, claimPath: 0},
+				etcdwrap.OpPut(claimPath, newBlockClaim(lease, "").String()),
+			)
+		}
+
+		// 1. fetch an ip cidr from ip pool
+		poolPath := utils.GetIPPoolPath()
+		val, poolRev, err := cli.Get(ctx, poolPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get ip from ip pool, msg: %w", err)
+		}
+		ippool := poolItems(val)
+		res, err := listReservations(ctx, cli)
+		if err != nil {
+			return false, fmt.Errorf("Cannot list reservations, msg: %w", err)
+		}
+		// blocks reserved entirely are left in pool
+		i := res.pickBlock(ippool)
+		if i < 0 {
+			return false, ErrPoolExhausted
+		}
+		ip := ippool[i]
+		utils.Log("Fetched IP " + ip)
+		_, block, err := net.ParseCIDR(ip)
+		if err != nil {
+			return false, fmt.Errorf("Invalid cidr %s in ip pool", ip)
+		}
+
+		// 2. take the cidr from pool, and write host & gateway at once,
+		// ips of the block are allocated by per-ip keys under mycni/ipam/blocks/<cidr>/
+		// mycni/ipam/<hostname> = ip, means that host has been allocated
+		lease, err := hostLease(ctx, cli)
+		if err != nil {
+			return false, err
+		}
+		ops := []etcdwrap.Op{
+			etcdwrap.OpPut(poolPath, utils.ConvertArray2String(append(ippool[:i:i], ippool[i+1:]...))),
+			etcdwrap.OpPut(utils.GetHostPath(), ip),
+			etcdwrap.OpPut(utils.GetHostBlockPath(ip), newBlockClaim(lease, "").String()),
+		}
+		if gw := pool.Gateway(block); gw != nil {
+			ones, _ := block.Mask.Size()
+			ops = append(ops, etcdwrap.OpPut(utils.GetHostGWPath(), fmt.Sprintf("%s/%d", gw, ones)))
+		}
+		ok, err := cli.Txn(ctx,
+			[]etcdwrap.Cmp{
+				etcdwrap.Compare(etcdwrap.ModRevision(poolPath), "=", poolRev),
+				etcdwrap.Compare(etcdwrap.ModRevision(utils.GetHostPath()), "=", hostRev),
+				res.unchanged(),
+			},
+			ops...,
+		)
+		if err != nil {
+			return false, fmt.Errorf("Cannot assign up to host! Error is: %w", err)
+		}
+		ans = ip
+		return ok, nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("Get valid ips failed! err is %v", err)
+		return "", err
 	}
-
-	cli.PutKV(hostPoolPath, utils.ConvertArray2String(ips))
-	return ip, nil
+	return ans, nil
 }
 
 // Release allocated Ip to the host, add it back to ip pool
-func ReleaseHostIP(cli *etcdwrap.WrappedClient) (bool, error) {
-	// 0. Find out whether host has been allocated an IP
-	hostip, err := cli.GetKV(utils.GetHostPath())
-	if err != nil {
-		return false, fmt.Errorf("Error when getting host ip! err is %v", err)
-	}
-	if hostip == "" {
-		// hostip has been empty/released
-		return true, nil
-	}
+func ReleaseHostIP(ctx context.Context, cli etcdwrap.Backend) (bool, error) {
+	err := withRetry(ctx, func() (bool, error) {
+		// 0. Find out whether host has been allocated an IP
+		hostip, rev, err := cli.Get(ctx, utils.GetHostPath())
+		if err != nil {
+			return false, fmt.Errorf("Error when getting host ip! err is %w", err)
+		}
+		if hostip == "" {
+			// hostip has been empty/released
+			return true, nil
+		}
+		poolPath := utils.GetIPPoolPath()
+		val, poolRev, err := cli.Get(ctx, poolPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get ip pool, msg: %w", err)
+		}
 
-	// 1. Assume pods on this host has been ALL released,
-	// if host has allocated ip subnet release it
-	err = cli.DelKV(utils.GetHostPath())
-	if err != nil {
-		return false, fmt.Errorf("Error when del host ip! err is %v", err)
-	}
-	err = cli.DelKV(utils.GetHostGWPath())
+		// 1. Assume pods on this host has been ALL released,
+		// if host has allocated ip subnet put it back into pool, only if no ip of block is in use
+		blockPath := utils.GetBlockPath(hostip)
+		resp, err := cli.Txn(ctx,
+			[]etcdwrap.Cmp{
+				etcdwrap.Compare(etcdwrap.ModRevision(utils.GetHostPath()), "=", rev),
+				etcdwrap.Compare(etcdwrap.ModRevision(poolPath), "=", poolRev),
+				etcdwrap.Compare(etcdwrap.CreateRevision(blockPath), "=", 0).WithPrefix(),
+			},
+			etcdwrap.OpDelete(utils.GetHostPath()),
+			etcdwrap.OpDelete(utils.GetHostGWPath()),
+			etcdwrap.OpDelete(utils.GetHostBlockPath(hostip)),
+			etcdwrap.OpPut(poolPath, utils.ConvertArray2String(append(poolItems(val), hostip))),
+		)
+		if err != nil {
+			return false, fmt.Errorf("Error when del host ip! err is %w", err)
+		}
+		if !resp {
+			used, err := ListBlockAllocations(ctx, hostip, cli)
+			if err == nil && len(used) > 0 {
+				return false, fmt.Errorf("Cannot release host ip %s, %d ips are still in use", hostip, len(used))
+			}
+		}
+		return resp, nil
+	})
 	if err != nil {
-		return false, fmt.Errorf("Error when del host's gateway ip! err is %v", err)
+		return false, err
 	}
 	return true, nil
 }
 
-// Allocate ip under certain host, fetch one from ip pool then assign to special device
+// Allocate ip under certain host, fetch one from blocks of host then assign to special device,
+// one more block is claimed from the pool if all of them are used up.
 // Returns the IPConfig of CNI Standards
-func AllocateIP2Pod(containerID, ifname string, cli *etcdwrap.WrappedClient) (*current.IPConfig, error) {
-	// 1. read the hostname, query etcd
-	// find whether allocated subnet for this host
-	// hostname := utils.GetHostName()
-	hoststring, err := cli.GetKV(utils.GetHostPath())
-	if err != nil {
-		return nil, fmt.Errorf("Cannot get subnet for host %v", err)
-	}
+func AllocateIP2Pod(ctx context.Context, containerID, ifname string, pool *initpool.Pool, cli etcdwrap.Backend) (*current.IPConfig, error) {
+	return allocateIP2Pod(ctx, containerID, ifname, nil, nil, pool, cli)
+}
 
-	// hostsubnet like: 10.1.1.0/28
-	if hoststring == "" {
-		hoststring, err = AllocateIP2Host(cli)
-		if err != nil {
-			return nil, fmt.Errorf("Error when allocate ip2host: %v", err)
+// Allocate the requested ip to special device of pod, any ip if req is nil.
+// The pod is recorded in the allocation if not nil, so is the pool if it's a named one.
+func allocateIP2Pod(ctx context.Context, containerID, ifname string, pod *podinfo.Pod, req *staticip.Request, pool *initpool.Pool, cli etcdwrap.Backend) (*current.IPConfig, error) {
+	// 1. make sure host has its primary block, which is always of the cluster pool
+	if pool.Name == "" {
+		if _, err := AllocateIP2Host(ctx, pool, cli); err != nil {
+			return nil, fmt.Errorf("Error when allocate ip2host: %w", err)
 		}
 	}
 
-	// Now we have host's subnet
-	var hostsubnet *net.IPNet
-	_, hostsubnet, err = net.ParseCIDR(hoststring)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot parse hoststring as valid ipcidr! err is %v", err)
-	}
-
-	// 2. get the result of reserved IP and gateway for container
-	var reservedIP *net.IPNet
-	var gw, newIp net.IP
-	var gwip, allocatedIP string
-
-	// get host gw
-	gwpath := utils.GetHostGWPath()
-	gwip, err = cli.GetKV(gwpath)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot get gateway! Error is: %v", err)
-	}
-	gw, _, err = net.ParseCIDR(gwip)
-
 	// now check container
 	id := containerID + "-" + ifname
+	devPath := utils.GetNetDevicePath(id)
 	utils.Log("Trying to allocated IP for pod " + id)
-	allocatedIP, err = cli.GetKV(utils.GetNetDevicePath(id))
-	if err != nil {
-		return nil, fmt.Errorf("Cannot get current network device! err is %v", err)
-	}
 
-	// Already allocated
-	if allocatedIP != "" {
-		allocatedIPAddr, _, err := net.ParseCIDR(allocatedIP) // allocated for device
+	var allocatedIP string
+	err := withRetry(ctx, func() (bool, error) {
+		ip, devRev, err := cli.Get(ctx, devPath)
 		if err != nil {
-			return nil, fmt.Errorf("Invalid ip cidr in allocated ip for container %s", id)
+			return false, fmt.Errorf("Cannot get current network device! err is %w", err)
+		}
+		// Already allocated
+		if ip != "" {
+			if req != nil && !req.Match(net.ParseIP(ipOf(ip))) {
+				return false, fmt.Errorf("%w: container %s already has ip %s, not %s", staticip.ErrInvalidRequest, id, ip, req)
+			}
+			allocatedIP = ip
+			return true, nil
 		}
 
-		reservedIP = &net.IPNet{IP: allocatedIPAddr, Mask: hostsubnet.Mask}
+		// 2. Not allocated, find a free ip in blocks of host from the pool
+		blocks, err := listPoolBlocks(ctx, pool, cli)
+		if err != nil {
+			return false, fmt.Errorf("Cannot list blocks of host! err is %w", err)
+		}
+		res, err := listReservations(ctx, cli)
+		if err != nil {
+			return false, fmt.Errorf("Cannot list reservations! err is %w", err)
+		}
+		usedByBlock := make(map[string]map[string]*Allocation, len(blocks))
+		for _, b := range blocks {
+			used, err := ListBlockAllocations(ctx, b.cidr, cli)
+			if err != nil {
+				return false, fmt.Errorf("Cannot list allocated ips of block! err is %w", err)
+			}
+			usedByBlock[b.cidr] = used
+			// ips following the gateway policy & excludes of pool
+			free := ""
+			for _, c := range pool.UsableIPs(b.block) {
+				if _, ok := used[ipOf(c)]; ok {
+					continue
+				}
+				ip := net.ParseIP(ipOf(c))
+				if res.reservedBy(ip) != nil {
+					continue
+				}
+				if req == nil || req.Match(ip) {
+					free = c
+					break
+				}
+			}
+			if free == "" {
+				continue
+			}
+
+			// create the ip key & record it for current device in one txn,
+			// fails if someone else takes the same ip first, the block is released or the ip is reserved
+			ipPath := utils.GetBlockIPPath(b.cidr, ipOf(free))
+			claimPath := utils.GetHostBlockPath(b.cidr)
+			ok, err := cli.Txn(ctx,
+				[]etcdwrap.Cmp{
+					etcdwrap.Compare(etcdwrap.ModRevision(ipPath), "=", 0),
+					etcdwrap.Compare(etcdwrap.ModRevision(devPath), "=", devRev),
+					etcdwrap.Compare(etcdwrap.ModRevision(claimPath), "=", b.rev),
+					res.unchanged(),
+				},
+				etcdwrap.OpPut(ipPath, newPoolAllocation(containerID, ifname, pod, pool.Name).String()),
+				etcdwrap.OpPut(devPath, free),
+			)
+			if err != nil {
+				return false, fmt.Errorf("Error happened when writing new config into etcd! %w", err)
+			}
+			allocatedIP = free
+			return ok, nil
+		}
 
-		return &current.IPConfig{
-			Address: *reservedIP,
-			Gateway: gw,
-		}, nil
-	}
+		// requested ip is not available, never taken from other blocks
+		if req != nil {
+			return false, unavailableError(req, res, blocks, usedByBlock)
+		}
 
-	// Not allocated, now we allocate one IP for it
-	var hostIPPool string
-	hostIPPool, err = cli.GetKV(utils.GetHostIPPoolPath())
-	utils.Log("Current hostIP pool is like: " + hostIPPool)
-	ips := strings.Split(hostIPPool, ";")
-	if len(ips) <= 0 {
-		return nil, fmt.Errorf("All ip address has been used under this host!")
+		// 3. All blocks are used up, claim one more and try again
+		if _, err := ClaimPoolBlock(ctx, pool.Name, cli); err != nil {
+			return false, err
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// convert into ip.Net object
-	newIp, _, err = net.ParseCIDR(ips[0]) // allocate for device
-	// Then put it back
-	cli.PutKV(utils.GetHostIPPoolPath(), utils.ConvertArray2String(ips[1:]))
-
-	reservedIP = &net.IPNet{IP: newIp, Mask: hostsubnet.Mask}
+	newIp, block, err := net.ParseCIDR(allocatedIP)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ip cidr in allocated ip for container %s", id)
+	}
 
 	// Address: net.IPNet
-	// Gateway: net.IP
+	// Gateway: net.IP, of the block which ip belongs to
 	// allocate ip for containerid + ifname
-	ipconf := &current.IPConfig{
-		Address: *reservedIP,
-		Gateway: gw,
-	}
-
-	// update current device's ip info into db
-	err = cli.PutKV(utils.GetNetDevicePath(id), ips[0])
-	if err != nil {
-		return nil, fmt.Errorf("Error happened when writing new config into etcd! %v", err)
-	}
-	return ipconf, nil
+	return &current.IPConfig{
+		Address: net.IPNet{IP: newIp, Mask: block.Mask},
+		Gateway: pool.Gateway(block),
+	}, nil
 }
 
 // Release pod ip with given containerID, ifname in skel.Args
-func ReleasePodIP(containerID, ifname string, cli *etcdwrap.WrappedClient) (bool, error) {
+func ReleasePodIP(ctx context.Context, containerID, ifname string, cli etcdwrap.Backend) (bool, error) {
 	// get the result of reserved IP and gateway for container
 	id := containerID + "-" + ifname
-	allocatedIP, err := cli.GetKV(utils.GetNetDevicePath(id))
-	if err != nil {
-		return false, fmt.Errorf("Cannot get current network device! err is %v", err)
-	}
+	devPath := utils.GetNetDevicePath(id)
 
-	// so if allocated ip is empty, do nothing
-	utils.Log("Release is ok till here")
-	if allocatedIP == "" {
-		return true, nil
-	}
+	err := withRetry(ctx, func() (bool, error) {
+		allocatedIP, devRev, err := cli.Get(ctx, devPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get current network device! err is %w", err)
+		}
 
-	// Now we return back one IP for it.
-	var hostIPPool string
-	hostIPPool, err = cli.GetKV(utils.GetHostIPPoolPath())
-	ips := strings.Split(hostIPPool, ";")
-	// Then put it back
-	ips = append(ips, allocatedIP)
+		// so if allocated ip is empty, do nothing
+		if allocatedIP == "" {
+			return true, nil
+		}
 
-	// update back to hostpool
-	cli.PutKV(utils.GetHostIPPoolPath(), utils.ConvertArray2String(ips))
-  utils.Log("Return back ip to pool ok")
+		// Now we return back one IP for it, the block is the network of ip like 10.1.1.2/28
+		ip, block, err := net.ParseCIDR(allocatedIP)
+		if err != nil {
+			return false, fmt.Errorf("Invalid ip cidr in allocated ip for container %s", id)
+		}
 
-	// update current device's ip info into db
-	err = cli.DelKV(utils.GetNetDevicePath(id))
+		// remove the ip key & current device's ip info in one txn
+		ok, err := etcdwrap.CommitIfUnchanged(ctx, cli,
+			map[string]int64{devPath: devRev},
+			etcdwrap.OpDelete(utils.GetBlockIPPath(block.String(), ip.String())),
+			etcdwrap.OpDelete(devPath),
+		)
+		if err != nil {
+			return false, fmt.Errorf("Error happened when removing config for device %s! error is %w", id, err)
+		}
+		return ok, nil
+	})
 	if err != nil {
-		return false, fmt.Errorf("Error happened when removing config for device %s! error is %v", id, err)
+		return false, err
 	}
-  utils.Log("Remove current dev's ip ok")
+	utils.Log("Return back ip to pool ok")
 	return true, nil
 }
 
 // Release Host Gateway item
-func ReleaseHostGateway(cli *etcdwrap.WrappedClient) (bool, error) {
-	err := cli.DelKV(utils.GetHostGWPath())
+func ReleaseHostGateway(ctx context.Context, cli etcdwrap.Backend) (bool, error) {
+	err := cli.Delete(ctx, utils.GetHostGWPath())
 	if err != nil {
-		return false, fmt.Errorf("Cannot release host gateway ip %v", err)
+		return false, fmt.Errorf("Cannot release host gateway ip %w", err)
 	}
 	return true, nil
 }
 
 // Find assigned ip with given info
-func FindByID(containerID, ifname string, cli *etcdwrap.WrappedClient) (bool, error) {
+func FindByID(ctx context.Context, containerID, ifname string, cli etcdwrap.Backend) (bool, error) {
 	id := containerID + "-" + ifname
-	res, err := cli.GetKV(utils.GetNetDevicePath(id))
+	res, _, err := cli.Get(ctx, utils.GetNetDevicePath(id))
 	if err != nil {
-		return false, fmt.Errorf("Error when get container info with id %s, %v", id, err)
+		return false, fmt.Errorf("Error when get container info with id %s, %w", id, err)
 	}
 	if res == "" {
 		return false, nil
@@ -254,13 +404,13 @@ func FindByID(containerID, ifname string, cli *etcdwrap.WrappedClient) (bool, er
 }
 
 // Find assigned ip with given info
-func FindIPByID(containerID, ifname string, cli *etcdwrap.WrappedClient) (string, error) {
+func FindIPByID(ctx context.Context, containerID, ifname string, cli etcdwrap.Backend) (string, error) {
 	id := containerID + "-" + ifname
 	utils.Log(id)
 
-	res, err := cli.GetKV(utils.GetNetDevicePath(id))
+	res, _, err := cli.Get(ctx, utils.GetNetDevicePath(id))
 	if err != nil {
-		return "", fmt.Errorf("Error when get container info with id %s, %v", id, err)
+		return "", fmt.Errorf("Error when get container info with id %s, %w", id, err)
 	}
 	if res == "" {
 		return "", nil
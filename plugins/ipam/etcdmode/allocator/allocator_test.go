@@ -1,11 +1,16 @@
 package allocator
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"github.com/stretchr/testify/assert"
 
 	"mycni/etcdwrap"
+	"mycni/pkg/testutils"
 	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/utils"
 	current "github.com/containernetworking/cni/pkg/types/100"
 )
 
@@ -46,6 +51,7 @@ import (
 // }
 
 func TestAllocateIP2Pod(t *testing.T) {
+	ctx := context.Background()
 	// we have two container, with both 'eth0' in its ns
 	containerID := "dummy0"
 	containerID1 := "dummy1"
@@ -60,50 +66,232 @@ func TestAllocateIP2Pod(t *testing.T) {
 	te.NotNil(cli)
 	// te.Equal(cli.GetInitPoolStatus(), false)
 
+	pool, err := initpool.PoolConfig{}.Parse()
+	te.Nil(err)
+
 	var r bool
-	r, err = initpool.InitPool(cli)
+	r, err = initpool.InitPool(ctx, pool, cli)
 	te.Nil(err)
 	te.Equal(r, true)
-	te.Equal(cli.GetInitPoolStatus(), true)
+	te.Equal(cli.GetInitPoolStatus(ctx), true)
 
 	// Allocate 2 devices here
 	var ipConf *current.IPConfig
-	ipConf, err = AllocateIP2Pod(containerID, ifname, cli)
+	ipConf, err = AllocateIP2Pod(ctx, containerID, ifname, pool, cli)
 	te.Nil(err)
 	t.Log(ipConf)
 
-	ipConf, err = AllocateIP2Pod(containerID1, ifname, cli)
+	ipConf, err = AllocateIP2Pod(ctx, containerID1, ifname, pool, cli)
 	te.Nil(err)
 	t.Log(ipConf)
 
 	// try to release ip back
 	var releasePodRes bool
-	releasePodRes, err = ReleasePodIP(containerID, ifname, cli)
+	releasePodRes, err = ReleasePodIP(ctx, containerID, ifname, cli)
 	te.Nil(err)
 	te.Equal(releasePodRes, true)
 
-	releasePodRes, err = ReleasePodIP(containerID1, ifname, cli)
+	releasePodRes, err = ReleasePodIP(ctx, containerID1, ifname, cli)
 	te.Nil(err)
 	te.Equal(releasePodRes, true)
 
 	// try to restore back
 	var releaseHostRes bool 
-	releaseHostRes, err = ReleaseHostIP(cli)
+	releaseHostRes, err = ReleaseHostIP(ctx, cli)
 	te.Nil(err)
 	te.Equal(releaseHostRes, true)
 
 	// double check that ip is released
 	var releasedIP string
-	releasedIP, err = cli.GetKV("mycni/ipam/master")
+	releasedIP, _, err = cli.Get(ctx, "mycni/ipam/master")
 	te.Nil(err)
 	te.Equal(releasedIP, "")
 
 	// double check that gateway ip is released
-	releasedIP, err = cli.GetKV("mycni/ipam/master/gateway")
+	releasedIP, _, err = cli.Get(ctx, "mycni/ipam/master/gateway")
 	te.Nil(err)
 	te.Equal(releasedIP, "")
 
 	// finally release client
 	cli.CloseEtcdClient()
 	te.Nil(err)
-}
\ No newline at end of file
+}
+// 16 blocks of /28
+func newTestPool(t *testing.T) *initpool.Pool {
+	pool, err := initpool.PoolConfig{ClusterCIDR: "10.1.0.0/24", BlockSize: 28}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// Run f on the memory backend and the kubernetes one with a fake apiserver
+func forEachBackend(t *testing.T, f func(t *testing.T, cli etcdwrap.Backend)) {
+	t.Run("memory", func(t *testing.T) { f(t, etcdwrap.NewMemoryBackend()) })
+	t.Run("kubernetes", func(t *testing.T) {
+		f(t, etcdwrap.NewKubeBackend(testutils.NewFakeKubeClient(t), &etcdwrap.KubeBackendConfig{}))
+	})
+}
+
+func TestParallelGetOneIPFromPool(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+
+	_, err := initpool.InitPool(ctx, newTestPool(t), cli)
+	te.Nil(err)
+
+	// 16 cidrs in pool, every taker gets a different one
+	var wg sync.WaitGroup
+	res := make([]string, 16)
+	errs := make([]error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i], errs[i] = GetOneIPFromPool(ctx, utils.GetIPPoolPath(), cli)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i := range res {
+		te.Nil(errs[i])
+		te.False(seen[res[i]], "cidr %s is taken twice", res[i])
+		seen[res[i]] = true
+	}
+
+	// pool is empty now
+	_, err = GetOneIPFromPool(ctx, utils.GetIPPoolPath(), cli)
+	te.NotNil(err)
+}
+
+func TestParallelAllocateIP2Pod(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, cli etcdwrap.Backend) {
+		te := assert.New(t)
+		ctx := context.Background()
+
+		pool := newTestPool(t)
+		_, err := initpool.InitPool(ctx, pool, cli)
+		te.Nil(err)
+
+		// a /28 host pool holds 13 usable ips, besides network, broadcast & gateway
+		const n = 13
+		var wg sync.WaitGroup
+		confs := make([]*current.IPConfig, n)
+		errs := make([]error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				confs[i], errs[i] = AllocateIP2Pod(ctx, fmt.Sprintf("dummy%d", i), "eth0", pool, cli)
+			}(i)
+		}
+		wg.Wait()
+
+		seen := make(map[string]bool)
+		for i := range confs {
+			te.Nil(errs[i])
+			ip := confs[i].Address.IP.String()
+			te.False(seen[ip], "ip %s is allocated twice", ip)
+			seen[ip] = true
+		}
+
+		// only one block is taken by the host
+		blocks, _, err := cli.Get(ctx, utils.GetIPPoolPath())
+		te.Nil(err)
+		te.Equal(len(utils.ConvertString2Array(blocks)), 15)
+
+		// the host block is full, one more is claimed
+		conf, err := AllocateIP2Pod(ctx, "dummy-full", "eth0", pool, cli)
+		te.Nil(err)
+		te.False(seen[conf.Address.IP.String()])
+		blocks, _, err = cli.Get(ctx, utils.GetIPPoolPath())
+		te.Nil(err)
+		te.Equal(len(utils.ConvertString2Array(blocks)), 14)
+
+		// release in parallel, every ip goes back exactly once
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = ReleasePodIP(ctx, fmt.Sprintf("dummy%d", i), "eth0", cli)
+			}(i)
+		}
+		wg.Wait()
+		for i := range errs {
+			te.Nil(errs[i])
+		}
+
+		block, _, err := cli.Get(ctx, utils.GetHostPath())
+		te.Nil(err)
+		used, err := ListBlockAllocations(ctx, block, cli)
+		te.Nil(err)
+		te.Equal(len(used), 0)
+	})
+}
+
+func TestMigrateHostPool(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+
+	// host pool in the old `;`-separated format, 10.1.1.2 is used by dummy0
+	te.Nil(cli.Put(ctx, utils.GetHostPath(), "10.1.1.0/28"))
+	te.Nil(cli.Put(ctx, utils.GetHostGWPath(), "10.1.1.1/28"))
+	te.Nil(cli.Put(ctx, utils.GetHostIPPoolPath(), "10.1.1.3/28;10.1.1.4/28"))
+	te.Nil(cli.Put(ctx, utils.GetNetDevicePath("dummy0-eth0"), "10.1.1.2/28"))
+
+	ok, err := MigrateHostPool(ctx, cli)
+	te.Nil(err)
+	te.True(ok)
+
+	used, err := ListBlockAllocations(ctx, "10.1.1.0/28", cli)
+	te.Nil(err)
+	te.Equal(len(used), 1)
+	te.Equal(used["10.1.1.2"].ContainerID, "dummy0")
+	te.Equal(used["10.1.1.2"].IfName, "eth0")
+
+	hostPool, _, err := cli.Get(ctx, utils.GetHostIPPoolPath())
+	te.Nil(err)
+	te.Equal(hostPool, "")
+
+	// only once
+	ok, err = MigrateHostPool(ctx, cli)
+	te.Nil(err)
+	te.False(ok)
+
+	// next allocation skips the migrated ip
+	pool, err := initpool.PoolConfig{BlockSize: 28}.Parse()
+	te.Nil(err)
+	conf, err := AllocateIP2Pod(ctx, "dummy1", "eth0", pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.1.3/28")
+}
+
+func TestReleaseHostIP(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	_, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+	te.Nil(err)
+	te.Equal(poolSize(t, cli), 3)
+
+	// ips of the block are still in use
+	_, err = ReleaseHostIP(ctx, cli)
+	te.NotNil(err)
+
+	_, err = ReleasePodIP(ctx, "dummy0", "eth0", cli)
+	te.Nil(err)
+	ok, err := ReleaseHostIP(ctx, cli)
+	te.Nil(err)
+	te.True(ok)
+
+	// block goes back into cluster pool
+	te.Equal(poolSize(t, cli), 4)
+	blocks, err := ListHostBlocks(ctx, cli)
+	te.Nil(err)
+	te.Empty(blocks)
+}
@@ -0,0 +1,144 @@
+package allocator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/podinfo"
+	"mycni/utils"
+)
+
+// Value of mycni/ipam/blocks/<cidr>/<ip>, one key per allocated address
+type Allocation struct {
+	ContainerID string    `json:"containerID"`
+	IfName      string    `json:"ifname"`
+	Node        string    `json:"node"`
+	Timestamp   time.Time `json:"timestamp"`
+	// pod of the device, nil if not allocated for a k8s pod
+	Pod *podinfo.Pod `json:"pod,omitempty"`
+	// set once the device is gone, while the ip is kept for the pod
+	ReleasedAt *time.Time `json:"releasedAt,omitempty"`
+	// named pool of the ip, empty for the cluster pool
+	Pool string `json:"pool,omitempty"`
+}
+
+func newAllocation(containerID, ifname string, pod *podinfo.Pod) *Allocation {
+	node, _ := os.Hostname()
+	return &Allocation{
+		ContainerID: containerID,
+		IfName:      ifname,
+		Node:        node,
+		Timestamp:   time.Now(),
+		Pod:         pod,
+	}
+}
+
+func newPoolAllocation(containerID, ifname string, pod *podinfo.Pod, pool string) *Allocation {
+	a := newAllocation(containerID, ifname, pod)
+	a.Pool = pool
+	return a
+}
+
+func (a *Allocation) String() string {
+	data, _ := json.Marshal(a)
+	return string(data)
+}
+
+func ParseAllocation(val string) (*Allocation, error) {
+	a := &Allocation{}
+	if err := json.Unmarshal([]byte(val), a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Strip mask of ip like 10.1.1.2/28
+func ipOf(ipcidr string) string {
+	return strings.Split(ipcidr, "/")[0]
+}
+
+// List allocated ips in block, keyed by ip without mask
+func ListBlockAllocations(ctx context.Context, cidr string, cli etcdwrap.Backend) (map[string]*Allocation, error) {
+	prefix := utils.GetBlockPath(cidr)
+	kvs, err := etcdwrap.ListKV(ctx, cli, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*Allocation, len(kvs))
+	for key, val := range kvs {
+		a, err := ParseAllocation(val)
+		if err != nil {
+			utils.Log(fmt.Sprintf("Invalid allocation %s: %v", key, err))
+			a = &Allocation{}
+		}
+		res[strings.TrimPrefix(key, prefix)] = a
+	}
+	return res, nil
+}
+
+// One-shot migration from the `;`-separated host pool into per-ip keys.
+//
+// Every ip recorded by devices of this host gets its own key in the block,
+// ips left in the old pool are free in the new layout, so the pool key is simply dropped.
+func MigrateHostPool(ctx context.Context, cli etcdwrap.Backend) (bool, error) {
+	poolPath := utils.GetHostIPPoolPath()
+	_, poolRev, err := cli.Get(ctx, poolPath)
+	if err != nil {
+		return false, err
+	}
+	// nothing to migrate
+	if poolRev == 0 {
+		return false, nil
+	}
+
+	cidr, _, err := cli.Get(ctx, utils.GetHostPath())
+	if err != nil {
+		return false, err
+	}
+	_, block, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, fmt.Errorf("Cannot parse host block %q: %w", cidr, err)
+	}
+
+	hostPrefix := utils.GetHostPath() + "/"
+	kvs, err := etcdwrap.ListKV(ctx, cli, hostPrefix)
+	if err != nil {
+		return false, err
+	}
+
+	ops := []etcdwrap.Op{etcdwrap.OpDelete(poolPath)}
+	for key, val := range kvs {
+		if key == poolPath || key == utils.GetHostGWPath() {
+			continue
+		}
+		ip := net.ParseIP(ipOf(val))
+		if ip == nil || !block.Contains(ip) {
+			continue
+		}
+
+		// device id is <containerID>-<ifname>
+		id := strings.TrimPrefix(key, hostPrefix)
+		a := newAllocation(id, "", nil)
+		if i := strings.LastIndex(id, "-"); i > 0 {
+			a.ContainerID, a.IfName = id[:i], id[i+1:]
+		}
+		ops = append(ops, etcdwrap.OpPut(utils.GetBlockIPPath(cidr, ip.String()), a.String()))
+	}
+
+	// fails if the old pool is touched in the meantime, try again next time
+	ok, err := etcdwrap.CommitIfUnchanged(ctx, cli, map[string]int64{poolPath: poolRev}, ops...)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		utils.Log(fmt.Sprintf("Migrated %d ips of block %s into per-ip keys", len(ops)-1, cidr))
+	}
+	return ok, nil
+}
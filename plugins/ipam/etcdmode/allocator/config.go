@@ -3,6 +3,24 @@ package allocator
 import (
 	"encoding/json"
 	"fmt"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/etcdmode/initpool"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// kubelet gives up the sandbox after its runtime request timeout(2m by default),
+	// leave the runtime enough time to clean up
+	DefaultCommandTimeout = 30 * time.Second
+
+	// where the ipam is stored
+	BackendEtcd       = "etcd"
+	BackendKubernetes = "kubernetes"
 )
 
 // The top-level network config - IPAM plugins are passed the full configuration
@@ -11,28 +29,142 @@ type Net struct {
 	Name          string      `json:"name"`
 	CNIVersion    string      `json:"cniVersion"`
 	IPAM          *IPAMConfig `json:"ipam"`
-	// RuntimeConfig struct {
-	// 	// The capability arg
-	// 	IPRanges []RangeSet `json:"ipRanges,omitempty"`
-	// 	IPs      []*ip.IP   `json:"ips,omitempty"`
-	// } `json:"runtimeConfig,omitempty"`
-	// Args *struct {
-	// 	A *IPAMArgs `json:"cni"`
-	// } `json:"args"`
+	// The capability arg, ips wanted by the pod
+	RuntimeConfig staticip.RuntimeConfig `json:"runtimeConfig,omitempty"`
 }
 
 // IPAMConfig represents the IP related network configuration.
 // This nests Range because we initially only supported a single
 // range directly, and wish to preserve backwards compatability
 type IPAMConfig struct {
-	Name       string
-	Type       string         `json:"type"`
-	// Routes     []*types.Route `json:"routes,omitempty"`
+	Name   string
+	Type   string         `json:"type"`
+	Routes []*types.Route `json:"routes,omitempty"`
 	// DataDir    string         `json:"dataDir,omitempty""`
 	// ResolvConf string         `json:"resolvConf,omitempty""`
 	// Ranges     []RangeSet     `json:"ranges,omitempty""`
+
+	// clusterCIDR, blockSize, excludes & gatewayPolicy of the cluster ip pool
+	initpool.PoolConfig
+	// named pools for pods selected by namespace, labels or node, picked in order before the cluster pool
+	Pools []NamedPoolConfig `json:"pools,omitempty"`
+
+	// how long a fully free block is kept by host before returned to pool, like "10m"
+	BlockReleaseGrace string `json:"blockReleaseGrace,omitempty"`
+
+	// deadline of one cni command, like "30s", every etcd request of it is bounded by it
+	Timeout string `json:"timeout,omitempty"`
+
+	// keep the last ip of a deleted pod, and give it back when the pod with the same namespace/name returns
+	StickyIPs bool `json:"stickyIPs,omitempty"`
+	// how long the ip is kept for a pod that doesn't return, like "1h"
+	StickyIPRetention string `json:"stickyIPRetention,omitempty"`
+
+	// etcd(default), or kubernetes for CRDs through the apiserver
+	Backend string `json:"backend,omitempty"`
+	// apiserver & the pool of the kubernetes backend
+	Kubernetes *etcdwrap.KubeBackendConfig `json:"kubernetes,omitempty"`
+
+	// connection to etcd, or the json file of it, MYCNI_ETCD_* env is used if neither is given
+	Etcd           *etcdwrap.Config `json:"etcd,omitempty"`
+	EtcdConfigFile string           `json:"etcdConfigFile,omitempty"`
+
+	// where the daemon publishes static ip annotations of pods, default /run/mycni/static-ips
+	StaticIPDir string `json:"staticIPDir,omitempty"`
+	// where the daemon publishes labels of pods, their namespaces & node, default /run/mycni/pod-meta
+	PodMetaDir string `json:"podMetaDir,omitempty"`
+	// cri endpoint asked by gc when cni.dev/valid-attachments is not given, like unix:///run/containerd/containerd.sock
+	RuntimeEndpoint string `json:"runtimeEndpoint,omitempty"`
+	// runtimeConfig.ips of the net
+	RuntimeIPs []string `json:"-"`
+
+	// apiserver client, built once per command
+	kubeClient client.Client
+}
+
+// Static ip wanted by the pod, from runtimeConfig, CNI_ARGS or annotations, nil if none.
+// Blocks are ipv4 only, so are the requests.
+func (c *IPAMConfig) StaticRequest(envArgs string) (*staticip.Request, error) {
+	req, err := staticip.Resolve(c.RuntimeIPs, envArgs, c.StaticIPDir)
+	if err != nil || req == nil {
+		return req, err
+	}
+	if !req.IPv4Only() {
+		return nil, fmt.Errorf("%w: only ipv4 is supported by etcdmode, got %s", staticip.ErrInvalidRequest, req)
+	}
+	return req, nil
+}
+
+// Grace of releasing free blocks, DefaultBlockReleaseGrace if not set
+func (c *IPAMConfig) ReleaseGrace() (time.Duration, error) {
+	if c.BlockReleaseGrace == "" {
+		return DefaultBlockReleaseGrace, nil
+	}
+	grace, err := time.ParseDuration(c.BlockReleaseGrace)
+	if err != nil || grace < 0 {
+		return 0, fmt.Errorf("invalid blockReleaseGrace %q", c.BlockReleaseGrace)
+	}
+	return grace, nil
+}
+
+// Retention of sticky ips, DefaultStickyIPRetention if not set
+func (c *IPAMConfig) StickyRetention() (time.Duration, error) {
+	if c.StickyIPRetention == "" {
+		return DefaultStickyIPRetention, nil
+	}
+	retention, err := time.ParseDuration(c.StickyIPRetention)
+	if err != nil || retention < time.Second {
+		return 0, fmt.Errorf("invalid stickyIPRetention %q", c.StickyIPRetention)
+	}
+	return retention, nil
+}
+
+// Deadline of one cni command, DefaultCommandTimeout if not set
+func (c *IPAMConfig) CommandTimeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return DefaultCommandTimeout, nil
+	}
+	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+	return timeout, nil
+}
+
+// Etcd config of the plugin, from `etcd`, `etcdConfigFile` or MYCNI_ETCD_* env
+func (c *IPAMConfig) EtcdConfig() (*etcdwrap.Config, error) {
+	switch {
+	case c.Etcd != nil && c.EtcdConfigFile != "":
+		return nil, fmt.Errorf("%w: only one of etcd and etcdConfigFile can be given", etcdwrap.ErrInvalidConfig)
+	case c.EtcdConfigFile != "":
+		return etcdwrap.LoadConfigFile(c.EtcdConfigFile)
+	case c.Etcd != nil:
+		return c.Etcd, c.Etcd.Validate()
+	}
+	return etcdwrap.ConfigFromEnv()
+}
+
+// Config of the kubernetes backend, defaults if not given
+func (c *IPAMConfig) KubeBackendConfig() *etcdwrap.KubeBackendConfig {
+	if c.Kubernetes == nil {
+		return &etcdwrap.KubeBackendConfig{}
+	}
+	return c.Kubernetes
 }
 
+// Client of the apiserver from KubeBackendConfig, built on first use
+// and shared by the backend & pod lookups of the same command
+func (c *IPAMConfig) KubeClient() (client.Client, error) {
+	if c.kubeClient != nil {
+		return c.kubeClient, nil
+	}
+	kc, err := c.KubeBackendConfig().Client()
+	if err != nil {
+		return nil, err
+	}
+	c.kubeClient = kc
+	return kc, nil
+}
 
 // NewIPAMConfig creates a NetworkConfig from the given network name.
 func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
@@ -47,6 +179,29 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 
 	// Copy net name into IPAM so not to drag Net struct around
 	n.IPAM.Name = n.Name
+	n.IPAM.RuntimeIPs = n.RuntimeConfig.IPs
+
+	if _, err := n.IPAM.ParsePools(); err != nil {
+		return nil, "", err
+	}
+	if _, err := n.IPAM.ReleaseGrace(); err != nil {
+		return nil, "", err
+	}
+	if _, err := n.IPAM.StickyRetention(); err != nil {
+		return nil, "", err
+	}
+	if _, err := n.IPAM.CommandTimeout(); err != nil {
+		return nil, "", err
+	}
+	switch n.IPAM.Backend {
+	case "", BackendEtcd:
+		if _, err := n.IPAM.EtcdConfig(); err != nil {
+			return nil, "", err
+		}
+	case BackendKubernetes:
+	default:
+		return nil, "", fmt.Errorf("unknown ipam backend %q, want etcd or kubernetes", n.IPAM.Backend)
+	}
 
 	// fmt.Println("Env Args are: %s", envArgs)
 	return n.IPAM, n.CNIVersion, nil
@@ -1,8 +1,16 @@
 package allocator
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 	"github.com/stretchr/testify/assert"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/etcdmode/initpool"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -27,4 +35,139 @@ func TestLoadConfig(t *testing.T) {
 		Name: "mynet",
 		Type: "etcdmode",
 	})
-}
\ No newline at end of file
+}
+func TestLoadPoolConfig(t *testing.T) {
+	input := `{
+		"cniVersion": "0.3.1",
+		"name": "mynet",
+		"type": "xyz",
+		"ipam": {
+			"type": "etcdmode",
+			"clusterCIDR": "10.2.0.0/16",
+			"blockSize": 26,
+			"excludes": ["10.2.0.0/24"],
+			"gatewayPolicy": "last",
+			"routes": [{"dst": "0.0.0.0/0"}]
+		}
+	}`
+	te := assert.New(t)
+
+	ipamconf, _, err := LoadIPAMConfig([]byte(input), "")
+	te.Nil(err)
+	te.Equal(ipamconf.PoolConfig, initpool.PoolConfig{
+		ClusterCIDR:   "10.2.0.0/16",
+		BlockSize:     26,
+		Excludes:      []string{"10.2.0.0/24"},
+		GatewayPolicy: "last",
+	})
+	te.Equal(len(ipamconf.Routes), 1)
+
+	// invalid pool is refused when loading
+	_, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "blockSize": 40}}`), "")
+	te.NotNil(err)
+}
+
+func TestLoadStickyConfig(t *testing.T) {
+	te := assert.New(t)
+
+	ipamconf, _, err := LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "stickyIPs": true, "stickyIPRetention": "30m"}}`), "")
+	te.Nil(err)
+	te.True(ipamconf.StickyIPs)
+	retention, err := ipamconf.StickyRetention()
+	te.Nil(err)
+	te.Equal(retention, 30*time.Minute)
+
+	ipamconf, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "stickyIPs": true}}`), "")
+	te.Nil(err)
+	retention, err = ipamconf.StickyRetention()
+	te.Nil(err)
+	te.Equal(retention, DefaultStickyIPRetention)
+
+	_, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "stickyIPRetention": "10ms"}}`), "")
+	te.NotNil(err)
+}
+
+func TestLoadCommandTimeout(t *testing.T) {
+	te := assert.New(t)
+
+	ipamconf, _, err := LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode"}}`), "")
+	te.Nil(err)
+	timeout, err := ipamconf.CommandTimeout()
+	te.Nil(err)
+	te.Equal(timeout, DefaultCommandTimeout)
+
+	ipamconf, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "timeout": "10s"}}`), "")
+	te.Nil(err)
+	timeout, err = ipamconf.CommandTimeout()
+	te.Nil(err)
+	te.Equal(timeout, 10*time.Second)
+
+	_, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "timeout": "0s"}}`), "")
+	te.NotNil(err)
+}
+
+func TestLoadEtcdConfig(t *testing.T) {
+	te := assert.New(t)
+
+	ipamconf, _, err := LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode",
+		"etcd": {"endpoints": ["https://10.0.0.1:2379"], "username": "root", "password": "secret", "keyPrefix": "cluster-a"}}}`), "")
+	te.Nil(err)
+	etcdConf, err := ipamconf.EtcdConfig()
+	te.Nil(err)
+	te.Equal(etcdConf.Endpoints, []string{"https://10.0.0.1:2379"})
+	te.Equal(etcdConf.Prefix(), "cluster-a/")
+
+	// the referred file
+	path := filepath.Join(t.TempDir(), "etcd.json")
+	te.Nil(os.WriteFile(path, []byte(`{"endpoints": ["10.0.0.2:2379"]}`), 0600))
+	ipamconf, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "etcdConfigFile": "`+path+`"}}`), "")
+	te.Nil(err)
+	etcdConf, err = ipamconf.EtcdConfig()
+	te.Nil(err)
+	te.Equal(etcdConf.Endpoints, []string{"10.0.0.2:2379"})
+
+	// invalid or ambiguous configs are refused when loading
+	for _, ipam := range []string{
+		`"etcd": {"endpoints": ["10.0.0.1"]}`,
+		`"etcd": {"endpoints": ["10.0.0.1:2379"], "username": "root"}`,
+		`"etcd": {"endpoints": ["10.0.0.1:2379"]}, "etcdConfigFile": "` + path + `"`,
+		`"etcdConfigFile": "/nonexistent/etcd.json"`,
+	} {
+		_, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", `+ipam+`}}`), "")
+		te.True(errors.Is(err, etcdwrap.ErrInvalidConfig), ipam)
+	}
+}
+
+func TestLoadBackendConfig(t *testing.T) {
+	te := assert.New(t)
+
+	ipamconf, _, err := LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode"}}`), "")
+	te.Nil(err)
+	te.Equal(ipamconf.KubeBackendConfig(), &etcdwrap.KubeBackendConfig{})
+
+	// etcd config is not needed by the kubernetes backend
+	ipamconf, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "backend": "kubernetes",
+		"kubernetes": {"kubeconfig": "/etc/cni/net.d/mycni.kubeconfig", "leaseNamespace": "mycni"}, "etcdConfigFile": "/nonexistent/etcd.json"}}`), "")
+	te.Nil(err)
+	te.Equal(ipamconf.Backend, BackendKubernetes)
+	te.Equal(ipamconf.KubeBackendConfig().LeaseNamespace, "mycni")
+
+	_, _, err = LoadIPAMConfig([]byte(`{"name": "mynet", "ipam": {"type": "etcdmode", "backend": "consul"}}`), "")
+	te.NotNil(err)
+}
+
+func TestStaticRequestIPv4Only(t *testing.T) {
+	te := assert.New(t)
+	conf := &IPAMConfig{StaticIPDir: t.TempDir()}
+
+	conf.RuntimeIPs = []string{"10.1.0.5"}
+	req, err := conf.StaticRequest("")
+	te.Nil(err)
+	te.Equal(req.String(), "10.1.0.5")
+
+	for _, ips := range [][]string{{"fd00::5"}, {"10.1.0.5", "fd00::5"}} {
+		conf.RuntimeIPs = ips
+		_, err = conf.StaticRequest("")
+		te.True(errors.Is(err, staticip.ErrInvalidRequest), "%v", ips)
+	}
+}
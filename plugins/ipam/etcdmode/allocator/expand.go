@@ -0,0 +1,248 @@
+package allocator
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/utils"
+)
+
+const (
+	// fully free blocks are returned to cluster pool after this
+	DefaultBlockReleaseGrace = 10 * time.Minute
+)
+
+var ErrPoolExhausted = errors.New("ip pool is exhausted, no free block left in cluster")
+
+// Value of mycni/ipam/<hostname>/blocks/<cidr>, a block claimed by host
+type BlockClaim struct {
+	Node      string     `json:"node"`
+	ClaimedAt time.Time  `json:"claimedAt"`
+	FreeSince *time.Time `json:"freeSince,omitempty"`
+	// lease of the node daemon, 0 if the daemon isn't running
+	Lease int64 `json:"lease,omitempty"`
+	// named pool the block is taken from, empty for the cluster pool
+	Pool string `json:"pool,omitempty"`
+}
+
+func newBlockClaim(lease int64, pool string) *BlockClaim {
+	node, _ := os.Hostname()
+	return &BlockClaim{Node: node, ClaimedAt: time.Now(), Lease: lease, Pool: pool}
+}
+
+func ParseBlockClaim(val string) (*BlockClaim, error) {
+	c := &BlockClaim{}
+	if err := json.Unmarshal([]byte(val), c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *BlockClaim) String() string {
+	data, _ := json.Marshal(c)
+	return string(data)
+}
+
+// claimed block with the revision it's read at
+type hostBlock struct {
+	cidr  string
+	block *net.IPNet
+	claim *BlockClaim
+	rev   int64
+}
+
+// List blocks claimed by current host, sorted by cidr
+func listHostBlocks(ctx context.Context, cli etcdwrap.Backend) ([]*hostBlock, error) {
+	prefix := utils.GetHostBlocksPath()
+	kvs, err := cli.GetPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*hostBlock
+	for key, kv := range kvs {
+		cidr := strings.TrimPrefix(key, prefix)
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			utils.Log(fmt.Sprintf("Invalid block claim %s: %v", key, err))
+			continue
+		}
+		claim, err := ParseBlockClaim(kv.Value)
+		if err != nil {
+			utils.Log(fmt.Sprintf("Invalid block claim %s: %v", key, err))
+			claim = &BlockClaim{}
+		}
+		blocks = append(blocks, &hostBlock{cidr: cidr, block: block, claim: claim, rev: kv.ModRevision})
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return binary.BigEndian.Uint32(blocks[i].block.IP.To4()) < binary.BigEndian.Uint32(blocks[j].block.IP.To4())
+	})
+	return blocks, nil
+}
+
+// List cidrs of blocks claimed by current host
+func ListHostBlocks(ctx context.Context, cli etcdwrap.Backend) ([]string, error) {
+	blocks, err := listHostBlocks(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		res = append(res, b.cidr)
+	}
+	return res, nil
+}
+
+// List blocks claimed by current host from pool, pools never overlap so the cidr tells
+func listPoolBlocks(ctx context.Context, pool *initpool.Pool, cli etcdwrap.Backend) ([]*hostBlock, error) {
+	blocks, err := listHostBlocks(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+	var res []*hostBlock
+	for _, b := range blocks {
+		if pool.ClusterCIDR.Contains(b.block.IP) {
+			res = append(res, b)
+		}
+	}
+	return res, nil
+}
+
+// Claim one more block from cluster pool for current host
+func ClaimBlock(ctx context.Context, cli etcdwrap.Backend) (string, error) {
+	return ClaimPoolBlock(ctx, "", cli)
+}
+
+// Claim one more block from the named pool for current host, cluster pool if pool is empty
+func ClaimPoolBlock(ctx context.Context, pool string, cli etcdwrap.Backend) (string, error) {
+	var ans string
+	err := withRetry(ctx, func() (bool, error) {
+		poolPath := utils.GetNamedIPPoolPath(pool)
+		val, poolRev, err := cli.Get(ctx, poolPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get ip from ip pool, msg: %w", err)
+		}
+		ippool := poolItems(val)
+		res, err := listReservations(ctx, cli)
+		if err != nil {
+			return false, fmt.Errorf("Cannot list reservations, msg: %w", err)
+		}
+		// blocks reserved entirely are left in pool
+		i := res.pickBlock(ippool)
+		if i < 0 {
+			return false, ErrPoolExhausted
+		}
+		ans = ippool[i]
+
+		lease, err := hostLease(ctx, cli)
+		if err != nil {
+			return false, err
+		}
+		claimPath := utils.GetHostBlockPath(ans)
+		return cli.Txn(ctx,
+			[]etcdwrap.Cmp{
+				etcdwrap.Compare(etcdwrap.ModRevision(poolPath), "=", poolRev),
+				etcdwrap.Compare(etcdwrap.ModRevision(claimPath), "=", 0),
+				res.unchanged(),
+			},
+			etcdwrap.OpPut(poolPath, utils.ConvertArray2String(append(ippool[:i:i], ippool[i+1:]...))),
+			etcdwrap.OpPut(claimPath, newBlockClaim(lease, pool).String()),
+		)
+	})
+	if err != nil {
+		return "", err
+	}
+	if pool != "" {
+		utils.Log(fmt.Sprintf("Claimed block %s of pool %s", ans, pool))
+		return ans, nil
+	}
+	utils.Log("Claimed block " + ans)
+	return ans, nil
+}
+
+// Return blocks of current host back to their pools, if they have been free for grace.
+//
+// A free block is marked on the first check, and released on a later one,
+// the primary block of host(mycni/ipam/<hostname>) is never released here.
+func ReleaseFreeBlocks(ctx context.Context, grace time.Duration, cli etcdwrap.Backend) ([]string, error) {
+	primary, _, err := cli.Get(ctx, utils.GetHostPath())
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := listHostBlocks(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+
+	var released []string
+	for _, b := range blocks {
+		if b.cidr == primary {
+			continue
+		}
+		used, err := ListBlockAllocations(ctx, b.cidr, cli)
+		if err != nil {
+			return released, err
+		}
+		claimPath := utils.GetHostBlockPath(b.cidr)
+
+		// in use again, unmark it
+		if len(used) > 0 {
+			if b.claim.FreeSince == nil {
+				continue
+			}
+			b.claim.FreeSince = nil
+			if _, err := etcdwrap.CompareAndSwap(ctx, cli, claimPath, b.rev, b.claim.String()); err != nil {
+				return released, err
+			}
+			continue
+		}
+
+		// free for the first time, mark it
+		now := time.Now()
+		if b.claim.FreeSince == nil {
+			b.claim.FreeSince = &now
+			if _, err := etcdwrap.CompareAndSwap(ctx, cli, claimPath, b.rev, b.claim.String()); err != nil {
+				return released, err
+			}
+			continue
+		}
+		if now.Sub(*b.claim.FreeSince) < grace {
+			continue
+		}
+
+		// put it back only if claim is untouched & still no ip in block
+		poolPath := utils.GetNamedIPPoolPath(b.claim.Pool)
+		val, poolRev, err := cli.Get(ctx, poolPath)
+		if err != nil {
+			return released, err
+		}
+		ok, err := cli.Txn(ctx,
+			[]etcdwrap.Cmp{
+				etcdwrap.Compare(etcdwrap.ModRevision(claimPath), "=", b.rev),
+				etcdwrap.Compare(etcdwrap.ModRevision(poolPath), "=", poolRev),
+				etcdwrap.Compare(etcdwrap.CreateRevision(utils.GetBlockPath(b.cidr)), "=", 0).WithPrefix(),
+			},
+			etcdwrap.OpDelete(claimPath),
+			etcdwrap.OpPut(poolPath, utils.ConvertArray2String(append(poolItems(val), b.cidr))),
+		)
+		if err != nil {
+			return released, err
+		}
+		if ok {
+			utils.Log("Released free block " + b.cidr)
+			released = append(released, b.cidr)
+		}
+	}
+	return released, nil
+}
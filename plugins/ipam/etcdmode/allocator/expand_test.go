@@ -0,0 +1,143 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/etcdwrap"
+	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/utils"
+)
+
+// 4 blocks of /28, 13 usable ips each
+func newSmallPool(t *testing.T, cli etcdwrap.Backend) *initpool.Pool {
+	ctx := context.Background()
+	pool, err := initpool.PoolConfig{ClusterCIDR: "10.1.0.0/26", BlockSize: 28}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := initpool.InitPool(ctx, pool, cli); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestExpandBlocks(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	for i := 0; i < 14; i++ {
+		_, err := AllocateIP2Pod(ctx, fmt.Sprintf("dummy%d", i), "eth0", pool, cli)
+		te.Nil(err)
+	}
+	blocks, err := ListHostBlocks(ctx, cli)
+	te.Nil(err)
+	te.Equal(blocks, []string{"10.1.0.0/28", "10.1.0.16/28"})
+
+	// ip of the second block comes with its own gateway
+	conf, err := AllocateIP2Pod(ctx, "dummy13", "eth0", pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.18/28")
+	te.Equal(conf.Gateway.String(), "10.1.0.17")
+
+	// the rest 2 blocks, then nothing left
+	for i := 14; i < 13*4; i++ {
+		_, err := AllocateIP2Pod(ctx, fmt.Sprintf("dummy%d", i), "eth0", pool, cli)
+		te.Nil(err)
+	}
+	_, err = AllocateIP2Pod(ctx, "dummy-full", "eth0", pool, cli)
+	te.True(errors.Is(err, ErrPoolExhausted))
+}
+
+func TestReleaseFreeBlocks(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	for i := 0; i < 14; i++ {
+		_, err := AllocateIP2Pod(ctx, fmt.Sprintf("dummy%d", i), "eth0", pool, cli)
+		te.Nil(err)
+	}
+	// dummy13 is the only one in 10.1.0.16/28
+	_, err := ReleasePodIP(ctx, "dummy13", "eth0", cli)
+	te.Nil(err)
+
+	// marked free on first check, kept within the grace
+	released, err := ReleaseFreeBlocks(ctx, time.Hour, cli)
+	te.Nil(err)
+	te.Empty(released)
+	released, err = ReleaseFreeBlocks(ctx, time.Hour, cli)
+	te.Nil(err)
+	te.Empty(released)
+
+	// the primary block is never released, even if free
+	for i := 0; i < 13; i++ {
+		_, err := ReleasePodIP(ctx, fmt.Sprintf("dummy%d", i), "eth0", cli)
+		te.Nil(err)
+	}
+	released, err = ReleaseFreeBlocks(ctx, 0, cli)
+	te.Nil(err)
+	te.Equal(released, []string{"10.1.0.16/28"})
+
+	blocks, err := ListHostBlocks(ctx, cli)
+	te.Nil(err)
+	te.Equal(blocks, []string{"10.1.0.0/28"})
+	val, _, err := cli.Get(ctx, utils.GetIPPoolPath())
+	te.Nil(err)
+	te.Contains(utils.ConvertString2Array(val), "10.1.0.16/28")
+}
+
+func TestReleaseBlockInUseAgain(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	_, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+	te.Nil(err)
+	extra, err := ClaimBlock(ctx, cli)
+	te.Nil(err)
+	te.Equal(extra, "10.1.0.16/28")
+
+	// marked free, then used before the grace is over
+	released, err := ReleaseFreeBlocks(ctx, 0, cli)
+	te.Nil(err)
+	te.Empty(released)
+	te.Nil(cli.Put(ctx, utils.GetBlockIPPath(extra, "10.1.0.18"), newAllocation("dummy1", "eth0", nil).String()))
+	released, err = ReleaseFreeBlocks(ctx, 0, cli)
+	te.Nil(err)
+	te.Empty(released)
+
+	// free again, has to wait for the whole grace once more
+	te.Nil(cli.Delete(ctx, utils.GetBlockIPPath(extra, "10.1.0.18")))
+	released, err = ReleaseFreeBlocks(ctx, 0, cli)
+	te.Nil(err)
+	te.Empty(released)
+	released, err = ReleaseFreeBlocks(ctx, 0, cli)
+	te.Nil(err)
+	te.Equal(released, []string{extra})
+}
+
+func TestCancelledCommand(t *testing.T) {
+	te := assert.New(t)
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	// the command has run out of time, nothing is allocated
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+	te.True(errors.Is(err, context.Canceled), "%v", err)
+
+	ok, err := FindByID(context.Background(), "dummy0", "eth0", cli)
+	te.Nil(err)
+	te.False(ok)
+}
@@ -0,0 +1,87 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/gc"
+	"mycni/utils"
+)
+
+// Device of current host with its ip, from mycni/ipam/<hostname>/<containerID>-<ifname>
+type hostDevice struct {
+	att gc.Attachment
+	ip  string
+}
+
+func listHostDevices(ctx context.Context, cli etcdwrap.Backend) ([]hostDevice, error) {
+	prefix := utils.GetHostPath() + "/"
+	kvs, err := etcdwrap.ListKV(ctx, cli, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var devs []hostDevice
+	for key, val := range kvs {
+		id := strings.TrimPrefix(key, prefix)
+		if key == utils.GetHostIPPoolPath() || key == utils.GetHostGWPath() || strings.HasPrefix(key, utils.GetHostBlocksPath()) {
+			continue
+		}
+		// device id is <containerID>-<ifname>
+		i := strings.LastIndex(id, "-")
+		if i <= 0 {
+			continue
+		}
+		devs = append(devs, hostDevice{att: gc.Attachment{ContainerID: id[:i], IfName: id[i+1:]}, ip: val})
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].att.String() < devs[j].att.String() })
+	return devs, nil
+}
+
+// Release ips of current host whose containers are gone, allocations younger than minAge are kept.
+// Returns the released attachments.
+func GC(ctx context.Context, checker gc.Checker, minAge time.Duration, cli etcdwrap.Backend) ([]gc.Attachment, error) {
+	devs, err := listHostDevices(ctx, cli)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list devices of host! err is %w", err)
+	}
+
+	var released []gc.Attachment
+	for _, d := range devs {
+		if checker.Alive(d.att) {
+			continue
+		}
+		if minAge > 0 && allocatedSince(ctx, d.ip, cli) < minAge {
+			continue
+		}
+		if _, err := ReleasePodIP(ctx, d.att.ContainerID, d.att.IfName, cli); err != nil {
+			return released, err
+		}
+		utils.Log(fmt.Sprintf("Released leaked ip %s of %s", d.ip, d.att))
+		released = append(released, d.att)
+	}
+	return released, nil
+}
+
+// How long the ip has been allocated, forever if unknown
+func allocatedSince(ctx context.Context, ipcidr string, cli etcdwrap.Backend) time.Duration {
+	ip, block, err := net.ParseCIDR(ipcidr)
+	if err != nil {
+		return time.Duration(math.MaxInt64)
+	}
+	val, _, err := cli.Get(ctx, utils.GetBlockIPPath(block.String(), ip.String()))
+	if err != nil || val == "" {
+		return time.Duration(math.MaxInt64)
+	}
+	a, err := ParseAllocation(val)
+	if err != nil || a.Timestamp.IsZero() {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Since(a.Timestamp)
+}
@@ -0,0 +1,58 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/gc"
+)
+
+// fakeRuntime lists the sandboxes still alive
+type fakeRuntime []string
+
+func (r fakeRuntime) ListContainers(ctx context.Context) ([]string, error) {
+	return r, nil
+}
+
+func TestGC(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	for i := 0; i < 3; i++ {
+		_, err := AllocateIP2Pod(ctx, fmt.Sprintf("dummy%d", i), "eth0", pool, cli)
+		te.Nil(err)
+	}
+
+	checker, err := gc.FromLister(context.TODO(), fakeRuntime{"dummy1"})
+	te.Nil(err)
+	// too young to be collected
+	released, err := GC(ctx, checker, time.Hour, cli)
+	te.Nil(err)
+	te.Empty(released)
+
+	released, err = GC(ctx, checker, 0, cli)
+	te.Nil(err)
+	te.Equal(released, []gc.Attachment{{ContainerID: "dummy0", IfName: "eth0"}, {ContainerID: "dummy2", IfName: "eth0"}})
+	devs, err := listHostDevices(ctx, cli)
+	te.Nil(err)
+	te.Equal(len(devs), 1)
+	te.Equal(devs[0].att.ContainerID, "dummy1")
+
+	// released ip is allocated again
+	conf, err := AllocateIP2Pod(ctx, "dummy3", "eth0", pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.2/28")
+
+	// valid attachments of the GC verb
+	checker = gc.FromAttachments([]gc.Attachment{{ContainerID: "dummy3", IfName: "eth0"}})
+	released, err = GC(ctx, checker, 0, cli)
+	te.Nil(err)
+	te.Equal(released, []gc.Attachment{{ContainerID: "dummy1", IfName: "eth0"}})
+}
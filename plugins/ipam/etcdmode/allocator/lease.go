@@ -0,0 +1,114 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/utils"
+)
+
+const (
+	// ttl of the node lease in seconds
+	DefaultNodeLeaseTTL = 30
+)
+
+// Lease of current host's daemon, 0 if no daemon keeps one
+func hostLease(ctx context.Context, cli etcdwrap.Backend) (int64, error) {
+	val, _, err := cli.Get(ctx, utils.GetHostLeasePath())
+	if err != nil {
+		return 0, fmt.Errorf("Cannot get lease of host! err is %w", err)
+	}
+	if val == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(val, 16, 64)
+	if err != nil {
+		utils.Log(fmt.Sprintf("Invalid lease %q of host: %v", val, err))
+		return 0, nil
+	}
+	return id, nil
+}
+
+// NodeLease ties blocks claimed by current host to an etcd lease,
+// which is kept alive by the node daemon.
+//
+// The lease key mycni/ipam/leases/<hostname> goes away with the lease,
+// claims of the host record the lease id, so the reclaimer knows when the node is gone.
+type NodeLease struct {
+	cli etcdwrap.Backend
+	TTL int64
+	ID  int64
+}
+
+func NewNodeLease(cli etcdwrap.Backend) *NodeLease {
+	return &NodeLease{cli: cli, TTL: DefaultNodeLeaseTTL}
+}
+
+// Grant a new lease, publish it & move claims of current host onto it
+func (l *NodeLease) Acquire(ctx context.Context) error {
+	id, err := l.cli.GrantLease(ctx, l.TTL)
+	if err != nil {
+		return fmt.Errorf("Cannot grant node lease: %w", err)
+	}
+	if err := l.cli.Put(ctx, utils.GetHostLeasePath(), strconv.FormatInt(id, 16), etcdwrap.WithLease(id)); err != nil {
+		return fmt.Errorf("Cannot put node lease: %w", err)
+	}
+	l.ID = id
+	return l.adoptClaims(ctx)
+}
+
+// claims made before the daemon started, or under an old lease
+func (l *NodeLease) adoptClaims(ctx context.Context) error {
+	blocks, err := listHostBlocks(ctx, l.cli)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if b.claim.Lease == l.ID {
+			continue
+		}
+		err := withRetry(ctx, func() (bool, error) {
+			claimPath := utils.GetHostBlockPath(b.cidr)
+			val, rev, err := l.cli.Get(ctx, claimPath)
+			if err != nil || rev == 0 {
+				// released in the meantime
+				return err == nil, err
+			}
+			claim, err := ParseBlockClaim(val)
+			if err != nil {
+				claim = newBlockClaim(0, "")
+			}
+			claim.Lease = l.ID
+			return etcdwrap.CompareAndSwap(ctx, l.cli, claimPath, rev, claim.String())
+		})
+		if err != nil {
+			return err
+		}
+		utils.Log(fmt.Sprintf("Block %s is now held by lease %x", b.cidr, l.ID))
+	}
+	return nil
+}
+
+// Keep the lease alive until ctx is done, a new one is acquired if it's lost
+func (l *NodeLease) Run(ctx context.Context) error {
+	for {
+		if err := l.Acquire(ctx); err != nil {
+			utils.Log(err.Error())
+		} else if ch, err := l.cli.KeepAlive(ctx, l.ID); err != nil {
+			utils.Log(fmt.Sprintf("Cannot keep node lease alive: %v", err))
+		} else {
+			for range ch {
+			}
+			utils.Log(fmt.Sprintf("Node lease %x is lost", l.ID))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
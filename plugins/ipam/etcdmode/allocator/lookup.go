@@ -0,0 +1,60 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"mycni/etcdwrap"
+	"mycni/utils"
+)
+
+// List allocated ips of all blocks, keyed by ip without mask
+func ListAllocations(ctx context.Context, cli etcdwrap.Backend) (map[string]*Allocation, error) {
+	kvs, err := etcdwrap.ListKV(ctx, cli, utils.GetBlocksPath())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*Allocation, len(kvs))
+	for key, val := range kvs {
+		// key is mycni/ipam/blocks/<cidr>/<ip>
+		ip := key[strings.LastIndex(key, "/")+1:]
+		a, err := ParseAllocation(val)
+		if err != nil {
+			utils.Log(fmt.Sprintf("Invalid allocation %s: %v", key, err))
+			a = &Allocation{}
+		}
+		res[ip] = a
+	}
+	return res, nil
+}
+
+// Find who owns the ip, nil if it's not allocated
+func FindByIP(ctx context.Context, ip string, cli etcdwrap.Backend) (*Allocation, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("invalid ip %q", ip)
+	}
+	allocs, err := ListAllocations(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+	return allocs[net.ParseIP(ip).String()], nil
+}
+
+// Find ips allocated to the pod, keyed by ip without mask
+func FindByPod(ctx context.Context, namespace, name string, cli etcdwrap.Backend) (map[string]*Allocation, error) {
+	allocs, err := ListAllocations(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*Allocation)
+	for ip, a := range allocs {
+		if a.Pod.Is(namespace, name) {
+			res[ip] = a
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/podinfo"
+)
+
+func TestFindByPodAndIP(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	db := &podinfo.Pod{Namespace: "default", Name: "db-0", UID: "uid-0"}
+	conf, err := AllocatePodIP(ctx, "c0", "eth0", db, nil, pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.2/28")
+	_, err = AllocatePodIP(ctx, "c0", "net1", db, nil, pool, cli)
+	te.Nil(err)
+	_, err = AllocatePodIP(ctx, "c1", "eth0", &podinfo.Pod{Namespace: "kube-system", Name: "db-0"}, nil, pool, cli)
+	te.Nil(err)
+	// not a k8s pod
+	_, err = AllocateIP2Pod(ctx, "c2", "eth0", pool, cli)
+	te.Nil(err)
+
+	a, err := FindByIP(ctx, "10.1.0.2", cli)
+	te.Nil(err)
+	te.Equal(a.ContainerID, "c0")
+	te.Equal(a.IfName, "eth0")
+	te.Equal(*a.Pod, *db)
+	a, err = FindByIP(ctx, "10.1.0.5", cli)
+	te.Nil(err)
+	te.Nil(a.Pod)
+	a, err = FindByIP(ctx, "10.1.0.9", cli)
+	te.Nil(err)
+	te.Nil(a)
+	_, err = FindByIP(ctx, "foo", cli)
+	te.NotNil(err)
+
+	allocs, err := FindByPod(ctx, "default", "db-0", cli)
+	te.Nil(err)
+	te.Equal(len(allocs), 2)
+	te.Equal(allocs["10.1.0.3"].IfName, "net1")
+	allocs, err = FindByPod(ctx, "default", "db-1", cli)
+	te.Nil(err)
+	te.Empty(allocs)
+
+	// released with the device
+	_, err = ReleasePodIP(ctx, "c0", "eth0", cli)
+	te.Nil(err)
+	allocs, err = FindByPod(ctx, "default", "db-0", cli)
+	te.Nil(err)
+	te.Equal(len(allocs), 1)
+}
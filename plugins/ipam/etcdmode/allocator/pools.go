@@ -0,0 +1,203 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"mycni/pkg/podinfo"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/etcdmode/initpool"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// name of the cluster pool(top-level clusterCIDR...) in the pool annotation
+	DefaultPoolName = "default"
+)
+
+var ErrNoPool = errors.New("no ip pool for the pod")
+
+// A named pool in `pools`, for pods matching all of its selectors.
+// Empty selectors match everything.
+type NamedPoolConfig struct {
+	Name string `json:"name"`
+	// clusterCIDR(required), blockSize, excludes & gatewayPolicy of the pool
+	initpool.PoolConfig
+
+	// pods in these namespaces
+	Namespaces []string `json:"namespaces,omitempty"`
+	// pods in namespaces with these labels
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// pods with these labels
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// pods on nodes with these labels
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+}
+
+// Whether labels of pod, namespace or node are needed to match the pool
+func (c *NamedPoolConfig) selectsByLabels() bool {
+	return c.NamespaceSelector != nil || c.PodSelector != nil || c.NodeSelector != nil
+}
+
+func selectorMatches(s *metav1.LabelSelector, set map[string]string) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(s)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(set)), nil
+}
+
+// Whether the pod is allowed to draw from the pool
+func (c *NamedPoolConfig) matches(meta *podinfo.Meta) (bool, error) {
+	if len(c.Namespaces) > 0 {
+		found := false
+		for _, ns := range c.Namespaces {
+			found = found || ns == meta.Namespace
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	for _, m := range []struct {
+		selector *metav1.LabelSelector
+		labels   map[string]string
+	}{
+		{c.NamespaceSelector, meta.NamespaceLabels},
+		{c.PodSelector, meta.Labels},
+		{c.NodeSelector, meta.NodeLabels},
+	} {
+		ok, err := selectorMatches(m.selector, m.labels)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Validate named pools, their names & cidrs are unique, and never overlap the cluster pool
+func (c *IPAMConfig) ParsePools() ([]*initpool.Pool, error) {
+	cluster, err := c.PoolConfig.Parse()
+	if err != nil {
+		return nil, err
+	}
+	pools := []*initpool.Pool{cluster}
+	for i := range c.Pools {
+		conf := &c.Pools[i]
+		if errs := validation.IsDNS1123Label(conf.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid pool name %q: %v", conf.Name, errs)
+		}
+		if conf.Name == DefaultPoolName {
+			return nil, fmt.Errorf("invalid pool name %q: reserved for the cluster pool", conf.Name)
+		}
+		if conf.ClusterCIDR == "" {
+			return nil, fmt.Errorf("pool %s: clusterCIDR is required", conf.Name)
+		}
+		pool, err := conf.PoolConfig.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", conf.Name, err)
+		}
+		pool.Name = conf.Name
+		for _, s := range []*metav1.LabelSelector{conf.NamespaceSelector, conf.PodSelector, conf.NodeSelector} {
+			if s == nil {
+				continue
+			}
+			if _, err := metav1.LabelSelectorAsSelector(s); err != nil {
+				return nil, fmt.Errorf("pool %s: invalid selector: %w", conf.Name, err)
+			}
+		}
+		for _, p := range pools {
+			if p.Name == pool.Name {
+				return nil, fmt.Errorf("duplicated pool %s", pool.Name)
+			}
+			if p.Overlaps(pool) {
+				return nil, fmt.Errorf("pool %s: %s overlaps %s", pool.Name, pool.ClusterCIDR, p.ClusterCIDR)
+			}
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// Metadata of the pod which pools are selected by.
+// If some pool selects by labels, they are read from the metadata published by the daemon,
+// or from the apiserver if not published yet. Or else only the pool annotation
+// published by the daemon is read, which needs no apiserver.
+func (c *IPAMConfig) PodMeta(ctx context.Context, pod *podinfo.Pod) (*podinfo.Meta, error) {
+	if pod == nil {
+		return nil, nil
+	}
+	selecting := ""
+	for i := range c.Pools {
+		if c.Pools[i].selectsByLabels() {
+			selecting = c.Pools[i].Name
+			break
+		}
+	}
+	if selecting == "" {
+		annotations, err := staticip.NewStore(c.StaticIPDir).Read(pod.Namespace, pod.Name)
+		if err != nil {
+			return nil, err
+		}
+		return &podinfo.Meta{Namespace: pod.Namespace, Annotations: annotations}, nil
+	}
+
+	store := podinfo.NewMetaStore(c.PodMetaDir)
+	meta, err := store.Read(pod.Namespace, pod.Name)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		return meta, nil
+	}
+	kc, err := c.KubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("pool %s selects pods by labels, but labels of pod %s are not published in %s and apiserver is unreachable: %w",
+			selecting, pod, store.Dir, err)
+	}
+	return podinfo.LookupMeta(ctx, kc, pod)
+}
+
+// Pick the pool of a pod: the one named by its pool annotation if any,
+// or else the first named pool matching the pod, the cluster pool if none does.
+// Pods not from kubelet(meta is nil) always go to the cluster pool.
+func (c *IPAMConfig) SelectPool(meta *podinfo.Meta) (*initpool.Pool, error) {
+	pools, err := c.ParsePools()
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return pools[0], nil
+	}
+
+	wanted := meta.Annotations[podinfo.AnnotationPool]
+	if wanted == DefaultPoolName {
+		return pools[0], nil
+	}
+	for i, conf := range c.Pools {
+		if wanted != "" && conf.Name != wanted {
+			continue
+		}
+		ok, err := conf.matches(meta)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return pools[i+1], nil
+		}
+		// compliance zones, a pod can't get into a pool by annotation alone
+		if wanted != "" {
+			return nil, fmt.Errorf("%w: pool %s doesn't select pod in namespace %s", ErrNoPool, wanted, meta.Namespace)
+		}
+	}
+	if wanted != "" {
+		return nil, fmt.Errorf("%w: unknown pool %s", ErrNoPool, wanted)
+	}
+	return pools[0], nil
+}
@@ -0,0 +1,220 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/podinfo"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/utils"
+)
+
+func TestLoadPools(t *testing.T) {
+	te := assert.New(t)
+	load := func(pools string) (*IPAMConfig, error) {
+		conf, _, err := LoadIPAMConfig([]byte(`{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"ipam": {"type": "etcdmode", "clusterCIDR": "10.1.0.0/16", "etcd": {"endpoints": ["127.0.0.1:2379"]}, "pools": `+pools+`}
+		}`), "")
+		return conf, err
+	}
+
+	conf, err := load(`[{
+		"name": "pci", "clusterCIDR": "10.2.0.0/24", "blockSize": 28,
+		"namespaces": ["payments"],
+		"podSelector": {"matchExpressions": [{"key": "tier", "operator": "In", "values": ["db"]}]},
+		"nodeSelector": {"matchLabels": {"zone": "pci"}}
+	}]`)
+	te.Nil(err)
+	pools, err := conf.ParsePools()
+	te.Nil(err)
+	te.Equal(len(pools), 2)
+	te.Equal(pools[1].Name, "pci")
+	te.Equal(pools[1].BlockSize, 28)
+	te.Equal(pools[1].Path(), utils.GetKeyPrefix()+"pools/pci/pool")
+
+	for _, pools := range []string{
+		`[{"name": "pci"}]`,
+		`[{"name": "default", "clusterCIDR": "10.2.0.0/24"}]`,
+		`[{"name": "PCI", "clusterCIDR": "10.2.0.0/24"}]`,
+		`[{"name": "pci", "clusterCIDR": "10.1.2.0/24"}]`,
+		`[{"name": "pci", "clusterCIDR": "10.2.0.0/24"}, {"name": "pci", "clusterCIDR": "10.3.0.0/24"}]`,
+		`[{"name": "pci", "clusterCIDR": "10.2.0.0/24"}, {"name": "hipaa", "clusterCIDR": "10.2.0.128/25"}]`,
+		`[{"name": "pci", "clusterCIDR": "10.2.0.0/24", "podSelector": {"matchExpressions": [{"key": "tier", "operator": "Bad"}]}}]`,
+	} {
+		_, err := load(pools)
+		te.NotNil(err, pools)
+	}
+}
+
+func TestSelectPool(t *testing.T) {
+	te := assert.New(t)
+	conf, _, err := LoadIPAMConfig([]byte(`{
+		"cniVersion": "0.3.1",
+		"name": "mynet",
+		"ipam": {
+			"type": "etcdmode",
+			"backend": "kubernetes",
+			"pools": [
+				{"name": "pci", "clusterCIDR": "10.2.0.0/24", "namespaces": ["payments"], "nodeSelector": {"matchLabels": {"zone": "pci"}}},
+				{"name": "restricted", "clusterCIDR": "10.3.0.0/24", "namespaceSelector": {"matchLabels": {"compliance": "restricted"}}},
+				{"name": "db", "clusterCIDR": "10.4.0.0/24", "podSelector": {"matchLabels": {"tier": "db"}}}
+			]
+		}
+	}`), "")
+	te.Nil(err)
+
+	pciNode := map[string]string{"zone": "pci"}
+	for _, c := range []struct {
+		meta *podinfo.Meta
+		pool string
+	}{
+		{nil, ""},
+		{&podinfo.Meta{Namespace: "default"}, ""},
+		{&podinfo.Meta{Namespace: "payments", NodeLabels: pciNode}, "pci"},
+		// not on a node of the zone
+		{&podinfo.Meta{Namespace: "payments"}, ""},
+		{&podinfo.Meta{Namespace: "hr", NamespaceLabels: map[string]string{"compliance": "restricted"}}, "restricted"},
+		// first match wins
+		{&podinfo.Meta{Namespace: "payments", NodeLabels: pciNode, Labels: map[string]string{"tier": "db"}}, "pci"},
+		{&podinfo.Meta{Namespace: "default", Labels: map[string]string{"tier": "db"}}, "db"},
+		// picked by annotation among the allowed ones
+		{&podinfo.Meta{Namespace: "payments", NodeLabels: pciNode, Labels: map[string]string{"tier": "db"},
+			Annotations: map[string]string{podinfo.AnnotationPool: "db"}}, "db"},
+		{&podinfo.Meta{Namespace: "default", Labels: map[string]string{"tier": "db"},
+			Annotations: map[string]string{podinfo.AnnotationPool: DefaultPoolName}}, ""},
+	} {
+		pool, err := conf.SelectPool(c.meta)
+		te.Nil(err)
+		te.Equal(pool.Name, c.pool, c.meta)
+	}
+
+	// annotation alone doesn't let a pod into a pool
+	_, err = conf.SelectPool(&podinfo.Meta{Namespace: "default", Annotations: map[string]string{podinfo.AnnotationPool: "pci"}})
+	te.True(errors.Is(err, ErrNoPool))
+	_, err = conf.SelectPool(&podinfo.Meta{Namespace: "default", Annotations: map[string]string{podinfo.AnnotationPool: "nope"}})
+	te.True(errors.Is(err, ErrNoPool))
+}
+
+func TestPodMeta(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	conf, _, err := LoadIPAMConfig([]byte(`{
+		"cniVersion": "0.3.1",
+		"name": "mynet",
+		"ipam": {
+			"type": "etcdmode",
+			"clusterCIDR": "10.1.0.0/16",
+			"etcd": {"endpoints": ["127.0.0.1:2379"]},
+			"podMetaDir": "`+dir+`",
+			"kubernetes": {"kubeconfig": "`+filepath.Join(dir, "no-kubeconfig")+`"},
+			"pools": [{"name": "db", "clusterCIDR": "10.4.0.0/24", "podSelector": {"matchLabels": {"tier": "db"}}}]
+		}
+	}`), "")
+	te.Nil(err)
+
+	// published by the daemon, no apiserver needed
+	published := &podinfo.Meta{Namespace: "default", Labels: map[string]string{"tier": "db"}}
+	te.Nil(podinfo.NewMetaStore(dir).Write("default", "db-0", published))
+	meta, err := conf.PodMeta(ctx, &podinfo.Pod{Namespace: "default", Name: "db-0"})
+	te.Nil(err)
+	te.Equal(meta, published)
+
+	// not published, and no apiserver to ask
+	_, err = conf.PodMeta(ctx, &podinfo.Pod{Namespace: "default", Name: "db-1"})
+	te.NotNil(err)
+	te.Contains(err.Error(), "pool db selects pods by labels")
+}
+
+func TestAllocateFromPools(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, cli etcdwrap.Backend) {
+		te := assert.New(t)
+		ctx := context.Background()
+		cluster := newSmallPool(t, cli)
+		pci, err := initpool.PoolConfig{ClusterCIDR: "10.2.0.0/26", BlockSize: 28, GatewayPolicy: initpool.GatewayLast}.Parse()
+		te.Nil(err)
+		pci.Name = "pci"
+		_, err = initpool.InitPool(ctx, pci, cli)
+		te.Nil(err)
+
+		pod := &podinfo.Pod{Namespace: "payments", Name: "db-0"}
+		conf, err := AllocatePodIP(ctx, "dummy0", "eth0", pod, nil, pci, cli)
+		te.Nil(err)
+		te.Equal(conf.Address.String(), "10.2.0.1/28")
+		te.Equal(conf.Gateway.String(), "10.2.0.14")
+		conf, err = AllocatePodIP(ctx, "dummy1", "eth0", nil, nil, cluster, cli)
+		te.Nil(err)
+		te.Equal(conf.Address.String(), "10.1.0.2/28")
+
+		// allocations & claims tell their pool
+		a, err := FindByIP(ctx, "10.2.0.1", cli)
+		te.Nil(err)
+		te.Equal(a.Pool, "pci")
+		a, err = FindByIP(ctx, "10.1.0.2", cli)
+		te.Nil(err)
+		te.Equal(a.Pool, "")
+		blocks, err := listHostBlocks(ctx, cli)
+		te.Nil(err)
+		te.Equal(len(blocks), 2)
+		te.Equal(blocks[1].claim.Pool, "pci")
+
+		// a static ip of another pool is never taken
+		req, _ := staticip.NewRequest([]string{"10.1.0.5"}, "")
+		_, err = AllocatePodIP(ctx, "dummy2", "eth0", nil, req, pci, cli)
+		te.True(errors.Is(err, staticip.ErrIPNotInBlock))
+
+		// the free block goes back to its own pool
+		_, err = ReleasePodIP(ctx, "dummy0", "eth0", cli)
+		te.Nil(err)
+		for i := 0; i < 2; i++ {
+			_, err = ReleaseFreeBlocks(ctx, 0, cli)
+			te.Nil(err)
+		}
+		val, _, err := cli.Get(ctx, pci.Path())
+		te.Nil(err)
+		te.Contains(utils.ConvertString2Array(val), "10.2.0.0/28")
+		val, _, err = cli.Get(ctx, cluster.Path())
+		te.Nil(err)
+		te.NotContains(utils.ConvertString2Array(val), "10.2.0.0/28")
+	})
+}
+
+func TestReissueStickyIPOtherPool(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	cluster := newSmallPool(t, cli)
+	pci, err := initpool.PoolConfig{ClusterCIDR: "10.2.0.0/26", BlockSize: 28}.Parse()
+	te.Nil(err)
+	pci.Name = "pci"
+	_, err = initpool.InitPool(ctx, pci, cli)
+	te.Nil(err)
+
+	pod := &podinfo.Pod{Namespace: "payments", Name: "db-0"}
+	conf, err := AllocatePodIP(ctx, "dummy0", "eth0", pod, nil, cluster, cli)
+	te.Nil(err)
+	_, err = ReleasePodIPSticky(ctx, "dummy0", "eth0", time.Hour, cli)
+	te.Nil(err)
+
+	// namespace is moved into the pci zone, the old ip isn't given back
+	reissued, err := ReissueStickyIP(ctx, "dummy1", "eth0", pod, pci, cli)
+	te.Nil(err)
+	te.Nil(reissued)
+	a, err := FindByIP(ctx, conf.Address.IP.String(), cli)
+	te.Nil(err)
+	te.Nil(a)
+
+	conf, err = AllocatePodIP(ctx, "dummy1", "eth0", pod, nil, pci, cli)
+	te.Nil(err)
+	te.True((&net.IPNet{IP: net.IPv4(10, 2, 0, 0), Mask: net.CIDRMask(26, 32)}).Contains(conf.Address.IP))
+}
@@ -0,0 +1,263 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/utils"
+
+	"k8s.io/utils/clock"
+)
+
+const (
+	DefaultReclaimInterval = time.Minute
+	// blocks of a node are kept for a while after its lease expires, in case it's just restarting
+	DefaultReclaimGrace = 5 * time.Minute
+	// ttl of the election session in seconds
+	DefaultElectionTTL = 15
+)
+
+// Reclaimer returns blocks of dead nodes back to their pools.
+//
+// A block is reclaimed once the lease in its claim has expired for the grace,
+// the node doesn't come back with a new lease, and no other node allocates in it.
+// Allocations, devices & the host keys of the dead node go away with the block.
+// Only the elected leader among node daemons does the work.
+type Reclaimer struct {
+	cli      etcdwrap.Backend
+	Name     string
+	Interval time.Duration
+	Grace    time.Duration
+	Clock    clock.WithTicker
+
+	// claims seen with an expired lease, and when
+	expiredSince map[string]time.Time
+}
+
+func NewReclaimer(cli etcdwrap.Backend, name string) *Reclaimer {
+	return &Reclaimer{
+		cli:          cli,
+		Name:         name,
+		Interval:     DefaultReclaimInterval,
+		Grace:        DefaultReclaimGrace,
+		Clock:        clock.RealClock{},
+		expiredSince: make(map[string]time.Time),
+	}
+}
+
+type nodeClaim struct {
+	node string
+	cidr string
+	key  string
+}
+
+// Find claims of all nodes, mycni/ipam/<node>/blocks/<cidr>
+func listAllClaims(ctx context.Context, cli etcdwrap.Backend) ([]nodeClaim, error) {
+	keys, err := etcdwrap.ListKeys(ctx, cli, utils.GetKeyPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var claims []nodeClaim
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, utils.GetKeyPrefix()), "/", 3)
+		if len(parts) != 3 || parts[1] != "blocks" || parts[0] == "blocks" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(parts[2]); err != nil {
+			continue
+		}
+		claims = append(claims, nodeClaim{node: parts[0], cidr: parts[2], key: key})
+	}
+	sort.Slice(claims, func(i, j int) bool { return claims[i].key < claims[j].key })
+	return claims, nil
+}
+
+// Check all claims once, returns the reclaimed blocks
+func (r *Reclaimer) ReclaimOnce(ctx context.Context) ([]string, error) {
+	claims, err := listAllClaims(ctx, r.cli)
+	if err != nil {
+		return nil, err
+	}
+
+	var reclaimed []string
+	seen := make(map[string]bool, len(claims))
+	for _, c := range claims {
+		seen[c.key] = true
+		ok, err := r.check(ctx, c)
+		if err != nil {
+			return reclaimed, err
+		}
+		if ok {
+			delete(r.expiredSince, c.key)
+			reclaimed = append(reclaimed, c.cidr)
+		}
+	}
+	// forget claims which are gone
+	for key := range r.expiredSince {
+		if !seen[key] {
+			delete(r.expiredSince, key)
+		}
+	}
+	return reclaimed, nil
+}
+
+func (r *Reclaimer) check(ctx context.Context, c nodeClaim) (bool, error) {
+	val, claimRev, err := r.cli.Get(ctx, c.key)
+	if err != nil || claimRev == 0 {
+		return false, err
+	}
+	claim, err := ParseBlockClaim(val)
+	if err != nil {
+		utils.Log(fmt.Sprintf("Invalid block claim %s: %v", c.key, err))
+		return false, nil
+	}
+	// claimed without daemon, nobody knows whether the node is alive
+	if claim.Lease == 0 {
+		delete(r.expiredSince, c.key)
+		return false, nil
+	}
+	ttl, err := r.cli.LeaseTTL(ctx, claim.Lease)
+	if err != nil {
+		return false, err
+	}
+	if ttl > 0 {
+		delete(r.expiredSince, c.key)
+		return false, nil
+	}
+
+	now := r.Clock.Now()
+	since, ok := r.expiredSince[c.key]
+	if !ok {
+		utils.Log(fmt.Sprintf("Lease %x of block %s on node %s has expired", claim.Lease, c.cidr, c.node))
+		r.expiredSince[c.key] = now
+		return false, nil
+	}
+	if now.Sub(since) < r.Grace {
+		return false, nil
+	}
+	return r.reclaim(ctx, c, claimRev, claim.Pool)
+}
+
+// Remove the claim & everything of the dead node in block, then put it back into the pool it's taken from
+func (r *Reclaimer) reclaim(ctx context.Context, c nodeClaim, claimRev int64, pool string) (bool, error) {
+	leasePath := utils.GetNodeLeasePath(c.node)
+	blockPath := utils.GetBlockPath(c.cidr)
+	allocs, err := r.cli.GetPrefix(ctx, blockPath)
+	if err != nil {
+		return false, err
+	}
+
+	// allocations of other nodes are alive, leave the block alone
+	var maxRev int64
+	for _, kv := range allocs {
+		a, err := ParseAllocation(kv.Value)
+		if err == nil && a.Node != "" && a.Node != c.node {
+			utils.Log(fmt.Sprintf("Block %s is still used by node %s, skip reclaiming", c.cidr, a.Node))
+			return false, nil
+		}
+		if kv.ModRevision > maxRev {
+			maxRev = kv.ModRevision
+		}
+	}
+
+	nodePath := utils.GetNodePath(c.node)
+	primary, primaryRev, err := r.cli.Get(ctx, nodePath)
+	if err != nil {
+		return false, err
+	}
+	poolPath := utils.GetNamedIPPoolPath(pool)
+	val, poolRev, err := r.cli.Get(ctx, poolPath)
+	if err != nil {
+		return false, err
+	}
+
+	cmps := []etcdwrap.Cmp{
+		etcdwrap.Compare(etcdwrap.ModRevision(c.key), "=", claimRev),
+		etcdwrap.Compare(etcdwrap.ModRevision(poolPath), "=", poolRev),
+		// the node has not come back
+		etcdwrap.Compare(etcdwrap.CreateRevision(leasePath), "=", 0),
+		// no ip is allocated in block since it's listed
+		etcdwrap.Compare(etcdwrap.ModRevision(blockPath), "<", maxRev+1).WithPrefix(),
+	}
+	ops := []etcdwrap.Op{
+		etcdwrap.OpDelete(c.key),
+		etcdwrap.OpDelete(blockPath, etcdwrap.WithPrefix()),
+		etcdwrap.OpPut(poolPath, utils.ConvertArray2String(append(poolItems(val), c.cidr))),
+	}
+
+	// devices of the node holding ips of block
+	_, block, _ := net.ParseCIDR(c.cidr)
+	devs, err := etcdwrap.ListKV(ctx, r.cli, nodePath+"/")
+	if err != nil {
+		return false, err
+	}
+	for key, ip := range devs {
+		if strings.HasPrefix(key, nodePath+"/blocks/") || key == nodePath+"/gateway" || key == nodePath+"/pool" {
+			continue
+		}
+		if addr, _, err := net.ParseCIDR(ip); err == nil && block.Contains(addr) {
+			ops = append(ops, etcdwrap.OpDelete(key))
+		}
+	}
+	// primary block of the node, host & gateway keys go too
+	if primary == c.cidr {
+		cmps = append(cmps, etcdwrap.Compare(etcdwrap.ModRevision(nodePath), "=", primaryRev))
+		ops = append(ops, etcdwrap.OpDelete(nodePath), etcdwrap.OpDelete(nodePath+"/gateway"))
+	}
+
+	ok, err := r.cli.Txn(ctx, cmps, ops...)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		utils.Log(fmt.Sprintf("Reclaimed block %s of dead node %s, %d ips released", c.cidr, c.node, len(allocs)))
+	}
+	return ok, nil
+}
+
+// Campaign for leadership, and reclaim periodically while being the leader
+func (r *Reclaimer) Run(ctx context.Context) error {
+	for {
+		if err := r.lead(ctx); err != nil {
+			utils.Log(fmt.Sprintf("Reclaimer %s lost leadership: %v", r.Name, err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *Reclaimer) lead(ctx context.Context) error {
+	leadership, err := r.cli.Campaign(ctx, utils.GetReclaimerElectionPath(), r.Name, DefaultElectionTTL)
+	if err != nil {
+		return err
+	}
+	utils.Log("Reclaimer " + r.Name + " is the leader now")
+	// a fresh leader has no idea how long leases have expired
+	r.expiredSince = make(map[string]time.Time)
+
+	ticker := r.Clock.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.ReclaimOnce(ctx); err != nil {
+			utils.Log(fmt.Sprintf("Failed to reclaim blocks: %v", err))
+		}
+		select {
+		case <-ctx.Done():
+			resignCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			return leadership.Resign(resignCtx)
+		case <-leadership.Done():
+			return fmt.Errorf("election session expired")
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	testingclock "k8s.io/utils/clock/testing"
+
+	"mycni/etcdwrap"
+	"mycni/utils"
+)
+
+// lease expires at once, instead of waiting for its ttl
+func expireLease(t *testing.T, cli etcdwrap.Backend, id int64) {
+	if err := cli.RevokeLease(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func poolSize(t *testing.T, cli etcdwrap.Backend) int {
+	ctx := context.Background()
+	val, _, err := cli.Get(ctx, utils.GetIPPoolPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(poolItems(val))
+}
+
+func TestReclaimExpiredBlocks(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	l := NewNodeLease(cli)
+	te.Nil(l.Acquire(ctx))
+	for i := 0; i < 14; i++ {
+		_, err := AllocateIP2Pod(ctx, fmt.Sprintf("dummy%d", i), "eth0", pool, cli)
+		te.Nil(err)
+	}
+	blocks, err := listHostBlocks(ctx, cli)
+	te.Nil(err)
+	te.Equal(len(blocks), 2)
+	for _, b := range blocks {
+		te.Equal(b.claim.Lease, l.ID)
+	}
+	te.Equal(poolSize(t, cli), 2)
+
+	clock := testingclock.NewFakeClock(time.Now())
+	r := NewReclaimer(cli, "r0")
+	r.Clock = clock
+
+	// node is alive
+	reclaimed, err := r.ReclaimOnce(ctx)
+	te.Nil(err)
+	te.Empty(reclaimed)
+
+	// node is gone, blocks are kept within the grace
+	expireLease(t, cli, l.ID)
+	reclaimed, err = r.ReclaimOnce(ctx)
+	te.Nil(err)
+	te.Empty(reclaimed)
+	clock.Step(time.Minute)
+	reclaimed, err = r.ReclaimOnce(ctx)
+	te.Nil(err)
+	te.Empty(reclaimed)
+
+	clock.Step(DefaultReclaimGrace)
+	reclaimed, err = r.ReclaimOnce(ctx)
+	te.Nil(err)
+	te.Equal(reclaimed, []string{"10.1.0.0/28", "10.1.0.16/28"})
+
+	// everything of the node is cleaned up
+	te.Equal(poolSize(t, cli), 4)
+	keys, err := etcdwrap.ListKeys(ctx, cli, utils.GetHostPath())
+	te.Nil(err)
+	te.Empty(keys)
+	keys, err = etcdwrap.ListKeys(ctx, cli, utils.GetBlocksPath())
+	te.Nil(err)
+	te.Empty(keys)
+}
+
+func TestReclaimSkipsLiveNodes(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	clock := testingclock.NewFakeClock(time.Now())
+	r := NewReclaimer(cli, "r0")
+	r.Clock = clock
+
+	// claimed without daemon, never reclaimed
+	_, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+	te.Nil(err)
+	reclaimed, err := r.ReclaimOnce(ctx)
+	te.Nil(err)
+	te.Empty(reclaimed)
+	clock.Step(2 * DefaultReclaimGrace)
+	reclaimed, err = r.ReclaimOnce(ctx)
+	te.Nil(err)
+	te.Empty(reclaimed)
+
+	// daemon starts, then restarts with a new lease within the grace
+	l := NewNodeLease(cli)
+	te.Nil(l.Acquire(ctx))
+	expireLease(t, cli, l.ID)
+	reclaimed, err = r.ReclaimOnce(ctx)
+	te.Nil(err)
+	te.Empty(reclaimed)
+
+	te.Nil(l.Acquire(ctx))
+	clock.Step(2 * DefaultReclaimGrace)
+	reclaimed, err = r.ReclaimOnce(ctx)
+	te.Nil(err)
+	te.Empty(reclaimed)
+
+	conf, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.2/28")
+}
+
+func TestReclaimerLeaderElection(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	l := NewNodeLease(cli)
+	te.Nil(l.Acquire(ctx))
+	_, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+	te.Nil(err)
+	expireLease(t, cli, l.ID)
+
+	// two daemons run reclaimers, only the leader works
+	clock := testingclock.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		r := NewReclaimer(cli, fmt.Sprintf("r%d", i))
+		r.Clock = clock
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			te.Nil(r.Run(ctx))
+		}()
+	}
+
+	te.Eventually(func() bool {
+		clock.Step(DefaultReclaimInterval)
+		return poolSize(t, cli) == 4
+	}, 10*time.Second, 50*time.Millisecond)
+
+	cancel()
+	wg.Wait()
+}
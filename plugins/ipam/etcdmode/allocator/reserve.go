@@ -0,0 +1,178 @@
+package allocator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/utils"
+)
+
+var (
+	ErrReservationExists   = errors.New("range is already reserved")
+	ErrReservationConflict = errors.New("range to reserve has allocated ips")
+)
+
+// Value of mycni/ipam/reservations/<cidr>, ips never handed out by allocation,
+// like a vip or tunnel address of node. A single ip is stored as /32.
+type Reservation struct {
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (r *Reservation) String() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// reserved ranges with the max revision they're read at
+type reservations struct {
+	ranges []*net.IPNet
+	byCIDR map[string]*Reservation
+	rev    int64
+}
+
+func listReservations(ctx context.Context, cli etcdwrap.Backend) (*reservations, error) {
+	prefix := utils.GetReservationsPath()
+	kvs, err := cli.GetPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &reservations{byCIDR: make(map[string]*Reservation, len(kvs))}
+	for key, kv := range kvs {
+		if kv.ModRevision > res.rev {
+			res.rev = kv.ModRevision
+		}
+		cidr := strings.TrimPrefix(key, prefix)
+		_, r, err := net.ParseCIDR(cidr)
+		if err != nil {
+			utils.Log(fmt.Sprintf("Invalid reservation %s: %v", key, err))
+			continue
+		}
+		v := &Reservation{}
+		if err := json.Unmarshal([]byte(kv.Value), v); err != nil {
+			utils.Log(fmt.Sprintf("Invalid reservation %s: %v", key, err))
+		}
+		res.ranges = append(res.ranges, r)
+		res.byCIDR[r.String()] = v
+	}
+	return res, nil
+}
+
+// Range reserving ip, nil if not reserved
+func (res *reservations) reservedBy(ip net.IP) *net.IPNet {
+	for _, r := range res.ranges {
+		if r.Contains(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Whether the whole block is reserved, such a block is never claimed
+func (res *reservations) covers(block *net.IPNet) bool {
+	blockOnes, _ := block.Mask.Size()
+	for _, r := range res.ranges {
+		ones, _ := r.Mask.Size()
+		if ones <= blockOnes && r.Contains(block.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Guard of txns, fails if any reservation is made since it's listed
+func (res *reservations) unchanged() etcdwrap.Cmp {
+	return etcdwrap.Compare(etcdwrap.ModRevision(utils.GetReservationsPath()), "<", res.rev+1).WithPrefix()
+}
+
+// Index of first block in pool which is not reserved entirely, -1 if none
+func (res *reservations) pickBlock(ippool []string) int {
+	for i, item := range ippool {
+		_, block, err := net.ParseCIDR(item)
+		if err != nil || !res.covers(block) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Reserve an ip or a cidr, fails if any ip inside has been allocated
+func Reserve(ctx context.Context, s, reason string, cli etcdwrap.Backend) error {
+	r, err := initpool.ParseRange(s)
+	if err != nil {
+		return fmt.Errorf("invalid range %q: %w", s, err)
+	}
+	path := utils.GetReservationPath(r.String())
+	value := (&Reservation{Reason: reason, CreatedAt: time.Now()}).String()
+
+	return withRetry(ctx, func() (bool, error) {
+		_, rev, err := cli.Get(ctx, path)
+		if err != nil {
+			return false, err
+		}
+		if rev != 0 {
+			return false, fmt.Errorf("%w: %s", ErrReservationExists, r)
+		}
+
+		// allocations of all blocks, ip is the last part of key
+		kvs, err := cli.GetPrefix(ctx, utils.GetBlocksPath())
+		if err != nil {
+			return false, err
+		}
+		var maxRev int64
+		for key, kv := range kvs {
+			if kv.ModRevision > maxRev {
+				maxRev = kv.ModRevision
+			}
+			ip := net.ParseIP(key[strings.LastIndex(key, "/")+1:])
+			if ip == nil || !r.Contains(ip) {
+				continue
+			}
+			a, _ := ParseAllocation(kv.Value)
+			if a == nil {
+				a = &Allocation{}
+			}
+			return false, fmt.Errorf("%w: %s is allocated to %s-%s on %s", ErrReservationConflict, ip, a.ContainerID, a.IfName, a.Node)
+		}
+
+		return cli.Txn(ctx,
+			[]etcdwrap.Cmp{
+				etcdwrap.Compare(etcdwrap.ModRevision(path), "=", 0),
+				// no ip is allocated since they're listed
+				etcdwrap.Compare(etcdwrap.ModRevision(utils.GetBlocksPath()), "<", maxRev+1).WithPrefix(),
+			},
+			etcdwrap.OpPut(path, value),
+		)
+	})
+}
+
+// Remove a reservation, returns false if it doesn't exist
+func Unreserve(ctx context.Context, s string, cli etcdwrap.Backend) (bool, error) {
+	r, err := initpool.ParseRange(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid range %q: %w", s, err)
+	}
+	path := utils.GetReservationPath(r.String())
+	val, _, err := cli.Get(ctx, path)
+	if err != nil || val == "" {
+		return false, err
+	}
+	return true, cli.Delete(ctx, path)
+}
+
+// List reservations, keyed by cidr
+func ListReservations(ctx context.Context, cli etcdwrap.Backend) (map[string]*Reservation, error) {
+	res, err := listReservations(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+	return res.byCIDR, nil
+}
@@ -0,0 +1,82 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/staticip"
+)
+
+func TestReserve(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	_, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+	te.Nil(err)
+
+	// vip & tunnel address of node, a range inside block
+	te.Nil(Reserve(ctx, "10.1.0.3", "vip", cli))
+	te.Nil(Reserve(ctx, "10.1.0.4/30", "tunnel", cli))
+	te.True(errors.Is(Reserve(ctx, "10.1.0.3/32", "", cli), ErrReservationExists))
+	// allocated to dummy0
+	te.True(errors.Is(Reserve(ctx, "10.1.0.2", "", cli), ErrReservationConflict))
+
+	list, err := ListReservations(ctx, cli)
+	te.Nil(err)
+	te.Equal(len(list), 2)
+	te.Equal(list["10.1.0.3/32"].Reason, "vip")
+
+	// reserved ips are skipped
+	for i, want := range []string{"10.1.0.8/28", "10.1.0.9/28"} {
+		conf, err := AllocateIP2Pod(ctx, fmt.Sprintf("dummy%d", i+1), "eth0", pool, cli)
+		te.Nil(err)
+		te.Equal(conf.Address.String(), want)
+	}
+	req, _ := staticip.NewRequest([]string{"10.1.0.5"}, "")
+	_, err = AllocateStaticIP2Pod(ctx, "db0", "eth0", req, pool, cli)
+	te.True(errors.Is(err, staticip.ErrInvalidRequest))
+
+	ok, err := Unreserve(ctx, "10.1.0.3", cli)
+	te.Nil(err)
+	te.True(ok)
+	ok, err = Unreserve(ctx, "10.1.0.3", cli)
+	te.Nil(err)
+	te.False(ok)
+	conf, err := AllocateIP2Pod(ctx, "dummy3", "eth0", pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.3/28")
+}
+
+func TestReservedBlockNotClaimed(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	// the first 2 blocks are excluded entirely
+	te.Nil(Reserve(ctx, "10.1.0.0/27", "", cli))
+	conf, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.34/28")
+
+	cidr, err := ClaimBlock(ctx, cli)
+	te.Nil(err)
+	te.Equal(cidr, "10.1.0.48/28")
+	_, err = ClaimBlock(ctx, cli)
+	te.True(errors.Is(err, ErrPoolExhausted))
+
+	// still in pool, once the reservation is gone
+	te.Equal(poolSize(t, cli), 2)
+	_, err = Unreserve(ctx, "10.1.0.0/27", cli)
+	te.Nil(err)
+	cidr, err = ClaimBlock(ctx, cli)
+	te.Nil(err)
+	te.Equal(cidr, "10.1.0.0/28")
+}
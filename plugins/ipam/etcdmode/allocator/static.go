@@ -0,0 +1,73 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/podinfo"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/utils"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// Allocate the requested ip, or any free one inside the requested range, to special device.
+// The ip has to be inside blocks of current host, and not taken by others.
+func AllocateStaticIP2Pod(ctx context.Context, containerID, ifname string, req *staticip.Request, pool *initpool.Pool, cli etcdwrap.Backend) (*current.IPConfig, error) {
+	return AllocatePodIP(ctx, containerID, ifname, nil, req, pool, cli)
+}
+
+// Allocate ip to special device of the pod, the requested one if req is not nil.
+// The pod is recorded in the allocation, so that the ip can be looked up by pod later.
+func AllocatePodIP(ctx context.Context, containerID, ifname string, pod *podinfo.Pod, req *staticip.Request, pool *initpool.Pool, cli etcdwrap.Backend) (*current.IPConfig, error) {
+	if req != nil {
+		utils.Log(fmt.Sprintf("Static ip %s is requested by %s-%s", req, containerID, ifname))
+	}
+	return allocateIP2Pod(ctx, containerID, ifname, pod, req, pool, cli)
+}
+
+// Clean up after a failed ADD of the device. Static ip errors are returned
+// before anything is claimed, and a device already holding another ip keeps
+// the allocation of its earlier ADD, so nothing is released for them.
+func ReleaseFailedAdd(ctx context.Context, containerID, ifname string, addErr error, cli etcdwrap.Backend) (bool, error) {
+	if errors.Is(addErr, staticip.ErrInvalidRequest) || errors.Is(addErr, staticip.ErrIPTaken) || errors.Is(addErr, staticip.ErrIPNotInBlock) {
+		return false, nil
+	}
+	return ReleasePodIP(ctx, containerID, ifname, cli)
+}
+
+// Tell why the requested ip can't be allocated
+func unavailableError(req *staticip.Request, res *reservations, blocks []*hostBlock, usedByBlock map[string]map[string]*Allocation) error {
+	var cidrs []string
+	for _, b := range blocks {
+		cidrs = append(cidrs, b.cidr)
+	}
+
+	// any free ip inside the range
+	if req.IP == nil {
+		for _, b := range blocks {
+			if b.block.Contains(req.Range.IP) || req.Range.Contains(b.block.IP) {
+				return fmt.Errorf("%w: no free ip left in range %s", staticip.ErrIPTaken, req.Range)
+			}
+		}
+		return fmt.Errorf("%w: range %s, blocks %v", staticip.ErrIPNotInBlock, req.Range, cidrs)
+	}
+
+	for _, b := range blocks {
+		if !b.block.Contains(req.IP) {
+			continue
+		}
+		if a, ok := usedByBlock[b.cidr][req.IP.String()]; ok {
+			return fmt.Errorf("%w: %s is allocated to %s-%s on %s", staticip.ErrIPTaken, req.IP, a.ContainerID, a.IfName, a.Node)
+		}
+		if r := res.reservedBy(req.IP); r != nil {
+			return fmt.Errorf("%w: %s is reserved by %s", staticip.ErrInvalidRequest, req.IP, r)
+		}
+		// network, broadcast, gateway or excluded
+		return fmt.Errorf("%w: %s is reserved in block %s", staticip.ErrInvalidRequest, req.IP, b.cidr)
+	}
+	return fmt.Errorf("%w: ip %s, blocks %v", staticip.ErrIPNotInBlock, req.IP, cidrs)
+}
@@ -0,0 +1,98 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/staticip"
+)
+
+func TestAllocateStaticIP2Pod(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	req, err := staticip.NewRequest([]string{"10.1.0.9"}, "")
+	te.Nil(err)
+	conf, err := AllocateStaticIP2Pod(ctx, "db0", "eth0", req, pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.9/28")
+	te.Equal(conf.Gateway.String(), "10.1.0.1")
+
+	// same device again is fine
+	conf, err = AllocateStaticIP2Pod(ctx, "db0", "eth0", req, pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.9/28")
+
+	// taken by db0
+	_, err = AllocateStaticIP2Pod(ctx, "db1", "eth0", req, pool, cli)
+	te.True(errors.Is(err, staticip.ErrIPTaken))
+	te.Contains(err.Error(), "db0-eth0")
+
+	// gateway of block
+	req, _ = staticip.NewRequest([]string{"10.1.0.1"}, "")
+	_, err = AllocateStaticIP2Pod(ctx, "db1", "eth0", req, pool, cli)
+	te.True(errors.Is(err, staticip.ErrInvalidRequest))
+
+	// block not claimed by this node
+	req, _ = staticip.NewRequest([]string{"10.1.0.20"}, "")
+	_, err = AllocateStaticIP2Pod(ctx, "db1", "eth0", req, pool, cli)
+	te.True(errors.Is(err, staticip.ErrIPNotInBlock))
+
+	// any free one in range
+	req, _ = staticip.NewRequest(nil, "10.1.0.8/30")
+	conf, err = AllocateStaticIP2Pod(ctx, "db1", "eth0", req, pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.8/28")
+	conf, err = AllocateStaticIP2Pod(ctx, "db2", "eth0", req, pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.10/28")
+	conf, err = AllocateStaticIP2Pod(ctx, "db3", "eth0", req, pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.11/28")
+	_, err = AllocateStaticIP2Pod(ctx, "db4", "eth0", req, pool, cli)
+	te.True(errors.Is(err, staticip.ErrIPTaken))
+
+	// dynamic allocation skips static ones
+	conf, err = AllocateStaticIP2Pod(ctx, "web0", "eth0", nil, pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.2/28")
+}
+
+func TestReleaseFailedAdd(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	conf, err := AllocateStaticIP2Pod(ctx, "db0", "eth0", nil, pool, cli)
+	te.Nil(err)
+	te.Equal(conf.Address.String(), "10.1.0.2/28")
+
+	// ADD again with a static ip other than the one db0 has
+	req, err := staticip.NewRequest([]string{"10.1.0.9"}, "")
+	te.Nil(err)
+	_, err = AllocateStaticIP2Pod(ctx, "db0", "eth0", req, pool, cli)
+	te.True(errors.Is(err, staticip.ErrInvalidRequest))
+
+	// the existing allocation is kept
+	released, rerr := ReleaseFailedAdd(ctx, "db0", "eth0", err, cli)
+	te.Nil(rerr)
+	te.False(released)
+	found, err := FindByID(ctx, "db0", "eth0", cli)
+	te.Nil(err)
+	te.True(found)
+
+	// other failures clean up what was allocated to the device
+	released, rerr = ReleaseFailedAdd(ctx, "db0", "eth0", context.DeadlineExceeded, cli)
+	te.Nil(rerr)
+	te.True(released)
+	found, err = FindByID(ctx, "db0", "eth0", cli)
+	te.Nil(err)
+	te.False(found)
+}
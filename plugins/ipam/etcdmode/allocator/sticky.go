@@ -0,0 +1,205 @@
+package allocator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/podinfo"
+	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/utils"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const (
+	// ip of a gone pod is kept for it this long
+	DefaultStickyIPRetention = time.Hour
+)
+
+// Value of mycni/ipam/sticky/<namespace>/<name>, the last ip of a pod kept after it's deleted.
+//
+// The record & the ip key in block are both attached to Lease,
+// so the ip goes back to the block once the lease expires, if the pod never returns.
+type StickyIP struct {
+	IP         string    `json:"ip"`
+	Node       string    `json:"node"`
+	ReleasedAt time.Time `json:"releasedAt"`
+	Lease      int64     `json:"lease"`
+}
+
+func ParseStickyIP(val string) (*StickyIP, error) {
+	s := &StickyIP{}
+	if err := json.Unmarshal([]byte(val), s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StickyIP) String() string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// Release pod ip of the device, but keep it for the pod for retention,
+// ips not allocated for a k8s pod are released at once.
+func ReleasePodIPSticky(ctx context.Context, containerID, ifname string, retention time.Duration, cli etcdwrap.Backend) (bool, error) {
+	id := containerID + "-" + ifname
+	devPath := utils.GetNetDevicePath(id)
+
+	var lease int64
+	var pod *podinfo.Pod
+	err := withRetry(ctx, func() (bool, error) {
+		allocatedIP, devRev, err := cli.Get(ctx, devPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get current network device! err is %w", err)
+		}
+		if allocatedIP == "" {
+			return true, nil
+		}
+		ip, block, err := net.ParseCIDR(allocatedIP)
+		if err != nil {
+			return false, fmt.Errorf("Invalid ip cidr in allocated ip for container %s", id)
+		}
+
+		ipPath := utils.GetBlockIPPath(block.String(), ip.String())
+		val, ipRev, err := cli.Get(ctx, ipPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get allocation of %s! err is %w", ip, err)
+		}
+		a, err := ParseAllocation(val)
+		if err != nil || a.Pod == nil {
+			pod = nil
+			return etcdwrap.CommitIfUnchanged(ctx, cli,
+				map[string]int64{devPath: devRev},
+				etcdwrap.OpDelete(ipPath),
+				etcdwrap.OpDelete(devPath),
+			)
+		}
+
+		// one lease for both keys, granted once even if the txn is retried
+		if lease == 0 {
+			if lease, err = cli.GrantLease(ctx, int64(retention.Seconds())); err != nil {
+				return false, fmt.Errorf("Cannot grant lease for sticky ip! err is %w", err)
+			}
+		}
+		pod = a.Pod
+		now := time.Now()
+		a.ReleasedAt = &now
+		sticky := &StickyIP{IP: allocatedIP, Node: a.Node, ReleasedAt: now, Lease: lease}
+		withLease := etcdwrap.WithLease(lease)
+		return etcdwrap.CommitIfUnchanged(ctx, cli,
+			map[string]int64{devPath: devRev, ipPath: ipRev},
+			etcdwrap.OpPut(ipPath, a.String(), withLease),
+			etcdwrap.OpPut(utils.GetStickyIPPath(a.Pod.Namespace, a.Pod.Name), sticky.String(), withLease),
+			etcdwrap.OpDelete(devPath),
+		)
+	})
+	if err != nil {
+		return false, err
+	}
+	if pod != nil {
+		utils.Log(fmt.Sprintf("Keep ip of %s for pod %s for %v", id, pod, retention))
+	}
+	return true, nil
+}
+
+// Give the ip kept for the pod to special device again, if it's inside blocks of current host.
+// Returns nil if nothing is kept for the pod, or the ip is inside blocks of other hosts or not in pool,
+// in which case the kept ip is released, as the pod has come back elsewhere.
+func ReissueStickyIP(ctx context.Context, containerID, ifname string, pod *podinfo.Pod, pool *initpool.Pool, cli etcdwrap.Backend) (*current.IPConfig, error) {
+	id := containerID + "-" + ifname
+	devPath := utils.GetNetDevicePath(id)
+	stickyPath := utils.GetStickyIPPath(pod.Namespace, pod.Name)
+
+	var reissued string
+	err := withRetry(ctx, func() (bool, error) {
+		reissued = ""
+		val, stickyRev, err := cli.Get(ctx, stickyPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get sticky ip of pod %s! err is %w", pod, err)
+		}
+		if val == "" {
+			return true, nil
+		}
+		sticky, err := ParseStickyIP(val)
+		if err != nil {
+			utils.Log(fmt.Sprintf("Invalid sticky ip %s: %v", stickyPath, err))
+			return true, cli.Delete(ctx, stickyPath)
+		}
+		ip, block, err := net.ParseCIDR(sticky.IP)
+		if err != nil {
+			utils.Log(fmt.Sprintf("Invalid sticky ip %s: %v", stickyPath, err))
+			return true, cli.Delete(ctx, stickyPath)
+		}
+
+		// device already has its ip
+		dev, devRev, err := cli.Get(ctx, devPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get current network device! err is %w", err)
+		}
+		if dev != "" {
+			return true, nil
+		}
+
+		ipPath := utils.GetBlockIPPath(block.String(), ip.String())
+		_, ipRev, err := cli.Get(ctx, ipPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get allocation of %s! err is %w", ip, err)
+		}
+		// ip has gone with its block, nothing to reissue
+		if ipRev == 0 {
+			return etcdwrap.CompareAndDelete(ctx, cli, stickyPath, stickyRev)
+		}
+
+		blocks, err := listHostBlocks(ctx, cli)
+		if err != nil {
+			return false, fmt.Errorf("Cannot list blocks of host! err is %w", err)
+		}
+		var hb *hostBlock
+		for _, b := range blocks {
+			if b.cidr == block.String() {
+				hb = b
+			}
+		}
+		revs := map[string]int64{stickyPath: stickyRev, ipPath: ipRev}
+		if hb == nil {
+			utils.Log(fmt.Sprintf("Pod %s is back on another node, release its ip %s kept on %s", pod, sticky.IP, sticky.Node))
+			return etcdwrap.CommitIfUnchanged(ctx, cli, revs, etcdwrap.OpDelete(stickyPath), etcdwrap.OpDelete(ipPath))
+		}
+		// selected by another pool now, like its namespace is moved into a compliance zone
+		if !pool.ClusterCIDR.Contains(ip) {
+			utils.Log(fmt.Sprintf("Pod %s is back in another pool, release its ip %s", pod, sticky.IP))
+			return etcdwrap.CommitIfUnchanged(ctx, cli, revs, etcdwrap.OpDelete(stickyPath), etcdwrap.OpDelete(ipPath))
+		}
+
+		// the ip key is detached from the lease by the put
+		revs[devPath] = devRev
+		revs[utils.GetHostBlockPath(hb.cidr)] = hb.rev
+		ok, err := etcdwrap.CommitIfUnchanged(ctx, cli, revs,
+			etcdwrap.OpPut(ipPath, newPoolAllocation(containerID, ifname, pod, pool.Name).String()),
+			etcdwrap.OpPut(devPath, sticky.IP),
+			etcdwrap.OpDelete(stickyPath),
+		)
+		if err != nil {
+			return false, fmt.Errorf("Error happened when reissuing sticky ip! %w", err)
+		}
+		if ok {
+			reissued = sticky.IP
+		}
+		return ok, nil
+	})
+	if err != nil || reissued == "" {
+		return nil, err
+	}
+
+	utils.Log(fmt.Sprintf("Reissued sticky ip %s to pod %s", reissued, pod))
+	ip, block, _ := net.ParseCIDR(reissued)
+	return &current.IPConfig{
+		Address: net.IPNet{IP: ip, Mask: block.Mask},
+		Gateway: pool.Gateway(block),
+	}, nil
+}
@@ -0,0 +1,108 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"mycni/etcdwrap"
+	"mycni/pkg/podinfo"
+	"mycni/utils"
+)
+
+func TestStickyIP(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, cli etcdwrap.Backend) {
+		te := assert.New(t)
+		ctx := context.Background()
+		pool := newSmallPool(t, cli)
+
+		db := &podinfo.Pod{Namespace: "default", Name: "db-0", UID: "uid-0"}
+		_, err := AllocateIP2Pod(ctx, "dummy0", "eth0", pool, cli)
+		te.Nil(err)
+		conf, err := AllocatePodIP(ctx, "c0", "eth0", db, nil, pool, cli)
+		te.Nil(err)
+		te.Equal(conf.Address.String(), "10.1.0.3/28")
+
+		// kept for db-0, not for others
+		_, err = ReleasePodIPSticky(ctx, "c0", "eth0", time.Hour, cli)
+		te.Nil(err)
+		_, err = ReleasePodIPSticky(ctx, "dummy0", "eth0", time.Hour, cli)
+		te.Nil(err)
+		a, err := FindByIP(ctx, "10.1.0.3", cli)
+		te.Nil(err)
+		te.NotNil(a.ReleasedAt)
+		conf, err = AllocateIP2Pod(ctx, "dummy1", "eth0", pool, cli)
+		te.Nil(err)
+		te.Equal(conf.Address.String(), "10.1.0.2/28")
+		conf, err = AllocateIP2Pod(ctx, "dummy2", "eth0", pool, cli)
+		te.Nil(err)
+		te.Equal(conf.Address.String(), "10.1.0.4/28")
+
+		// db-0 comes back with another container
+		conf, err = ReissueStickyIP(ctx, "c1", "eth0", &podinfo.Pod{Namespace: "default", Name: "db-0", UID: "uid-1"}, pool, cli)
+		te.Nil(err)
+		te.Equal(conf.Address.String(), "10.1.0.3/28")
+		te.Equal(conf.Gateway.String(), "10.1.0.1")
+		a, err = FindByIP(ctx, "10.1.0.3", cli)
+		te.Nil(err)
+		te.Equal(a.ContainerID, "c1")
+		te.Nil(a.ReleasedAt)
+		te.Equal(a.Pod.UID, "uid-1")
+		val, _, err := cli.Get(ctx, utils.GetStickyIPPath("default", "db-0"))
+		te.Nil(err)
+		te.Equal(val, "")
+		// nothing kept any more
+		conf, err = ReissueStickyIP(ctx, "c2", "eth0", db, pool, cli)
+		te.Nil(err)
+		te.Nil(conf)
+
+		// db-0 never returns
+		_, err = ReleasePodIPSticky(ctx, "c1", "eth0", time.Hour, cli)
+		te.Nil(err)
+		val, _, err = cli.Get(ctx, utils.GetStickyIPPath("default", "db-0"))
+		te.Nil(err)
+		sticky, err := ParseStickyIP(val)
+		te.Nil(err)
+		te.Equal(sticky.IP, "10.1.0.3/28")
+		expireLease(t, cli, sticky.Lease)
+		a, err = FindByIP(ctx, "10.1.0.3", cli)
+		te.Nil(err)
+		te.Nil(a)
+		conf, err = ReissueStickyIP(ctx, "c3", "eth0", db, pool, cli)
+		te.Nil(err)
+		te.Nil(conf)
+		conf, err = AllocateIP2Pod(ctx, "dummy3", "eth0", pool, cli)
+		te.Nil(err)
+		te.Equal(conf.Address.String(), "10.1.0.3/28")
+	})
+}
+
+func TestStickyIPOnOtherNode(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+	pool := newSmallPool(t, cli)
+
+	db := &podinfo.Pod{Namespace: "default", Name: "db-0"}
+	_, err := AllocatePodIP(ctx, "c0", "eth0", db, nil, pool, cli)
+	te.Nil(err)
+	_, err = ReleasePodIPSticky(ctx, "c0", "eth0", time.Hour, cli)
+	te.Nil(err)
+
+	// kept in a block of another node
+	blocks, err := ListHostBlocks(ctx, cli)
+	te.Nil(err)
+	te.Nil(cli.Delete(ctx, utils.GetHostBlockPath(blocks[0])))
+
+	conf, err := ReissueStickyIP(ctx, "c1", "eth0", db, pool, cli)
+	te.Nil(err)
+	te.Nil(conf)
+	a, err := FindByIP(ctx, "10.1.0.2", cli)
+	te.Nil(err)
+	te.Nil(a)
+	val, _, err := cli.Get(ctx, utils.GetStickyIPPath("default", "db-0"))
+	te.Nil(err)
+	te.Equal(val, "")
+}
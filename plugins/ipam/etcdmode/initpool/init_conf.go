@@ -1,43 +1,92 @@
 package initpool
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"reflect"
 	"strings"
 
-	"mycni/utils"
 	"mycni/etcdwrap"
+	"mycni/utils"
 )
 
-// Generate a list of ip, like 10.1.1.0/28,  10.1.2.0/28, ...
-func RandomGenerateIpCIDRs() []string {
-	ans := make([]string, 16)
-	for i := 0; i < 16; i++ {
-		ans[i] = fmt.Sprintf("10.1.%d.0/28", (i + 1))
+// Check that blocks stored by older versions(without pool config) fit into pool
+func checkLegacyPool(pool *Pool, val string) error {
+	for _, s := range strings.Split(val, ";") {
+		if s == "" {
+			continue
+		}
+		_, block, err := net.ParseCIDR(s)
+		if err != nil || !pool.ValidBlock(block) {
+			return fmt.Errorf("%w: block %s is not a /%d of %s", ErrPoolConflict, s, pool.BlockSize, pool.ClusterCIDR)
+		}
 	}
-	return ans
+	return nil
 }
 
-// Init ip cidr pool(for all host in this cluster)
-func InitPool(cli *etcdwrap.WrappedClient) (bool, error) {
-	ips := RandomGenerateIpCIDRs()
-	ipCIDRs := strings.Join(ips, ";")
-	
-	if cli.GetInitPoolStatus() == false {
-		err := cli.PutKV(utils.GetIPPoolPath(), ipCIDRs)
-		if (err != nil) {
-			return false, fmt.Errorf("Cannot add ipcidr into pool! %v", err)
-		}
-		cli.SetInitPoolStatus(true)
+// Init ip cidr pool(for all host in this cluster), carved from the pool config.
+// Refuses to go on if the pool has been initialized with a different config.
+func InitPool(ctx context.Context, pool *Pool, cli etcdwrap.Backend) (bool, error) {
+	conf := pool.Config()
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return false, err
+	}
+
+	confPath := pool.ConfigPath()
+	poolPath := pool.Path()
+	for {
+		stored, confRev, err := cli.Get(ctx, confPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get pool config! %w", err)
+		}
+		if stored != "" {
+			var storedConf PoolConfig
+			if err := json.Unmarshal([]byte(stored), &storedConf); err != nil {
+				return false, fmt.Errorf("Invalid pool config in etcd! %w", err)
+			}
+			if !reflect.DeepEqual(storedConf, conf) {
+				return false, fmt.Errorf("%w: stored %s, configured %s", ErrPoolConflict, stored, data)
+			}
+			return true, nil
+		}
+
+		val, poolRev, err := cli.Get(ctx, poolPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot get ip pool! %w", err)
+		}
+		ops := []etcdwrap.Op{etcdwrap.OpPut(confPath, string(data))}
+		if poolRev != 0 {
+			// pool of older versions, keep it if it fits
+			if err := checkLegacyPool(pool, val); err != nil {
+				return false, err
+			}
+		} else {
+			ops = append(ops, etcdwrap.OpPut(poolPath, utils.ConvertArray2String(pool.Blocks())))
+		}
+
+		// someone else may be initializing at the same time, check again then
+		ok, err := etcdwrap.CommitIfUnchanged(ctx, cli, map[string]int64{confPath: confRev, poolPath: poolRev}, ops...)
+		if err != nil {
+			return false, fmt.Errorf("Cannot add ipcidr into pool! %w", err)
+		}
+		if ok {
+			return true, nil
+		}
 	}
-	return true, nil
 }
 
 // Release ip cidr pool
-func ReleasePool(cli *etcdwrap.WrappedClient) (bool, error) {
-	err := cli.DelKV(utils.GetIPPoolPath())
+func ReleasePool(ctx context.Context, cli etcdwrap.Backend) (bool, error) {
+	err := cli.Delete(ctx, utils.GetIPPoolPath())
+	if err != nil {
+		return false, fmt.Errorf("Release ip pool failed! Error is %w", err)
+	}
+	err = cli.Delete(ctx, utils.GetPoolConfigPath())
 	if err != nil {
-		return false, fmt.Errorf("Release ip pool failed! Error is %v", err)
+		return false, fmt.Errorf("Release ip pool config failed! Error is %w", err)
 	}
-	cli.SetInitPoolStatus(false)
 	return true, nil
-}
\ No newline at end of file
+}
@@ -1,34 +1,118 @@
 package initpool
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"mycni/etcdwrap"
+	"mycni/utils"
 )
 
-func TestRandomGenerateIpCIDRs(t *testing.T) {
+func TestInitPoolConflict(t *testing.T) {
 	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
 
-	res := RandomGenerateIpCIDRs()
-	// t.Log(res)
-	te.Equal(len(res), 16)
+	pool, err := PoolConfig{ClusterCIDR: "10.1.0.0/24", BlockSize: 28}.Parse()
+	te.Nil(err)
+	r, err := InitPool(ctx, pool, cli)
+	te.Nil(err)
+	te.True(r)
+
+	blocks, _, err := cli.Get(ctx, utils.GetIPPoolPath())
+	te.Nil(err)
+	te.Equal(len(utils.ConvertString2Array(blocks)), 16)
+
+	// same config again is fine, pool is kept
+	te.Nil(cli.Put(ctx, utils.GetIPPoolPath(), "10.1.0.16/28"))
+	_, err = InitPool(ctx, pool, cli)
+	te.Nil(err)
+	blocks, _, err = cli.Get(ctx, utils.GetIPPoolPath())
+	te.Nil(err)
+	te.Equal(blocks, "10.1.0.16/28")
+
+	// a different block size is refused
+	other, err := PoolConfig{ClusterCIDR: "10.1.0.0/24", BlockSize: 26}.Parse()
+	te.Nil(err)
+	_, err = InitPool(ctx, other, cli)
+	te.True(errors.Is(err, ErrPoolConflict))
+}
+
+func TestInitPoolLegacy(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+
+	// pool written by older versions, without config
+	te.Nil(cli.Put(ctx, utils.GetIPPoolPath(), "10.1.1.0/28;10.1.2.0/28"))
+
+	pool, err := PoolConfig{}.Parse()
+	te.Nil(err)
+	_, err = InitPool(ctx, pool, cli)
+	te.True(errors.Is(err, ErrPoolConflict))
+
+	pool, err = PoolConfig{BlockSize: 28}.Parse()
+	te.Nil(err)
+	_, err = InitPool(ctx, pool, cli)
+	te.Nil(err)
+	blocks, _, err := cli.Get(ctx, utils.GetIPPoolPath())
+	te.Nil(err)
+	te.Equal(blocks, "10.1.1.0/28;10.1.2.0/28")
+}
+
+func TestInitPoolNamed(t *testing.T) {
+	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
+
+	pool, err := PoolConfig{ClusterCIDR: "10.1.0.0/24", BlockSize: 26}.Parse()
+	te.Nil(err)
+	_, err = InitPool(ctx, pool, cli)
+	te.Nil(err)
+
+	// a named pool has its own config & blocks, never conflicts with the cluster pool
+	named, err := PoolConfig{ClusterCIDR: "10.2.0.0/24", BlockSize: 28}.Parse()
+	te.Nil(err)
+	named.Name = "pci"
+	_, err = InitPool(ctx, named, cli)
+	te.Nil(err)
+
+	blocks, _, err := cli.Get(ctx, utils.GetNamedIPPoolPath("pci"))
+	te.Nil(err)
+	te.Equal(len(utils.ConvertString2Array(blocks)), 16)
+	blocks, _, err = cli.Get(ctx, utils.GetIPPoolPath())
+	te.Nil(err)
+	te.Equal(len(utils.ConvertString2Array(blocks)), 4)
 }
 
 func TestReleasePool(t *testing.T) {
 	te := assert.New(t)
+	ctx := context.Background()
+	cli := etcdwrap.NewMemoryBackend()
 
-	etcdwrap.Init()
-	cli, err := etcdwrap.GetEtcdClient()
+	pool, err := PoolConfig{ClusterCIDR: "10.1.0.0/24", BlockSize: 28}.Parse()
+	te.Nil(err)
+	_, err = InitPool(ctx, pool, cli)
 	te.Nil(err)
-	te.NotNil(cli)
-	// te.Equal(cli.GetInitPoolStatus(), false)
 
 	var r2 bool
-	r2, err = ReleasePool(cli)
+	r2, err = ReleasePool(ctx, cli)
 	te.Nil(err)
 	te.Equal(r2, true)
+	for _, key := range []string{utils.GetIPPoolPath(), utils.GetPoolConfigPath()} {
+		value, _, err := cli.Get(ctx, key)
+		te.Nil(err)
+		te.Equal(value, "", key)
+	}
+
+	// a released pool can be initialized again, even with other options
+	other, err := PoolConfig{ClusterCIDR: "10.1.0.0/24", BlockSize: 26}.Parse()
+	te.Nil(err)
+	_, err = InitPool(ctx, other, cli)
+	te.Nil(err)
 }
 
 func TestIteratePool(t *testing.T) {
@@ -0,0 +1,231 @@
+package initpool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"mycni/utils"
+)
+
+const (
+	DefaultClusterCIDR = "10.1.0.0/16"
+	DefaultBlockSize   = 24
+
+	// a cluster cidr is carved into 2^16 blocks at most
+	MaxBlockBits = 16
+
+	GatewayFirst = "first" // first usable ip of block, like 10.1.1.1
+	GatewayLast  = "last"  // last usable ip of block, like 10.1.1.254
+	GatewayNone  = "none"  // no gateway, every usable ip goes to pods
+)
+
+var ErrPoolConflict = errors.New("stored ip pool conflicts with ipam config")
+
+// Pool settings in the ipam config, all fields are optional
+type PoolConfig struct {
+	ClusterCIDR   string   `json:"clusterCIDR,omitempty"`
+	BlockSize     int      `json:"blockSize,omitempty"`
+	Excludes      []string `json:"excludes,omitempty"`
+	GatewayPolicy string   `json:"gatewayPolicy,omitempty"`
+}
+
+// Parsed pool settings, with defaults filled
+type Pool struct {
+	// name of a named pool, empty for the cluster pool
+	Name          string
+	ClusterCIDR   *net.IPNet
+	BlockSize     int
+	Excludes      []*net.IPNet
+	GatewayPolicy string
+}
+
+// Parse cidr or a single ip(as /32)
+func ParseRange(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("only ipv4 is supported, got %s", s)
+		}
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if cidr.IP.To4() == nil {
+		return nil, fmt.Errorf("only ipv4 is supported, got %s", s)
+	}
+	return cidr, nil
+}
+
+// Validate the config and fill defaults
+func (c PoolConfig) Parse() (*Pool, error) {
+	p := &Pool{BlockSize: c.BlockSize, GatewayPolicy: c.GatewayPolicy}
+
+	cidr := c.ClusterCIDR
+	if cidr == "" {
+		cidr = DefaultClusterCIDR
+	}
+	_, clusterCIDR, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clusterCIDR %q: %w", cidr, err)
+	}
+	if clusterCIDR.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid clusterCIDR %q: only ipv4 is supported", cidr)
+	}
+	clusterCIDR.IP = clusterCIDR.IP.To4()
+	p.ClusterCIDR = clusterCIDR
+
+	if p.BlockSize == 0 {
+		p.BlockSize = DefaultBlockSize
+	}
+	ones, _ := clusterCIDR.Mask.Size()
+	if p.BlockSize < ones || p.BlockSize > 30 {
+		return nil, fmt.Errorf("invalid blockSize %d: must be within [%d, 30]", p.BlockSize, ones)
+	}
+	if p.BlockSize-ones > MaxBlockBits {
+		return nil, fmt.Errorf("invalid blockSize %d: too many blocks in %s", p.BlockSize, cidr)
+	}
+
+	for _, e := range c.Excludes {
+		ex, err := ParseRange(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude %q: %w", e, err)
+		}
+		p.Excludes = append(p.Excludes, ex)
+	}
+
+	switch p.GatewayPolicy {
+	case "":
+		p.GatewayPolicy = GatewayFirst
+	case GatewayFirst, GatewayLast, GatewayNone:
+	default:
+		return nil, fmt.Errorf("invalid gatewayPolicy %q", p.GatewayPolicy)
+	}
+	return p, nil
+}
+
+// Normalized config, stored in etcd to detect conflicts
+func (p *Pool) Config() PoolConfig {
+	c := PoolConfig{
+		ClusterCIDR:   p.ClusterCIDR.String(),
+		BlockSize:     p.BlockSize,
+		GatewayPolicy: p.GatewayPolicy,
+	}
+	for _, e := range p.Excludes {
+		c.Excludes = append(c.Excludes, e.String())
+	}
+	sort.Strings(c.Excludes)
+	return c
+}
+
+// Key of free blocks in etcd
+func (p *Pool) Path() string {
+	return utils.GetNamedIPPoolPath(p.Name)
+}
+
+// Key of the normalized config in etcd
+func (p *Pool) ConfigPath() string {
+	return utils.GetNamedPoolConfigPath(p.Name)
+}
+
+// Whether cidrs of p & o share any address
+func (p *Pool) Overlaps(o *Pool) bool {
+	return p.ClusterCIDR.Contains(o.ClusterCIDR.IP) || o.ClusterCIDR.Contains(p.ClusterCIDR.IP)
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// first & last address of cidr
+func cidrRange(cidr *net.IPNet) (uint32, uint32) {
+	mask := binary.BigEndian.Uint32(cidr.Mask)
+	start := ipToUint32(cidr.IP) & mask
+	return start, start | ^mask
+}
+
+// whether cidr is entirely inside one of excludes
+func (p *Pool) fullyExcluded(cidr *net.IPNet) bool {
+	start, end := cidrRange(cidr)
+	for _, e := range p.Excludes {
+		es, ee := cidrRange(e)
+		if es <= start && end <= ee {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) Excluded(ip net.IP) bool {
+	for _, e := range p.Excludes {
+		if e.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Carve cluster cidr into blocks, blocks inside excluded ranges are skipped
+func (p *Pool) Blocks() []string {
+	start, end := cidrRange(p.ClusterCIDR)
+	size := uint32(1) << (32 - p.BlockSize)
+
+	var blocks []string
+	for n := uint64(start); n <= uint64(end); n += uint64(size) {
+		block := &net.IPNet{IP: uint32ToIP(uint32(n)), Mask: net.CIDRMask(p.BlockSize, 32)}
+		if p.fullyExcluded(block) {
+			continue
+		}
+		blocks = append(blocks, block.String())
+	}
+	return blocks
+}
+
+// Whether block can be carved from this pool
+func (p *Pool) ValidBlock(block *net.IPNet) bool {
+	ones, _ := block.Mask.Size()
+	return ones == p.BlockSize && p.ClusterCIDR.Contains(block.IP)
+}
+
+// Gateway of block following the policy, nil if none
+func (p *Pool) Gateway(block *net.IPNet) net.IP {
+	start, end := cidrRange(block)
+	// /31 & /32 have no room for gateway
+	if end-start < 3 {
+		return nil
+	}
+	switch p.GatewayPolicy {
+	case GatewayFirst:
+		return uint32ToIP(start + 1)
+	case GatewayLast:
+		return uint32ToIP(end - 1)
+	}
+	return nil
+}
+
+// Ips of block for pods, like 10.1.1.2/24,
+// network, broadcast, gateway & excluded ones are skipped
+func (p *Pool) UsableIPs(block *net.IPNet) []string {
+	start, end := cidrRange(block)
+	ones, _ := block.Mask.Size()
+	gw := p.Gateway(block)
+
+	var ips []string
+	for n := uint64(start) + 1; n < uint64(end); n++ {
+		ip := uint32ToIP(uint32(n))
+		if ip.Equal(gw) || p.Excluded(ip) {
+			continue
+		}
+		ips = append(ips, fmt.Sprintf("%s/%d", ip, ones))
+	}
+	return ips
+}
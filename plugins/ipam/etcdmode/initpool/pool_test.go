@@ -0,0 +1,66 @@
+package initpool
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePoolConfig(t *testing.T) {
+	te := assert.New(t)
+
+	pool, err := PoolConfig{}.Parse()
+	te.Nil(err)
+	te.Equal(pool.Config(), PoolConfig{
+		ClusterCIDR:   DefaultClusterCIDR,
+		BlockSize:     DefaultBlockSize,
+		GatewayPolicy: GatewayFirst,
+	})
+
+	for _, c := range []PoolConfig{
+		{ClusterCIDR: "10.1.0.0"},
+		{ClusterCIDR: "fd00::/64"},
+		{ClusterCIDR: "10.1.0.0/16", BlockSize: 8},
+		{ClusterCIDR: "10.0.0.0/8", BlockSize: 28},
+		{Excludes: []string{"10.1.1.x"}},
+		{GatewayPolicy: "middle"},
+	} {
+		_, err := c.Parse()
+		te.NotNil(err, "%+v", c)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	te := assert.New(t)
+
+	pool, err := PoolConfig{
+		ClusterCIDR: "10.1.0.0/24",
+		BlockSize:   26,
+		Excludes:    []string{"10.1.0.64/26", "10.1.0.130"},
+	}.Parse()
+	te.Nil(err)
+
+	// fully excluded block is skipped, partially excluded one is kept
+	te.Equal(pool.Blocks(), []string{"10.1.0.0/26", "10.1.0.128/26", "10.1.0.192/26"})
+}
+
+func TestUsableIPs(t *testing.T) {
+	te := assert.New(t)
+	_, block, _ := net.ParseCIDR("10.1.1.0/29")
+
+	pool, err := PoolConfig{Excludes: []string{"10.1.1.3"}}.Parse()
+	te.Nil(err)
+	te.Equal(pool.Gateway(block).String(), "10.1.1.1")
+	te.Equal(pool.UsableIPs(block), []string{"10.1.1.2/29", "10.1.1.4/29", "10.1.1.5/29", "10.1.1.6/29"})
+
+	pool, err = PoolConfig{GatewayPolicy: GatewayLast}.Parse()
+	te.Nil(err)
+	te.Equal(pool.Gateway(block).String(), "10.1.1.6")
+	te.Equal(len(pool.UsableIPs(block)), 5)
+
+	pool, err = PoolConfig{GatewayPolicy: GatewayNone}.Parse()
+	te.Nil(err)
+	te.Nil(pool.Gateway(block))
+	te.Equal(len(pool.UsableIPs(block)), 6)
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"mycni/etcdwrap"
+	"mycni/pkg/gc"
+	"mycni/pkg/podinfo"
 	"mycni/plugins/ipam/etcdmode/allocator"
 	"mycni/plugins/ipam/etcdmode/initpool"
+	"mycni/utils"
 	"runtime"
 	"strings"
 
@@ -20,14 +25,80 @@ func init() {
 }
 
 func main() {
+	if gc.HandleVerb(cmdGC) {
+		return
+	}
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("etcdmode"))
 }
 
+// Connect to etcd or the apiserver, by backend of the ipam block
+func newBackend(ipamConf *allocator.IPAMConfig) (etcdwrap.Backend, error) {
+	if ipamConf.Backend == allocator.BackendKubernetes {
+		kc, err := ipamConf.KubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return etcdwrap.NewKubeBackend(kc, ipamConf.KubeBackendConfig()), nil
+	}
+	conf, err := ipamConf.EtcdConfig()
+	if err != nil {
+		return nil, err
+	}
+	etcdwrap.InitWithConfig(conf)
+	return etcdwrap.GetEtcdClient()
+}
+
+// Context of one cni command, every etcd request of it ends by the deadline
+func commandContext(ipamConf *allocator.IPAMConfig) (context.Context, context.CancelFunc) {
+	timeout, _ := ipamConf.CommandTimeout()
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Release allocations of this host whose containers are gone
+func cmdGC(stdin []byte) error {
+	ipamConf, _, err := allocator.LoadIPAMConfig(stdin, "")
+	if err != nil {
+		return err
+	}
+	gcConf, err := gc.LoadConf(stdin)
+	if err != nil {
+		return err
+	}
+	var lister gc.Lister
+	if ipamConf.RuntimeEndpoint != "" {
+		lister = &gc.CrictlLister{Endpoint: ipamConf.RuntimeEndpoint}
+	}
+	checker, minAge, err := gc.NewChecker(gcConf, lister)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(ipamConf)
+	defer cancel()
+	cli, err := newBackend(ipamConf)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to ipam backend! Error is %v", err)
+	}
+	if _, err := allocator.GC(ctx, checker, minAge, cli); err != nil {
+		return fmt.Errorf("Failed to gc allocations: %v", err)
+	}
+	return nil
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
 	// first load cni conf, with ipam config
 	// args.StdinData: json conf
 	// args.Args: string
-	_, confVersion, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	ipamConf, confVersion, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+	req, err := ipamConf.StaticRequest(args.Args)
+	if err != nil {
+		return err
+	}
+	// recorded in the allocation, nil if not called by kubelet
+	pod, err := podinfo.FromArgs(args.Args)
 	if err != nil {
 		return err
 	}
@@ -36,46 +107,81 @@ func cmdAdd(args *skel.CmdArgs) error {
 	// no dns here
 	// new store here
 	// since we use etcd for ip allocation, we don't need to store it locally.
-	etcdwrap.Init()
-	cli, err := etcdwrap.GetEtcdClient()
+	ctx, cancel := commandContext(ipamConf)
+	defer cancel()
+
+	// pool of the pod, by its namespace, labels & node
+	meta, err := ipamConf.PodMeta(ctx, pod)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata of pod %s, err is %v", pod, err)
+	}
+	pool, err := ipamConf.SelectPool(meta)
 	if err != nil {
-		return fmt.Errorf("failed to boot etcd client!")
+		return err
+	}
+
+	cli, err := newBackend(ipamConf)
+	if err != nil {
+		return fmt.Errorf("failed to connect to ipam backend! Error is %v", err)
+	}
+
+	// init pool first, or check that it matches the config
+	if _, err := initpool.InitPool(ctx, pool, cli); err != nil {
+		return fmt.Errorf("Failed to init ip pool: %v", err)
+	}
+
+	// host pool of older versions is moved into per-ip keys once
+	if _, err := allocator.MigrateHostPool(ctx, cli); err != nil {
+		return fmt.Errorf("Failed to migrate host ip pool: %v", err)
 	}
 
-	// init pool first
-	poolready := cli.GetInitPoolStatus()
-	if poolready == false {
-		_, err := initpool.InitPool(cli)
+	// the last ip of a returning pod, only if no static ip is wanted
+	var ipConf *current.IPConfig
+	if ipamConf.StickyIPs && pod != nil && req == nil {
+		ipConf, err = allocator.ReissueStickyIP(ctx, args.ContainerID, args.IfName, pod, pool, cli)
 		if err != nil {
-			return fmt.Errorf("Failed to initip pool")
+			return fmt.Errorf("failed to reissue sticky ip for pod %s, err is %v", pod, err)
 		}
 	}
-
-	ipConf, err := allocator.AllocateIP2Pod(args.ContainerID, args.IfName, cli)
-	ipConf.Interface = current.Int(2) // Assume each pod is init only once, ifindex would always be 2
+	if ipConf == nil {
+		ipConf, err = allocator.AllocatePodIP(ctx, args.ContainerID, args.IfName, pod, req, pool, cli)
+	}
 	if err != nil {
-		// TODO: Deallocate all already allocated IPs
-		_, _ = allocator.ReleasePodIP(args.ContainerID, args.IfName, cli)
+		// still cleaned up if the command has timed out, bounded by the request timeout
+		_, _ = allocator.ReleaseFailedAdd(context.WithoutCancel(ctx), args.ContainerID, args.IfName, err, cli)
+		// let kubelet know that it's worth retrying later, after some pods are gone
+		if errors.Is(err, allocator.ErrPoolExhausted) {
+			return types.NewError(types.ErrTryAgainLater, "ip pool exhausted",
+				fmt.Sprintf("failed to allocate for container %s, err is %v", args.ContainerID, err))
+		}
+		// or once etcd responds again
+		if errors.Is(err, context.DeadlineExceeded) {
+			return types.NewError(types.ErrTryAgainLater, "etcd timed out",
+				fmt.Sprintf("failed to allocate for container %s, err is %v", args.ContainerID, err))
+		}
 		return fmt.Errorf("failed to allocate for container %s, err is %v", args.ContainerID, err)
 	}
+	ipConf.Interface = current.Int(2) // Assume each pod is init only once, ifindex would always be 2
 
 	result.IPs = append(result.IPs, ipConf)
+	result.Routes = ipamConf.Routes
 	return types.PrintResult(result, confVersion)
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-	_, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
 	if err != nil {
 		return err
 	}
 
 	// See if the container has been properly allocated with ip
-	etcdwrap.Init()
-	cli, err := etcdwrap.GetEtcdClient()
+	ctx, cancel := commandContext(ipamConf)
+	defer cancel()
+	cli, err := newBackend(ipamConf)
 	if err != nil {
-		return fmt.Errorf("Failed to bootup etcd client! Error is %v", err)
+		return fmt.Errorf("Failed to connect to ipam backend! Error is %v", err)
 	}
-	containerIpFound, err := allocator.FindByID(args.ContainerID, args.IfName, cli)
+	containerIpFound, err := allocator.FindByID(ctx, args.ContainerID, args.IfName, cli)
 	if err != nil || containerIpFound == false {
 		return fmt.Errorf("etcdmode: Failed to find address added by container %v", args.ContainerID)
 	}
@@ -83,14 +189,26 @@ func cmdCheck(args *skel.CmdArgs) error {
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	etcdwrap.Init()
-	cli, err := etcdwrap.GetEtcdClient()
+	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
 	if err != nil {
-		return fmt.Errorf("Failed to bootup etcd client! Error is %v", err)
+		return err
+	}
+	grace, _ := ipamConf.ReleaseGrace()
+	retention, _ := ipamConf.StickyRetention()
+
+	ctx, cancel := commandContext(ipamConf)
+	defer cancel()
+	cli, err := newBackend(ipamConf)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to ipam backend! Error is %v", err)
 	}
 	// Loop through all ranges, releasing all IPs, even if an error occurs
 	var errors []string
-	_, err = allocator.ReleasePodIP(args.ContainerID, args.IfName, cli)
+	if ipamConf.StickyIPs {
+		_, err = allocator.ReleasePodIPSticky(ctx, args.ContainerID, args.IfName, retention, cli)
+	} else {
+		_, err = allocator.ReleasePodIP(ctx, args.ContainerID, args.IfName, cli)
+	}
 	if err != nil {
 		errors = append(errors, err.Error())
 	}
@@ -99,5 +217,10 @@ func cmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf(strings.Join(errors, ";"))
 	}
 
+	// give back blocks which have been free long enough, it's fine to do it next time if fails
+	if _, err := allocator.ReleaseFreeBlocks(ctx, grace, cli); err != nil {
+		utils.Log(fmt.Sprintf("Failed to release free blocks: %v", err))
+	}
+
 	return nil
 }
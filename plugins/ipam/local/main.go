@@ -1,87 +1,176 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"runtime"
+	"time"
 
 	"mycni/pkg/config"
+	"mycni/pkg/gc"
+	"mycni/pkg/podinfo"
+	"mycni/pkg/staticip"
 	"mycni/plugins/ipam/local/store"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
-	cip "github.com/containernetworking/plugins/pkg/ip"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
 
 type IPAM struct {
-	subnet  *net.IPNet
-	gateway net.IP
-	store   *store.Store
+	conf  *IPAMConfig
+	store *store.Store
 }
 
-var (
-	IPOverflowError = errors.New("ip overflow")
-)
-
-const (
-	ClusterCIDR = "10.244.0.0/16"
-)
-
 func init() {
 	runtime.LockOSThread()
 }
 
 func main() {
+	if gc.HandleVerb(cmdGC) {
+		return
+	}
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("local"))
 }
 
-// 根据cni配置初始化ipam
-func NewIPAM(conf *config.CNIConf, s *store.Store) (*IPAM, error) {
-	_, ipnet, err := net.ParseCIDR(conf.Subnet)
+// 打开network的store 损坏且备份不可用时 从运行时缓存的结果恢复
+// 释放的ip按ipam的quarantine隔离
+func newStore(conf *config.PluginConf, ipamConf *IPAMConfig) (*store.Store, error) {
+	quarantine, err := ipamConf.QuarantineWindow()
 	if err != nil {
 		return nil, err
 	}
-
-	im := &IPAM{
-		subnet: ipnet,
-		store:  s,
-	}
-
-	// gateway = 子网段的第一个ip
-	im.gateway, err = im.NextIP(im.subnet.IP)
+	s, err := store.NewStore(conf.DataDir, conf.Name)
 	if err != nil {
 		return nil, err
 	}
+	s.Recover = store.FromResultCache(conf.CNICacheDir, conf.Name)
+	s.Quarantine = quarantine
+	return s, nil
+}
 
-	return im, nil
+// 根据ipam配置初始化 conf需要已经Canonicalize
+func NewIPAM(conf *IPAMConfig, s *store.Store) (*IPAM, error) {
+	// 空闲ip从每个range的位图中查找
+	var ranges []store.Range
+	for _, set := range conf.Ranges {
+		for i := range set {
+			ranges = append(ranges, set[i].storeRange())
+		}
+	}
+	if err := s.SetRanges(ranges...); err != nil {
+		return nil, err
+	}
+	return &IPAM{conf: conf, store: s}, nil
 }
 
-func (im *IPAM) Mask() net.IPMask {
-	return im.subnet.Mask
+// ip所在range的地址和网关
+func (im *IPAM) ipConfig(ip net.IP) (*current.IPConfig, error) {
+	for _, set := range im.conf.Ranges {
+		if r := set.rangeFor(ip); r != nil {
+			return &current.IPConfig{
+				Address: net.IPNet{IP: ip, Mask: r.Subnet.Mask},
+				Gateway: r.Gateway,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: ip %s is in none of the ranges", staticip.ErrIPNotInBlock, ip)
 }
 
-func (im *IPAM) Gateway() net.IP {
-	return im.gateway
+// ipam的路由 加上分配到的ip所在range的路由
+func (im *IPAM) Routes(ips []*current.IPConfig) []*types.Route {
+	routes := append([]*types.Route{}, im.conf.Routes...)
+	for _, ipc := range ips {
+		for _, set := range im.conf.Ranges {
+			r := set.rangeFor(ipc.Address.IP)
+			if r == nil {
+				continue
+			}
+			for _, route := range r.Routes {
+				route := *route
+				if route.GW == nil {
+					route.GW = r.Gateway
+				}
+				routes = append(routes, &route)
+			}
+		}
+	}
+	return routes
 }
 
-func (im *IPAM) IPNet(ip net.IP) *net.IPNet {
-	return &net.IPNet{IP: ip, Mask: im.Mask()}
+func (im *IPAM) AllocateIP(id, ifName string) ([]*current.IPConfig, error) {
+	return im.AllocatePodIP(id, ifName, nil, nil)
 }
 
-func (im *IPAM) NextIP(ip net.IP) (net.IP, error) {
-	next := cip.NextIP(ip)
-	if !im.subnet.Contains(next) {
-		return nil, IPOverflowError
+// 在range set中查找未分配 可用且 ok 的ip 前面的range没有时才用后面的
+// 跳过隔离期内的ip 整个range set都没有时 才取隔离期内释放最早的 调用前store需要已经加锁
+func (im *IPAM) findFree(set RangeSet, fromLast bool, ok func(net.IP) bool) net.IP {
+	// 网络地址 网关 广播地址和预留的也不分配
+	free := func(r *Range, ip net.IP) bool {
+		_, reserved := im.store.Reserved(ip)
+		return r.usable(ip) == nil && !reserved && ok(ip)
 	}
+	for i := range set {
+		r := &set[i]
+		var from net.IP
+		if fromLast {
+			from = im.store.LastIn(r.storeRange())
+		}
+		next := im.store.NextFree(r.storeRange(), from, func(ip net.IP) bool {
+			_, quarantined := im.store.Quarantined(ip)
+			return !quarantined && free(r, ip)
+		})
+		if next != nil {
+			return next
+		}
+	}
+	return im.store.OldestQuarantined(func(ip net.IP) bool {
+		r := set.rangeFor(ip)
+		return r != nil && free(r, ip)
+	})
+}
 
+// 从range set中第一个还有空闲ip的range分配 range内从上一个已经分配的地址开始
+func (im *IPAM) allocateNext(set RangeSet) (net.IP, error) {
+	next := im.findFree(set, true, func(net.IP) bool { return true })
+	if next == nil {
+		return nil, fmt.Errorf("no available ip in ranges of subnet %s", set[0].subnet())
+	}
 	return next, nil
 }
 
-func (im *IPAM) AllocateIP(id, ifName string) (net.IP, error) {
+// 分配请求的ip 隔离期内的也可以 或者请求范围内任意一个空闲ip 调用前store需要已经加锁
+func (im *IPAM) allocateStatic(set RangeSet, req *staticip.Request) (net.IP, error) {
+	if req.IP != nil {
+		if err := set.rangeFor(req.IP).usable(req.IP); err != nil {
+			return nil, err
+		}
+		if owner, ok := im.store.GetIDByIP(req.IP); ok {
+			return nil, fmt.Errorf("%w: %s is allocated to %s", staticip.ErrIPTaken, req.IP, owner)
+		}
+		if cidr, ok := im.store.Reserved(req.IP); ok {
+			return nil, fmt.Errorf("%w: %s is reserved by %s", staticip.ErrInvalidRequest, req.IP, cidr)
+		}
+		return req.IP, nil
+	}
+
+	// 范围内的第一个空闲ip
+	if next := im.findFree(set, false, req.Range.Contains); next != nil {
+		return next, nil
+	}
+	return nil, fmt.Errorf("%w: no free ip left in range %s", staticip.ErrIPTaken, req.Range)
+}
+
+// 分配指定的ip 或者指定范围内任意一个空闲ip
+func (im *IPAM) AllocateStaticIP(id, ifName string, req *staticip.Request) ([]*current.IPConfig, error) {
+	return im.AllocatePodIP(id, ifName, nil, req)
+}
+
+// 为pod从每个range set各分配一个ip 并记录所属的pod
+// 指定了req时 每个地址族请求的ip由所在的range set分配 其他的照常分配
+func (im *IPAM) AllocatePodIP(id, ifName string, pod *podinfo.Pod, req *staticip.Request) ([]*current.IPConfig, error) {
 	im.store.Lock()
 	defer im.store.Unlock()
 
@@ -89,55 +178,108 @@ func (im *IPAM) AllocateIP(id, ifName string) (net.IP, error) {
 		return nil, err
 	}
 
-	// 已经分配了ip 跳过
-	ip, _ := im.store.GetIPByID(id)
-	if len(ip) > 0 {
-		return ip, nil
+	// 接口已经分配了ip 跳过 有请求时每个地址族都必须与请求一致
+	if ips := im.store.GetIPs(id, ifName); len(ips) > 0 {
+		var configs []*current.IPConfig
+		for _, ip := range ips {
+			ipc, err := im.ipConfig(ip)
+			if err != nil {
+				return nil, err
+			}
+			configs = append(configs, ipc)
+		}
+		for _, part := range requestParts(req) {
+			matched := false
+			for _, ip := range ips {
+				matched = matched || part.Match(ip)
+			}
+			if !matched {
+				return nil, fmt.Errorf("%w: %s-%s already has ip %v, not %s", staticip.ErrInvalidRequest, id, ifName, ips, req)
+			}
+		}
+		return configs, nil
 	}
 
-	// 上一个已经分配的地址
-	last := im.store.Last()
-	if len(last) == 0 {
-		last = im.gateway
+	// 请求的每个地址族都要有range set
+	for _, part := range requestParts(req) {
+		wanted := false
+		for _, set := range im.conf.Ranges {
+			wanted = wanted || set.wants(part)
+		}
+		if !wanted {
+			return nil, fmt.Errorf("%w: %s is in none of the subnets", staticip.ErrIPNotInBlock, part)
+		}
 	}
 
-	start := make(net.IP, len(last))
-	copy(start, last)
-	for {
-		next, err := im.NextIP(start)
-		if err == IPOverflowError && !last.Equal(im.gateway) {
-			start = im.gateway
-			continue
-		} else if err != nil {
+	// 不同range set的地址族不同 先都找到再一起记录
+	var ips []net.IP
+	for _, set := range im.conf.Ranges {
+		var ip net.IP
+		var err error
+		if part := requestFor(req, set); part != nil {
+			ip, err = im.allocateStatic(set, part)
+		} else {
+			ip, err = im.allocateNext(set)
+		}
+		if err != nil {
 			return nil, err
 		}
+		ips = append(ips, ip)
+	}
 
-		if !im.store.Contain(next) {
-			err := im.store.Add(next, id, ifName)
-			return next, err
+	var configs []*current.IPConfig
+	for _, ip := range ips {
+		if err := im.store.AddPod(ip, id, ifName, pod); err != nil {
+			return nil, err
 		}
-
-		start = next
-		if start.Equal(last) {
-			break
+		ipc, err := im.ipConfig(ip)
+		if err != nil {
+			return nil, err
 		}
+		configs = append(configs, ipc)
+	}
+	return configs, nil
+}
+
+// 回收容器已经不存在的ip 分配不足minAge的跳过
+func GC(s *store.Store, checker gc.Checker, minAge time.Duration) ([]gc.Attachment, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LoadData(); err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("no available ip")
+	var released []gc.Attachment
+	for ip, info := range s.Entries() {
+		att := gc.Attachment{ContainerID: info.ID, IfName: info.IFName}
+		if checker.Alive(att) {
+			continue
+		}
+		if minAge > 0 && !info.Created.IsZero() && time.Since(info.Created) < minAge {
+			continue
+		}
+		if err := s.DelByIP(net.ParseIP(ip)); err != nil {
+			return released, err
+		}
+		released = append(released, att)
+	}
+	return released, nil
 }
 
-func (im *IPAM) ReleaseIP(id string) error {
-	im.store.Lock()
-	defer im.store.Unlock()
+// 释放容器一个接口的所有ip 已经释放过的什么也不做 不需要ranges
+func ReleaseIP(s *store.Store, id, ifName string) ([]net.IP, error) {
+	s.Lock()
+	defer s.Unlock()
 
-	if err := im.store.LoadData(); err != nil {
-		return err
+	if err := s.LoadData(); err != nil {
+		return nil, err
 	}
 
-	return im.store.Del(id)
+	return s.Release(id, ifName)
 }
 
-func (im *IPAM) CheckIP(id string) (net.IP, error) {
+func (im *IPAM) CheckIP(id, ifName string) ([]net.IP, error) {
 	im.store.RLock()
 	defer im.store.RUnlock()
 
@@ -145,79 +287,74 @@ func (im *IPAM) CheckIP(id string) (net.IP, error) {
 		return nil, err
 	}
 
-	ip, ok := im.store.GetIPByID(id)
-	if !ok {
-		return nil, fmt.Errorf("failed to find container %s ip", id)
+	ips := im.store.GetIPs(id, ifName)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("failed to find ip of %s-%s", id, ifName)
 	}
 
-	return ip, nil
+	return ips, nil
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	cniConf, err := config.LoadCNIConfig(args.StdinData)
+	pluginConf, ipamConf, err := loadConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	s, err := store.NewStore(cniConf.DataDir, cniConf.Name)
+	s, err := newStore(pluginConf, ipamConf)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	ipam, err := NewIPAM(cniConf, s)
+	ipam, err := NewIPAM(ipamConf, s)
 	if err != nil {
 		return err
 	}
 
-	gateway := ipam.Gateway()
-	allocated_ip, err := ipam.AllocateIP(args.ContainerID, args.IfName)
+	// runtimeConfig.ips > CNI_ARGS IP= > pod annotations
+	req, err := staticip.Resolve(pluginConf.RuntimeIPs(), args.Args, pluginConf.StaticIPDir)
 	if err != nil {
 		return err
 	}
 
-	_, cidr, err := net.ParseCIDR(ClusterCIDR)
+	// 记录所属的pod 不是kubelet调用时为空
+	pod, err := podinfo.FromArgs(args.Args)
+	if err != nil {
+		return err
+	}
+
+	ips, err := ipam.AllocatePodIP(args.ContainerID, args.IfName, pod, req)
 	if err != nil {
 		return err
 	}
 
-	// 这里额外添加一条路由规则 用于跨节点的通信情况
 	result := &current.Result{
 		CNIVersion: current.ImplementedSpecVersion,
-		IPs: []*current.IPConfig{
-			{
-				Address: net.IPNet{IP: allocated_ip, Mask: ipam.Mask()},
-				Gateway: gateway,
-			},
-		},
-		Routes: []*types.Route{
-			{
-				Dst: net.IPNet{IP: cidr.IP, Mask: cidr.Mask},
-				GW:  gateway,
-			},
-		},
-	}
-	return types.PrintResult(result, cniConf.CNIVersion)
+		IPs:        ips,
+		Routes:     ipam.Routes(ips),
+	}
+	return types.PrintResult(result, pluginConf.CNIVersion)
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-	conf, err := config.LoadCNIConfig(args.StdinData)
+	pluginConf, ipamConf, err := loadConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	s, err := store.NewStore(conf.DataDir, conf.Name)
+	s, err := newStore(pluginConf, ipamConf)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	ipam, err := NewIPAM(conf, s)
+	ipam, err := NewIPAM(ipamConf, s)
 	if err != nil {
 		return fmt.Errorf("failed to create ipam: %v", err)
 	}
 
-	_, err = ipam.CheckIP(args.ContainerID)
+	_, err = ipam.CheckIP(args.ContainerID, args.IfName)
 	if err != nil {
 		return err
 	}
@@ -225,24 +362,55 @@ func cmdCheck(args *skel.CmdArgs) error {
 	return nil
 }
 
+// 可以重复调用 接口的ip已经释放或者从未分配时也成功
 func cmdDel(args *skel.CmdArgs) error {
-	cniConf, err := config.LoadCNIConfig(args.StdinData)
+	pluginConf, err := config.LoadPluginConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	ipamConf, err := parseIPAMConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	s, err := store.NewStore(cniConf.DataDir, cniConf.Name)
+	s, err := newStore(pluginConf, ipamConf)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	ipam, err := NewIPAM(cniConf, s)
+	_, err = ReleaseIP(s, args.ContainerID, args.IfName)
+	return err
+}
+
+func cmdGC(stdin []byte) error {
+	pluginConf, err := config.LoadPluginConfig(stdin)
 	if err != nil {
-		return fmt.Errorf("failed to create ipam: %v", err)
+		return err
 	}
-	if err := ipam.ReleaseIP(args.ContainerID); err != nil {
+	ipamConf, err := parseIPAMConfig(stdin)
+	if err != nil {
 		return err
 	}
-	return nil
+	gcConf, err := gc.LoadConf(stdin)
+	if err != nil {
+		return err
+	}
+	var lister gc.Lister
+	if pluginConf.RuntimeEndpoint != "" {
+		lister = &gc.CrictlLister{Endpoint: pluginConf.RuntimeEndpoint}
+	}
+	checker, minAge, err := gc.NewChecker(gcConf, lister)
+	if err != nil {
+		return err
+	}
+
+	s, err := newStore(pluginConf, ipamConf)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	_, err = GC(s, checker, minAge)
+	return err
 }
@@ -1,11 +1,24 @@
 package main
 
 import(
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"mycni/pkg/gc"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/local/store"
 
 	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	cip "github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
 )
 
 const (
@@ -53,3 +66,424 @@ func TestIPAMLoop(t *testing.T) {
 	}
 }
 
+// ipam of a node subnet in subnet.json
+func newSubnetConf(t *testing.T, subnet string) *IPAMConfig {
+	ranges, err := subnetRanges(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &IPAMConfig{Ranges: ranges}
+	if err := conf.Canonicalize(); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestLoadConf(t *testing.T) {
+	te := assert.New(t)
+	load := func(ipam string) (*IPAMConfig, error) {
+		_, conf, err := loadConf([]byte(`{"cniVersion": "1.0.0", "name": "mynet", "ipam": {"type": "local", ` + ipam + `}}`))
+		return conf, err
+	}
+
+	conf, err := load(`"ranges": [
+		[{"subnet": "10.244.1.0/24", "rangeStart": "10.244.1.10", "rangeEnd": "10.244.1.11", "routes": [{"dst": "10.244.0.0/16"}]},
+		 {"subnet": "10.245.1.0/24", "gateway": "10.245.1.254"}],
+		[{"subnet": "fd00:10:244:1::/64"}]
+	], "routes": [{"dst": "0.0.0.0/0", "gw": "10.244.1.1"}]`)
+	te.Nil(err)
+	te.Equal(len(conf.Ranges), 2)
+	r := conf.Ranges[0][1]
+	te.Equal(r.storeRange().String(), "10.245.1.1-10.245.1.254")
+	te.Equal(r.Gateway.String(), "10.245.1.254")
+	r = conf.Ranges[1][0]
+	te.Equal(r.storeRange().String(), "fd00:10:244:1::1-fd00:10:244:1:ffff:ffff:ffff:ffff")
+	te.Equal(r.Gateway.String(), "fd00:10:244:1::1")
+	te.Equal(len(conf.Routes), 1)
+
+	for _, ranges := range []string{
+		`[[]]`,
+		`[[{"subnet": "10.244.1.0/24", "rangeStart": "10.244.2.10"}]]`,
+		`[[{"subnet": "10.244.1.0/24", "rangeStart": "10.244.1.20", "rangeEnd": "10.244.1.10"}]]`,
+		`[[{"subnet": "10.244.1.0/24", "gateway": "fd00::1"}]]`,
+		`[[{"subnet": "10.244.1.0/24"}, {"subnet": "fd00::/64"}]]`,
+		`[[{"subnet": "10.244.1.0/24"}, {"subnet": "10.244.1.0/25"}]]`,
+		`[[{"subnet": "10.244.1.0/24"}], [{"subnet": "10.245.1.0/24"}]]`,
+		`[[{"subnet": "10.244.1.0/31"}]], "quarantine": "soon"`,
+		`[[{"subnet": "10.244.1.0/24"}]], "quarantine": "-1s"`,
+	} {
+		_, err := load(`"ranges": ` + ranges)
+		te.NotNil(err, ranges)
+	}
+}
+
+func TestAllocateDualStack(t *testing.T) {
+	te := assert.New(t)
+
+	s, err := store.NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+	_, conf, err := loadConf([]byte(`{"cniVersion": "1.0.0", "name": "mynet", "ipam": {"type": "local", "ranges": [
+		[{"subnet": "10.244.1.0/24", "rangeStart": "10.244.1.10", "rangeEnd": "10.244.1.11", "routes": [{"dst": "10.244.0.0/16"}]},
+		 {"subnet": "10.245.1.0/24", "gateway": "10.245.1.254"}],
+		[{"subnet": "fd00:10:244:1::/64"}]
+	], "routes": [{"dst": "0.0.0.0/0", "gw": "10.244.1.1"}]}}`))
+	te.Nil(err)
+	im, err := NewIPAM(conf, s)
+	te.Nil(err)
+
+	// one ip of each family, the first range is used up first
+	var got []string
+	for _, id := range []string{"c0", "c1", "c2"} {
+		ips, err := im.AllocateIP(id, "eth0")
+		te.Nil(err)
+		te.Equal(len(ips), 2)
+		got = append(got, ips[0].Address.String(), ips[1].Address.String())
+	}
+	te.Equal(got, []string{
+		"10.244.1.10/24", "fd00:10:244:1::2/64",
+		"10.244.1.11/24", "fd00:10:244:1::3/64",
+		"10.245.1.1/24", "fd00:10:244:1::4/64",
+	})
+
+	// routes of the ranges the ips come from, via their gateways
+	ips, err := im.AllocateIP("c0", "eth0")
+	te.Nil(err)
+	te.Equal(ips[1].Gateway.String(), "fd00:10:244:1::1")
+	routes := im.Routes(ips)
+	te.Equal(len(routes), 2)
+	te.Equal(routes[0].Dst.String(), "0.0.0.0/0")
+	te.Equal(routes[1].Dst.String(), "10.244.0.0/16")
+	te.Equal(routes[1].GW.String(), "10.244.1.1")
+	ips, err = im.AllocateIP("c2", "eth0")
+	te.Nil(err)
+	te.Equal(len(im.Routes(ips)), 1)
+	te.Equal(ips[0].Gateway.String(), "10.245.1.254")
+
+	// a static ip is taken in its own family, the other one is allocated as usual
+	req, err := staticip.NewRequest([]string{"10.245.1.100"}, "")
+	te.Nil(err)
+	ips, err = im.AllocateStaticIP("c3", "eth0", req)
+	te.Nil(err)
+	te.Equal(ips[0].Address.IP.String(), "10.245.1.100")
+	te.Equal(ips[1].Address.IP.String(), "fd00:10:244:1::5")
+	req, _ = staticip.NewRequest([]string{"10.246.1.100"}, "")
+	_, err = im.AllocateStaticIP("c4", "eth0", req)
+	te.True(errors.Is(err, staticip.ErrIPNotInBlock))
+	req, _ = staticip.NewRequest([]string{"10.244.1.100"}, "")
+	_, err = im.AllocateStaticIP("c4", "eth0", req)
+	te.True(errors.Is(err, staticip.ErrIPNotInBlock))
+
+	// both are released
+	_, err = ReleaseIP(s, "c0", "eth0")
+	te.Nil(err)
+	te.Nil(s.LoadData())
+	te.False(s.Contain(net.ParseIP("10.244.1.10")))
+	te.False(s.Contain(net.ParseIP("fd00:10:244:1::2")))
+	ips, err = im.AllocateIP("c5", "eth0")
+	te.Nil(err)
+	te.Equal(ips[0].Address.IP.String(), "10.244.1.10")
+}
+
+func TestAllocateStaticDualStack(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	add := func(id string, ips string) (*current.Result, error) {
+		conf := fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "dataDir": %q,
+			"runtimeConfig": {"ips": [%s]},
+			"ipam": {"type": "local", "ranges": [[{"subnet": "10.244.1.0/24"}], [{"subnet": "fd00:10:244:1::/64"}]]}}`, dir, ips)
+		args := &skel.CmdArgs{ContainerID: id, Netns: nspath, IfName: ifname, StdinData: []byte(conf)}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return current.GetResult(r)
+	}
+
+	// runtimeConfig pins one ip of each family
+	res, err := add("c0", `"fd00:10:244:1::100/64", "10.244.1.100/24"`)
+	te.Nil(err)
+	te.Equal(len(res.IPs), 2)
+	te.Equal(res.IPs[0].Address.String(), "10.244.1.100/24")
+	te.Equal(res.IPs[1].Address.String(), "fd00:10:244:1::100/64")
+	// same again
+	res, err = add("c0", `"10.244.1.100", "fd00:10:244:1::100"`)
+	te.Nil(err)
+	te.Equal(len(res.IPs), 2)
+
+	// only the ipv6 is pinned, the ipv4 goes on after the last one
+	res, err = add("c1", `"fd00:10:244:1::200"`)
+	te.Nil(err)
+	te.Equal(res.IPs[0].Address.IP.String(), "10.244.1.101")
+	te.Equal(res.IPs[1].Address.IP.String(), "fd00:10:244:1::200")
+
+	_, err = add("c2", `"fd00:10:244:1::100"`)
+	te.True(errors.Is(err, staticip.ErrIPTaken))
+	_, err = add("c2", `"10.244.1.102", "fd00:10:244:2::1"`)
+	te.True(errors.Is(err, staticip.ErrIPNotInBlock))
+	_, err = add("c0", `"10.244.1.100", "fd00:10:244:1::101"`)
+	te.True(errors.Is(err, staticip.ErrInvalidRequest))
+}
+
+func TestAllocateStaticIP(t *testing.T) {
+	te := assert.New(t)
+
+	s, err := store.NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+	im, err := NewIPAM(newSubnetConf(t, "10.244.1.0/24"), s)
+	te.Nil(err)
+
+	req, err := staticip.NewRequest([]string{"10.244.1.100"}, "")
+	te.Nil(err)
+	ips, err := im.AllocateStaticIP("db0", "eth0", req)
+	te.Nil(err)
+	te.Equal(ips[0].Address.String(), "10.244.1.100/24")
+	te.Equal(ips[0].Gateway.String(), "10.244.1.1")
+
+	// taken by db0
+	_, err = im.AllocateStaticIP("db1", "eth0", req)
+	te.True(errors.Is(err, staticip.ErrIPTaken))
+
+	// gateway & broadcast
+	for _, s := range []string{"10.244.1.1", "10.244.1.255"} {
+		req, _ = staticip.NewRequest([]string{s}, "")
+		_, err = im.AllocateStaticIP("db1", "eth0", req)
+		te.True(errors.Is(err, staticip.ErrInvalidRequest), s)
+	}
+
+	// outside subnet of node
+	req, _ = staticip.NewRequest([]string{"10.244.2.100"}, "")
+	_, err = im.AllocateStaticIP("db1", "eth0", req)
+	te.True(errors.Is(err, staticip.ErrIPNotInBlock))
+
+	// any free one in range
+	req, _ = staticip.NewRequest(nil, "10.244.1.100/31")
+	ips, err = im.AllocateStaticIP("db1", "eth0", req)
+	te.Nil(err)
+	te.Equal(ips[0].Address.IP.String(), "10.244.1.101")
+	_, err = im.AllocateStaticIP("db2", "eth0", req)
+	te.True(errors.Is(err, staticip.ErrIPTaken))
+}
+
+func TestGC(t *testing.T) {
+	te := assert.New(t)
+
+	s, err := store.NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+	im, err := NewIPAM(newSubnetConf(t, "10.244.1.0/24"), s)
+	te.Nil(err)
+
+	for _, id := range []string{"c0", "c1", "c2"} {
+		_, err := im.AllocateIP(id, "eth0")
+		te.Nil(err)
+	}
+
+	// too young to be collected
+	checker := gc.FromAttachments([]gc.Attachment{{ContainerID: "c1", IfName: "eth0"}})
+	released, err := GC(s, checker, time.Hour)
+	te.Nil(err)
+	te.Empty(released)
+
+	released, err = GC(s, checker, 0)
+	te.Nil(err)
+	te.ElementsMatch(released, []gc.Attachment{{ContainerID: "c0", IfName: "eth0"}, {ContainerID: "c2", IfName: "eth0"}})
+	te.Nil(s.LoadData())
+	te.Len(s.Entries(), 1)
+	ips, err := im.CheckIP("c1", "eth0")
+	te.Nil(err)
+	te.Len(ips, 1)
+}
+
+func TestReleaseIP(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	conf := fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "dataDir": %q, "ipam": {"type": "local", "ranges": [
+		[{"subnet": "10.244.1.0/24"}], [{"subnet": "fd00:10:244:1::/64"}]
+	]}}`, dir)
+	_, ipamConf, err := loadConf([]byte(conf))
+	te.Nil(err)
+	s, err := store.NewStore(dir, "mynet")
+	te.Nil(err)
+	defer s.Close()
+	im, err := NewIPAM(ipamConf, s)
+	te.Nil(err)
+
+	// every interface of a container has its own ips
+	eth0, err := im.AllocateIP("c0", "eth0")
+	te.Nil(err)
+	eth1, err := im.AllocateIP("c0", "eth1")
+	te.Nil(err)
+	te.NotEqual(eth1[0].Address.String(), eth0[0].Address.String())
+	_, err = im.AllocateIP("c1", "eth0")
+	te.Nil(err)
+	ips, err := im.CheckIP("c0", "eth1")
+	te.Nil(err)
+	te.Len(ips, 2)
+
+	// both ips of the interface are gone, the other interface keeps its own
+	del := func(id, ifName string) error {
+		args := &skel.CmdArgs{ContainerID: id, Netns: nspath, IfName: ifName, StdinData: []byte(conf)}
+		return testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+	}
+	te.Nil(del("c0", "eth0"))
+	te.Nil(s.LoadData())
+	for _, ipc := range eth0 {
+		te.False(s.Contain(ipc.Address.IP), ipc.Address.String())
+	}
+	_, err = im.CheckIP("c0", "eth0")
+	te.NotNil(err)
+	ips, err = im.CheckIP("c0", "eth1")
+	te.Nil(err)
+	te.Len(ips, 2)
+
+	// again, or of an interface never added
+	te.Nil(del("c0", "eth0"))
+	te.Nil(del("c2", "eth0"))
+	te.Nil(s.LoadData())
+	te.Len(s.Entries(), 4)
+
+	released, err := ReleaseIP(s, "c0", "eth1")
+	te.Nil(err)
+	te.Len(released, 2)
+	released, err = ReleaseIP(s, "c0", "eth1")
+	te.Nil(err)
+	te.Empty(released)
+}
+
+func TestQuarantine(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	open := func(quarantine string) (*store.Store, *IPAM) {
+		pluginConf, ipamConf, err := loadConf([]byte(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "dataDir": %q,
+			"ipam": {"type": "local", "ranges": [[{"subnet": "10.244.1.0/29"}]], "quarantine": %q}}`, dir, quarantine)))
+		te.Nil(err)
+		s, err := newStore(pluginConf, ipamConf)
+		te.Nil(err)
+		im, err := NewIPAM(ipamConf, s)
+		te.Nil(err)
+		return s, im
+	}
+	alloc := func(im *IPAM, id string) string {
+		ips, err := im.AllocateIP(id, "eth0")
+		if err != nil {
+			return err.Error()
+		}
+		return ips[0].Address.IP.String()
+	}
+
+	// .2 - .6, released before quarantine is on
+	s, im := open("")
+	for _, id := range []string{"c0", "c1", "c2", "c3", "c4"} {
+		alloc(im, id)
+	}
+	_, err := ReleaseIP(s, "c3", "eth0")
+	te.Nil(err)
+	te.Nil(s.Close())
+
+	s, im = open("1h")
+	defer s.Close()
+	_, err = ReleaseIP(s, "c0", "eth0")
+	te.Nil(err)
+	te.Nil(s.LoadData())
+	_, quarantined := s.Quarantined(net.ParseIP("10.244.1.2"))
+	te.True(quarantined)
+	_, quarantined = s.Quarantined(net.ParseIP("10.244.1.5"))
+	te.False(quarantined)
+
+	// wraps around past the quarantined .2, which is only taken once nothing else is left
+	te.Equal(alloc(im, "c5"), "10.244.1.5")
+	te.Equal(alloc(im, "c6"), "10.244.1.2")
+	te.Contains(alloc(im, "c7"), "no available ip")
+
+	// asked for explicitly
+	_, err = ReleaseIP(s, "c1", "eth0")
+	te.Nil(err)
+	req, _ := staticip.NewRequest([]string{"10.244.1.3"}, "")
+	ips, err := im.AllocateStaticIP("c8", "eth0", req)
+	te.Nil(err)
+	te.Equal(ips[0].Address.IP.String(), "10.244.1.3")
+	_, quarantined = s.Quarantined(net.ParseIP("10.244.1.3"))
+	te.False(quarantined)
+}
+
+// store of a /16 with fill ips allocated, written the way an older plugin left it,
+// migrated by the first write
+func newFilledIPAM(b *testing.B, fill int) (*store.Store, *IPAM) {
+	dir := b.TempDir()
+	data := store.Data{IPs: make(map[string]store.ContainerNetInfo, fill)}
+	ip := net.ParseIP("10.244.0.1").To4()
+	for i := 0; i < fill; i++ {
+		ip = cip.NextIP(ip)
+		data.IPs[ip.String()] = store.ContainerNetInfo{ID: fmt.Sprintf("c%d", i), IFName: "eth0"}
+	}
+	data.Last = ip.String()
+	raw, err := json.Marshal(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	s, err := store.NewStore(dir, "mynet")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mynet", "mynet.json"), raw, 0644); err != nil {
+		b.Fatal(err)
+	}
+	ranges, err := subnetRanges("10.244.0.0/16")
+	if err != nil {
+		b.Fatal(err)
+	}
+	conf := &IPAMConfig{Ranges: ranges}
+	if err := conf.Canonicalize(); err != nil {
+		b.Fatal(err)
+	}
+	im, err := NewIPAM(conf, s)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return s, im
+}
+
+// A whole ADD as a /16 fills up: load the head & bitmap, find a free ip, write it down.
+// None of it grows with the allocated ips, so a nearly full pool costs about the same as an empty one
+func BenchmarkAllocatePodIP(b *testing.B) {
+	const factor = 3
+	cost := make(map[int]time.Duration)
+	for _, pct := range []int{0, 50, 90, 99} {
+		pct := pct
+		fill := 65533 * pct / 100
+		b.Run(fmt.Sprintf("%d%%", pct), func(b *testing.B) {
+			s, im := newFilledIPAM(b, fill)
+			defer s.Close()
+			// 第一次写入时迁移旧文件 之后都是增量写入
+			if _, err := im.AllocateIP("warmup", "eth0"); err != nil {
+				b.Fatal(err)
+			}
+			var total time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err := im.AllocateIP("bench", "eth0"); err != nil {
+					b.Fatal(err)
+				}
+				total += time.Since(start)
+				// 用完放回 保持填充率不变
+				b.StopTimer()
+				if _, err := ReleaseIP(s, "bench", "eth0"); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+			cost[pct] = total / time.Duration(b.N)
+		})
+	}
+	if cost[0] > 0 && cost[99] > factor*cost[0] {
+		b.Errorf("allocating from a 99%% full pool takes %v, more than %d times %v of an empty one", cost[99], factor, cost[0])
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"mycni/pkg/config"
+	"mycni/pkg/staticip"
+	"mycni/plugins/ipam/local/store"
+
+	"github.com/containernetworking/cni/pkg/types"
+	cip "github.com/containernetworking/plugins/pkg/ip"
+)
+
+const (
+	// subnet.json 模式下返回的路由 用于跨节点的通信
+	ClusterCIDR = "10.244.0.0/16"
+)
+
+// 与host-local的range相同 rangeStart/rangeEnd/gateway为空时取默认值
+type Range struct {
+	Subnet     types.IPNet `json:"subnet"`
+	RangeStart net.IP      `json:"rangeStart,omitempty"`
+	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`
+	Gateway    net.IP      `json:"gateway,omitempty"`
+	// 从这个range分配到ip时返回的路由 没有gw的经过gateway
+	Routes []*types.Route `json:"routes,omitempty"`
+}
+
+// 同一地址族的一组range 前面的满了才用后面的
+type RangeSet []Range
+
+// cni配置中的ipam部分
+type IPAMConfig struct {
+	// 每个range set分配一个ip 最多一个v4和一个v6
+	Ranges []RangeSet `json:"ranges,omitempty"`
+	// 所有容器都返回的路由 原样返回
+	Routes []*types.Route `json:"routes,omitempty"`
+	// 释放的ip多久之内不优先分配 如 30s 默认不隔离
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// 释放的ip的隔离期 没有配置时为0
+func (c *IPAMConfig) QuarantineWindow() (time.Duration, error) {
+	if c.Quarantine == "" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(c.Quarantine)
+	if err != nil || window < 0 {
+		return 0, fmt.Errorf("invalid quarantine %q", c.Quarantine)
+	}
+	return window, nil
+}
+
+// 只读取ipam部分 不检查ranges 没有时为空的配置
+func parseIPAMConfig(stdin []byte) (*IPAMConfig, error) {
+	n := struct {
+		IPAM *IPAMConfig `json:"ipam"`
+	}{}
+	if err := json.Unmarshal(stdin, &n); err != nil {
+		return nil, fmt.Errorf("failed to parse ipam configuration: %v", err)
+	}
+	if n.IPAM == nil {
+		return &IPAMConfig{}, nil
+	}
+	if _, err := n.IPAM.QuarantineWindow(); err != nil {
+		return nil, err
+	}
+	return n.IPAM, nil
+}
+
+// 读取插件配置 ipam中没有ranges时 使用subnet.json中节点的subnet
+func loadConf(stdin []byte) (*config.PluginConf, *IPAMConfig, error) {
+	pluginConf, err := config.LoadPluginConfig(stdin)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf, err := parseIPAMConfig(stdin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(conf.Ranges) == 0 {
+		subnetConf, err := config.LoadSubnetConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		if conf.Ranges, err = subnetRanges(subnetConf.Subnet); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := conf.Canonicalize(); err != nil {
+		return nil, nil, err
+	}
+	return pluginConf, conf, nil
+}
+
+// 节点的subnet 网关为第一个ip 路由到整个集群
+func subnetRanges(subnet string) ([]RangeSet, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	_, cidr, err := net.ParseCIDR(ClusterCIDR)
+	if err != nil {
+		return nil, err
+	}
+	return []RangeSet{{{Subnet: types.IPNet(*ipnet), Routes: []*types.Route{{Dst: *cidr}}}}}, nil
+}
+
+// 填上默认值并检查 range之间不能重叠
+func (c *IPAMConfig) Canonicalize() error {
+	if len(c.Ranges) == 0 {
+		return errors.New("no ranges to allocate from")
+	}
+	families := make(map[bool]bool)
+	for i, set := range c.Ranges {
+		if len(set) == 0 {
+			return fmt.Errorf("range set %d is empty", i)
+		}
+		for j := range set {
+			if err := set[j].Canonicalize(); err != nil {
+				return fmt.Errorf("range set %d: %w", i, err)
+			}
+			if set[j].v4() != set[0].v4() {
+				return fmt.Errorf("range set %d mixes ipv4 and ipv6", i)
+			}
+			for k := range set[:j] {
+				if set[j].Overlaps(&set[k]) {
+					return fmt.Errorf("range set %d: %s overlaps %s", i, set[j].storeRange(), set[k].storeRange())
+				}
+			}
+		}
+		// 每个接口只有一个v4和一个v6地址
+		if families[set[0].v4()] {
+			return fmt.Errorf("range set %d: only one range set per ip family is supported", i)
+		}
+		families[set[0].v4()] = true
+	}
+	return nil
+}
+
+func (r *Range) subnet() *net.IPNet {
+	return (*net.IPNet)(&r.Subnet)
+}
+
+func (r *Range) v4() bool {
+	return r.Subnet.IP.To4() != nil
+}
+
+// v4地址统一为4字节
+func (r *Range) canonicalIP(ip net.IP) net.IP {
+	if r.v4() {
+		return ip.To4()
+	}
+	if ip.To4() != nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+// 默认从subnet的第二个ip到最后一个 v4不含广播地址 网关为第一个ip
+func (r *Range) Canonicalize() error {
+	ip := r.Subnet.IP.To4()
+	if ip == nil {
+		ip = r.Subnet.IP.To16()
+	}
+	ones, size := r.Subnet.Mask.Size()
+	if ip == nil || size != len(ip)*8 {
+		return fmt.Errorf("invalid subnet %s", r.subnet())
+	}
+	if ones > size-2 {
+		return fmt.Errorf("subnet %s is too small", r.subnet())
+	}
+	r.Subnet = types.IPNet{IP: ip.Mask(r.Subnet.Mask), Mask: r.Subnet.Mask}
+	subnet := r.subnet()
+
+	last := make(net.IP, len(subnet.IP))
+	for i := range last {
+		last[i] = subnet.IP[i] | ^subnet.Mask[i]
+	}
+	if r.v4() {
+		last = cip.PrevIP(last)
+	}
+	for _, f := range []struct {
+		name string
+		ip   *net.IP
+		def  net.IP
+	}{
+		{"rangeStart", &r.RangeStart, cip.NextIP(subnet.IP)},
+		{"rangeEnd", &r.RangeEnd, last},
+		{"gateway", &r.Gateway, cip.NextIP(subnet.IP)},
+	} {
+		if *f.ip == nil {
+			*f.ip = f.def
+		}
+		ip := r.canonicalIP(*f.ip)
+		if ip == nil || !subnet.Contains(ip) {
+			return fmt.Errorf("%s %s is not in subnet %s", f.name, *f.ip, subnet)
+		}
+		*f.ip = ip
+	}
+	if cip.Cmp(r.RangeStart, r.RangeEnd) > 0 {
+		return fmt.Errorf("rangeStart %s is after rangeEnd %s", r.RangeStart, r.RangeEnd)
+	}
+	return nil
+}
+
+// ip在 [rangeStart, rangeEnd] 内
+func (r *Range) Contains(ip net.IP) bool {
+	ip = r.canonicalIP(ip)
+	return ip != nil && cip.Cmp(ip, r.RangeStart) >= 0 && cip.Cmp(ip, r.RangeEnd) <= 0
+}
+
+func (r *Range) Overlaps(o *Range) bool {
+	return r.v4() == o.v4() && cip.Cmp(r.RangeStart, o.RangeEnd) <= 0 && cip.Cmp(o.RangeStart, r.RangeEnd) <= 0
+}
+
+func (r *Range) storeRange() store.Range {
+	return store.Range{Start: r.RangeStart, End: r.RangeEnd}
+}
+
+// 可以分配给pod的ip 排除网络地址 网关和广播地址
+func (r *Range) usable(ip net.IP) error {
+	subnet := r.subnet()
+	if !subnet.Contains(ip) {
+		return fmt.Errorf("%w: ip %s, subnet %s", staticip.ErrIPNotInBlock, ip, subnet)
+	}
+	broadcast := r.v4() && !subnet.Contains(cip.NextIP(ip))
+	if ip.Equal(subnet.IP) || ip.Equal(r.Gateway) || broadcast {
+		return fmt.Errorf("%w: %s is reserved in subnet %s", staticip.ErrInvalidRequest, ip, subnet)
+	}
+	if !r.Contains(ip) {
+		return fmt.Errorf("%w: ip %s, range %s", staticip.ErrIPNotInBlock, ip, r.storeRange())
+	}
+	return nil
+}
+
+// 包含ip的range 没有时取subnet包含它的 用于报错
+func (s RangeSet) rangeFor(ip net.IP) *Range {
+	var inSubnet *Range
+	for i := range s {
+		if s[i].Contains(ip) {
+			return &s[i]
+		}
+		if inSubnet == nil && s[i].subnet().Contains(ip) {
+			inSubnet = &s[i]
+		}
+	}
+	return inSubnet
+}
+
+// 请求的ip或者范围是否落在这组range中
+func (s RangeSet) wants(req *staticip.Request) bool {
+	for i := range s {
+		subnet := s[i].subnet()
+		if req.IP != nil && subnet.Contains(req.IP) {
+			return true
+		}
+		if req.Range != nil && (req.Range.Contains(subnet.IP) || subnet.Contains(req.Range.IP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求中每个地址族的部分 req为nil时为空
+func requestParts(req *staticip.Request) []*staticip.Request {
+	if req == nil {
+		return nil
+	}
+	var parts []*staticip.Request
+	for _, v4 := range []bool{true, false} {
+		if part := req.Family(v4); part != nil {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// 请求中由这组range分配的部分 没有时返回nil
+func requestFor(req *staticip.Request, set RangeSet) *staticip.Request {
+	if req == nil {
+		return nil
+	}
+	if part := req.Family(set[0].v4()); part != nil && set.wants(part) {
+		return part
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"strings"
+)
+
+const (
+	// v4的位图最多覆盖 /8 即2M字节
+	maxBitmapBits = 24
+	// v6的range只从前64K个地址中分配 否则位图过大
+	maxV6Bits = 16
+)
+
+// 一段可分配的地址 两端都包含在内
+type Range struct {
+	Start net.IP
+	End   net.IP
+}
+
+// like: 10.244.1.2-10.244.1.254
+func (r Range) String() string {
+	return r.Start.String() + "-" + r.End.String()
+}
+
+func ParseRange(s string) (Range, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return Range{}, fmt.Errorf("invalid range %q", s)
+	}
+	r := Range{Start: net.ParseIP(parts[0]), End: net.ParseIP(parts[1])}
+	if r.Start == nil || r.End == nil {
+		return Range{}, fmt.Errorf("invalid range %q", s)
+	}
+	return r, nil
+}
+
+// ip的128位整数表示 v4为 ::ffff:a.b.c.d
+func ipToInt(ip net.IP) (uint64, uint64) {
+	ip16 := ip.To16()
+	return binary.BigEndian.Uint64(ip16[:8]), binary.BigEndian.Uint64(ip16[8:])
+}
+
+func intToIP(hi, lo uint64, v4 bool) net.IP {
+	ip := make(net.IP, 16)
+	binary.BigEndian.PutUint64(ip[:8], hi)
+	binary.BigEndian.PutUint64(ip[8:], lo)
+	if v4 {
+		return ip.To4()
+	}
+	return ip
+}
+
+// a - b 不够减时borrow为1
+func sub128(ahi, alo, bhi, blo uint64) (uint64, uint64, uint64) {
+	lo, borrow := bits.Sub64(alo, blo, 0)
+	hi, borrow := bits.Sub64(ahi, bhi, borrow)
+	return hi, lo, borrow
+}
+
+// range的分配位图 第i位表示range内第i个地址已分配
+type bitmap struct {
+	r      Range
+	v4     bool
+	basehi uint64
+	baselo uint64
+	size   uint32
+	// range内上一个分配的地址 下一次从它之后开始找
+	last  net.IP
+	words []uint64
+}
+
+func newBitmap(r Range) (*bitmap, error) {
+	if r.Start == nil || r.End == nil {
+		return nil, fmt.Errorf("invalid range %s", r)
+	}
+	v4 := r.Start.To4() != nil
+	if (r.End.To4() != nil) != v4 {
+		return nil, fmt.Errorf("range %s mixes ipv4 and ipv6", r)
+	}
+	shi, slo := ipToInt(r.Start)
+	ehi, elo := ipToInt(r.End)
+	dhi, dlo, borrow := sub128(ehi, elo, shi, slo)
+	if borrow != 0 {
+		return nil, fmt.Errorf("range %s ends before it starts", r)
+	}
+
+	var n uint32
+	switch {
+	case v4 && dlo >= 1<<maxBitmapBits:
+		return nil, fmt.Errorf("range %s is too large to be indexed", r)
+	case !v4 && (dhi != 0 || dlo >= 1<<maxV6Bits):
+		n = 1 << maxV6Bits
+	default:
+		n = uint32(dlo) + 1
+	}
+	return &bitmap{
+		r:      r,
+		v4:     v4,
+		basehi: shi,
+		baselo: slo,
+		size:   n,
+		words:  make([]uint64, (n+63)/64),
+	}, nil
+}
+
+// ip在range内的下标
+func (b *bitmap) index(ip net.IP) (uint32, bool) {
+	if ip == nil || (ip.To4() != nil) != b.v4 {
+		return 0, false
+	}
+	hi, lo := ipToInt(ip)
+	dhi, dlo, borrow := sub128(hi, lo, b.basehi, b.baselo)
+	if borrow != 0 || dhi != 0 || dlo >= uint64(b.size) {
+		return 0, false
+	}
+	return uint32(dlo), true
+}
+
+func (b *bitmap) ip(i uint32) net.IP {
+	lo, carry := bits.Add64(b.baselo, uint64(i), 0)
+	return intToIP(b.basehi+carry, lo, b.v4)
+}
+
+func (b *bitmap) set(ip net.IP) {
+	if i, ok := b.index(ip); ok {
+		b.words[i/64] |= 1 << (i % 64)
+	}
+}
+
+func (b *bitmap) clear(ip net.IP) {
+	if i, ok := b.index(ip); ok {
+		b.words[i/64] &^= 1 << (i % 64)
+	}
+}
+
+func (b *bitmap) test(ip net.IP) bool {
+	i, ok := b.index(ip)
+	return ok && b.words[i/64]&(1<<(i%64)) != 0
+}
+
+// 已分配的地址数
+func (b *bitmap) count() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// 空闲的地址数
+func (b *bitmap) free() int {
+	return int(b.size) - b.count()
+}
+
+// [from, to) 内第一个空闲且 ok 的地址 整字跳过已满的64个地址
+func (b *bitmap) scan(from, to uint32, ok func(net.IP) bool) net.IP {
+	for i := from; i < to; {
+		w := i / 64
+		// 低于i的位视为已占用
+		free := ^b.words[w] &^ (1<<(i%64) - 1)
+		for free != 0 {
+			j := w*64 + uint32(bits.TrailingZeros64(free))
+			if j >= to {
+				return nil
+			}
+			if ip := b.ip(j); ok(ip) {
+				return ip
+			}
+			free &= free - 1
+		}
+		i = (w + 1) * 64
+	}
+	return nil
+}
+
+// from之后的第一个空闲且 ok 的地址 到range末尾后从头开始 没有时返回nil
+func (b *bitmap) nextFree(from net.IP, ok func(net.IP) bool) net.IP {
+	start := uint32(0)
+	if i, in := b.index(from); in {
+		start = i + 1
+	}
+	if ip := b.scan(start, b.size, ok); ip != nil {
+		return ip
+	}
+	return b.scan(0, start, ok)
+}
+
+// 落盘格式 小端序的64位字
+func (b *bitmap) bytes() []byte {
+	raw := make([]byte, len(b.words)*8)
+	for i, w := range b.words {
+		binary.LittleEndian.PutUint64(raw[i*8:], w)
+	}
+	return raw
+}
+
+func (b *bitmap) load(raw []byte) error {
+	if len(raw) != len(b.words)*8 {
+		return fmt.Errorf("bitmap of %d bytes doesn't fit range %s", len(raw), b.r)
+	}
+	for i := range b.words {
+		b.words[i] = binary.LittleEndian.Uint64(raw[i*8:])
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mycni/pkg/podinfo"
+)
+
+const (
+	// libcni 默认的缓存目录 results/ 下每个attachment一个文件
+	DefaultCNICacheDir = "/var/lib/cni"
+)
+
+// libcni 在ADD成功后缓存的结果 DEL时删除
+type cachedResult struct {
+	ContainerID string      `json:"containerId"`
+	IfName      string      `json:"ifName"`
+	NetworkName string      `json:"networkName"`
+	CniArgs     [][2]string `json:"cniArgs,omitempty"`
+	Result      struct {
+		IPs []struct {
+			Address string `json:"address"`
+		} `json:"ips"`
+		Interfaces []struct {
+			Sandbox string `json:"sandbox,omitempty"`
+		} `json:"interfaces"`
+	} `json:"result"`
+}
+
+// 容器的netns还在 即接口还活着 没有记录netns的结果视为活着
+func (r *cachedResult) alive() bool {
+	for _, intf := range r.Result.Interfaces {
+		if intf.Sandbox == "" {
+			continue
+		}
+		if _, err := os.Stat(intf.Sandbox); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *cachedResult) pod() *podinfo.Pod {
+	var args []string
+	for _, kv := range r.CniArgs {
+		args = append(args, kv[0]+"="+kv[1])
+	}
+	pod, _ := podinfo.FromArgs(strings.Join(args, ";"))
+	return pod
+}
+
+// 从运行时缓存的结果中 找回network下netns仍然存在的attachment的ip
+func FromResultCache(cacheDir, network string) RecoverFunc {
+	if cacheDir == "" {
+		cacheDir = DefaultCNICacheDir
+	}
+	return func() (map[string]ContainerNetInfo, error) {
+		// like: /var/lib/cni/results/mynet-<containerID>-eth0
+		files, err := filepath.Glob(filepath.Join(cacheDir, "results", network+"-*"))
+		if err != nil {
+			return nil, err
+		}
+
+		ips := make(map[string]ContainerNetInfo)
+		for _, file := range files {
+			raw, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			r := &cachedResult{}
+			if err := json.Unmarshal(raw, r); err != nil || r.NetworkName != network || !r.alive() {
+				continue
+			}
+			fi, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			for _, ipc := range r.Result.IPs {
+				ip, _, err := net.ParseCIDR(ipc.Address)
+				if err != nil {
+					continue
+				}
+				ips[ip.String()] = ContainerNetInfo{
+					ID:      r.ContainerID,
+					IFName:  r.IfName,
+					Created: fi.ModTime(),
+					Pod:     r.pod(),
+				}
+			}
+		}
+		return ips, nil
+	}
+}
@@ -2,13 +2,33 @@ package store
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
+
+	"mycni/pkg/podinfo"
+	"mycni/utils"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
 	defaultDataDir = "/var/lib/testcni"
+	// 上一个版本的store文件 用于从损坏中恢复
+	backupSuffix = ".bak"
+
+	// 落盘格式的版本 1: 只有ips 2: 加上subnet的分配位图 3: 每个range一个位图
+	// 4: ips拆到每个ip一个文件 store文件只留位图等 加载和写入都与已分配的数量无关
+	currentVersion = 4
+
+	// 每个ip一个文件 内容为占用它的容器 like: ips/10.244.1.2
+	ipsDir = "ips"
+	// 每个容器id一个文件 ifname => ips 按容器查找ip用 like: ids/<containerID>
+	idsDir = "ids"
 )
 
 // 定义了容器网络的信息
@@ -17,18 +37,60 @@ const (
 type ContainerNetInfo struct {
 	ID     string `json:"id"`
 	IFName string `json:"if"`
+	// 分配时间 旧版本的记录为空
+	Created time.Time `json:"created,omitempty"`
+	// 所属的pod 不是k8s pod时为空
+	Pod *podinfo.Pod `json:"pod,omitempty"`
 }
 
 type Data struct {
-	IPs  map[string]ContainerNetInfo `json:"ips"`
+	// 旧版本的文件没有 即版本1
+	Version int `json:"version,omitempty"`
+	// 版本3及之前的所有分配记录 版本4起在ips目录下 加载时迁移过去
+	IPs  map[string]ContainerNetInfo `json:"ips,omitempty"`
 	Last string                      `json:"last"`
+	// 预留的地址段 cidr => 原因 不会被分配出去
+	Reserved map[string]string `json:"reserved,omitempty"`
+	// 版本3 每个range已分配地址的位图
+	Indexes []IndexData `json:"indexes,omitempty"`
+	// 隔离期内释放的ip ip => 释放时间 旧版本会忽略
+	Released map[string]time.Time `json:"released,omitempty"`
 }
 
+// 一个range的位图 以及其中上一个分配的地址
+type IndexData struct {
+	Range string `json:"range"`
+	Last  string `json:"last,omitempty"`
+	// base64
+	Bitmap []byte `json:"bitmap"`
+	// 版本4 range内空闲的地址数 与位图对得上时直接使用 不必从ip文件重建
+	Free int `json:"free"`
+}
+
+var (
+	ErrReservationConflict = errors.New("range to reserve has allocated ips")
+	ErrCorrupted           = errors.New("store file is corrupted and can't be recovered")
+	ErrNewerVersion        = errors.New("store file is written by a newer version")
+)
+
+// 从现有的网络状态重建分配记录 ip => 容器信息
+type RecoverFunc func() (map[string]ContainerNetInfo, error)
+
 type Store struct {
 	lk       *FileLock
 	dir      string
 	data     *Data
 	filePath string // Path to local conf
+
+	// store文件和备份都损坏时使用 为空时直接报错
+	Recover RecoverFunc
+	// 释放的ip在这段时间内不优先分配 conntrack arp等可能还指向旧的容器 为0时不隔离
+	Quarantine time.Duration
+
+	// 要索引的range 为空时沿用文件中的
+	ranges []Range
+	// 每个range的分配位图 用于查找空闲ip
+	indexes []*bitmap
 }
 
 func NewStore(dataDir, network string) (*Store, error) {
@@ -50,98 +112,704 @@ func NewStore(dataDir, network string) (*Store, error) {
 	filePath := filepath.Join(dir, network + ".json")
 	
 	// 初始表
-	data := &Data{IPs: make(map[string]ContainerNetInfo)}
+	data := &Data{IPs: make(map[string]ContainerNetInfo), Reserved: make(map[string]string)}
+
+	return &Store{lk: lk, dir: dir, data: data, filePath: filePath}, nil
+}
 
-	return &Store{lk, dir, data, filePath}, nil
+// 设置要索引的range 在LoadData之前调用 文件中没有的range重建位图
+func (s *Store) SetRanges(ranges ...Range) error {
+	for _, r := range ranges {
+		if _, err := newBitmap(r); err != nil {
+			return err
+		}
+	}
+	s.ranges = ranges
+	return nil
 }
 
+// 只读取store文件 ip的分配记录用到时才读 加载的开销与已分配的数量无关
 func (s *Store) LoadData() error {
 	data := &Data{}
 	// 读取到raw
 	raw, err := os.ReadFile(s.filePath)
 
+	recovered := false
 	if err != nil {
-		if os.IsNotExist(err) {
-			f, err := os.Create(s.filePath)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			// 初始化一个空文件
-			_, err = f.Write([]byte("{}"))
-			if err != nil {
-				return err
-			}
-		} else {
+		if !os.IsNotExist(err) {
 			return err
 		}
-	} else {
-		// unmarshall
-		if err := json.Unmarshal(raw, &data); err != nil {
+		// 初始化一个空文件
+		if err := writeFileAtomic(s.filePath, []byte("{}")); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(raw, &data); err != nil {
+		// 写入时崩溃留下的半个文件 从备份或者现有网络状态恢复
+		if data, err = s.recover(err); err != nil {
 			return err
 		}
+		recovered = true
+	}
+	if data.Version > currentVersion {
+		return fmt.Errorf("%w: %s is version %d, supported up to %d", ErrNewerVersion, s.filePath, data.Version, currentVersion)
 	}
-	// 空的ip地址
-	if data.IPs == nil {
-		data.IPs = make(map[string]ContainerNetInfo)
+	if data.Reserved == nil {
+		data.Reserved = make(map[string]string)
+	}
+
+	// 旧版本的ips拆成每个ip一个文件 之后立即写回新版本
+	migrated := data.IPs
+	if len(migrated) > 0 {
+		utils.Log(fmt.Sprintf("Migrating %d ips of store %s to version %d", len(migrated), s.filePath, currentVersion))
+		if err := s.writeEntries(migrated); err != nil {
+			return err
+		}
 	}
+	data.IPs = nil
 
 	s.data = data
+	if err := s.reindex(migrated); err != nil {
+		return err
+	}
+	if recovered || migrated != nil {
+		return s.Store()
+	}
+	return nil
+}
+
+// 加载range的位图 文件中没有 旧版本或者与空闲数对不上时 从ip文件重建
+// ips为空时需要重建才读ip文件
+func (s *Store) reindex(ips map[string]ContainerNetInfo) error {
+	stored := make(map[string]IndexData, len(s.data.Indexes))
+	ranges := s.ranges
+	for _, d := range s.data.Indexes {
+		stored[d.Range] = d
+		if r, err := ParseRange(d.Range); err == nil && s.ranges == nil {
+			ranges = append(ranges, r)
+		}
+	}
+
+	s.indexes = nil
+	var rebuilt []string
+	for _, r := range ranges {
+		index, err := newBitmap(r)
+		if err != nil {
+			return err
+		}
+		d, ok := stored[r.String()]
+		if !ok || s.data.Version != currentVersion || index.load(d.Bitmap) != nil || index.free() != d.Free {
+			rebuilt = append(rebuilt, r.String())
+			if ips == nil {
+				ips = s.Entries()
+			}
+			index.words = make([]uint64, len(index.words))
+			for ip := range ips {
+				index.set(net.ParseIP(ip))
+			}
+		}
+		// 旧版本只有全局的last
+		index.last = net.ParseIP(d.Last)
+		if last := s.Last(); index.last == nil {
+			if _, ok := index.index(last); ok {
+				index.last = last
+			}
+		}
+		s.indexes = append(s.indexes, index)
+	}
+
+	if len(rebuilt) > 0 && s.data.Version == currentVersion {
+		utils.Log(fmt.Sprintf("Rebuilding index of store %s for ranges %v", s.filePath, rebuilt))
+	}
 	return nil
 }
 
+func (s *Store) backupPath() string {
+	return s.filePath + backupSuffix
+}
+
+// 恢复损坏的store文件 并立即写回 损坏的文件不会进入备份
+// ip文件不受影响 位图可能比ip文件旧 丢弃后重建
+func (s *Store) recover(cause error) (*Data, error) {
+	utils.Log(fmt.Sprintf("Store %s is corrupted: %v", s.filePath, cause))
+
+	data := &Data{}
+	raw, err := os.ReadFile(s.backupPath())
+	if err == nil {
+		err = json.Unmarshal(raw, data)
+	}
+	switch {
+	case err == nil:
+		utils.Log(fmt.Sprintf("Recovered %d reservations of %s from backup", len(data.Reserved), s.filePath))
+	case s.Recover != nil:
+		utils.Log(fmt.Sprintf("Backup of %s is not usable: %v", s.filePath, err))
+		ips, err := s.Recover()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+		}
+		// 预留的地址段无处可查 只能重新预留 已有ip文件的以文件为准
+		data = &Data{Version: currentVersion}
+		missing := make(map[string]ContainerNetInfo)
+		for ip, info := range ips {
+			if s.Contain(net.ParseIP(ip)) {
+				continue
+			}
+			missing[ip] = info
+			utils.Log(fmt.Sprintf("Recovered ip %s of %s-%s from live attachments", ip, info.ID, info.IFName))
+		}
+		if err := s.writeEntries(missing); err != nil {
+			return nil, err
+		}
+		utils.Log(fmt.Sprintf("Recovered %d ips of %s from live attachments, reservations are lost", len(missing), s.filePath))
+	default:
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupted, s.filePath, cause)
+	}
+	data.Indexes = nil
+
+	raw, err = json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(s.filePath, raw); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 // 获取上次分配后的下一个可用IP
 func (s *Store) Last() net.IP {
 	return net.ParseIP(s.data.Last)
 }
 
-// 通过 id 获取对应容器IP
-func (s *Store) GetIPByID(id string) (net.IP, bool) {
-	for ip, info := range s.data.IPs {
-		if info.ID == id {
-			return net.ParseIP(ip), true
+func (s *Store) indexOf(r Range) *bitmap {
+	for _, index := range s.indexes {
+		if index.r.String() == r.String() {
+			return index
 		}
 	}
+	return nil
+}
+
+// range内上一个分配的ip 没有时返回nil
+func (s *Store) LastIn(r Range) net.IP {
+	if index := s.indexOf(r); index != nil {
+		return index.last
+	}
+	return nil
+}
+
+// 在range内从from之后查找第一个未分配且 ok 的ip 到range末尾后从头开始
+// range需要先SetRanges 没有时返回nil
+func (s *Store) NextFree(r Range, from net.IP, ok func(net.IP) bool) net.IP {
+	index := s.indexOf(r)
+	if index == nil {
+		return nil
+	}
+	// 先写ip文件再写位图 中间崩溃时位图会漏掉已分配的ip 用到时补上
+	return index.nextFree(from, func(ip net.IP) bool {
+		if s.Contain(ip) {
+			index.set(ip)
+			return false
+		}
+		return ok(ip)
+	})
+}
+
+func (s *Store) ipPath(ip string) string {
+	return filepath.Join(s.dir, ipsDir, ip)
+}
+
+func (s *Store) idPath(id string) string {
+	return filepath.Join(s.dir, idsDir, id)
+}
+
+// 读取ip的分配记录 文件存在即视为已分配
+func (s *Store) readIP(ip string) (ContainerNetInfo, bool) {
+	info := ContainerNetInfo{}
+	raw, err := os.ReadFile(s.ipPath(ip))
+	if err != nil {
+		return info, !os.IsNotExist(err)
+	}
+	if err := json.Unmarshal(raw, &info); err != nil {
+		utils.Log(fmt.Sprintf("Invalid record of ip %s: %v", ip, err))
+	}
+	return info, true
+}
+
+// 容器每个接口的ip ifname => ips 可能包含已经被别人占用的 用之前要和ip文件核对
+func (s *Store) readID(id string) map[string][]string {
+	ifs := make(map[string][]string)
+	raw, err := os.ReadFile(s.idPath(id))
+	if err != nil {
+		return ifs
+	}
+	if err := json.Unmarshal(raw, &ifs); err != nil {
+		utils.Log(fmt.Sprintf("Invalid index of container %s: %v", id, err))
+	}
+	return ifs
+}
+
+// 没有ip了就删掉文件
+func (s *Store) writeID(id string, ifs map[string][]string) error {
+	if len(ifs) == 0 {
+		err := os.Remove(s.idPath(id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	raw, err := json.Marshal(ifs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.idPath(id), raw)
+}
+
+// 加入容器的索引 同一个接口的ip保持有序
+func (s *Store) indexID(id, ifname, ip string) error {
+	ifs := s.readID(id)
+	for _, i := range ifs[ifname] {
+		if i == ip {
+			return nil
+		}
+	}
+	ifs[ifname] = append(ifs[ifname], ip)
+	sort.Strings(ifs[ifname])
+	return s.writeID(id, ifs)
+}
+
+// 从容器的索引中去掉ip
+func (s *Store) unindexID(id, ifname, ip string) error {
+	ifs := s.readID(id)
+	ips := ifs[ifname]
+	for i := range ips {
+		if ips[i] == ip {
+			ips = append(ips[:i:i], ips[i+1:]...)
+			break
+		}
+	}
+	if len(ips) > 0 {
+		ifs[ifname] = ips
+	} else {
+		delete(ifs, ifname)
+	}
+	return s.writeID(id, ifs)
+}
+
+// 容器一个接口的ip 只留ip文件中确实属于它的
+func (s *Store) ifIPs(id, ifname string, ips []string) []string {
+	var owned []string
+	for _, ip := range ips {
+		if info, ok := s.readIP(ip); ok && info.ID == id && info.IFName == ifname {
+			owned = append(owned, ip)
+		}
+	}
+	return owned
+}
+
+// 容器所有接口的ip 按接口名排序
+func (s *Store) idIPs(id string) []string {
+	ifs := s.readID(id)
+	names := make([]string, 0, len(ifs))
+	for name := range ifs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ips []string
+	for _, name := range names {
+		ips = append(ips, s.ifIPs(id, name, ifs[name])...)
+	}
+	return ips
+}
+
+// 通过 id 获取对应容器IP 有多个时返回第一个
+func (s *Store) GetIPByID(id string) (net.IP, bool) {
+	if ips := s.idIPs(id); len(ips) > 0 {
+		return net.ParseIP(ips[0]), true
+	}
 	return nil, false
 }
 
+// 容器的一个接口的所有ip
+func (s *Store) GetIPs(id, ifname string) []net.IP {
+	var ips []net.IP
+	for _, ip := range s.ifIPs(id, ifname, s.readID(id)[ifname]) {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips
+}
+
+// 通过 ip 获取占用它的容器id
+func (s *Store) GetIDByIP(ip net.IP) (string, bool) {
+	info, ok := s.readIP(ip.String())
+	return info.ID, ok
+}
+
+// 通过 ip 获取占用它的容器信息
+func (s *Store) GetByIP(ip net.IP) (ContainerNetInfo, bool) {
+	return s.readIP(ip.String())
+}
+
+// 通过 pod 获取它的所有ip ip => 容器信息 需要读所有ip文件
+func (s *Store) GetByPod(namespace, name string) map[string]ContainerNetInfo {
+	res := make(map[string]ContainerNetInfo)
+	for ip, info := range s.Entries() {
+		if info.Pod.Is(namespace, name) {
+			res[ip] = info
+		}
+	}
+	return res
+}
+
 // 加入store
 func (s *Store) Add(ip net.IP, id, ifname string) error {
-	if len(ip) > 0 {
-		s.data.IPs[ip.String()] = ContainerNetInfo{
-			ID: id,
-			IFName: ifname,
+	return s.AddPod(ip, id, ifname, nil)
+}
+
+// 加入store 同时记录所属的pod
+// 先写ip文件和容器索引 再写位图 只写这一个ip相关的文件
+func (s *Store) AddPod(ip net.IP, id, ifname string, pod *podinfo.Pod) error {
+	if len(ip) == 0 {
+		return nil
+	}
+	key := ip.String()
+	if old, ok := s.readIP(key); ok && (old.ID != id || old.IFName != ifname) {
+		if err := s.unindexID(old.ID, old.IFName, key); err != nil {
+			return err
 		}
+	}
+	raw, err := json.Marshal(ContainerNetInfo{
+		ID:      id,
+		IFName:  ifname,
+		Created: time.Now(),
+		Pod:     pod,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, ipsDir), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, idsDir), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.ipPath(key), raw); err != nil {
+		return err
+	}
+	if err := s.indexID(id, ifname, key); err != nil {
+		return err
+	}
 
-		s.data.Last = ip.String()
-		return s.Store()
+	delete(s.data.Released, key)
+	for _, index := range s.indexes {
+		if _, ok := index.index(ip); ok {
+			index.set(ip)
+			index.last = ip
+		}
+	}
+	s.data.Last = key
+	return s.Store()
+}
+
+// 批量写入分配记录 用于迁移和恢复 最后整体落盘一次
+func (s *Store) writeEntries(ips map[string]ContainerNetInfo) error {
+	if err := os.MkdirAll(filepath.Join(s.dir, ipsDir), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, idsDir), 0755); err != nil {
+		return err
+	}
+	byID := make(map[string]map[string][]string)
+	for ip, info := range ips {
+		raw, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(s.ipPath(ip), raw, 0644); err != nil {
+			return err
+		}
+		ifs := byID[info.ID]
+		if ifs == nil {
+			ifs = s.readID(info.ID)
+			byID[info.ID] = ifs
+		}
+		ifs[info.IFName] = append(ifs[info.IFName], ip)
+	}
+	for id, ifs := range byID {
+		for _, ips := range ifs {
+			sort.Strings(ips)
+		}
+		raw, err := json.Marshal(ifs)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(s.idPath(id), raw, 0644); err != nil {
+			return err
+		}
+	}
+	return syncFS(s.dir)
+}
+
+// 清掉位图中的ip 记录隔离 返回之前的分配记录
+// 位图先于ip文件写回 中间崩溃时ip仍然视为已分配 DEL重试时再删
+func (s *Store) release(ip string) (ContainerNetInfo, bool) {
+	info, ok := s.readIP(ip)
+	if !ok {
+		return info, false
+	}
+	for _, index := range s.indexes {
+		index.clear(net.ParseIP(ip))
+	}
+	if s.Quarantine > 0 {
+		if s.data.Released == nil {
+			s.data.Released = make(map[string]time.Time)
+		}
+		s.data.Released[ip] = time.Now()
+	}
+	return info, true
+}
+
+// 位图写回之后 删除ip文件和容器索引中的记录
+func (s *Store) removeIPs(released map[string]ContainerNetInfo) error {
+	if len(released) == 0 {
+		return nil
+	}
+	if err := s.Store(); err != nil {
+		return err
+	}
+	for ip, info := range released {
+		if err := os.Remove(s.ipPath(ip)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := s.unindexID(info.ID, info.IFName, ip); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// 根据给定id删除使用的ip
+// ip是否还在隔离期内 返回释放时间
+func (s *Store) Quarantined(ip net.IP) (time.Time, bool) {
+	t, ok := s.data.Released[ip.String()]
+	return t, ok && s.Quarantine > 0 && time.Since(t) < s.Quarantine
+}
+
+// 隔离期内 没有分配出去且 ok 的ip中释放最早的 没有时返回nil
+func (s *Store) OldestQuarantined(ok func(net.IP) bool) net.IP {
+	var oldest net.IP
+	var at time.Time
+	for key, t := range s.data.Released {
+		ip := net.ParseIP(key)
+		if _, q := s.Quarantined(ip); !q || s.Contain(ip) || !ok(ip) {
+			continue
+		}
+		if oldest == nil || t.Before(at) || (t.Equal(at) && key < oldest.String()) {
+			oldest, at = ip, t
+		}
+	}
+	return oldest
+}
+
+// 删除容器所有接口的ip
 func (s *Store) Del(id string) error {
-	for ip, info := range s.data.IPs {
-		if info.ID == id {
-			delete(s.data.IPs, ip)
-			return s.Store()
+	released := make(map[string]ContainerNetInfo)
+	for _, ip := range s.idIPs(id) {
+		if info, ok := s.release(ip); ok {
+			released[ip] = info
 		}
 	}
-	return nil
+	return s.removeIPs(released)
+}
+
+// 删除容器一个接口的所有ip 只写一次store文件 没有时什么也不做
+func (s *Store) Release(id, ifname string) ([]net.IP, error) {
+	ips := s.GetIPs(id, ifname)
+	released := make(map[string]ContainerNetInfo)
+	for _, ip := range ips {
+		if info, ok := s.release(ip.String()); ok {
+			released[ip.String()] = info
+		}
+	}
+	return ips, s.removeIPs(released)
+}
+
+// 删除给定ip的记录
+func (s *Store) DelByIP(ip net.IP) error {
+	_, _, err := s.ReleaseByIP(ip)
+	return err
+}
+
+// 管理员手动释放ip 返回之前占用它的容器 没有分配时返回false
+func (s *Store) ReleaseByIP(ip net.IP) (ContainerNetInfo, bool, error) {
+	info, ok := s.release(ip.String())
+	if !ok {
+		return info, false, nil
+	}
+	return info, true, s.removeIPs(map[string]ContainerNetInfo{ip.String(): info})
+}
+
+// 所有已分配的ip ip => 容器信息 需要读所有ip文件
+func (s *Store) Entries() map[string]ContainerNetInfo {
+	res := make(map[string]ContainerNetInfo)
+	entries, err := os.ReadDir(filepath.Join(s.dir, ipsDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.Log(fmt.Sprintf("Cannot list ips of store %s: %v", s.filePath, err))
+		}
+		return res
+	}
+	for _, e := range entries {
+		// 写了一半的临时文件
+		if net.ParseIP(e.Name()) == nil {
+			continue
+		}
+		if info, ok := s.readIP(e.Name()); ok {
+			res[e.Name()] = info
+		}
+	}
+	return res
 }
 
 func (s *Store) Contain(ip net.IP) bool {
-	_, ok := s.data.IPs[ip.String()]
-	return ok
+	_, err := os.Stat(s.ipPath(ip.String()))
+	return err == nil
+}
+
+// 预留地址段 其中已经分配出去的ip会导致失败
+func (s *Store) Reserve(cidr *net.IPNet, reason string) error {
+	for ip, info := range s.Entries() {
+		if cidr.Contains(net.ParseIP(ip)) {
+			return fmt.Errorf("%w: %s is allocated to %s", ErrReservationConflict, ip, info.ID)
+		}
+	}
+	if s.data.Reserved == nil {
+		s.data.Reserved = make(map[string]string)
+	}
+	s.data.Reserved[cidr.String()] = reason
+	return s.Store()
 }
 
+// 取消预留 不存在时返回false
+func (s *Store) Unreserve(cidr *net.IPNet) (bool, error) {
+	if _, ok := s.data.Reserved[cidr.String()]; !ok {
+		return false, nil
+	}
+	delete(s.data.Reserved, cidr.String())
+	return true, s.Store()
+}
+
+// 所有预留的地址段 cidr => 原因
+func (s *Store) Reservations() map[string]string {
+	return s.data.Reserved
+}
+
+// ip所在的预留地址段
+func (s *Store) Reserved(ip net.IP) (string, bool) {
+	for cidr := range s.data.Reserved {
+		_, r, err := net.ParseCIDR(cidr)
+		if err == nil && r.Contains(ip) {
+			return cidr, true
+		}
+	}
+	return "", false
+}
+
+// 写入临时文件并fsync 当前版本轮转为备份后 再原子地rename覆盖
+// 任何时候崩溃 store文件要么是旧版本 要么是新版本
 func (s *Store) Store() error {
+	// 没有range时不记录位图 之后知道range时从ip文件重建
+	s.data.Version = currentVersion
+	if len(s.indexes) > 0 {
+		s.data.Indexes = make([]IndexData, 0, len(s.indexes))
+		for _, index := range s.indexes {
+			d := IndexData{Range: index.r.String(), Bitmap: index.bytes(), Free: index.free()}
+			if index.last != nil {
+				d.Last = index.last.String()
+			}
+			s.data.Indexes = append(s.data.Indexes, d)
+		}
+	}
+	// 过了隔离期的不再记录
+	if s.Quarantine > 0 {
+		for ip, t := range s.data.Released {
+			if time.Since(t) >= s.Quarantine {
+				delete(s.data.Released, ip)
+			}
+		}
+	}
 	raw, err := json.Marshal(s.data)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(s.filePath, raw, 0644)
+	tmp, err := writeTemp(s.filePath, raw)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	// 硬链接 备份和store文件任何时候都至少有一个是完整的
+	if err := os.Remove(s.backupPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(s.filePath, s.backupPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return commit(tmp, s.filePath)
+}
+
+// 同目录下的临时文件 内容已经落盘
+func writeTemp(path string, raw []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(raw)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// rename后fsync目录 保证rename本身也已落盘
+func commit(tmp, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// 把目录所在文件系统的脏数据都落盘 批量写入后用一次代替逐个fsync
+func syncFS(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return unix.Syncfs(int(d.Fd()))
+}
+
+func writeFileAtomic(path string, raw []byte) error {
+	tmp, err := writeTemp(path, raw)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return commit(tmp, path)
 }
 
 func (s *Store) Close() error {
@@ -1,8 +1,19 @@
 package store
 
 import(
+	"encoding/json"
+	"errors"
+	"fmt"
 	"testing"
 	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"mycni/pkg/podinfo"
+
+	cip "github.com/containernetworking/plugins/pkg/ip"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewStore(t *testing.T) {
@@ -40,3 +51,380 @@ func TestNewStore(t *testing.T) {
 		t.Log("Res doesn't match!")
 	}
 }
+
+func TestReserve(t *testing.T) {
+	te := assert.New(t)
+	s, err := NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+	te.Nil(s.LoadData())
+
+	te.Nil(s.Add(net.ParseIP("10.244.0.2"), "dummy0", "eth0"))
+	_, vip, _ := net.ParseCIDR("10.244.0.3/32")
+	_, tunnel, _ := net.ParseCIDR("10.244.0.0/30")
+	te.Nil(s.Reserve(vip, "vip"))
+	te.True(errors.Is(s.Reserve(tunnel, "tunnel"), ErrReservationConflict))
+
+	// kept in file
+	te.Nil(s.LoadData())
+	cidr, ok := s.Reserved(net.ParseIP("10.244.0.3"))
+	te.True(ok)
+	te.Equal(cidr, "10.244.0.3/32")
+	te.Equal(s.Reservations(), map[string]string{"10.244.0.3/32": "vip"})
+
+	ok, err = s.Unreserve(vip)
+	te.Nil(err)
+	te.True(ok)
+	_, ok = s.Reserved(net.ParseIP("10.244.0.3"))
+	te.False(ok)
+}
+
+func TestLookup(t *testing.T) {
+	te := assert.New(t)
+	s, err := NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+	te.Nil(s.LoadData())
+
+	db := &podinfo.Pod{Namespace: "default", Name: "db-0", UID: "uid-0"}
+	te.Nil(s.AddPod(net.ParseIP("10.244.0.2"), "c0", "eth0", db))
+	te.Nil(s.AddPod(net.ParseIP("10.244.0.3"), "c1", "eth0", &podinfo.Pod{Namespace: "kube-system", Name: "db-0"}))
+	te.Nil(s.Add(net.ParseIP("10.244.0.4"), "c2", "eth0"))
+
+	// kept in file
+	te.Nil(s.LoadData())
+	info, ok := s.GetByIP(net.ParseIP("10.244.0.2"))
+	te.True(ok)
+	te.Equal(info.ID, "c0")
+	te.Equal(*info.Pod, *db)
+	info, ok = s.GetByIP(net.ParseIP("10.244.0.4"))
+	te.True(ok)
+	te.Nil(info.Pod)
+	_, ok = s.GetByIP(net.ParseIP("10.244.0.5"))
+	te.False(ok)
+
+	list := s.GetByPod("default", "db-0")
+	te.Equal(len(list), 1)
+	te.Equal(list["10.244.0.2"].ID, "c0")
+	te.Empty(s.GetByPod("default", "db-1"))
+}
+
+func TestRelease(t *testing.T) {
+	te := assert.New(t)
+	s, err := NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+	te.Nil(s.LoadData())
+
+	for ip, att := range map[string][2]string{
+		"10.244.0.2": {"c0", "eth0"},
+		"fd00::2":    {"c0", "eth0"},
+		"10.244.0.3": {"c0", "eth1"},
+		"10.244.0.4": {"c1", "eth0"},
+	} {
+		te.Nil(s.Add(net.ParseIP(ip), att[0], att[1]))
+	}
+	te.Equal(len(s.GetIPs("c0", "eth0")), 2)
+
+	ips, err := s.Release("c0", "eth0")
+	te.Nil(err)
+	te.ElementsMatch(ips, []net.IP{net.ParseIP("10.244.0.2"), net.ParseIP("fd00::2")})
+	te.Empty(s.GetIPs("c0", "eth0"))
+	ip, ok := s.GetIPByID("c0")
+	te.True(ok)
+	te.Equal(ip.String(), "10.244.0.3")
+	ips, err = s.Release("c0", "eth0")
+	te.Nil(err)
+	te.Empty(ips)
+
+	info, ok, err := s.ReleaseByIP(net.ParseIP("10.244.0.4"))
+	te.Nil(err)
+	te.True(ok)
+	te.Equal(info.ID, "c1")
+	_, ok, err = s.ReleaseByIP(net.ParseIP("10.244.0.4"))
+	te.Nil(err)
+	te.False(ok)
+
+	// what's left is read back
+	te.Nil(s.LoadData())
+	te.Equal(len(s.Entries()), 1)
+	te.Nil(s.Del("c0"))
+	te.Empty(s.Entries())
+}
+
+func TestQuarantined(t *testing.T) {
+	te := assert.New(t)
+	s, err := NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+	te.Nil(s.LoadData())
+	s.Quarantine = time.Minute
+
+	for i, id := range []string{"c0", "c1", "c2"} {
+		te.Nil(s.Add(net.ParseIP(fmt.Sprintf("10.244.0.%d", i+2)), id, "eth0"))
+	}
+	for _, id := range []string{"c2", "c0", "c1"} {
+		te.Nil(s.Del(id))
+	}
+	all := func(net.IP) bool { return true }
+	te.Equal(s.OldestQuarantined(all).String(), "10.244.0.4")
+	te.Equal(s.OldestQuarantined(func(ip net.IP) bool { return ip[15] != 4 }).String(), "10.244.0.2")
+
+	// expired ones are dropped on the next write, taken ones at once
+	s.data.Released["10.244.0.4"] = time.Now().Add(-2 * time.Minute)
+	_, ok := s.Quarantined(net.ParseIP("10.244.0.4"))
+	te.False(ok)
+	te.Nil(s.Add(net.ParseIP("10.244.0.2"), "c3", "eth0"))
+	te.Nil(s.LoadData())
+	te.Equal(len(s.data.Released), 1)
+	at, ok := s.Quarantined(net.ParseIP("10.244.0.3"))
+	te.True(ok)
+	te.WithinDuration(at, time.Now(), time.Minute)
+	te.Equal(s.OldestQuarantined(all).String(), "10.244.0.3")
+
+	// not recorded without quarantine
+	s.Quarantine = 0
+	te.Nil(s.Del("c3"))
+	_, ok = s.data.Released["10.244.0.2"]
+	te.False(ok)
+	te.Nil(s.OldestQuarantined(all))
+}
+
+func TestStoreBackup(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	s, err := NewStore(dir, "mynet")
+	te.Nil(err)
+	defer s.Close()
+	te.Nil(s.LoadData())
+
+	te.Nil(s.Add(net.ParseIP("10.244.0.2"), "c0", "eth0"))
+	te.Nil(s.Add(net.ParseIP("10.244.0.3"), "c1", "eth0"))
+
+	// the previous version is kept, no temp file is left
+	files, err := filepath.Glob(filepath.Join(dir, "mynet", "mynet.json*"))
+	te.Nil(err)
+	te.Equal(files, []string{s.filePath, s.backupPath()})
+	raw, err := os.ReadFile(s.backupPath())
+	te.Nil(err)
+	te.Contains(string(raw), "10.244.0.2")
+	te.NotContains(string(raw), "10.244.0.3")
+
+	// crashed in the middle of a write
+	te.Nil(os.WriteFile(s.filePath, []byte(`{"ips":{"10.244.0.2":`), 0644))
+	te.Nil(s.LoadData())
+	te.True(s.Contain(net.ParseIP("10.244.0.2")))
+	// allocations are kept in their own files, not lost with the head
+	te.True(s.Contain(net.ParseIP("10.244.0.3")))
+
+	// written back, and the corrupted one never becomes the backup
+	te.Nil(s.Add(net.ParseIP("10.244.0.4"), "c2", "eth0"))
+	raw, err = os.ReadFile(s.backupPath())
+	te.Nil(err)
+	te.Contains(string(raw), "10.244.0.2")
+}
+
+func TestRecoverFromResultCache(t *testing.T) {
+	te := assert.New(t)
+	cacheDir := t.TempDir()
+	netns := filepath.Join(t.TempDir(), "cni-1234")
+	te.Nil(os.WriteFile(netns, nil, 0644))
+	te.Nil(os.MkdirAll(filepath.Join(cacheDir, "results"), 0755))
+	for name, result := range map[string]string{
+		"mynet-c0-eth0": `{"kind":"cniCacheV1","containerId":"c0","ifName":"eth0","networkName":"mynet",
+			"cniArgs":[["K8S_POD_NAMESPACE","default"],["K8S_POD_NAME","db-0"]],
+			"result":{"cniVersion":"1.0.0","interfaces":[{"name":"eth0","sandbox":"` + netns + `"}],"ips":[{"address":"10.244.0.5/16","interface":0}]}}`,
+		// netns is gone
+		"mynet-c1-eth0": `{"kind":"cniCacheV1","containerId":"c1","ifName":"eth0","networkName":"mynet",
+			"result":{"interfaces":[{"name":"eth0","sandbox":"/var/run/netns/gone"}],"ips":[{"address":"10.244.0.6/16"}]}}`,
+		"mynet2-c2-eth0": `{"kind":"cniCacheV1","containerId":"c2","ifName":"eth0","networkName":"mynet2",
+			"result":{"ips":[{"address":"10.245.0.7/16"}]}}`,
+	} {
+		te.Nil(os.WriteFile(filepath.Join(cacheDir, "results", name), []byte(result), 0644))
+	}
+
+	s, err := NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+	te.Nil(os.WriteFile(s.filePath, []byte(`{"ips":`), 0644))
+	te.True(errors.Is(s.LoadData(), ErrCorrupted))
+
+	s.Recover = FromResultCache(cacheDir, "mynet")
+	te.Nil(s.LoadData())
+	entries := s.Entries()
+	te.Equal(len(entries), 1)
+	te.Equal(entries["10.244.0.5"].ID, "c0")
+	te.Equal(entries["10.244.0.5"].IFName, "eth0")
+	te.Equal(*entries["10.244.0.5"].Pod, podinfo.Pod{Namespace: "default", Name: "db-0"})
+
+	// kept in file
+	s.Recover = nil
+	te.Nil(s.LoadData())
+	te.True(s.Contain(net.ParseIP("10.244.0.5")))
+}
+
+func TestIndex(t *testing.T) {
+	te := assert.New(t)
+	dir := t.TempDir()
+	s, err := NewStore(dir, "mynet")
+	te.Nil(err)
+	defer s.Close()
+
+	// written by older versions, without index
+	te.Nil(os.WriteFile(s.filePath, []byte(`{"ips":{"10.244.1.2":{"id":"c0","if":"eth0"},"10.244.1.3":{"id":"c1","if":"eth0"},"10.244.2.3":{"id":"c2","if":"eth0"}},"last":"10.244.1.3"}`), 0644))
+	r, err := ParseRange("10.244.1.0-10.244.1.255")
+	te.Nil(err)
+	te.Nil(s.SetRanges(r))
+	te.Nil(s.LoadData())
+
+	ip, ok := s.GetIPByID("c1")
+	te.True(ok)
+	te.Equal(ip.String(), "10.244.1.3")
+	all := func(net.IP) bool { return true }
+	te.Equal(s.LastIn(r).String(), "10.244.1.3")
+	te.Equal(s.NextFree(r, s.LastIn(r), all).String(), "10.244.1.4")
+	// wraps around, and skips what ok refuses
+	te.Equal(s.NextFree(r, net.ParseIP("10.244.1.255"), all).String(), "10.244.1.0")
+	te.Equal(s.NextFree(r, net.ParseIP("10.244.1.255"), func(ip net.IP) bool { return ip[3] > 4 }).String(), "10.244.1.5")
+
+	te.Nil(s.Add(net.ParseIP("10.244.1.4"), "c3", "eth0"))
+	te.Nil(s.Del("c0"))
+	_, ok = s.GetIPByID("c0")
+	te.False(ok)
+	te.Equal(s.NextFree(r, net.ParseIP("10.244.1.1"), all).String(), "10.244.1.2")
+
+	// migrated on write
+	raw, err := os.ReadFile(s.filePath)
+	te.Nil(err)
+	data := &Data{}
+	te.Nil(json.Unmarshal(raw, data))
+	te.Equal(data.Version, currentVersion)
+	te.Equal(len(data.Indexes), 1)
+	te.Equal(data.Indexes[0].Range, "10.244.1.0-10.244.1.255")
+	te.Equal(data.Indexes[0].Last, "10.244.1.4")
+	te.Equal(data.Indexes[0].Free, 254)
+	te.Empty(data.IPs)
+	ids, err := filepath.Glob(filepath.Join(dir, "mynet", idsDir, "*"))
+	te.Nil(err)
+	te.Equal(len(ids), 3)
+
+	// index is read back, also without knowing the ranges
+	s2, err := NewStore(dir, "mynet")
+	te.Nil(err)
+	defer s2.Close()
+	te.Nil(s2.LoadData())
+	te.Equal(s2.NextFree(r, s2.LastIn(r), all).String(), "10.244.1.5")
+	te.False(s2.indexes[0].test(net.ParseIP("10.244.1.2")))
+	te.True(s2.indexes[0].test(net.ParseIP("10.244.1.3")))
+
+	// ranges of the node change, index is rebuilt
+	r2, _ := ParseRange("10.244.2.2-10.244.2.254")
+	te.Nil(s2.SetRanges(r, r2))
+	te.Nil(s2.LoadData())
+	te.Equal(s2.NextFree(r2, s2.LastIn(r2), all).String(), "10.244.2.2")
+	te.Equal(s2.NextFree(r2, net.ParseIP("10.244.2.2"), all).String(), "10.244.2.4")
+
+	te.Nil(os.WriteFile(s.filePath, []byte(`{"version":5}`), 0644))
+	te.True(errors.Is(s.LoadData(), ErrNewerVersion))
+}
+
+func TestIndexIPv6(t *testing.T) {
+	te := assert.New(t)
+	s, err := NewStore(t.TempDir(), "mynet")
+	te.Nil(err)
+	defer s.Close()
+
+	// a /64 is only allocated from its first 64K addresses
+	r, err := ParseRange("fd00:10:244:1::1-fd00:10:244:1:ffff:ffff:ffff:ffff")
+	te.Nil(err)
+	te.Nil(s.SetRanges(r))
+	te.Nil(s.LoadData())
+	te.Equal(s.indexes[0].size, uint32(1<<maxV6Bits))
+
+	all := func(net.IP) bool { return true }
+	te.Equal(s.NextFree(r, nil, all).String(), "fd00:10:244:1::1")
+	te.Nil(s.Add(net.ParseIP("fd00:10:244:1::1"), "c0", "eth0"))
+	te.Equal(s.NextFree(r, s.LastIn(r), all).String(), "fd00:10:244:1::2")
+	te.Equal(s.NextFree(r, net.ParseIP("fd00:10:244:1::1:0"), all).String(), "fd00:10:244:1::2")
+	te.Equal(s.indexes[0].ip(0xffff).String(), "fd00:10:244:1::1:0")
+
+	// v4 ips are never in a v6 range
+	_, ok := s.indexes[0].index(net.ParseIP("10.244.1.1"))
+	te.False(ok)
+
+	for _, bad := range []string{"10.0.0.1-fd00::1", "10.0.0.9-10.0.0.1", "10.0.0.0-11.0.0.0"} {
+		r, err := ParseRange(bad)
+		te.Nil(err)
+		te.NotNil(s.SetRanges(r), bad)
+	}
+}
+
+// store of a /16 with the first fill of ips allocated
+func newFilledStore(b *testing.B, fill int) *Store {
+	s, err := NewStore(b.TempDir(), "mynet")
+	if err != nil {
+		b.Fatal(err)
+	}
+	r, _ := ParseRange("10.244.0.0-10.244.255.255")
+	if err := s.SetRanges(r); err != nil {
+		b.Fatal(err)
+	}
+	ips := make(map[string]ContainerNetInfo, fill)
+	ip := net.ParseIP("10.244.0.1").To4()
+	for i := 0; i < fill; i++ {
+		ip = cip.NextIP(ip)
+		ips[ip.String()] = ContainerNetInfo{ID: fmt.Sprintf("c%d", i), IFName: "eth0"}
+	}
+	s.data.Last = ip.String()
+	if err := s.writeEntries(ips); err != nil {
+		b.Fatal(err)
+	}
+	if err := s.reindex(ips); err != nil {
+		b.Fatal(err)
+	}
+	if err := s.Store(); err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+// Finding a free ip & writing it down, as a /16 fills up,
+// the whole allocation is measured by BenchmarkAllocatePodIP of the plugin
+func BenchmarkAllocate(b *testing.B) {
+	for _, pct := range []int{0, 50, 90, 99} {
+		fill := 65533 * pct / 100
+		b.Run(fmt.Sprintf("%d%%", pct), func(b *testing.B) {
+			s := newFilledStore(b, fill)
+			r := s.indexes[0].r
+			usable := func(net.IP) bool { return true }
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ip := s.NextFree(r, s.LastIn(r), usable)
+				if err := s.Add(ip, "bench", "eth0"); err != nil {
+					b.Fatal(err)
+				}
+				// 用完放回 保持填充率不变
+				if _, err := s.Release("bench", "eth0"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Looking up & releasing by container id, as a /16 fills up
+func BenchmarkGetIPByID(b *testing.B) {
+	for _, pct := range []int{0, 50, 90, 99} {
+		fill := 65533*pct/100 + 1
+		b.Run(fmt.Sprintf("%d%%", pct), func(b *testing.B) {
+			s := newFilledStore(b, fill)
+			id := fmt.Sprintf("c%d", fill-1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := s.GetIPByID(id); !ok {
+					b.Fatal(id)
+				}
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"mycni/bpfmap"
 	"mycni/pkg/ip"
 	"mycni/pkg/ipam"
+	"mycni/pkg/masq"
 	"mycni/tc"
 	"mycni/utils"
 	"os"
@@ -42,14 +43,17 @@ type NetConf struct {
 	// 	Mac string `json:"mac,omitempty"`
 	// } `json:"runtimeConfig,omitempty"`
 
-	podname   string
-	namespace string
-}
-
-type K8SEnvArgs struct {
-	types.CommonArgs
-	K8S_POD_NAMESPACE types.UnmarshallableString `json:"K8S_POD_NAMESPACE,omitempty"`
-	K8S_POD_NAME      types.UnmarshallableString `json:"K8S_POD_NAME,omitempty"`
+	// Attach host_ingress to node's uplink, so replies to pods skip host stack
+	HostIngress bool `json:"hostIngress,omitempty"`
+	// Uplink device for host_ingress, default to the one holding default route
+	Uplink string `json:"uplink,omitempty"`
+
+	// Masquerade pods' traffic leaving the cluster
+	IPMasq bool `json:"ipMasq,omitempty"`
+	// Destinations keeping pod ip, pod subnet & routes from ipam are always included
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs,omitempty"`
+	// "nftables"(default) or "ebpf"
+	MasqMode string `json:"masqMode,omitempty"`
 }
 
 func init() {
@@ -65,8 +69,8 @@ func main() {
 
 /*****************************Veth Part******************************/
 
-// load net conf
-func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
+// load net conf, pod namespace & name in CNI_ARGS are recorded by ipam
+func loadNetConf(bytes []byte) (*NetConf, string, error) {
 	// first create an empty config
 	n := &NetConf{}
 
@@ -74,18 +78,12 @@ func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
 
-	if envArgs != "" {
-		e := K8SEnvArgs{}
-		if err := types.LoadArgs(envArgs, &e); err != nil {
+	if n.IPMasq {
+		if err := masq.ValidMode(n.MasqMode); err != nil {
 			return nil, "", err
 		}
-
-		// Loading some k8s arguments
-		if e.K8S_POD_NAME != "" {
-			n.podname = string(e.K8S_POD_NAME)
-		}
-		if e.K8S_POD_NAMESPACE != "" {
-			n.namespace = string(e.K8S_POD_NAMESPACE)
+		if _, err := masq.ParseNonMasqCIDRs(n.NonMasqueradeCIDRs); err != nil {
+			return nil, "", err
 		}
 	}
 
@@ -360,50 +358,6 @@ func setVethPairInfo2LxcMap(podIP string, hostVeth, nsVeth *netlink.Veth) error
 	)
 }
 
-// set podname - ip mapping
-func setPodIP2PodMap(podname, podIP string) error {
-	key := [8]byte{}
-	pod_strlen := len(podname)
-	for i := pod_strlen - 5; i < pod_strlen; i++ {
-		key[(i - (pod_strlen - 5))] = byte(podname[i])
-	}
-
-	// Note: podIP has cidr mask!
-	netip, _, err := net.ParseCIDR(podIP)
-	if err != nil {
-		return err
-	}
-	podIP = netip.String()
-
-	value := InetIpToUInt32(podIP)
-	_, err = bpfmap.CreatePodIPMap()
-	if err != nil {
-		return err
-	}
-
-	return bpfmap.SetPodIPMap(
-		bpfmap.PodInfoKey{PodName: key},
-		bpfmap.PodInfoValue{IP: value},
-	)
-}
-
-func loadPodIP(podname string) (string, error) {
-	key := [8]byte{}
-	pod_strlen := len(podname)
-	utils.Log("podname is " + podname)
-	for i := pod_strlen - 5; i < pod_strlen; i++ {
-		key[i-(pod_strlen-5)] = byte(podname[i])
-	}
-
-	res, err := bpfmap.GetKeyValueFromPodIPMap(bpfmap.PodInfoKey{PodName: key})
-	if err != nil {
-		return "", err
-	}
-
-	ip_str := UInt32ToInetIP(res.IP)
-	return ip_str, nil
-}
-
 // set current vxlan id into map
 func setVxlanInfo2NodeMap(vxlan *netlink.Vxlan) error {
 	key := bpfmap.VirtualNetKey{
@@ -442,6 +396,139 @@ func attachBPF2VXLAN(vxlan *netlink.Vxlan) error {
 	return tc.AttachBPF2Device(name, egressPath, tc.EGRESS)
 }
 
+// setup masquerade for pod ips in result
+func setupIPMasq(n *NetConf, result *current.Result) error {
+	nonMasq, err := masq.ParseNonMasqCIDRs(n.NonMasqueradeCIDRs)
+	if err != nil {
+		return err
+	}
+
+	// traffic inside pod subnet & cluster routes keeps pod ip
+	for _, ipc := range result.IPs {
+		nonMasq = append(nonMasq, &net.IPNet{
+			IP:   ipc.Address.IP.Mask(ipc.Address.Mask),
+			Mask: ipc.Address.Mask,
+		})
+	}
+	for _, r := range result.Routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 || r.Dst.IP.To4() == nil {
+			continue
+		}
+		dst := r.Dst
+		nonMasq = append(nonMasq, &dst)
+	}
+
+	// serialized with other pods' ADD/DEL on this node
+	lock, err := masq.LockNode()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if n.MasqMode == masq.MODE_EBPF {
+		uplink, err := masq.SetupBPF(n.Uplink, nonMasq)
+		if err != nil {
+			return err
+		}
+		utils.Log("ebpf masquerade on uplink " + uplink + " complete!")
+		return nil
+	}
+
+	if err := masq.EnsureRules(nonMasq); err != nil {
+		return err
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() == nil {
+			continue
+		}
+		if err := masq.AddPod(ipc.Address.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove pod ips from masquerade, rules are removed with the last pod on node
+func teardownIPMasq(n *NetConf, ipnets []*net.IPNet) error {
+	lock, err := masq.LockNode()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if n.MasqMode == masq.MODE_EBPF {
+		eps, err := bpfmap.ListLxcMap()
+		if err != nil {
+			return err
+		}
+		if len(eps) == 0 {
+			return masq.TeardownBPF(n.Uplink)
+		}
+		return nil
+	}
+
+	for _, ipnet := range ipnets {
+		if err := masq.DelPod(ipnet.IP); err != nil {
+			return err
+		}
+	}
+	pods, err := masq.ListPods()
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return masq.Teardown()
+	}
+	return nil
+}
+
+// attach host_ingress to the uplink once if hostIngress is enabled,
+// the uplink is shared with ebpf masquerade, so it is done under node lock
+func setupHostIngress(n *NetConf) error {
+	lock, err := masq.LockNode()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if n.HostIngress {
+		uplink, err := tc.AttachBPF2Uplink(n.Uplink)
+		if err != nil {
+			return err
+		}
+		utils.Log("attach bpf to uplink " + uplink + " ingress complete!")
+		return nil
+	}
+
+	// hostIngress is disabled, drop host_ingress left by previous conf
+	// ebpf masquerade still needs it to translate replies back
+	if n.IPMasq && n.MasqMode == masq.MODE_EBPF {
+		return nil
+	}
+	if err := tc.DetachBPFFromUplink(n.Uplink); err != nil {
+		utils.Log("Detach host_ingress failed: " + err.Error())
+	}
+	return nil
+}
+
+// detach host_ingress from the uplink with the last pod on node
+func teardownHostIngress(n *NetConf) error {
+	lock, err := masq.LockNode()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	eps, err := bpfmap.ListLxcMap()
+	if err != nil {
+		return err
+	}
+	if len(eps) != 0 {
+		return nil
+	}
+	return tc.DetachBPFFromUplink(n.Uplink)
+}
+
 /*****************************************************/
 
 // command Add, setup vxlan with given ipam & args
@@ -453,7 +540,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	//		   IgnoreUnknown=1;
 	//         K8S_POD_NAMESPACE=kube-system;
 	//         K8S_POD_NAME=coredns-c676cc86f-4kz2t","
-	n, cniVersion, err := loadNetConf(args.StdinData, args.Args)
+	n, cniVersion, err := loadNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
@@ -568,6 +655,17 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	utils.Log("vxlan info written to bpfmap")
 
+	if err := setupHostIngress(n); err != nil {
+		return err
+	}
+
+	if n.IPMasq {
+		if err := setupIPMasq(n, result); err != nil {
+			return err
+		}
+		utils.Log("ip masquerade setup complete!")
+	}
+
 	return types.PrintResult(result, cniVersion)
 }
 
@@ -576,9 +674,8 @@ func cmdCheck(args *skel.CmdArgs) error {
 }
 
 // 这里把bpfmap中 lxcmap的部分给放在删除设备的时候一起执行
-// podname-IP的映射多余了
 func cmdDel(args *skel.CmdArgs) error {
-	n, _, err := loadNetConf(args.StdinData, args.Args)
+	n, _, err := loadNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
@@ -618,6 +715,18 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	})
 
+	if n.IPMasq {
+		if merr := teardownIPMasq(n, ipnets); merr != nil {
+			utils.Log("Teardown ip masquerade failed: " + merr.Error())
+		}
+	}
+
+	if n.HostIngress {
+		if herr := teardownHostIngress(n); herr != nil {
+			utils.Log("Detach host_ingress failed: " + herr.Error())
+		}
+	}
+
 	// If there exists any ip net => return err
 	if len(ipnets) != 0 {
 		return err
@@ -128,6 +128,16 @@ func DetachBPF(device string) error {
 	return err
 }
 
+// Detach bpf programs from certain device on given direction,
+// clsact qdisc is kept for the other direction
+func DetachBPFFromDevice(device string, dir BPF_TC_DIRECT) error {
+	cmd := fmt.Sprintf("tc filter delete dev %s %s", device, dir)
+	p := exec.Command("/bin/sh", "-c", cmd)
+	_, err := p.Output()
+	utils.Log(cmd)
+	return err
+}
+
 // Show bpf program details attached to certain net device
 //
 // Direction is given by direct.
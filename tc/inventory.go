@@ -0,0 +1,120 @@
+package tc
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Program attached to a net device's tc hook
+type AttachedProg struct {
+	Device    string        `json:"device"`
+	Direction BPF_TC_DIRECT `json:"direction"`
+	ID        uint32        `json:"id"`
+	Tag       string        `json:"tag"`
+	Name      string        `json:"name"`
+}
+
+// Get program name from the obj path, like /opt/cni/bin/veth_ingress.bpf.o => veth_ingress
+func ProgName(prog string) string {
+	return strings.TrimSuffix(filepath.Base(prog), ".bpf.o")
+}
+
+// Parse output of `tc filter show dev [DEV] [DIRECT]`
+//
+// a bpf filter line is like:
+// filter protocol all pref 49152 bpf chain 0 handle 0x1 veth_ingress.bpf.o:[classifier] direct-action not_in_hw id 42 name veth_ingress tag 3b185187f1855c4c jited
+func parseFilterShow(dev string, direct BPF_TC_DIRECT, out string) []AttachedProg {
+	var progs []AttachedProg
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "filter" {
+			continue
+		}
+
+		prog := AttachedProg{Device: dev, Direction: direct}
+		found := false
+		for i, f := range fields {
+			// obj name is used only if kernel does not report prog name
+			if strings.Contains(f, ".o:[") && prog.Name == "" {
+				prog.Name = ProgName(f[:strings.Index(f, ":[")])
+			}
+			if i+1 >= len(fields) {
+				continue
+			}
+			switch f {
+			case "id":
+				id, err := strconv.ParseUint(fields[i+1], 10, 32)
+				if err != nil {
+					continue
+				}
+				prog.ID = uint32(id)
+				found = true
+			case "name":
+				prog.Name = fields[i+1]
+			case "tag":
+				prog.Tag = fields[i+1]
+			}
+		}
+
+		// header lines(without prog id) are skipped
+		if found {
+			progs = append(progs, prog)
+		}
+	}
+	return progs
+}
+
+// List bpf programs attached to certain device on given direction
+func ListAttached(dev string, direct BPF_TC_DIRECT) ([]AttachedProg, error) {
+	out, err := ShowBPF(dev, string(direct))
+	if err != nil {
+		return nil, fmt.Errorf("failed to show bpf on %s %s: %v", dev, direct, err)
+	}
+	return parseFilterShow(dev, direct, out), nil
+}
+
+// List all host veths and tunnel devices on current node
+func ListDevices() ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	var devs []string
+	for _, link := range links {
+		switch link.Type() {
+		case "veth", "vxlan":
+			devs = append(devs, link.Attrs().Name)
+		}
+	}
+	return devs, nil
+}
+
+// Inventory of programs attached to every host veth and tunnel device,
+// both directions are included.
+func Inventory() ([]AttachedProg, error) {
+	devs, err := ListDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var progs []AttachedProg
+	for _, dev := range devs {
+		// device without clsact has nothing attached
+		if !ExistClsact(dev) {
+			continue
+		}
+		for _, direct := range []BPF_TC_DIRECT{INGRESS, EGRESS} {
+			attached, err := ListAttached(dev, direct)
+			if err != nil {
+				return nil, err
+			}
+			progs = append(progs, attached...)
+		}
+	}
+	return progs, nil
+}
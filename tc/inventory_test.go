@@ -0,0 +1,73 @@
+package tc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFilterShow(t *testing.T) {
+	te := assert.New(t)
+
+	out := `filter protocol all pref 49152 bpf chain 0
+filter protocol all pref 49152 bpf chain 0 handle 0x1 veth_ingress.bpf.o:[classifier] direct-action not_in_hw id 42 name veth_ingress tag 3b185187f1855c4c jited
+`
+	progs := parseFilterShow("veth1234", INGRESS, out)
+	te.Equal(len(progs), 1)
+	te.Equal(progs[0], AttachedProg{
+		Device:    "veth1234",
+		Direction: INGRESS,
+		ID:        42,
+		Tag:       "3b185187f1855c4c",
+		Name:      "veth_ingress",
+	})
+
+	// older iproute2 does not print prog name
+	out = `filter protocol all pref 49152 bpf chain 0 handle 0x1 vxlan_egress.bpf.o:[classifier] direct-action not_in_hw id 7 tag 0011223344556677 jited`
+	progs = parseFilterShow("vxlan2", EGRESS, out)
+	te.Equal(len(progs), 1)
+	te.Equal(progs[0].Name, "vxlan_egress")
+	te.Equal(progs[0].ID, uint32(7))
+
+	// nothing attached
+	te.Equal(len(parseFilterShow("vxlan2", INGRESS, "")), 0)
+}
+
+func TestDiff(t *testing.T) {
+	te := assert.New(t)
+
+	expected := []Attachment{
+		{Device: "veth1234", Direction: INGRESS, Prog: GetVethIngressPath()},
+		{Device: "vxlan2", Direction: INGRESS, Prog: GetVxlanIngressPath()},
+		{Device: "vxlan2", Direction: EGRESS, Prog: GetVxlanEgressPath()},
+	}
+	actual := []AttachedProg{
+		{Device: "veth1234", Direction: INGRESS, ID: 42, Name: "veth_ingress"},
+		// attached on the wrong direction
+		{Device: "vxlan2", Direction: INGRESS, ID: 43, Name: "vxlan_egress"},
+	}
+
+	missing := Diff(expected, actual)
+	te.Equal(missing, expected[1:])
+	te.Equal(len(Diff(expected[:1], actual)), 0)
+}
+
+func TestUplinkAttachments(t *testing.T) {
+	te := assert.New(t)
+
+	expected, err := UplinkConf{Device: "eth0"}.Attachments()
+	te.Nil(err)
+	te.Equal(len(expected), 0)
+
+	expected, err = UplinkConf{Device: "eth0", HostIngress: true}.Attachments()
+	te.Nil(err)
+	te.Equal(expected, []Attachment{{Device: "eth0", Direction: INGRESS, Prog: GetHostIngressPath()}})
+
+	// host_ingress is shared, so it is expected only once
+	expected, err = UplinkConf{Device: "eth0", HostIngress: true, SNAT: true}.Attachments()
+	te.Nil(err)
+	te.Equal(expected, []Attachment{
+		{Device: "eth0", Direction: INGRESS, Prog: GetHostIngressPath()},
+		{Device: "eth0", Direction: EGRESS, Prog: GetSNATEgressPath()},
+	})
+}
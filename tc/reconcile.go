@@ -0,0 +1,183 @@
+package tc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"mycni/bpfmap"
+	"mycni/utils"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DefaultReconcileInterval = 30 * time.Second
+)
+
+// Program expected to be attached on a device
+type Attachment struct {
+	Device    string
+	Direction BPF_TC_DIRECT
+	Prog      string // path to bpf obj
+}
+
+// Expected attachments, derived from bpf maps:
+//
+// every lxc in lxc_map should have veth_ingress on its ingress,
+// the vxlan device in node_vxlan_map should have vxlan_ingress/vxlan_egress,
+// and the uplink should have programs of enabled features while there are pods.
+func ExpectedAttachments(uplink UplinkConf) ([]Attachment, error) {
+	var expected []Attachment
+
+	eps, err := bpfmap.ListLxcMap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list lxc_map: %v", err)
+	}
+	for _, ep := range eps {
+		link, err := netlink.LinkByIndex(int(ep.LXCIfIndex))
+		if err != nil {
+			// stale entry, the veth has gone with its pod
+			utils.Log(fmt.Sprintf("lxc ifindex %d not found: %v", ep.LXCIfIndex, err))
+			continue
+		}
+		expected = append(expected, Attachment{
+			Device:    link.Attrs().Name,
+			Direction: INGRESS,
+			Prog:      GetVethIngressPath(),
+		})
+	}
+
+	// programs on the uplink are detached with the last pod
+	if len(eps) > 0 {
+		uplinkExpected, err := uplink.Attachments()
+		if err != nil {
+			return nil, err
+		}
+		expected = append(expected, uplinkExpected...)
+	}
+
+	vxlan, err := bpfmap.GetKeyValueFromVxlanMap(bpfmap.VirtualNetKey{NetType: bpfmap.MODE_VXLAN})
+	if err != nil {
+		// no vxlan device has been set up yet
+		return expected, nil
+	}
+	link, err := netlink.LinkByIndex(int(vxlan.IfIndex))
+	if err != nil {
+		utils.Log(fmt.Sprintf("vxlan ifindex %d not found: %v", vxlan.IfIndex, err))
+		return expected, nil
+	}
+	expected = append(expected,
+		Attachment{Device: link.Attrs().Name, Direction: INGRESS, Prog: GetVxlanIngressPath()},
+		Attachment{Device: link.Attrs().Name, Direction: EGRESS, Prog: GetVxlanEgressPath()},
+	)
+	return expected, nil
+}
+
+// Compare expected attachments with what is actually attached,
+// return the ones that are missing
+func Diff(expected []Attachment, actual []AttachedProg) []Attachment {
+	type hook struct {
+		dev    string
+		direct BPF_TC_DIRECT
+		name   string
+	}
+	attached := make(map[hook]bool)
+	for _, prog := range actual {
+		attached[hook{prog.Device, prog.Direction, prog.Name}] = true
+	}
+
+	var missing []Attachment
+	for _, exp := range expected {
+		if !attached[hook{exp.Device, exp.Direction, ProgName(exp.Prog)}] {
+			missing = append(missing, exp)
+		}
+	}
+	return missing
+}
+
+// Reconciler keeps tc programs attached as bpf maps expect
+type Reconciler struct {
+	interval time.Duration
+	uplink   UplinkConf
+}
+
+func NewReconciler(interval time.Duration, uplink UplinkConf) *Reconciler {
+	if interval <= 0 {
+		interval = DefaultReconcileInterval
+	}
+	return &Reconciler{interval: interval, uplink: uplink}
+}
+
+// Reconcile once, re-attach missing programs and report the drift
+func (r *Reconciler) Reconcile() ([]Attachment, error) {
+	expected, err := ExpectedAttachments(r.uplink)
+	if err != nil {
+		return nil, err
+	}
+
+	var actual []AttachedProg
+	checked := make(map[string]bool)
+	for _, exp := range expected {
+		if checked[exp.Device] {
+			continue
+		}
+		checked[exp.Device] = true
+		if !ExistClsact(exp.Device) {
+			continue
+		}
+		for _, direct := range []BPF_TC_DIRECT{INGRESS, EGRESS} {
+			progs, err := ListAttached(exp.Device, direct)
+			if err != nil {
+				return nil, err
+			}
+			actual = append(actual, progs...)
+		}
+	}
+
+	drift := Diff(expected, actual)
+	for _, d := range drift {
+		utils.Log(fmt.Sprintf("Drift found: %s %s missing %s, re-attaching", d.Device, d.Direction, ProgName(d.Prog)))
+		if err := AttachBPF2Device(d.Device, d.Prog, d.Direction); err != nil {
+			return drift, fmt.Errorf("failed to re-attach %s to %s %s: %v", d.Prog, d.Device, d.Direction, err)
+		}
+	}
+	return drift, nil
+}
+
+// Run reconciler on interval, as well as on netlink link events,
+// until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) error {
+	updates := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(updates, ctx.Done()); err != nil {
+		return fmt.Errorf("failed to subscribe link events: %v", err)
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	reconcile := func() {
+		if _, err := r.Reconcile(); err != nil {
+			utils.Log("Reconcile tc attachments failed: " + err.Error())
+		}
+	}
+
+	reconcile()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			reconcile()
+		case update, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("link event subscription closed")
+			}
+			// only new/changed links could lose their programs
+			if update.Header.Type == unix.RTM_NEWLINK {
+				reconcile()
+			}
+		}
+	}
+}
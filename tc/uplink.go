@@ -0,0 +1,162 @@
+package tc
+
+import (
+	"fmt"
+	"mycni/consts"
+
+	"github.com/vishvananda/netlink"
+)
+
+func GetHostIngressPath() string {
+	return consts.K8S_CNI_PATH + "/host_ingress.bpf.o"
+}
+
+func GetSNATEgressPath() string {
+	return consts.K8S_CNI_PATH + "/snat_egress.bpf.o"
+}
+
+// Find node's uplink, which is the device holding the default route
+func GetUplinkDevice() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		return link.Attrs().Name, nil
+	}
+	return "", fmt.Errorf("no default route found on this node")
+}
+
+// Programs wanted on the uplink. host_ingress is shared by
+// hostIngress and ebpf masquerade, so it stays while either needs it.
+type UplinkConf struct {
+	Device      string // empty for the device holding default route
+	HostIngress bool
+	SNAT        bool
+}
+
+// Attachments expected on the uplink with conf's features
+func (c UplinkConf) Attachments() ([]Attachment, error) {
+	if !c.HostIngress && !c.SNAT {
+		return nil, nil
+	}
+	device, err := uplinkDevice(c.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := []Attachment{{Device: device, Direction: INGRESS, Prog: GetHostIngressPath()}}
+	if c.SNAT {
+		expected = append(expected, Attachment{Device: device, Direction: EGRESS, Prog: GetSNATEgressPath()})
+	}
+	return expected, nil
+}
+
+func uplinkDevice(device string) (string, error) {
+	if device != "" {
+		return device, nil
+	}
+	return GetUplinkDevice()
+}
+
+// Check if prog is attached to device on given direction
+func IsAttached(device string, prog string, direct BPF_TC_DIRECT) (bool, error) {
+	if !ExistClsact(device) {
+		return false, nil
+	}
+	progs, err := ListAttached(device, direct)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range progs {
+		if p.Name == ProgName(prog) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// attach prog only if it is not attached yet, the uplink is shared by all pods
+// on the node, reloading it on every pod ADD resets its state for nothing.
+func attachOnce(device string, prog string, direct BPF_TC_DIRECT) error {
+	attached, err := IsAttached(device, prog, direct)
+	if err != nil {
+		return err
+	}
+	if attached {
+		return nil
+	}
+	if err := AttachBPF2Device(device, prog, direct); err != nil {
+		return fmt.Errorf("failed to attach %s to uplink %s: %v", prog, device, err)
+	}
+	return nil
+}
+
+// detach prog only if it is attached, so DEL can be called repeatedly
+func detachOnce(device string, prog string, direct BPF_TC_DIRECT) error {
+	attached, err := IsAttached(device, prog, direct)
+	if err != nil {
+		return err
+	}
+	if !attached {
+		return nil
+	}
+	if err := DetachBPFFromDevice(device, direct); err != nil {
+		return fmt.Errorf("failed to detach %s from uplink %s: %v", prog, device, err)
+	}
+	return nil
+}
+
+// Attach host_ingress to uplink's ingress, so replies to pods
+// are redirected into their veth peer directly.
+//
+// if device is empty, the device holding default route is used.
+func AttachBPF2Uplink(device string) (string, error) {
+	device, err := uplinkDevice(device)
+	if err != nil {
+		return "", err
+	}
+	if err := attachOnce(device, GetHostIngressPath(), INGRESS); err != nil {
+		return "", err
+	}
+	return device, nil
+}
+
+// Detach host_ingress from the uplink
+func DetachBPFFromUplink(device string) error {
+	device, err := uplinkDevice(device)
+	if err != nil {
+		return err
+	}
+	return detachOnce(device, GetHostIngressPath(), INGRESS)
+}
+
+// Attach snat_egress to uplink's egress for ebpf masquerade,
+// replies are translated back by host_ingress, so it is attached as well.
+func AttachSNAT2Uplink(device string) (string, error) {
+	device, err := AttachBPF2Uplink(device)
+	if err != nil {
+		return "", err
+	}
+	if err := attachOnce(device, GetSNATEgressPath(), EGRESS); err != nil {
+		return "", err
+	}
+	return device, nil
+}
+
+// Detach snat_egress from the uplink
+func DetachSNATFromUplink(device string) error {
+	device, err := uplinkDevice(device)
+	if err != nil {
+		return err
+	}
+	return detachOnce(device, GetSNATEgressPath(), EGRESS)
+}
@@ -39,6 +39,14 @@ if [ -f "/opt/cni/bin/vxlan_egress.bpf.o" ];then
     rm /opt/cni/bin/vxlan_egress.bpf.o
 fi
 
+if [ -f "/opt/cni/bin/host_ingress.bpf.o" ];then
+    rm /opt/cni/bin/host_ingress.bpf.o
+fi
+
+if [ -f "/opt/cni/bin/snat_egress.bpf.o" ];then
+    rm /opt/cni/bin/snat_egress.bpf.o
+fi
+
 cd bin
 
 cp local /opt/cni/bin
@@ -47,5 +55,14 @@ cp veth_ingress.bpf.o /opt/cni/bin
 cp vxlan_ingress.bpf.o /opt/cni/bin
 cp vxlan_egress.bpf.o /opt/cni/bin
 
+# built by build_linux.sh only when clang is available, needed by ebpf masquerade
+for obj in host_ingress.bpf.o snat_egress.bpf.o; do
+    if [ -f "$obj" ];then
+        cp "$obj" /opt/cni/bin
+    else
+        echo "$obj not found, build it with clang to use masqMode ebpf"
+    fi
+done
+
 # This will test whether IP allocator works?
 # go test -v -run TestAllocateIP2Pod
\ No newline at end of file
@@ -122,18 +122,83 @@ func GetLineFromYaml(yml string, key string) (string, error) {
 	return res.String(), nil
 }
 
+// prefix of all ipam keys in etcd, set by the etcd config
+var keyPrefix = consts.ETCD_COMMON_PREFIX
+
+// Set prefix of ipam keys, empty for the default mycni/ipam/
+func SetKeyPrefix(prefix string) {
+	if prefix == "" {
+		prefix = consts.ETCD_COMMON_PREFIX
+	}
+	keyPrefix = prefix
+}
+
+func GetKeyPrefix() string {
+	return keyPrefix
+}
+
 // get host path in etcd, mycni/ipam/hostname
 func GetHostPath() string {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return "/test-error-path"
 	}
-	return consts.ETCD_COMMON_PREFIX + hostname
+	return GetNodePath(hostname)
+}
+
+// get path of any node in etcd, mycni/ipam/<node>
+func GetNodePath(node string) string {
+	return GetKeyPrefix() + node
+}
+
+// get claim of one block by given node, mycni/ipam/<node>/blocks/<cidr>
+func GetNodeBlockPath(node, cidr string) string {
+	return GetNodePath(node) + "/blocks/" + cidr
+}
+
+// get lease key of given node, mycni/ipam/leases/<node>, gone once the lease expires
+func GetNodeLeasePath(node string) string {
+	return GetKeyPrefix() + "leases/" + node
+}
+
+// get lease key of current host
+func GetHostLeasePath() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "/test-error-path"
+	}
+	return GetNodeLeasePath(hostname)
+}
+
+// get election path of the block reclaimer
+func GetReclaimerElectionPath() string {
+	return GetKeyPrefix() + "reclaimer"
 }
 
 // get alls ip pool path in etcd
 func GetIPPoolPath() string {
-	return consts.ETCD_COMMON_PREFIX + "pool"
+	return GetKeyPrefix() + "pool"
+}
+
+// get config path of the ip pool in etcd
+func GetPoolConfigPath() string {
+	return GetKeyPrefix() + "config"
+}
+
+// get free blocks' path of a named pool, mycni/ipam/pools/<name>/pool, the cluster pool if name is empty
+func GetNamedIPPoolPath(name string) string {
+	if name == "" {
+		return GetIPPoolPath()
+	}
+	return GetKeyPrefix() + "pools/" + name + "/pool"
+}
+
+// get config path of a named pool, mycni/ipam/pools/<name>/config, the cluster pool's if name is empty
+func GetNamedPoolConfigPath(name string) string {
+	if name == "" {
+		return GetPoolConfigPath()
+	}
+	return GetKeyPrefix() + "pools/" + name + "/config"
 }
 
 // get current host's ip pool path in etcd
@@ -141,6 +206,16 @@ func GetHostIPPoolPath() string {
 	return GetHostPath() + "/pool"
 }
 
+// get blocks claimed by current host, mycni/ipam/<hostname>/blocks/
+func GetHostBlocksPath() string {
+	return GetHostPath() + "/blocks/"
+}
+
+// get claim of one block by current host
+func GetHostBlockPath(cidr string) string {
+	return GetHostBlocksPath() + cidr
+}
+
 // get current host's gateway ip
 func GetHostGWPath() string {
 	return GetHostPath() + "/gateway"
@@ -150,6 +225,41 @@ func GetNetDevicePath(id string) string {
 	return GetHostPath() + "/" + id
 }
 
+// get all blocks' path in etcd, mycni/ipam/blocks/
+func GetBlocksPath() string {
+	return GetKeyPrefix() + "blocks/"
+}
+
+// get allocated ips' path of a block, mycni/ipam/blocks/<cidr>/
+func GetBlockPath(cidr string) string {
+	return GetBlocksPath() + cidr + "/"
+}
+
+// get path of one ip in block, mycni/ipam/blocks/<cidr>/<ip>
+func GetBlockIPPath(cidr, ip string) string {
+	return GetBlockPath(cidr) + ip
+}
+
+// get reserved ranges' path in etcd, mycni/ipam/reservations/
+func GetReservationsPath() string {
+	return GetKeyPrefix() + "reservations/"
+}
+
+// get path of one reserved range, mycni/ipam/reservations/<cidr>
+func GetReservationPath(cidr string) string {
+	return GetReservationsPath() + cidr
+}
+
+// get sticky ips' path in etcd, mycni/ipam/sticky/
+func GetStickyIPsPath() string {
+	return GetKeyPrefix() + "sticky/"
+}
+
+// get last ip kept for a pod, mycni/ipam/sticky/<namespace>/<name>
+func GetStickyIPPath(namespace, name string) string {
+	return GetStickyIPsPath() + namespace + "/" + name
+}
+
 // get gateway according to given ip
 func GetGateway(givenIP string) string {
 	// Assume givenIP is valid, and well-formated